@@ -14,6 +14,7 @@ import (
 	"lime-bot/internal/db"
 	"lime-bot/internal/gates/wgagent"
 	"lime-bot/internal/health"
+	"lime-bot/internal/payments"
 	"lime-bot/internal/scheduler"
 	"lime-bot/internal/telegram"
 	"lime-bot/internal/wgtest"
@@ -128,12 +129,18 @@ func main() {
 		slog.Error("Failed to create scheduler", "error", err)
 		os.Exit(1)
 	}
+	scheduler.OnRenewal(telegramService.HandleRenewalPayment)
+	scheduler.SetCheckoutReport(telegramService.CheckoutReport)
 	slog.Info("Scheduler created successfully")
 
 	// Создаем health сервер
 	healthServer := health.NewServer(cfg.HealthAddr)
 	slog.Info("Health server created", "addr", cfg.HealthAddr)
 
+	// Webhook онлайн-эквайринга принимается тем же HTTP сервером
+	healthServer.Handle(payments.WebhookPath, payments.WebhookHandler(telegramService.PaymentProviders(), telegramService.HandlePaymentNotification))
+	slog.Info("Payment webhook registered", "path", payments.WebhookPath, "providers", telegramService.PaymentProviders().Names())
+
 	// Настраиваем graceful shutdown
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -5,6 +5,7 @@ go 1.24
 require (
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/robfig/cron/v3 v3.0.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	gorm.io/driver/sqlite v1.5.4
 	gorm.io/gorm v1.25.6
 )
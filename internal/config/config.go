@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	BotToken         string
@@ -17,6 +22,51 @@ type Config struct {
 
 	HealthAddr string
 
+	TrialRequirePhone bool
+
+	// ApprovalPolicy - когда выдавать ключи по ручному переводу:
+	// approve_first, trust_on_receipt или trust_known
+	ApprovalPolicy string
+
+	// PendingPaymentTTL - через сколько неоплаченный заказ без чека отменяется
+	PendingPaymentTTL time.Duration
+	// MethodRotation - какие способы оплаты показывать покупателю:
+	// all, round_robin или least_used
+	MethodRotation string
+
+	// CheckoutReminderDelays - через сколько после последнего шага напоминать о
+	// брошенном оформлении /buy, по напоминанию на каждую задержку.
+	// CheckoutReminderMax - напоминаний одному пользователю за неделю (0 - без ограничения)
+	CheckoutReminderDelays []time.Duration
+	CheckoutReminderMax    int
+
+	// AutoRenewDays - за сколько дней до окончания списывать автопродление с баланса
+	AutoRenewDays int
+	// TopUpURL - ссылка на пополнение баланса в уведомлениях о нехватке средств
+	TopUpURL string
+
+	// Награда пригласившему за первую одобренную оплату приглашенного:
+	// бонусные дни к активной подписке и/или зачисление на баланс
+	ReferralBonusDays   int
+	ReferralBonusAmount int
+	// ReferralInviteeDiscount - скидка в процентах на первый заказ приглашенного
+	ReferralInviteeDiscount int
+
+	// Антифрод реферальной программы. ReferralMinPayment - сколько рублей должен
+	// оплатить приглашенный до награды, ReferralDailyCap - сколько наград в сутки
+	// начисляется одному пригласившему автоматически (0 - без ограничения),
+	// ReferralNewAccountID - ID Telegram, начиная с которого аккаунт считается
+	// недавно созданным (0 - не проверять)
+	ReferralMinPayment   int
+	ReferralDailyCap     int
+	ReferralNewAccountID int64
+
+	AcquiringURL           string
+	AcquiringShopID        string
+	AcquiringSecretKey     string
+	AcquiringWebhookSecret string
+	AcquiringReturnURL     string
+
 	TGToken  string
 	TGChatID string
 }
@@ -37,6 +87,32 @@ func Load() *Config {
 
 		HealthAddr: getEnvOrDefault("HEALTH_ADDR", "0.0.0.0:8080"),
 
+		TrialRequirePhone: os.Getenv("TRIAL_REQUIRE_PHONE") == "true",
+
+		ApprovalPolicy:    getEnvOrDefault("APPROVAL_POLICY", "trust_on_receipt"),
+		PendingPaymentTTL: getDurationOrDefault("PENDING_PAYMENT_TTL", 24*time.Hour),
+		MethodRotation:    getEnvOrDefault("METHOD_ROTATION", "all"),
+
+		CheckoutReminderDelays: getDurationsOrDefault("CHECKOUT_REMINDER_DELAYS", []time.Duration{time.Hour, 24 * time.Hour}),
+		CheckoutReminderMax:    getIntOrDefault("CHECKOUT_REMINDER_MAX", 3),
+
+		AutoRenewDays: getIntOrDefault("AUTO_RENEW_DAYS", 3),
+		TopUpURL:      os.Getenv("TOPUP_URL"),
+
+		ReferralBonusDays:       getIntOrDefault("REFERRAL_BONUS_DAYS", 7),
+		ReferralBonusAmount:     getIntOrDefault("REFERRAL_BONUS_AMOUNT", 0),
+		ReferralInviteeDiscount: getIntOrDefault("REFERRAL_INVITEE_DISCOUNT", 0),
+
+		ReferralMinPayment:   getIntOrDefault("REFERRAL_MIN_PAYMENT", 100),
+		ReferralDailyCap:     getIntOrDefault("REFERRAL_DAILY_CAP", 3),
+		ReferralNewAccountID: int64(getIntOrDefault("REFERRAL_NEW_ACCOUNT_ID", 0)),
+
+		AcquiringURL:           os.Getenv("ACQUIRING_URL"),
+		AcquiringShopID:        os.Getenv("ACQUIRING_SHOP_ID"),
+		AcquiringSecretKey:     os.Getenv("ACQUIRING_SECRET_KEY"),
+		AcquiringWebhookSecret: os.Getenv("ACQUIRING_WEBHOOK_SECRET"),
+		AcquiringReturnURL:     os.Getenv("ACQUIRING_RETURN_URL"),
+
 		TGToken:  os.Getenv("TG_TOKEN"),
 		TGChatID: os.Getenv("TG_CHAT_ID"),
 	}
@@ -48,3 +124,38 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// getDurationsOrDefault разбирает список через запятую, например "1h,24h".
+// off отключает, ошибка в любом элементе - значение по умолчанию
+func getDurationsOrDefault(key string, defaultValue []time.Duration) []time.Duration {
+	value := os.Getenv(key)
+	if value == "off" {
+		return nil
+	}
+	if value == "" {
+		return defaultValue
+	}
+	var result []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		duration, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil || duration <= 0 {
+			return defaultValue
+		}
+		result = append(result, duration)
+	}
+	return result
+}
+
+func getIntOrDefault(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value >= 0 {
+		return value
+	}
+	return defaultValue
+}
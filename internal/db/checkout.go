@@ -0,0 +1,205 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CheckoutReminderWindow - период, за который считается лимит напоминаний
+// одному пользователю
+const CheckoutReminderWindow = 7 * 24 * time.Hour
+
+// CheckoutResumePrefix - префикс callback кнопки "Продолжить оформление".
+// Общий для бота и планировщика напоминаний
+const CheckoutResumePrefix = "buy_resume_"
+
+// syncCheckoutPayments закрывает оформления, к заказам которых уже приложен
+// чек или пришла оплата, и возвращает заказы открытых оформлений
+func syncCheckoutPayments(tx *gorm.DB, checkouts []Checkout) (map[uint]Payment, error) {
+	var ids []uint
+	for _, checkout := range checkouts {
+		if !checkout.Completed && checkout.PaymentID != nil {
+			ids = append(ids, *checkout.PaymentID)
+		}
+	}
+	payments := make(map[uint]Payment, len(ids))
+	if len(ids) == 0 {
+		return payments, nil
+	}
+
+	var rows []Payment
+	if err := tx.Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("fetch checkout payments: %w", err)
+	}
+	for _, payment := range rows {
+		payments[payment.ID] = payment
+	}
+
+	for i := range checkouts {
+		checkout := &checkouts[i]
+		if checkout.Completed || checkout.PaymentID == nil {
+			continue
+		}
+		payment := payments[*checkout.PaymentID]
+		if payment.ReceiptFileID == "" && payment.Status != "approved" {
+			continue
+		}
+		checkout.Completed = true
+		// UpdateColumn не трогает UpdatedAt: время последнего шага нужно для воронки
+		if err := tx.Model(&Checkout{}).Where("id = ?", checkout.ID).UpdateColumn("completed", true).Error; err != nil {
+			return nil, fmt.Errorf("complete checkout %d: %w", checkout.ID, err)
+		}
+	}
+	return payments, nil
+}
+
+// DueCheckoutReminders - брошенные оформления, о которых пора напомнить.
+// n-е напоминание уходит, когда с последнего шага прошло delays[n]. Напоминаем
+// только о последнем оформлении пользователя и только пока заказ ждет оплаты,
+// maxPerUser ограничивает число напоминаний за CheckoutReminderWindow (0 - без ограничения)
+func DueCheckoutReminders(tx *gorm.DB, delays []time.Duration, maxPerUser int, now time.Time) ([]Checkout, error) {
+	if len(delays) == 0 {
+		return nil, nil
+	}
+
+	var checkouts []Checkout
+	// Прежние оформления покупатель бросил сам, начав новое, поэтому берем
+	// последнее, даже если оно уже завершено
+	latest := tx.Model(&Checkout{}).Select("MAX(id)").Group("user_id")
+	if err := tx.Where("id IN (?)", latest).Order("id ASC").Find(&checkouts).Error; err != nil {
+		return nil, fmt.Errorf("fetch latest checkouts: %w", err)
+	}
+	payments, err := syncCheckoutPayments(tx, checkouts)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []int64
+	for _, checkout := range checkouts {
+		if !checkout.Completed {
+			userIDs = append(userIDs, checkout.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	var reminders []CheckoutReminder
+	if err := tx.Where("user_id IN ?", userIDs).Find(&reminders).Error; err != nil {
+		return nil, fmt.Errorf("fetch checkout reminders: %w", err)
+	}
+	perCheckout := make(map[uint]int)
+	perUser := make(map[int64]int)
+	for _, reminder := range reminders {
+		perCheckout[reminder.CheckoutID]++
+		if now.Sub(reminder.CreatedAt) < CheckoutReminderWindow {
+			perUser[reminder.UserID]++
+		}
+	}
+
+	var due []Checkout
+	for _, checkout := range checkouts {
+		if checkout.Completed {
+			continue
+		}
+		// Отмененный или просроченный заказ покупатель уже закрыл сам
+		if checkout.PaymentID != nil && payments[*checkout.PaymentID].Status != "pending" {
+			continue
+		}
+		sent := perCheckout[checkout.ID]
+		if sent >= len(delays) || now.Sub(checkout.UpdatedAt) < delays[sent] {
+			continue
+		}
+		if maxPerUser > 0 && perUser[checkout.UserID] >= maxPerUser {
+			continue
+		}
+		due = append(due, checkout)
+	}
+	return due, nil
+}
+
+// CheckoutFunnel - воронка оформлений /buy: на каком шаге остановились
+// оформления и сколько покупку на нем бросили. Порядок шагов и их названия
+// знает бот (telegram.BuyStep)
+type CheckoutFunnel struct {
+	From time.Time
+
+	Started    int
+	Completed  int
+	InProgress int
+	// Stopped - оформления по последнему шагу, включая завершенные
+	Stopped   map[string]int
+	Abandoned map[string]int
+
+	Reminders int
+	Resumed   int
+	// Recovered - оформления, завершенные после напоминания
+	Recovered int
+}
+
+// CheckoutIdle - через сколько бездействия оформление считается брошенным:
+// к моменту первого напоминания
+func CheckoutIdle(delays []time.Duration) time.Duration {
+	if len(delays) == 0 {
+		return time.Hour
+	}
+	return delays[0]
+}
+
+// BuildCheckoutFunnel собирает воронку оформлений, начатых с since. Оформление
+// считается брошенным, если покупатель не делал ничего дольше idle
+func BuildCheckoutFunnel(tx *gorm.DB, since time.Time, idle time.Duration, now time.Time) (*CheckoutFunnel, error) {
+	funnel := &CheckoutFunnel{
+		From:      since,
+		Stopped:   make(map[string]int),
+		Abandoned: make(map[string]int),
+	}
+
+	var checkouts []Checkout
+	if err := tx.Scopes(CreatedSince(since)).Order("id ASC").Find(&checkouts).Error; err != nil {
+		return nil, fmt.Errorf("fetch checkouts: %w", err)
+	}
+	if _, err := syncCheckoutPayments(tx, checkouts); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(checkouts))
+	completed := make(map[uint]bool)
+	for _, checkout := range checkouts {
+		ids = append(ids, checkout.ID)
+		funnel.Started++
+		funnel.Stopped[checkout.Step]++
+
+		switch {
+		case checkout.Completed:
+			funnel.Completed++
+			completed[checkout.ID] = true
+		case now.Sub(checkout.UpdatedAt) >= idle:
+			funnel.Abandoned[checkout.Step]++
+		default:
+			funnel.InProgress++
+		}
+	}
+
+	if len(ids) == 0 {
+		return funnel, nil
+	}
+	var reminders []CheckoutReminder
+	if err := tx.Where("checkout_id IN ?", ids).Find(&reminders).Error; err != nil {
+		return nil, fmt.Errorf("fetch checkout reminders: %w", err)
+	}
+	recovered := make(map[uint]bool)
+	for _, reminder := range reminders {
+		funnel.Reminders++
+		if reminder.ResumedAt != nil {
+			funnel.Resumed++
+		}
+		if completed[reminder.CheckoutID] {
+			recovered[reminder.CheckoutID] = true
+		}
+	}
+	funnel.Recovered = len(recovered)
+	return funnel, nil
+}
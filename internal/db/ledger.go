@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrInsufficientBalance - списание больше остатка на балансе
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// UserBalance считает баланс пользователя по журналу движений
+func UserBalance(tx *gorm.DB, userID int64) (int, error) {
+	var balance int
+	err := tx.Model(&LedgerEntry{}).Where("user_id = ?", userID).
+		Select("COALESCE(SUM(amount), 0)").Scan(&balance).Error
+	if err != nil {
+		return 0, fmt.Errorf("calculate balance for user %d: %w", userID, err)
+	}
+	return balance, nil
+}
+
+// AppendLedger добавляет движение по балансу. Списание больше остатка
+// возвращает ErrInsufficientBalance. Используется и ботом, и планировщиком
+func AppendLedger(tx *gorm.DB, entry *LedgerEntry) error {
+	if entry.Amount < 0 {
+		balance, err := UserBalance(tx, entry.UserID)
+		if err != nil {
+			return err
+		}
+		if balance+entry.Amount < 0 {
+			return ErrInsufficientBalance
+		}
+	}
+
+	if err := tx.Create(entry).Error; err != nil {
+		return fmt.Errorf("append ledger entry for user %d: %w", entry.UserID, err)
+	}
+	return nil
+}
@@ -2,32 +2,148 @@ package db
 
 import (
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
 
 	"gorm.io/gorm"
 )
 
+// AdminRoles - допустимые значения admins.role, совпадают с тегом модели Admin
+var AdminRoles = []string{"super", "admin", "cashier", "support", "partner"}
+
+// PaymentStatuses - допустимые значения payments.status, совпадают с тегом модели Payment
+var PaymentStatuses = []string{"pending", "approved", "rejected", "expired", "canceled", "refunding", "refunded"}
+
+// LedgerKinds - допустимые значения ledger_entries.kind, совпадают с тегом модели LedgerEntry
+var LedgerKinds = []string{"topup", "purchase", "referral", "refund", "adjustment"}
+
+// PlanVisibilities - допустимые значения plans.visibility
+var PlanVisibilities = []string{"public", "hidden", "partner"}
+
+// Migrate приводит схему базы к моделям: бэкфиллы новых столбцов, CHECK-ограничения
+// перечислений, индексы и стандартные причины отклонения. Все шаги схемы
+// добавляются только сюда
 func Migrate(db *gorm.DB) error {
+	if err := backfillPaymentProvider(db); err != nil {
+		return err
+	}
+	newWholesale := !db.Migrator().HasColumn(&Payment{}, "wholesale")
+	newSuperseded := !db.Migrator().HasColumn(&Plan{}, "superseded_by")
+	newResubmit := !db.Migrator().HasColumn(&Payment{}, "resubmit_allowed")
+
 	// Сначала выполняем обычную миграцию
 	err := db.AutoMigrate(
 		&Server{},
 		&Interface{},
 		&Plan{},
 		&User{},
+		&Admin{},
+		&PaymentMethod{},
 		&Payment{},
 		&Subscription{},
-		&Admin{},
+		&Referral{},
+		&RejectReason{},
+		&CashierNotice{},
+		&LedgerEntry{},
+		&PartnerPrice{},
+		&PartnerKey{},
+		&PlanDiscount{},
+		&PlanPrice{},
+		&ExchangeRate{},
+		&Checkout{},
+		&CheckoutReminder{},
 	)
 	if err != nil {
 		return err
 	}
+	if newWholesale {
+		if err := backfillPaymentWholesale(db); err != nil {
+			return err
+		}
+	}
+	if newSuperseded {
+		if err := backfillPlanSuperseded(db); err != nil {
+			return err
+		}
+	}
+	if newResubmit {
+		if err := backfillPaymentResubmit(db); err != nil {
+			return err
+		}
+	}
 
 	// Обновляем enum-constraint'ы
-	if err := updateEnumConstraint(db, "admins", "role", []string{"super", "admin", "cashier", "support"}); err != nil {
+	if err := updateEnumConstraint(db, "admins", "role", AdminRoles); err != nil {
 		return err
 	}
-	return updateEnumConstraint(db, "payments", "status", []string{"pending", "approved", "rejected"})
+	if err := updateEnumConstraint(db, "payments", "status", PaymentStatuses); err != nil {
+		return err
+	}
+	if err := updateEnumConstraint(db, "plans", "visibility", PlanVisibilities); err != nil {
+		return err
+	}
+	if err := updateEnumConstraint(db, "ledger_entries", "kind", LedgerKinds); err != nil {
+		return err
+	}
+	if err := ensurePendingAmountIndex(db); err != nil {
+		return err
+	}
+	return seedRejectReasons(db)
+}
+
+// backfillPaymentProvider проставляет пустой provider платежам, созданным до
+// появления онлайн-провайдеров: это ручные переводы. Выполняется до AutoMigrate,
+// иначе пересоздание столбца с NOT NULL упадет на старых строках
+func backfillPaymentProvider(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Payment{}, "provider") {
+		return nil
+	}
+	return db.Exec("UPDATE payments SET provider = '' WHERE provider IS NULL").Error
+}
+
+// backfillPaymentWholesale помечает оптовыми заказы, созданные до появления
+// payments.wholesale: оплаченные, по которым выпущены ключи партнера, и
+// ожидающие оплаты заказы активных партнеров. Выполняется один раз, когда
+// столбец только добавлен
+func backfillPaymentWholesale(db *gorm.DB) error {
+	return db.Exec("UPDATE payments SET wholesale = true WHERE id IN (SELECT payment_id FROM partner_keys) " +
+		"OR (status = 'pending' AND change_sub_id IS NULL AND user_id IN " +
+		"(SELECT tg_id FROM admins WHERE role = 'partner' AND disabled = false))").Error
+}
+
+// backfillPlanSuperseded переводит прежние версии тарифов из архива в
+// замененные: раньше правка условий архивировала старую версию, и подписки на
+// ней теряли автопродление. Выполняется один раз, когда столбец только добавлен
+func backfillPlanSuperseded(db *gorm.DB) error {
+	return db.Exec("UPDATE plans SET archived = false, " +
+		"superseded_by = (SELECT next.id FROM plans AS next WHERE next.previous_id = plans.id) " +
+		"WHERE EXISTS (SELECT 1 FROM plans AS next WHERE next.previous_id = plans.id)").Error
+}
+
+// backfillPaymentResubmit разрешает повторную отправку чека заказам, отклоненным
+// до появления payments.resubmit_allowed, если причина с таким названием ее не
+// запрещала. Выполняется один раз, когда столбец только добавлен
+func backfillPaymentResubmit(db *gorm.DB) error {
+	return db.Exec("UPDATE payments SET resubmit_allowed = true WHERE status = 'rejected' AND provider = '' " +
+		"AND reject_reason NOT IN (SELECT title FROM reject_reasons WHERE allow_resubmit = false)").Error
+}
+
+// ensurePendingAmountIndex не дает двум ожидающим ручным рублевым заказам
+// получить одну сумму: по ней кассир находит заказ из SMS банка. Создается
+// после updateEnumConstraint, который в SQLite пересоздает таблицу payments
+func ensurePendingAmountIndex(db *gorm.DB) error {
+	if db.Dialector.Name() == "mysql" {
+		return nil
+	}
+	err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_pending_amount ON payments (amount) " +
+		"WHERE status = 'pending' AND provider = '' AND currency = 'RUB'").Error
+	if err != nil {
+		// В старой базе могут ждать оплаты заказы с одинаковой суммой -
+		// индекс создастся при следующем запуске, когда они закроются
+		slog.Warn("Pending amount index not created", "error", err)
+	}
+	return nil
 }
 
 // updateEnumConstraint гарантирует, что для столбца есть актуальный CHECK-constraint
@@ -61,8 +177,9 @@ func recreateSQLiteTableWithConstraint(db *gorm.DB, table, column, allowedList,
 			return err
 		}
 
-		// Удаляем старый CHECK (если был) и добавляем новый
-		newCheck := fmt.Sprintf("CHECK (%s IN (%s))", column, allowedList)
+		// Удаляем старый CHECK (если был) и добавляем новый. Constraint именованный,
+		// чтобы при следующем изменении списка значений его можно было найти
+		newCheck := fmt.Sprintf("CONSTRAINT `%s` CHECK (%s IN (%s))", constraint, column, allowedList)
 
 		// Удаляем существующий constraint полностью
 		re := regexp.MustCompile(
@@ -73,6 +190,16 @@ func recreateSQLiteTableWithConstraint(db *gorm.DB, table, column, allowedList,
 		)
 		schema = re.ReplaceAllString(schema, "")
 
+		// Безымянные CHECK от прошлых версий миграции иначе копились бы
+		// и продолжали запрещать новые значения
+		legacy := regexp.MustCompile(
+			fmt.Sprintf(
+				",?\\s*CHECK \\(%s IN \\([^)]*\\)\\)",
+				regexp.QuoteMeta(column),
+			),
+		)
+		schema = legacy.ReplaceAllString(schema, "")
+
 		// Создаем временную таблицу
 		tmp := table + "_new"
 		createSQL := strings.Replace(schema, table, tmp, 1)
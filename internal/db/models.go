@@ -22,9 +22,31 @@ type Plan struct {
 	ID           uint      `gorm:"primaryKey"`
 	Name         string    `gorm:"not null"`
 	PriceInt     int       `gorm:"not null"`
+	PriceStars   int       `gorm:"default:0"`
 	DurationDays int       `gorm:"not null"`
+	IsTrial      bool      `gorm:"default:false"`
 	Archived     bool      `gorm:"default:false"`
 	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	// Seats - мест в семейном тарифе вместе с владельцем. 0 или 1 - обычный тариф
+	Seats int
+
+	// Description - описание в Markdown для /plans. SortOrder задает порядок
+	// в списках, Recommended добавляет отметку «рекомендуем»
+	Description string
+	SortOrder   int
+	Recommended bool
+	// Visibility - public, hidden (только по ссылке start=plan_<id>) или partner
+	Visibility string `gorm:"not null;default:public"`
+	// MaxQty - сколько ключей можно купить в одном заказе, 0 - без ограничения
+	MaxQty int
+
+	// При изменении названия, цены или срока купленного тарифа создается новая
+	// версия, а прежняя снимается с продажи и ссылается на нее SupersededBy.
+	// Подписки сохраняют условия покупки и продлеваются по ним
+	Version      int `gorm:"not null;default:1"`
+	PreviousID   *uint
+	SupersededBy *uint
 }
 
 type User struct {
@@ -33,11 +55,15 @@ type User struct {
 	Phone     string
 	RefCode   string
 	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	// Source - рекламная кампания из ссылки start=src_<кампания>, по которой
+	// пользователь впервые запустил бота
+	Source string `gorm:"index"`
 }
 
 type Admin struct {
 	TgID     int64  `gorm:"primaryKey"`
-	Role     string `gorm:"check:role IN ('super','admin','cashier','support')"`
+	Role     string `gorm:"check:role IN ('super','admin','cashier','support','partner')"`
 	Disabled bool   `gorm:"default:false"`
 }
 
@@ -48,19 +74,106 @@ type PaymentMethod struct {
 	OwnerName   string    `gorm:"not null"`
 	Archived    bool      `gorm:"default:false"`
 	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	// Currency - валюта перевода: RUB, USD, EUR или USDT. Способ показывается
+	// только для тарифов с ценой в этой валюте
+	Currency string `gorm:"not null;default:RUB"`
+
+	// Лимиты, чтобы банк не заблокировал карту. DailyLimit - сумма заказов за
+	// сутки в валюте способа, MaxPending - неоплаченных заказов одновременно,
+	// 0 - без ограничения. ActiveFrom и ActiveTo - часы приема переводов,
+	// при равных значениях способ работает круглосуточно
+	DailyLimit int
+	MaxPending int
+	ActiveFrom int
+	ActiveTo   int
+
+	// Реквизиты для платежного QR-кода по ГОСТ Р 56042-2014: расчетный счет
+	// получателя, БИК и корреспондентский счет банка. Без них QR не выдается
+	Account     string
+	BIC         string
+	CorrAccount string
+}
+
+// RejectReason - шаблон причины отклонения платежа. В Template подставляются
+// {order}, {amount} и {reason}
+type RejectReason struct {
+	ID            uint   `gorm:"primaryKey"`
+	Title         string `gorm:"not null"`
+	Template      string `gorm:"not null"`
+	AllowResubmit bool
+	Archived      bool `gorm:"default:false"`
+}
+
+// CashierNotice - копия чека, отправленная кассиру. Нужна, чтобы после
+// решения одного кассира обновить сообщения у остальных
+type CashierNotice struct {
+	ID        uint  `gorm:"primaryKey"`
+	PaymentID uint  `gorm:"not null;index"`
+	ChatID    int64 `gorm:"not null"`
+	MessageID int   `gorm:"not null"`
+	CreatedAt time.Time
 }
 
 type Payment struct {
-	ID            uint  `gorm:"primaryKey"`
-	UserID        int64 `gorm:"not null"`
-	MethodID      uint  `gorm:"not null"`
-	Amount        int   `gorm:"not null"`
-	PlanID        uint  `gorm:"not null"`
-	Qty           int   `gorm:"not null"`
+	ID            uint   `gorm:"primaryKey"`
+	UserID        int64  `gorm:"not null"`
+	MethodID      uint   `gorm:"not null"`
+	Amount        int    `gorm:"not null"`
+	Currency      string `gorm:"default:RUB"`
+	PlanID        uint   `gorm:"not null"`
+	Qty           int    `gorm:"not null"`
 	ReceiptFileID string
-	Status        string `gorm:"check:status IN ('pending','approved','rejected')"`
-	ApprovedBy    *int64
-	CreatedAt     time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+	Status        string `gorm:"check:status IN ('pending','approved','rejected','expired','canceled','refunding','refunded')"`
+	RejectReason  string
+	// ResubmitAllowed - причина отклонения разрешает прислать исправленный чек.
+	// Фиксируется при отклонении: правка шаблона причины на заказ не влияет
+	ResubmitAllowed bool
+	ApprovedBy      *int64
+	CreatedAt       time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	// Provider пустой для ручных переводов, иначе имя онлайн-провайдера
+	Provider         string `gorm:"not null;default:''"`
+	InvoiceID        string `gorm:"index"`
+	ProviderChargeID string
+
+	// ReceiptUniqueID и ReceiptHash нужны для поиска повторно присланных чеков
+	ReceiptUniqueID string `gorm:"index"`
+	ReceiptHash     string
+	DuplicateOf     *uint
+
+	// RefundedAmount может быть меньше Amount при возврате за неиспользованные дни
+	RefundedAmount int
+	RefundedBy     *int64
+	RefundReason   string
+	RefundedAt     *time.Time
+
+	// ChangeSubID - подписка, тариф которой меняется этим платежом вместо выдачи
+	// новых ключей. ProrationCredit - зачтенная стоимость оставшихся дней
+	ChangeSubID     *uint
+	ProrationCredit int
+	// PrevPlanID, PrevStartDate, PrevEndDate и PrevPaidAmount - тариф, срок и
+	// оплата ключа до смены. По ним возврат доплаты откатывает смену тарифа
+	PrevPlanID     *uint
+	PrevStartDate  *time.Time
+	PrevEndDate    *time.Time
+	PrevPaidAmount int
+
+	// RenewSubID - подписка, продленная этим платежом при автопродлении с баланса
+	RenewSubID *uint `gorm:"index"`
+
+	// ListAmount - цена заказа по прайсу тарифа, VolumeDiscount - примененная
+	// скидка за количество в процентах. Нужны для отчетов по скидкам
+	ListAmount     int
+	VolumeDiscount int
+
+	// Surcharge - надбавка к цене, которая делает сумму ручного перевода
+	// уникальной. После одобрения возвращается на баланс
+	Surcharge int
+
+	// Wholesale - оптовый заказ партнера: при одобрении выпускаются ссылки
+	// активации вместо ключей. Фиксируется при создании заказа
+	Wholesale bool
 
 	User            User          `gorm:"foreignKey:UserID;references:TgID"`
 	Method          PaymentMethod `gorm:"foreignKey:MethodID"`
@@ -82,6 +195,18 @@ type Subscription struct {
 	EndDate    time.Time `gorm:"type:date;not null"`
 	Active     bool      `gorm:"default:true"`
 	PaymentID  *uint
+	// AutoRenew - продлевать с баланса перед окончанием
+	AutoRenew bool
+	// PaidAmount - сколько рублей заплачено за срок от StartDate до EndDate:
+	// зачет и доплата при смене тарифа плюс автопродления. 0 - берется доля
+	// ключа в заказе PaymentID, см. KeyPaidAmount
+	PaidAmount int
+
+	// SeatOf - подписка владельца, если это место в семейном тарифе. У места
+	// свой пир, но дата окончания общая с владельцем. InviteCode - код
+	// приглашения в места владельца
+	SeatOf     *uint  `gorm:"index"`
+	InviteCode string `gorm:"index"`
 
 	User    User     `gorm:"foreignKey:UserID;references:TgID"`
 	Plan    Plan     `gorm:"foreignKey:PlanID"`
@@ -94,6 +219,120 @@ type Referral struct {
 	InviteeID int64     `gorm:"not null"`
 	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP"`
 
+	// RewardStatus: pending - ждем оплату приглашенного, review - подозрительное
+	// приглашение ждет решения админа, rewarded - награда начислена,
+	// rejected - награда не положена
+	RewardStatus    string `gorm:"default:pending"`
+	RewardPaymentID *uint
+	BonusDays       int
+	BonusAmount     int
+	RewardedAt      *time.Time
+
+	// FraudReason - почему приглашение отправлено на проверку или отклонено
+	FraudReason string
+	ReviewedBy  *int64
+
 	Inviter User `gorm:"foreignKey:InviterID;references:TgID"`
 	Invitee User `gorm:"foreignKey:InviteeID;references:TgID"`
 }
+
+// LedgerEntry - движение по балансу пользователя. Записи только добавляются,
+// баланс равен сумме Amount: пополнения положительные, списания отрицательные
+type LedgerEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    int64  `gorm:"not null;index"`
+	Amount    int    `gorm:"not null"`
+	Kind      string `gorm:"not null;check:kind IN ('topup','purchase','referral','refund','adjustment')"`
+	PaymentID *uint
+	AdminID   *int64
+	Comment   string
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	User User `gorm:"foreignKey:UserID;references:TgID"`
+}
+
+// PartnerPrice - оптовая цена тарифа для партнера
+type PartnerPrice struct {
+	ID        uint  `gorm:"primaryKey"`
+	PartnerID int64 `gorm:"not null;uniqueIndex:idx_partner_plan"`
+	PlanID    uint  `gorm:"not null;uniqueIndex:idx_partner_plan"`
+	PriceInt  int   `gorm:"not null"`
+
+	Plan Plan `gorm:"foreignKey:PlanID"`
+}
+
+// PlanDiscount - скидка за количество ключей тарифа в одном заказе. Действует
+// правило с наибольшим MinQty, не превышающим количество
+type PlanDiscount struct {
+	ID      uint `gorm:"primaryKey"`
+	PlanID  uint `gorm:"not null;uniqueIndex:idx_plan_min_qty"`
+	MinQty  int  `gorm:"not null;uniqueIndex:idx_plan_min_qty"`
+	Percent int  `gorm:"not null"`
+}
+
+// PlanPrice - цена тарифа в валюте, отличной от рублей и звезд. Amount в
+// минимальных единицах валюты: центах для USD, EUR и USDT
+type PlanPrice struct {
+	ID       uint   `gorm:"primaryKey"`
+	PlanID   uint   `gorm:"not null;uniqueIndex:idx_plan_currency"`
+	Currency string `gorm:"not null;uniqueIndex:idx_plan_currency"`
+	Amount   int    `gorm:"not null"`
+}
+
+// ExchangeRate - курс валюты к рублю для сводной выручки в отчетах.
+// Rate - рублей за единицу валюты (за 1 USD, 1 ⭐)
+type ExchangeRate struct {
+	Currency  string  `gorm:"primaryKey"`
+	Rate      float64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+// PartnerKey - ключ, купленный партнером оптом. Пир создается, когда клиент
+// партнера активирует ключ по ссылке с Code
+type PartnerKey struct {
+	ID             uint   `gorm:"primaryKey"`
+	PartnerID      int64  `gorm:"not null;index"`
+	PaymentID      uint   `gorm:"not null;index"`
+	PlanID         uint   `gorm:"not null"`
+	Code           string `gorm:"not null;uniqueIndex"`
+	ClaimedBy      *int64
+	ClaimedAt      *time.Time
+	SubscriptionID *uint
+	// Revoked - ключ отозван возвратом платежа и больше не активируется
+	Revoked   bool
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+
+	Plan         Plan          `gorm:"foreignKey:PlanID"`
+	Claimer      *User         `gorm:"foreignKey:ClaimedBy;references:TgID"`
+	Subscription *Subscription `gorm:"foreignKey:SubscriptionID"`
+}
+
+// Checkout - оформление заказа в /buy. Повторяет выбор покупателя, чтобы
+// напомнить о брошенной покупке и продолжить ее с того же шага даже после
+// перезапуска бота. Step - шаг покупки, PaymentID - заказ на перевод без чека
+type Checkout struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    int64  `gorm:"not null;index"`
+	Step      string `gorm:"not null"`
+	PlanID    uint
+	Platform  string
+	Qty       int
+	MethodID  uint
+	Pay       string
+	PaymentID *uint
+	// Completed - заказ оплачен, к нему приложен чек или выдан пробный период
+	Completed bool `gorm:"default:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// CheckoutReminder - отправленное напоминание о брошенном оформлении.
+// ResumedAt - покупатель вернулся к оформлению по кнопке из напоминания
+type CheckoutReminder struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     int64  `gorm:"not null;index"`
+	CheckoutID uint   `gorm:"not null;index"`
+	Step       string `gorm:"not null"`
+	CreatedAt  time.Time
+	ResumedAt  *time.Time
+}
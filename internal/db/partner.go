@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PartnerStatement - выписка партнера за календарный месяц
+type PartnerStatement struct {
+	PartnerID int64
+	From      time.Time
+	To        time.Time
+
+	Orders     []Payment
+	KeysBought int
+	Spent      int
+	Refunded   int
+	Claimed    int
+	// Free - ключи, которые на момент выписки еще никто не активировал
+	Free int
+}
+
+// BuildPartnerStatement собирает выписку партнера за месяц, в котором лежит month.
+// Используется и ботом по запросу, и планировщиком для ежемесячной рассылки
+func BuildPartnerStatement(tx *gorm.DB, partnerID int64, month time.Time) (*PartnerStatement, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	st := &PartnerStatement{PartnerID: partnerID, From: from, To: from.AddDate(0, 1, 0)}
+
+	var payments []Payment
+	err := tx.Preload("Plan").Where("user_id = ? AND status IN ?", partnerID, []string{"approved", "refunded"}).
+		Scopes(CreatedBetween(st.From, st.To)).Order("id ASC").Find(&payments).Error
+	if err != nil {
+		return nil, fmt.Errorf("fetch partner %d payments: %w", partnerID, err)
+	}
+	for _, payment := range payments {
+		st.Orders = append(st.Orders, payment)
+		st.KeysBought += payment.Qty
+		st.Spent += payment.Amount - payment.Surcharge
+		st.Refunded += payment.RefundedAmount
+	}
+
+	var keys []PartnerKey
+	if err := tx.Where("partner_id = ?", partnerID).Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("fetch partner %d keys: %w", partnerID, err)
+	}
+	for _, key := range keys {
+		if key.ClaimedAt != nil && st.contains(*key.ClaimedAt) {
+			st.Claimed++
+		}
+		if key.ClaimedBy == nil && !key.Revoked {
+			st.Free++
+		}
+	}
+
+	return st, nil
+}
+
+func (st *PartnerStatement) contains(t time.Time) bool {
+	t = t.In(st.From.Location())
+	return !t.Before(st.From) && t.Before(st.To)
+}
+
+// Empty - за месяц не было ни покупок, ни активаций
+func (st *PartnerStatement) Empty() bool {
+	return len(st.Orders) == 0 && st.Claimed == 0
+}
+
+// Text форматирует выписку для отправки партнеру
+func (st *PartnerStatement) Text() string {
+	text := fmt.Sprintf("📄 Выписка за %s\n\n🛒 Заказов: %d, ключей: %d\n💰 Оплачено: %d руб.",
+		st.From.Format("01.2006"), len(st.Orders), st.KeysBought, st.Spent)
+	if st.Refunded > 0 {
+		text += fmt.Sprintf("\n↩️ Возвращено: %d руб.", st.Refunded)
+	}
+	text += fmt.Sprintf("\n✅ Активировано клиентами: %d\n🆓 Свободных ключей сейчас: %d", st.Claimed, st.Free)
+
+	if len(st.Orders) > 0 {
+		text += "\n\nЗаказы:"
+		for _, order := range st.Orders {
+			text += fmt.Sprintf("\n#%d %s %s x%d - %d руб.", order.ID, order.CreatedAt.Format("02.01"), order.Plan.Name, order.Qty, order.Amount)
+			if order.Status == "refunded" {
+				text += " (возврат)"
+			}
+		}
+	}
+	return text
+}
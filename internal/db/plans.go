@@ -0,0 +1,29 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// PlanOnSale - условие выборки тарифов, которые продаются: не архивированы и
+// не заменены новой версией
+const PlanOnSale = "archived = false AND superseded_by IS NULL"
+
+// OnSale - продается ли тариф
+func (p *Plan) OnSale() bool {
+	return !p.Archived && p.SupersededBy == nil
+}
+
+// LatestPlanVersion возвращает последнюю версию тарифа по цепочке SupersededBy
+func LatestPlanVersion(tx *gorm.DB, plan *Plan) (*Plan, error) {
+	latest := *plan
+	for latest.SupersededBy != nil {
+		next := *latest.SupersededBy
+		latest = Plan{}
+		if err := tx.First(&latest, next).Error; err != nil {
+			return nil, fmt.Errorf("fetch plan version %d: %w", next, err)
+		}
+	}
+	return &latest, nil
+}
@@ -35,27 +35,42 @@ func (r *Repository) DB() *gorm.DB {
 	return r.db
 }
 
+// AutoMigrate приводит схему базы к моделям, см. Migrate
 func (r *Repository) AutoMigrate() error {
-	// обычная миграция схемы
-	if err := r.db.AutoMigrate(
-		&Plan{},
-		&User{},
-		&Admin{},
-		&PaymentMethod{},
-		&Payment{},
-		&Subscription{},
-		&Referral{},
-	); err != nil {
-		return err
-	}
+	return Migrate(r.db)
+}
 
-	// ensure enum constraints are up to date
-	if err := updateEnumConstraint(r.db, "admins", "role", []string{"super", "admin", "cashier", "support"}); err != nil {
+// seedRejectReasons заполняет стандартные причины отклонения при первом запуске
+func seedRejectReasons(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&RejectReason{}).Count(&count).Error; err != nil {
 		return err
 	}
-	if err := updateEnumConstraint(r.db, "payments", "status", []string{"pending", "approved", "rejected"}); err != nil {
-		return err
+	if count > 0 {
+		return nil
 	}
 
-	return nil
+	reasons := []RejectReason{
+		{
+			Title:         "Неверная сумма",
+			Template:      "❌ Платеж по заказу #{order} отклонен: сумма перевода не совпадает с суммой заказа ({amount}).\n\nДоплатите разницу и отправьте исправленный чек.",
+			AllowResubmit: true,
+		},
+		{
+			Title:         "Нечитаемый чек",
+			Template:      "❌ Чек к заказу #{order} не удалось прочитать.\n\nОтправьте четкий скриншот или PDF из приложения банка.",
+			AllowResubmit: true,
+		},
+		{
+			Title:         "Дубликат чека",
+			Template:      "❌ Чек к заказу #{order} уже использовался для другого заказа.\n\nЕсли это ошибка, обратитесь в поддержку.",
+			AllowResubmit: false,
+		},
+		{
+			Title:         "Перевод не поступил",
+			Template:      "❌ Перевод по заказу #{order} на {amount} не поступил.\n\nПроверьте реквизиты и отправьте чек, подтверждающий перевод.",
+			AllowResubmit: true,
+		},
+	}
+	return db.Create(&reasons).Error
 }
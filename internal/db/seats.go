@@ -0,0 +1,18 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SyncSeatEndDates переносит дату окончания подписки владельца на места
+// семейного тарифа. Вызывается везде, где продлевается подписка
+func SyncSeatEndDates(tx *gorm.DB, ownerSubID uint, endDate time.Time) error {
+	err := tx.Model(&Subscription{}).Where("seat_of = ?", ownerSubID).Update("end_date", endDate).Error
+	if err != nil {
+		return fmt.Errorf("sync seats of subscription %d: %w", ownerSubID, err)
+	}
+	return nil
+}
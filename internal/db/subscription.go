@@ -0,0 +1,36 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// KeyPaidAmount возвращает, сколько рублей заплачено за текущий срок ключа.
+// Если сумма не записана в подписке, берется доля ключа в его заказе - уже со
+// скидкой за количество, скидкой приглашенного и оптовой ценой партнера.
+// Заказ в другой валюте оценивается по рублевой цене тарифа из sub.Plan,
+// ключ без заказа (пробный период) - нулем
+func KeyPaidAmount(tx *gorm.DB, sub *Subscription) (int, error) {
+	if sub.PaidAmount > 0 || sub.PaymentID == nil {
+		return sub.PaidAmount, nil
+	}
+
+	var payment Payment
+	if err := tx.First(&payment, *sub.PaymentID).Error; err != nil {
+		return 0, fmt.Errorf("fetch payment %d of subscription %d: %w", *sub.PaymentID, sub.ID, err)
+	}
+	if payment.Currency != "" && payment.Currency != "RUB" {
+		return sub.Plan.PriceInt, nil
+	}
+	if payment.Qty <= 0 {
+		return 0, nil
+	}
+
+	paid := (payment.Amount - payment.Surcharge) / payment.Qty
+	// Старые подписки после смены тарифа ссылаются на доплату, к ней добавляется зачет
+	if payment.ChangeSubID != nil {
+		paid += payment.ProrationCredit
+	}
+	return paid, nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TimeSince - SQL-условие "column не раньше параметра". SQLite хранит время
+// строкой: CURRENT_TIMESTAMP - в UTC без пояса, gorm - с поясом сервера, и
+// строки сравниваются некорректно. julianday приводит обе стороны к одной шкале
+func TimeSince(tx *gorm.DB, column string) string {
+	if tx.Dialector.Name() == "sqlite" {
+		return "julianday(" + column + ") >= julianday(?)"
+	}
+	return column + " >= ?"
+}
+
+// TimeBefore - SQL-условие "column раньше параметра", см. TimeSince
+func TimeBefore(tx *gorm.DB, column string) string {
+	if tx.Dialector.Name() == "sqlite" {
+		return "julianday(" + column + ") < julianday(?)"
+	}
+	return column + " < ?"
+}
+
+// CreatedSince отбирает записи, созданные не раньше since
+func CreatedSince(since time.Time) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(TimeSince(tx, "created_at"), since)
+	}
+}
+
+// CreatedBetween отбирает записи, созданные в [from, to)
+func CreatedBetween(from, to time.Time) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(TimeSince(tx, "created_at"), from).Where(TimeBefore(tx, "created_at"), to)
+	}
+}
@@ -65,6 +65,23 @@ type RemovePeerRequest struct {
 	PublicKey string `json:"public_key"`
 }
 
+// GetPeerInfoRequest запрос состояния пира
+type GetPeerInfoRequest struct {
+	Interface string `json:"interface"`
+	PublicKey string `json:"public_key"`
+}
+
+// GetPeerInfoResponse состояние пира: последний handshake и трафик
+type GetPeerInfoResponse struct {
+	PublicKey         string `json:"public_key"`
+	AllowedIP         string `json:"allowed_ip"`
+	LastHandshakeUnix int64  `json:"last_handshake_unix"`
+	RxBytes           int64  `json:"rx_bytes"`
+	TxBytes           int64  `json:"tx_bytes"`
+	Enabled           bool   `json:"enabled"`
+	PeerID            string `json:"peer_id"`
+}
+
 // Client представляет клиент для взаимодействия с WG агентом
 type Client struct {
 	addr       string
@@ -302,3 +319,27 @@ func (c *Client) EnablePeer(ctx context.Context, req *EnablePeerRequest) error {
 	slog.Info("Peer enabled successfully", "public_key", req.PublicKey[:10]+"...")
 	return nil
 }
+
+// GetPeerInfo возвращает состояние пира
+func (c *Client) GetPeerInfo(ctx context.Context, req *GetPeerInfoRequest) (*GetPeerInfoResponse, error) {
+	resp, err := c.makeRequest(ctx, "POST", "/api/v1/peers/info", req)
+	if err != nil {
+		slog.Error("Failed to get peer info", "public_key", req.PublicKey[:10]+"...", "error", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		slog.Error("WG Agent returned error for peer info", "status", resp.StatusCode, "body", string(body), "public_key", req.PublicKey[:10]+"...")
+		return nil, errors.New("WG agent error " + string(rune(resp.StatusCode)) + ": " + string(body))
+	}
+
+	var result GetPeerInfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		slog.Error("Failed to decode peer info response", "public_key", req.PublicKey[:10]+"...", "error", err)
+		return nil, errors.New("failed to decode response: " + err.Error())
+	}
+
+	return &result, nil
+}
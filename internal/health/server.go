@@ -9,6 +9,7 @@ import (
 
 type Server struct {
 	server *http.Server
+	mux    *http.ServeMux
 }
 
 func NewServer(addr string) *Server {
@@ -24,9 +25,16 @@ func NewServer(addr string) *Server {
 			Addr:    addr,
 			Handler: mux,
 		},
+		mux: mux,
 	}
 }
 
+// Handle регистрирует дополнительный обработчик, например webhook платежей.
+// Вызывать до Start
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
 func (s *Server) Start() error {
 	slog.Info("Health HTTP сервер запущен", "addr", s.server.Addr)
 	return s.server.ListenAndServe()
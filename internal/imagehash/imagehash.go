@@ -0,0 +1,84 @@
+// Package imagehash считает перцептивный хэш изображений для поиска
+// повторно присланных скриншотов
+package imagehash
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// DHash - разностный хэш: изображение сжимается до 9x8 в оттенках серого,
+// каждый бит показывает, светлее ли пиксель своего правого соседа.
+// Устойчив к пересжатию и изменению размера скриншота
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var gray [h][w]float64
+
+	b := img.Bounds()
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			gray[y][x] = average(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// average возвращает среднюю яркость прямоугольника
+func average(img image.Image, x0, y0, x1, y1 int) float64 {
+	var sum float64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return sum / float64((x1-x0)*(y1-y0))
+}
+
+// FromReader декодирует JPEG или PNG и возвращает его хэш
+func FromReader(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("decode image: %w", err)
+	}
+	return DHash(img), nil
+}
+
+// Distance - число различающихся бит. До 5-6 - почти наверняка то же изображение
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Format кодирует хэш в 16 hex-символов для хранения в БД
+func Format(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func Parse(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
@@ -0,0 +1,52 @@
+package imagehash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// receipt рисует условный чек: полосы разной яркости
+func receipt(w, h int, shift uint8) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + y*97/h) % 256)
+			if (x*7/w)%2 == 0 {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v + shift, v + shift, v + shift, 255})
+		}
+	}
+	return img
+}
+
+func TestDHashSimilarity(t *testing.T) {
+	original := DHash(receipt(360, 640, 0))
+
+	// Тот же скриншот, пересжатый в JPEG и уменьшенный
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, receipt(180, 320, 0), &jpeg.Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := FromReader(&buf)
+	if err != nil {
+		t.Fatalf("FromReader failed: %v", err)
+	}
+
+	if d := Distance(original, recompressed); d > 6 {
+		t.Errorf("recompressed copy distance = %d, want <= 6", d)
+	}
+
+	other := DHash(image.NewRGBA(image.Rect(0, 0, 360, 640)))
+	if d := Distance(original, other); d <= 6 {
+		t.Errorf("different image distance = %d, want > 6", d)
+	}
+
+	parsed, err := Parse(Format(original))
+	if err != nil || parsed != original {
+		t.Errorf("Parse(Format(%x)) = %x, %v", original, parsed, err)
+	}
+}
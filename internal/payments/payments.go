@@ -1,5 +1,89 @@
 package payments
 
-func ProcessPayment() {
-	
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Статусы платежа у провайдера, к которым приводятся ответы и уведомления
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusCanceled  = "canceled"
+)
+
+var ErrUnknownProvider = errors.New("unknown payment provider")
+
+// CreateRequest описывает платеж, который нужно создать у провайдера
+type CreateRequest struct {
+	OrderID     string
+	Amount      int
+	Currency    string
+	Description string
+	ReturnURL   string
+}
+
+// CreateResult содержит идентификатор платежа у провайдера и ссылку на оплату
+type CreateResult struct {
+	ProviderPaymentID string
+	ConfirmationURL   string
+	Status            string
+}
+
+// Notification - разобранное и проверенное уведомление от провайдера
+type Notification struct {
+	ProviderPaymentID string
+	OrderID           string
+	Status            string
+	Amount            int
+}
+
+// Provider - онлайн-эквайринг с оплатой по ссылке и уведомлениями на webhook
+type Provider interface {
+	Name() string
+	CreatePayment(ctx context.Context, req CreateRequest) (*CreateResult, error)
+	GetPayment(ctx context.Context, providerPaymentID string) (*Notification, error)
+	Refund(ctx context.Context, providerPaymentID string, amount int) error
+	// ParseWebhook проверяет подпись и разбирает тело уведомления
+	ParseWebhook(body []byte, signature string) (*Notification, error)
+}
+
+// Registry хранит подключенных провайдеров по имени
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+func (r *Registry) Register(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[p.Name()] = p
+}
+
+func (r *Registry) Get(name string) (Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Names возвращает имена провайдеров в стабильном порядке для построения клавиатур
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
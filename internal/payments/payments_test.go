@@ -0,0 +1,189 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// fakeAcquirer - локальный фейковый провайдер с API в стиле YooKassa
+type fakeAcquirer struct {
+	mu       sync.Mutex
+	payments map[string]redirectPayment
+	refunds  []string
+	nextID   int
+}
+
+func newFakeAcquirer(t *testing.T) (*fakeAcquirer, *httptest.Server) {
+	fake := &fakeAcquirer{payments: make(map[string]redirectPayment)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/payments", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "shop" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Amount       redirectAmount    `json:"amount"`
+			Metadata     map[string]string `json:"metadata"`
+			Confirmation map[string]string `json:"confirmation"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fake.mu.Lock()
+		fake.nextID++
+		p := redirectPayment{ID: "pay_" + strconv.Itoa(fake.nextID), Status: "pending", Amount: req.Amount, Metadata: req.Metadata}
+		p.Confirmation.Type = "redirect"
+		p.Confirmation.ConfirmationURL = "https://pay.example/" + p.ID
+		fake.payments[p.ID] = p
+		fake.mu.Unlock()
+
+		json.NewEncoder(w).Encode(p)
+	})
+
+	mux.HandleFunc("/payments/", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		p, ok := fake.payments[r.URL.Path[len("/payments/"):]]
+		fake.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	})
+
+	mux.HandleFunc("/refunds", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			PaymentID string `json:"payment_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		fake.mu.Lock()
+		fake.refunds = append(fake.refunds, req.PaymentID)
+		fake.mu.Unlock()
+		w.Write([]byte(`{"status":"succeeded"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+// succeed переводит платеж в succeeded и возвращает подписанное уведомление
+func (f *fakeAcquirer) succeed(id string) ([]byte, string) {
+	f.mu.Lock()
+	p := f.payments[id]
+	p.Status = "succeeded"
+	f.payments[id] = p
+	f.mu.Unlock()
+
+	body, _ := json.Marshal(redirectEvent{Event: "payment.succeeded", Object: p})
+	return body, Sign(body, testWebhookSecret)
+}
+
+func newTestProvider(srv *httptest.Server) *RedirectProvider {
+	return NewRedirectProvider(RedirectConfig{
+		Name:          "acquiring",
+		BaseURL:       srv.URL,
+		ShopID:        "shop",
+		SecretKey:     "secret",
+		WebhookSecret: testWebhookSecret,
+		HTTPClient:    srv.Client(),
+	})
+}
+
+func TestRedirectProviderFlow(t *testing.T) {
+	fake, srv := newFakeAcquirer(t)
+	provider := newTestProvider(srv)
+	ctx := context.Background()
+
+	res, err := provider.CreatePayment(ctx, CreateRequest{OrderID: "order_7", Amount: 450, Currency: "RUB", ReturnURL: "https://t.me/bot"})
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+	if res.ConfirmationURL == "" || res.Status != StatusPending {
+		t.Fatalf("unexpected create result: %+v", res)
+	}
+
+	body, sig := fake.succeed(res.ProviderPaymentID)
+	n, err := provider.ParseWebhook(body, sig)
+	if err != nil {
+		t.Fatalf("ParseWebhook failed: %v", err)
+	}
+	if n.Status != StatusSucceeded || n.OrderID != "order_7" || n.Amount != 450 {
+		t.Errorf("unexpected notification: %+v", n)
+	}
+
+	if _, err := provider.ParseWebhook(body, Sign(body, "wrong")); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	got, err := provider.GetPayment(ctx, res.ProviderPaymentID)
+	if err != nil || got.Status != StatusSucceeded {
+		t.Errorf("GetPayment = %+v, %v", got, err)
+	}
+
+	if err := provider.Refund(ctx, res.ProviderPaymentID, 450); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	if len(fake.refunds) != 1 || fake.refunds[0] != res.ProviderPaymentID {
+		t.Errorf("unexpected refunds: %v", fake.refunds)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	fake, srv := newFakeAcquirer(t)
+	provider := newTestProvider(srv)
+
+	registry := NewRegistry()
+	registry.Register(provider)
+
+	var received []*Notification
+	handler := WebhookHandler(registry, func(name string, n *Notification) error {
+		received = append(received, n)
+		return nil
+	})
+
+	res, err := provider.CreatePayment(context.Background(), CreateRequest{OrderID: "order_1", Amount: 200, Currency: "RUB"})
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+	body, sig := fake.succeed(res.ProviderPaymentID)
+
+	tests := []struct {
+		name   string
+		path   string
+		sig    string
+		status int
+	}{
+		{"valid", WebhookPath + "acquiring", sig, http.StatusOK},
+		{"bad signature", WebhookPath + "acquiring", "deadbeef", http.StatusUnauthorized},
+		{"unknown provider", WebhookPath + "other", sig, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			req.Header.Set(SignatureHeader, tt.sig)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	if len(received) != 1 || received[0].ProviderPaymentID != res.ProviderPaymentID {
+		t.Errorf("unexpected notifications: %+v", received)
+	}
+}
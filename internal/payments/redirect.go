@@ -0,0 +1,233 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// RedirectConfig - настройки эквайринга в стиле YooKassa
+type RedirectConfig struct {
+	Name          string
+	BaseURL       string
+	ShopID        string
+	SecretKey     string
+	WebhookSecret string
+	HTTPClient    *http.Client
+}
+
+// RedirectProvider создает платеж, отдает ссылку на оплату и принимает
+// подписанные HMAC-SHA256 уведомления о смене статуса
+type RedirectProvider struct {
+	cfg    RedirectConfig
+	client *http.Client
+}
+
+func NewRedirectProvider(cfg RedirectConfig) *RedirectProvider {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	if cfg.Name == "" {
+		cfg.Name = "acquiring"
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	return &RedirectProvider{cfg: cfg, client: client}
+}
+
+func (p *RedirectProvider) Name() string {
+	return p.cfg.Name
+}
+
+type redirectAmount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type redirectPayment struct {
+	ID           string            `json:"id"`
+	Status       string            `json:"status"`
+	Amount       redirectAmount    `json:"amount"`
+	Metadata     map[string]string `json:"metadata"`
+	Confirmation struct {
+		Type            string `json:"type"`
+		ReturnURL       string `json:"return_url,omitempty"`
+		ConfirmationURL string `json:"confirmation_url,omitempty"`
+	} `json:"confirmation"`
+}
+
+type redirectEvent struct {
+	Event  string          `json:"event"`
+	Object redirectPayment `json:"object"`
+}
+
+func (p *RedirectProvider) CreatePayment(ctx context.Context, req CreateRequest) (*CreateResult, error) {
+	body := map[string]interface{}{
+		"amount":       redirectAmount{Value: formatMoney(req.Amount), Currency: req.Currency},
+		"capture":      true,
+		"description":  req.Description,
+		"metadata":     map[string]string{"order_id": req.OrderID},
+		"confirmation": map[string]string{"type": "redirect", "return_url": req.ReturnURL},
+	}
+
+	var resp redirectPayment
+	// OrderID служит ключом идемпотентности, повторный запрос не создаст второй платеж
+	if err := p.do(ctx, "/payments", req.OrderID, body, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.ID == "" || resp.Confirmation.ConfirmationURL == "" {
+		return nil, fmt.Errorf("provider returned incomplete payment for order %s", req.OrderID)
+	}
+
+	return &CreateResult{
+		ProviderPaymentID: resp.ID,
+		ConfirmationURL:   resp.Confirmation.ConfirmationURL,
+		Status:            normalizeStatus(resp.Status),
+	}, nil
+}
+
+func (p *RedirectProvider) GetPayment(ctx context.Context, providerPaymentID string) (*Notification, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.BaseURL+"/payments/"+providerPaymentID, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.SetBasicAuth(p.cfg.ShopID, p.cfg.SecretKey)
+
+	var resp redirectPayment
+	if err := p.send(httpReq, &resp); err != nil {
+		return nil, err
+	}
+	return toNotification(resp)
+}
+
+func (p *RedirectProvider) Refund(ctx context.Context, providerPaymentID string, amount int) error {
+	body := map[string]interface{}{
+		"payment_id": providerPaymentID,
+		"amount":     redirectAmount{Value: formatMoney(amount), Currency: "RUB"},
+	}
+	return p.do(ctx, "/refunds", "refund_"+providerPaymentID+"_"+strconv.Itoa(amount), body, nil)
+}
+
+func (p *RedirectProvider) ParseWebhook(body []byte, signature string) (*Notification, error) {
+	if !p.validSignature(body, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event redirectEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook body: %w", err)
+	}
+	return toNotification(event.Object)
+}
+
+// Sign подписывает тело уведомления секретом webhook. Используется провайдером
+// и тестовым фейковым сервером
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *RedirectProvider) validSignature(body []byte, signature string) bool {
+	if p.cfg.WebhookSecret == "" || signature == "" {
+		return false
+	}
+	expected := Sign(body, p.cfg.WebhookSecret)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
+
+func (p *RedirectProvider) do(ctx context.Context, path, idempotenceKey string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.SetBasicAuth(p.cfg.ShopID, p.cfg.SecretKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Idempotence-Key", idempotenceKey)
+
+	return p.send(httpReq, out)
+}
+
+func (p *RedirectProvider) send(httpReq *http.Request, out interface{}) error {
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("provider request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("provider response read failed: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("provider returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func toNotification(p redirectPayment) (*Notification, error) {
+	if p.ID == "" {
+		return nil, errors.New("payment id is missing")
+	}
+	amount, err := parseMoney(p.Amount.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &Notification{
+		ProviderPaymentID: p.ID,
+		OrderID:           p.Metadata["order_id"],
+		Status:            normalizeStatus(p.Status),
+		Amount:            amount,
+	}, nil
+}
+
+func normalizeStatus(status string) string {
+	switch status {
+	case "succeeded":
+		return StatusSucceeded
+	case "canceled":
+		return StatusCanceled
+	}
+	return StatusPending
+}
+
+// formatMoney переводит целые рубли в строку вида "199.00"
+func formatMoney(amount int) string {
+	return strconv.Itoa(amount) + ".00"
+}
+
+// parseMoney отбрасывает копейки: цены тарифов хранятся в целых рублях
+func parseMoney(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	whole, _, _ := strings.Cut(value, ".")
+	amount, err := strconv.Atoi(whole)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", value, err)
+	}
+	return amount, nil
+}
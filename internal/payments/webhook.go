@@ -0,0 +1,64 @@
+package payments
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// WebhookPath - префикс пути, на который провайдеры шлют уведомления: /payments/webhook/<provider>
+const WebhookPath = "/payments/webhook/"
+
+// SignatureHeader - заголовок с HMAC-подписью тела уведомления
+const SignatureHeader = "X-Signature"
+
+// NotifyFunc применяет проверенное уведомление к заказу
+type NotifyFunc func(provider string, n *Notification) error
+
+// WebhookHandler принимает уведомления провайдеров, проверяет подпись и передает их в notify
+func WebhookHandler(registry *Registry, notify NotifyFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, WebhookPath), "/")
+		provider, err := registry.Get(name)
+		if err != nil {
+			slog.Warn("Webhook for unknown provider", "provider", name)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		n, err := provider.ParseWebhook(body, r.Header.Get(SignatureHeader))
+		if err != nil {
+			slog.Warn("Webhook rejected", "provider", name, "error", err)
+			if errors.Is(err, ErrInvalidSignature) {
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+
+		slog.Info("Webhook received", "provider", name, "provider_payment_id", n.ProviderPaymentID, "status", n.Status)
+
+		if err := notify(name, n); err != nil {
+			// 5xx заставит провайдера повторить уведомление позже
+			slog.Error("Webhook processing failed", "provider", name, "provider_payment_id", n.ProviderPaymentID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
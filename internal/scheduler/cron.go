@@ -13,6 +13,7 @@ import (
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
 )
 
 type Scheduler struct {
@@ -21,6 +22,11 @@ type Scheduler struct {
 	bot      *tgbotapi.BotAPI
 	cfg      *config.Config
 	wgClient *wgagent.Client
+
+	// onRenewal вызывается после автопродления с ID созданного платежа
+	onRenewal func(paymentID uint)
+	// checkoutReport строит еженедельный отчет о брошенных оформлениях
+	checkoutReport func(now time.Time) (string, error)
 }
 
 func NewScheduler(repo *db.Repository, bot *tgbotapi.BotAPI, cfg *config.Config) (*Scheduler, error) {
@@ -58,6 +64,18 @@ func NewScheduler(repo *db.Repository, bot *tgbotapi.BotAPI, cfg *config.Config)
 	}, nil
 }
 
+// OnRenewal задает обработчик платежей автопродления, например для начисления
+// реферальных наград
+func (s *Scheduler) OnRenewal(fn func(paymentID uint)) {
+	s.onRenewal = fn
+}
+
+// SetCheckoutReport задает построитель отчета о брошенных оформлениях: шаги
+// /buy и их названия знает бот. Пустой отчет не отправляется
+func (s *Scheduler) SetCheckoutReport(fn func(now time.Time) (string, error)) {
+	s.checkoutReport = fn
+}
+
 func (s *Scheduler) Start() error {
 	slog.Info("Starting scheduler with cron jobs")
 
@@ -75,6 +93,49 @@ func (s *Scheduler) Start() error {
 	}
 	slog.Info("Added expiration reminders job: every 30 minutes")
 
+	// Напоминания о завершении пробного периода - каждый день в 12:00
+	_, err = s.cron.AddFunc("0 12 * * *", s.sendTrialConversionReminders)
+	if err != nil {
+		return errors.New("failed to add trial reminders job: " + err.Error())
+	}
+	slog.Info("Added trial conversion reminders job: daily at 12:00")
+
+	// Автопродление с баланса - каждый день в 11:00. Неудачные попытки
+	// повторяются на следующий день, пока подписка не истечет
+	_, err = s.cron.AddFunc("0 11 * * *", s.renewSubscriptions)
+	if err != nil {
+		return errors.New("failed to add auto-renew job: " + err.Error())
+	}
+	slog.Info("Added auto-renew job: daily at 11:00", "days_before", s.cfg.AutoRenewDays)
+
+	// Отмена неоплаченных заказов - каждые 10 минут
+	_, err = s.cron.AddFunc("*/10 * * * *", s.expirePendingPayments)
+	if err != nil {
+		return errors.New("failed to add pending payments expiry job: " + err.Error())
+	}
+	slog.Info("Added pending payments expiry job: every 10 minutes", "ttl", s.cfg.PendingPaymentTTL)
+
+	// Напоминания о брошенных оформлениях - каждые 10 минут
+	_, err = s.cron.AddFunc("*/10 * * * *", s.sendCheckoutReminders)
+	if err != nil {
+		return errors.New("failed to add checkout reminders job: " + err.Error())
+	}
+	slog.Info("Added checkout reminders job: every 10 minutes", "delays", s.cfg.CheckoutReminderDelays, "max_per_user", s.cfg.CheckoutReminderMax)
+
+	// Воронка оформлений за неделю - по понедельникам в 10:00
+	_, err = s.cron.AddFunc("0 10 * * 1", s.sendCheckoutReport)
+	if err != nil {
+		return errors.New("failed to add checkout report job: " + err.Error())
+	}
+	slog.Info("Added checkout report job: weekly on Monday at 10:00")
+
+	// Выписки партнерам за прошлый месяц - 1 числа в 10:00
+	_, err = s.cron.AddFunc("0 10 1 * *", s.sendPartnerStatements)
+	if err != nil {
+		return errors.New("failed to add partner statements job: " + err.Error())
+	}
+	slog.Info("Added partner statements job: monthly on the 1st at 10:00")
+
 	// Проверка здоровья WG Agent - каждые 5 минут
 	_, err = s.cron.AddFunc("*/5 * * * *", s.healthCheckWGAgent)
 	if err != nil {
@@ -171,7 +232,10 @@ func (s *Scheduler) sendExpirationReminders() {
 	threeDaysLater := time.Now().AddDate(0, 0, 3).Format("2006-01-02")
 
 	var soonExpiringSubs []db.Subscription
-	result := s.repo.DB().Where("active = true AND end_date = ?", threeDaysLater).
+	// Пробные подписки получают отдельное напоминание в sendTrialConversionReminders
+	// Подписки с автопродлением получают уведомления от renewSubscriptions
+	result := s.repo.DB().Where("active = true AND auto_renew = false AND end_date = ?", threeDaysLater).
+		Where("plan_id NOT IN (?)", s.repo.DB().Model(&db.Plan{}).Select("id").Where("is_trial = true")).
 		Preload("User").
 		Preload("Plan").
 		Find(&soonExpiringSubs)
@@ -213,6 +277,44 @@ func (s *Scheduler) sendExpirationReminders() {
 	}
 }
 
+// Напоминание о покупке за день до окончания пробного периода
+func (s *Scheduler) sendTrialConversionReminders() {
+	slog.Debug("Checking for trial conversion reminders")
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+
+	var trialSubs []db.Subscription
+	result := s.repo.DB().Where("active = true AND end_date = ?", tomorrow).
+		Where("plan_id IN (?)", s.repo.DB().Model(&db.Plan{}).Select("id").Where("is_trial = true")).
+		Find(&trialSubs)
+
+	if result.Error != nil {
+		slog.Error("Failed to fetch ending trial subscriptions", "error", result.Error)
+		s.sendCriticalAlert("❌ Ошибка получения пробных подписок: " + result.Error.Error())
+		return
+	}
+
+	if len(trialSubs) == 0 {
+		slog.Debug("No trial subscriptions ending tomorrow")
+		return
+	}
+
+	sent := 0
+	for _, sub := range trialSubs {
+		text := "🎁 Пробный период заканчивается завтра (" + sub.EndDate.Format("02.01.2006") + ").\n\n" +
+			"Чтобы VPN продолжил работать без перерыва, оформите подписку командой /buy"
+
+		msg := tgbotapi.NewMessage(sub.UserID, text)
+		if _, err := s.bot.Send(msg); err != nil {
+			slog.Error("Failed to send trial reminder", "user_id", sub.UserID, "subscription_id", sub.ID, "error", err)
+			continue
+		}
+		sent++
+	}
+
+	slog.Info("Trial conversion reminders sent", "sent", sent, "total", len(trialSubs))
+}
+
 // Проверка здоровья WG Agent
 func (s *Scheduler) healthCheckWGAgent() {
 	slog.Debug("Performing WG Agent health check")
@@ -269,3 +371,328 @@ func (s *Scheduler) sendHealthAlert(message string) {
 	slog.Warn("Health alert", "message", message)
 	s.sendAdminReport("🚨 " + message)
 }
+
+// Отмена заказов, по которым так и не прислали чек. Заказы с чеком ждут
+// решения кассира, онлайн-платежи закрывает сам провайдер
+func (s *Scheduler) expirePendingPayments() {
+	slog.Debug("Checking for expired pending payments")
+
+	deadline := time.Now().Add(-s.cfg.PendingPaymentTTL)
+
+	var expired []db.Payment
+	result := s.repo.DB().
+		Where("status = 'pending' AND receipt_file_id = '' AND provider IN ('', 'stars') AND created_at < ?", deadline).
+		Find(&expired)
+
+	if result.Error != nil {
+		slog.Error("Failed to fetch pending payments", "error", result.Error)
+		s.sendCriticalAlert("❌ Ошибка получения неоплаченных заказов: " + result.Error.Error())
+		return
+	}
+
+	if len(expired) == 0 {
+		return
+	}
+
+	count := 0
+	for _, payment := range expired {
+		// Условие на статус защищает от гонки с одобрением кассиром или оплатой
+		res := s.repo.DB().Model(&db.Payment{}).
+			Where("id = ? AND status = 'pending' AND receipt_file_id = ''", payment.ID).
+			Update("status", "expired")
+		if res.Error != nil {
+			slog.Error("Failed to expire payment", "payment_id", payment.ID, "error", res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		count++
+
+		text := "⌛ Заказ #" + strconv.FormatUint(uint64(payment.ID), 10) + " отменен: истек срок оплаты.\n\n" +
+			"Если вы уже перевели деньги, напишите в поддержку. Новый заказ - /buy"
+		if _, err := s.bot.Send(tgbotapi.NewMessage(payment.UserID, text)); err != nil {
+			slog.Error("Failed to notify about expired payment", "user_id", payment.UserID, "payment_id", payment.ID, "error", err)
+		}
+	}
+
+	slog.Info("Pending payments expired", "count", count, "ttl", s.cfg.PendingPaymentTTL)
+}
+
+// Продление подписок с автопродлением: стоимость тарифа списывается с баланса,
+// срок продлевается от текущей даты окончания
+func (s *Scheduler) renewSubscriptions() {
+	slog.Debug("Checking for subscriptions to auto-renew")
+
+	today := time.Now().Format("2006-01-02")
+	// Сравнение строго "меньше следующего дня" работает и для дат со временем
+	horizon := time.Now().AddDate(0, 0, s.cfg.AutoRenewDays+1).Format("2006-01-02")
+
+	var subs []db.Subscription
+	result := s.repo.DB().Where("active = true AND auto_renew = true AND seat_of IS NULL AND end_date >= ? AND end_date < ?", today, horizon).
+		Preload("Plan").
+		Find(&subs)
+
+	if result.Error != nil {
+		slog.Error("Failed to fetch subscriptions for auto-renew", "error", result.Error)
+		s.sendCriticalAlert("❌ Ошибка получения подписок для автопродления: " + result.Error.Error())
+		return
+	}
+
+	if len(subs) == 0 {
+		return
+	}
+
+	renewed, failed := 0, 0
+	for _, sub := range subs {
+		onSale, err := s.planLineOnSale(&sub.Plan)
+		if err != nil {
+			slog.Error("Failed to fetch latest plan version", "subscription_id", sub.ID, "plan_id", sub.PlanID, "error", err)
+			continue
+		}
+		if sub.Plan.IsTrial || !onSale || sub.Plan.PriceInt <= 0 {
+			// Тариф больше не продается - выключаем автопродление, чтобы не повторять попытки
+			s.repo.DB().Model(&db.Subscription{}).Where("id = ?", sub.ID).Update("auto_renew", false)
+			s.notifyUser(sub.UserID, "🔁 Автопродление ключа "+sub.PeerID+" выключено: тариф \""+sub.Plan.Name+"\" больше недоступен.\n\n"+
+				"Выберите новый тариф в /buy до "+sub.EndDate.Format("02.01.2006"), nil)
+			continue
+		}
+
+		already, err := s.renewedThisCycle(&sub)
+		if err != nil {
+			slog.Error("Failed to check previous renewal", "subscription_id", sub.ID, "error", err)
+			continue
+		}
+		if already {
+			// Тариф короче окна автопродления - второй раз за период не продлеваем
+			continue
+		}
+
+		newEnd, paymentID, err := s.renewSubscription(&sub)
+		if errors.Is(err, db.ErrInsufficientBalance) {
+			failed++
+			s.notifyRenewalFailed(&sub)
+			continue
+		}
+		if err != nil {
+			failed++
+			slog.Error("Auto-renew failed", "subscription_id", sub.ID, "user_id", sub.UserID, "error", err)
+			continue
+		}
+
+		renewed++
+		if s.onRenewal != nil {
+			s.onRenewal(paymentID)
+		}
+		s.notifyUser(sub.UserID, "🔁 Подписка \""+sub.Plan.Name+"\" ("+sub.Platform+") продлена до "+newEnd.Format("02.01.2006")+".\n"+
+			"С баланса списано "+strconv.Itoa(sub.Plan.PriceInt)+" руб. Баланс: /balance", nil)
+	}
+
+	slog.Info("Auto-renew completed", "renewed", renewed, "failed", failed, "total", len(subs))
+	if renewed > 0 || failed > 0 {
+		s.sendAdminReport("🔁 Автопродление: продлено " + strconv.Itoa(renewed) + ", не хватило средств или ошибка: " + strconv.Itoa(failed))
+	}
+}
+
+// planLineOnSale - продается ли тариф подписки. Прежняя версия тарифа
+// продлевается по условиям покупки, пока не архивирована последняя версия
+func (s *Scheduler) planLineOnSale(plan *db.Plan) (bool, error) {
+	latest, err := db.LatestPlanVersion(s.repo.DB(), plan)
+	if err != nil {
+		return false, err
+	}
+	return !latest.Archived, nil
+}
+
+// renewedThisCycle проверяет, продлевалась ли подписка за последний период
+// тарифа. Без проверки тариф короче окна автопродления продлевался бы каждый день
+func (s *Scheduler) renewedThisCycle(sub *db.Subscription) (bool, error) {
+	var count int64
+	err := s.repo.DB().Model(&db.Payment{}).
+		Where("renew_sub_id = ? AND status IN ? AND created_at > ?", sub.ID, []string{"approved", "refunding"},
+			time.Now().AddDate(0, 0, -sub.Plan.DurationDays)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// renewSubscription списывает стоимость тарифа и продлевает подписку в одной
+// транзакции. Списание оформляется одобренным платежом с баланса, чтобы
+// продление попадало в выручку, возвраты и реферальную программу
+func (s *Scheduler) renewSubscription(sub *db.Subscription) (time.Time, uint, error) {
+	newEnd := sub.EndDate.AddDate(0, 0, sub.Plan.DurationDays)
+
+	var paymentID uint
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		paid, err := db.KeyPaidAmount(tx, sub)
+		if err != nil {
+			return err
+		}
+
+		// Условие на end_date защищает от двойного списания при параллельном запуске
+		res := tx.Model(&db.Subscription{}).
+			Where("id = ? AND auto_renew = true AND end_date = ?", sub.ID, sub.EndDate).
+			Updates(map[string]interface{}{
+				"end_date":    newEnd,
+				"paid_amount": paid + sub.Plan.PriceInt,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("subscription changed during renewal")
+		}
+		if err := db.SyncSeatEndDates(tx, sub.ID, newEnd); err != nil {
+			return err
+		}
+
+		payment := &db.Payment{
+			UserID:     sub.UserID,
+			Amount:     sub.Plan.PriceInt,
+			Currency:   "RUB",
+			PlanID:     sub.PlanID,
+			Qty:        1,
+			Status:     "approved",
+			Provider:   "balance",
+			RenewSubID: &sub.ID,
+			ListAmount: sub.Plan.PriceInt,
+		}
+		if err := tx.Create(payment).Error; err != nil {
+			return err
+		}
+		paymentID = payment.ID
+
+		return db.AppendLedger(tx, &db.LedgerEntry{
+			UserID:    sub.UserID,
+			Amount:    -sub.Plan.PriceInt,
+			Kind:      "purchase",
+			PaymentID: &payment.ID,
+			Comment:   "автопродление " + sub.Plan.Name + " (" + sub.PeerID + ")",
+		})
+	})
+	return newEnd, paymentID, err
+}
+
+func (s *Scheduler) notifyRenewalFailed(sub *db.Subscription) {
+	balance, err := db.UserBalance(s.repo.DB(), sub.UserID)
+	if err != nil {
+		slog.Error("Failed to fetch balance for renewal notice", "user_id", sub.UserID, "error", err)
+	}
+
+	text := "⚠️ Не удалось продлить подписку \"" + sub.Plan.Name + "\" (" + sub.Platform + "): недостаточно средств.\n\n" +
+		"Нужно: " + strconv.Itoa(sub.Plan.PriceInt) + " руб., на балансе: " + strconv.Itoa(balance) + " руб.\n" +
+		"Подписка действует до " + sub.EndDate.Format("02.01.2006") + ", попробуем продлить снова завтра."
+
+	var keyboard *tgbotapi.InlineKeyboardMarkup
+	if s.cfg.TopUpURL != "" {
+		markup := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL("💳 Пополнить баланс", s.cfg.TopUpURL)),
+		)
+		keyboard = &markup
+	} else {
+		text += "\n\nДля пополнения баланса напишите в поддержку: /support"
+	}
+
+	s.notifyUser(sub.UserID, text, keyboard)
+}
+
+// Ежемесячная выписка каждому активному партнеру. Партнерам без покупок и
+// активаций за месяц выписка не отправляется
+func (s *Scheduler) sendPartnerStatements() {
+	var partners []db.Admin
+	if err := s.repo.DB().Where("role = ? AND disabled = false", "partner").Find(&partners).Error; err != nil {
+		slog.Error("Failed to fetch partners for statements", "error", err)
+		return
+	}
+
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	sent := 0
+	for _, partner := range partners {
+		statement, err := db.BuildPartnerStatement(s.repo.DB(), partner.TgID, month)
+		if err != nil {
+			slog.Error("Failed to build partner statement", "partner_id", partner.TgID, "error", err)
+			continue
+		}
+		if statement.Empty() {
+			continue
+		}
+		s.notifyUser(partner.TgID, statement.Text(), nil)
+		sent++
+	}
+
+	slog.Info("Partner statements sent", "count", sent, "month", month.Format("2006-01"))
+}
+
+func (s *Scheduler) notifyUser(userID int64, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+	msg := tgbotapi.NewMessage(userID, text)
+	if keyboard != nil {
+		msg.ReplyMarkup = keyboard
+	}
+	if _, err := s.bot.Send(msg); err != nil {
+		slog.Error("Failed to notify user", "user_id", userID, "error", err)
+	}
+}
+
+// Напоминания о брошенных оформлениях /buy с кнопкой продолжить с того же шага
+func (s *Scheduler) sendCheckoutReminders() {
+	now := time.Now()
+	due, err := db.DueCheckoutReminders(s.repo.DB(), s.cfg.CheckoutReminderDelays, s.cfg.CheckoutReminderMax, now)
+	if err != nil {
+		slog.Error("Failed to fetch abandoned checkouts", "error", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	sent := 0
+	for _, checkout := range due {
+		text := "🛒 Вы не закончили оформление подписки"
+		var plan db.Plan
+		if checkout.PlanID != 0 && s.repo.DB().First(&plan, checkout.PlanID).Error == nil {
+			text += " \"" + plan.Name + "\""
+		}
+		text += ". Выбор сохранен - продолжите с того же места."
+		button := "▶️ Продолжить оформление"
+		if checkout.PaymentID != nil {
+			text = "⏳ Заказ #" + strconv.FormatUint(uint64(*checkout.PaymentID), 10) + " ждет оплаты. " +
+				"Реквизиты и точная сумма - по кнопке ниже. Передумали - заказ можно отменить там же."
+			button = "💳 Продолжить оплату"
+		}
+
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(button, db.CheckoutResumePrefix+strconv.FormatUint(uint64(checkout.ID), 10)),
+		))
+		msg := tgbotapi.NewMessage(checkout.UserID, text)
+		msg.ReplyMarkup = keyboard
+		if _, err := s.bot.Send(msg); err != nil {
+			slog.Error("Failed to send checkout reminder", "user_id", checkout.UserID, "checkout_id", checkout.ID, "error", err)
+			continue
+		}
+
+		reminder := &db.CheckoutReminder{UserID: checkout.UserID, CheckoutID: checkout.ID, Step: checkout.Step}
+		if err := s.repo.DB().Create(reminder).Error; err != nil {
+			slog.Error("Failed to save checkout reminder", "checkout_id", checkout.ID, "error", err)
+			continue
+		}
+		sent++
+	}
+
+	slog.Info("Checkout reminders sent", "sent", sent, "due", len(due))
+}
+
+// Еженедельный отчет о брошенных оформлениях по шагам
+func (s *Scheduler) sendCheckoutReport() {
+	if s.checkoutReport == nil {
+		return
+	}
+	report, err := s.checkoutReport(time.Now())
+	if err != nil {
+		slog.Error("Failed to build checkout funnel", "error", err)
+		return
+	}
+	if report == "" {
+		return
+	}
+	s.sendAdminReport(report)
+}
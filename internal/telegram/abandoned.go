@@ -0,0 +1,221 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// startCheckout начинает оформление /buy и сохраняет его, чтобы планировщик
+// мог напомнить о брошенной покупке
+func (s *Service) startCheckout(userID int64) *BuyState {
+	state := &BuyState{
+		UserID: userID,
+		Step:   BuyStepPlan,
+	}
+
+	checkout := &db.Checkout{UserID: userID, Step: BuyStepPlan.String()}
+	if err := s.repo.DB().Create(checkout).Error; err != nil {
+		slog.Error("Failed to save checkout", "user_id", userID, "error", err)
+	} else {
+		state.CheckoutID = checkout.ID
+	}
+
+	buyStates[userID] = state
+	return state
+}
+
+// saveCheckout переносит выбор покупателя в запись оформления. Оформление,
+// которого больше нет в buyStates, закончилось пробным периодом, счетом или
+// оплатой с баланса
+func (s *Service) saveCheckout(state *BuyState) {
+	if state.CheckoutID == 0 {
+		return
+	}
+
+	var paymentID *uint
+	if state.PaymentID != 0 {
+		id := state.PaymentID
+		paymentID = &id
+	}
+	err := s.repo.DB().Model(&db.Checkout{ID: state.CheckoutID}).Updates(map[string]interface{}{
+		"step":       state.Step.String(),
+		"plan_id":    state.PlanID,
+		"platform":   state.Platform.String(),
+		"qty":        state.Qty,
+		"method_id":  state.MethodID,
+		"pay":        state.Pay,
+		"payment_id": paymentID,
+		"completed":  buyStates[state.UserID] != state,
+	}).Error
+	if err != nil {
+		slog.Error("Failed to save checkout", "checkout_id", state.CheckoutID, "user_id", state.UserID, "error", err)
+	}
+}
+
+// handleBuyResume продолжает оформление по кнопке из напоминания с того же
+// шага. Состояние восстанавливается из базы, если бот перезапускался
+func (s *Service) handleBuyResume(callback *tgbotapi.CallbackQuery) {
+	checkoutID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackBuyResume.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+
+	var checkout db.Checkout
+	if err := s.repo.DB().Where("id = ? AND user_id = ?", checkoutID, callback.From.ID).First(&checkout).Error; err != nil {
+		s.answerCallback(callback.ID, "Оформление не найдено, начните заново - /buy")
+		return
+	}
+
+	err = s.repo.DB().Model(&db.CheckoutReminder{}).
+		Where("checkout_id = ? AND resumed_at IS NULL", checkout.ID).
+		Update("resumed_at", time.Now()).Error
+	if err != nil {
+		slog.Error("Failed to mark checkout reminder resumed", "checkout_id", checkout.ID, "error", err)
+	}
+
+	if checkout.Completed {
+		s.answerCallback(callback.ID, "Этот заказ уже оформлен")
+		return
+	}
+
+	state, ok := buyStates[callback.From.ID]
+	if !ok || state.CheckoutID != checkout.ID {
+		state = &BuyState{
+			UserID:     checkout.UserID,
+			PlanID:     checkout.PlanID,
+			Platform:   Platform(checkout.Platform),
+			Qty:        checkout.Qty,
+			MethodID:   checkout.MethodID,
+			Pay:        checkout.Pay,
+			Step:       BuyStep(checkout.Step),
+			CheckoutID: checkout.ID,
+		}
+		if checkout.PaymentID != nil {
+			state.PaymentID = *checkout.PaymentID
+		}
+		if !state.Step.IsValid() {
+			state.Step = BuyStepPlan
+		}
+		buyStates[callback.From.ID] = state
+	}
+
+	slog.Info("Checkout resumed", "checkout_id", checkout.ID, "user_id", state.UserID, "step", state.Step)
+
+	if state.PaymentID != 0 {
+		var payment db.Payment
+		err := s.repo.DB().Preload("Method").Preload("Plan").
+			Where("id = ? AND user_id = ?", state.PaymentID, state.UserID).First(&payment).Error
+		if err == nil && payment.Status == PaymentStatusPending.String() && payment.ReceiptFileID == "" {
+			state.Step = BuyStepReceipt
+			s.answerCallback(callback.ID, "")
+			s.sendPaymentInstructions(callback.Message.Chat.ID, &payment, &payment.Method, &payment.Plan)
+			s.saveCheckout(state)
+			return
+		}
+		// Заказ уже отменен или просрочен - оформим его заново с тем же выбором
+		state.PaymentID = 0
+		state.Step = BuyStepConfirm
+	}
+
+	s.answerCallback(callback.ID, s.showBuyStep(callback, state, state.Step))
+	s.saveCheckout(state)
+}
+
+// handleCheckouts показывает, на каких шагах покупатели бросают оформление
+func (s *Service) handleCheckouts(msg *tgbotapi.Message) {
+	days := 7
+	if arg := strings.TrimSpace(msg.CommandArguments()); arg != "" {
+		value, err := strconv.Atoi(arg)
+		if err != nil || value < 1 || value > 365 {
+			s.reply(msg.Chat.ID, "Использование: /checkouts [дней]\nПример: /checkouts 30 - оформления за последние 30 дней")
+			return
+		}
+		days = value
+	}
+
+	now := time.Now()
+	funnel, err := db.BuildCheckoutFunnel(s.repo.DB(), now.AddDate(0, 0, -days), db.CheckoutIdle(s.cfg.CheckoutReminderDelays), now)
+	if err != nil {
+		s.logAndReportError("Checkout funnel failed", ErrDatabasef("Failed to build checkout funnel: %v", err), map[string]interface{}{
+			"admin_id": msg.From.ID,
+			"days":     days,
+		})
+		s.reply(msg.Chat.ID, "Ошибка построения отчета")
+		return
+	}
+
+	s.reply(msg.Chat.ID, checkoutFunnelText(funnel))
+}
+
+// CheckoutReport - еженедельный отчет планировщика о брошенных оформлениях.
+// Пустая строка - за неделю оформлений не было
+func (s *Service) CheckoutReport(now time.Time) (string, error) {
+	funnel, err := db.BuildCheckoutFunnel(s.repo.DB(), now.AddDate(0, 0, -7), db.CheckoutIdle(s.cfg.CheckoutReminderDelays), now)
+	if err != nil {
+		return "", ErrDatabasef("Failed to build checkout funnel: %v", err)
+	}
+	if funnel.Started == 0 {
+		return "", nil
+	}
+	return checkoutFunnelText(funnel), nil
+}
+
+// checkoutFunnelSteps - шаги /buy в порядке отчета. Онлайн-оплата, звезды и
+// баланс завершают оформление на шаге payment, ручной перевод - на receipt
+var checkoutFunnelSteps = []BuyStep{BuyStepPlan, BuyStepPlatform, BuyStepQty, BuyStepMethod, BuyStepConfirm, BuyStepPayment, BuyStepReceipt}
+
+// checkoutFunnelReached считает, сколько оформлений дошли до каждого шага:
+// последний шаг засчитывается вместе со всеми предыдущими по BuyStep.Prev
+func checkoutFunnelReached(funnel *db.CheckoutFunnel) map[BuyStep]int {
+	reached := make(map[BuyStep]int)
+	for name, count := range funnel.Stopped {
+		step := BuyStep(name)
+		for {
+			reached[step] += count
+			prev := step.Prev()
+			if prev == step {
+				break
+			}
+			step = prev
+		}
+	}
+	return reached
+}
+
+// checkoutFunnelText форматирует воронку для /checkouts и еженедельного отчета
+func checkoutFunnelText(funnel *db.CheckoutFunnel) string {
+	text := fmt.Sprintf("🛒 Оформления покупок с %s\n\nНачато: %d, завершено: %d (%d%%), в процессе: %d",
+		funnel.From.Format("02.01.2006"), funnel.Started, funnel.Completed, percent(funnel.Completed, funnel.Started), funnel.InProgress)
+	if funnel.Started == 0 {
+		return text
+	}
+
+	reached := checkoutFunnelReached(funnel)
+	text += "\n\nГде бросают (дошли → бросили):"
+	for _, step := range checkoutFunnelSteps {
+		if reached[step] == 0 {
+			continue
+		}
+		abandoned := funnel.Abandoned[step.String()]
+		text += fmt.Sprintf("\n%s: %d → %d (%d%%)", step.DisplayName(), reached[step], abandoned, percent(abandoned, reached[step]))
+	}
+
+	text += fmt.Sprintf("\n\n🔔 Напоминаний: %d, вернулись по кнопке: %d, завершили после напоминания: %d",
+		funnel.Reminders, funnel.Resumed, funnel.Recovered)
+	return text
+}
+
+func percent(part, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return part * 100 / total
+}
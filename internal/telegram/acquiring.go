@@ -0,0 +1,296 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/config"
+	"lime-bot/internal/db"
+	"lime-bot/internal/payments"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// acquiringPayments принимает оплату картой через онлайн-провайдера с переходом по ссылке
+type acquiringPayments struct {
+	s        *Service
+	provider payments.Provider
+}
+
+var _ Payments = (*acquiringPayments)(nil)
+
+func orderID(paymentID uint) string {
+	return "order_" + strconv.FormatUint(uint64(paymentID), 10)
+}
+
+// newProviderRegistry подключает онлайн-провайдеров, для которых заданы настройки
+func newProviderRegistry(cfg *config.Config) *payments.Registry {
+	registry := payments.NewRegistry()
+	if cfg.AcquiringURL != "" {
+		registry.Register(payments.NewRedirectProvider(payments.RedirectConfig{
+			BaseURL:       cfg.AcquiringURL,
+			ShopID:        cfg.AcquiringShopID,
+			SecretKey:     cfg.AcquiringSecretKey,
+			WebhookSecret: cfg.AcquiringWebhookSecret,
+		}))
+	}
+	return registry
+}
+
+func (p *acquiringPayments) CreateInvoice(userID int64, planID uint, qty int) (string, error) {
+	var plan db.Plan
+	if err := p.s.repo.DB().First(&plan, planID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrPlanNotFoundf("Plan #%v not found", planID)
+		}
+		return "", ErrDatabasef("Failed to fetch plan #%v: %v", planID, err)
+	}
+
+	payment := &db.Payment{
+		UserID:   userID,
+		Amount:   p.s.orderPrice(userID, &plan, qty),
+		Currency: CurrencyRUB,
+		PlanID:   plan.ID,
+		Qty:      qty,
+		Status:   PaymentStatusPending.String(),
+		Provider: p.provider.Name(),
+	}
+	p.s.recordListPrice(payment, &plan)
+	if err := p.s.repo.DB().Create(payment).Error; err != nil {
+		return "", ErrDatabasef("Failed to create online payment: %v", err)
+	}
+
+	returnURL := p.s.cfg.AcquiringReturnURL
+	if returnURL == "" && p.s.bot != nil {
+		returnURL = "https://t.me/" + p.s.bot.Self.UserName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	res, err := p.provider.CreatePayment(ctx, payments.CreateRequest{
+		OrderID:     orderID(payment.ID),
+		Amount:      payment.Amount,
+		Currency:    CurrencyRUB,
+		Description: fmt.Sprintf("Lime VPN: %s x%d, заказ #%d", plan.Name, qty, payment.ID),
+		ReturnURL:   returnURL,
+	})
+	if err != nil {
+		p.s.repo.DB().Model(payment).Update("status", PaymentStatusRejected.String())
+		return "", ErrPaymentf("Failed to create payment at %v: %v", p.provider.Name(), err)
+	}
+
+	if err := p.s.repo.DB().Model(payment).Update("invoice_id", res.ProviderPaymentID).Error; err != nil {
+		return "", ErrDatabasef("Failed to save provider payment id: %v", err)
+	}
+
+	slog.Info("Online payment created", "payment_id", payment.ID, "provider", p.provider.Name(), "provider_payment_id", res.ProviderPaymentID)
+	return res.ConfirmationURL, nil
+}
+
+// VerifyPayment опрашивает провайдера напрямую - на случай, если webhook не дошел
+func (p *acquiringPayments) VerifyPayment(invoiceID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	n, err := p.provider.GetPayment(ctx, invoiceID)
+	if err != nil {
+		return false, ErrPaymentf("Failed to fetch payment %v: %v", invoiceID, err)
+	}
+
+	if err := p.s.HandlePaymentNotification(p.provider.Name(), n); err != nil {
+		return false, err
+	}
+	return n.Status == payments.StatusSucceeded, nil
+}
+
+func (p *acquiringPayments) Refund(invoiceID string, amount int) error {
+	var payment db.Payment
+	if err := p.s.repo.DB().Where("invoice_id = ? AND provider = ?", invoiceID, p.provider.Name()).First(&payment).Error; err != nil {
+		return ErrPaymentf("Online payment %v not found: %v", invoiceID, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := p.provider.Refund(ctx, invoiceID, amount); err != nil {
+		return ErrPaymentf("Refund at %v failed: %v", p.provider.Name(), err)
+	}
+
+	slog.Info("Online payment refunded", "payment_id", payment.ID, "provider", p.provider.Name(), "amount", amount)
+	return nil
+}
+
+// PaymentProviders возвращает реестр онлайн-провайдеров для регистрации webhook
+func (s *Service) PaymentProviders() *payments.Registry {
+	return s.providers
+}
+
+// onlinePayments возвращает Payments для провайдера из реестра
+func (s *Service) onlinePayments(name string) (Payments, error) {
+	if s.providers == nil {
+		return nil, payments.ErrUnknownProvider
+	}
+	provider, err := s.providers.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &acquiringPayments{s: s, provider: provider}, nil
+}
+
+// HandlePaymentNotification применяет уведомление провайдера к платежу.
+// Повторные уведомления по уже обработанному платежу игнорируются
+func (s *Service) HandlePaymentNotification(provider string, n *payments.Notification) error {
+	var payment db.Payment
+	err := s.repo.DB().Where("provider = ? AND invoice_id = ?", provider, n.ProviderPaymentID).First(&payment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Чужой или удаленный платеж - подтверждаем получение, чтобы провайдер не повторял
+			slog.Warn("Notification for unknown payment", "provider", provider, "provider_payment_id", n.ProviderPaymentID)
+			return nil
+		}
+		return ErrDatabasef("Failed to fetch payment %v: %v", n.ProviderPaymentID, err)
+	}
+
+	if payment.Status == PaymentStatusApproved.String() || payment.Status == PaymentStatusRefunded.String() || payment.RefundedAt != nil {
+		return nil
+	}
+
+	switch n.Status {
+	case payments.StatusSucceeded:
+		if n.Amount != payment.Amount {
+			return s.refundMismatchedPayment(provider, &payment, n.Amount)
+		}
+
+		// Заказ успел просрочиться или отмениться, а деньги уже списаны - выдаем ключи
+		if payment.Status != PaymentStatusPending.String() {
+			s.logAndReportError("Online payment succeeded after close", ErrPaymentf("Payment #%v paid with status %v, approving", payment.ID, payment.Status), map[string]interface{}{
+				"payment_id": payment.ID,
+				"provider":   provider,
+			})
+			if err := reopenPayment(s.repo.DB(), &payment); err != nil {
+				return err
+			}
+		}
+
+		if err := s.approvePayment(payment.ID, 0); err != nil {
+			return err
+		}
+		s.reply(payment.UserID, fmt.Sprintf("✅ Оплата заказа #%d получена! Ваши ключи выше.", payment.ID))
+
+	case payments.StatusCanceled:
+		if payment.Status != PaymentStatusPending.String() {
+			return nil
+		}
+		if err := s.repo.DB().Model(&payment).Update("status", PaymentStatusRejected.String()).Error; err != nil {
+			return ErrDatabasef("Failed to cancel payment #%v: %v", payment.ID, err)
+		}
+		s.reply(payment.UserID, fmt.Sprintf("❌ Оплата заказа #%d не прошла. Попробуйте снова через /buy", payment.ID))
+	}
+
+	return nil
+}
+
+// reopenPayment возвращает в ожидание закрытый заказ, который все-таки
+// оплатили, чтобы одобрить его обычным путем
+func reopenPayment(tx *gorm.DB, payment *db.Payment) error {
+	res := tx.Model(&db.Payment{}).Where("id = ? AND status = ?", payment.ID, payment.Status).
+		Update("status", PaymentStatusPending.String())
+	if res.Error != nil {
+		return ErrDatabasef("Failed to reopen payment #%v: %v", payment.ID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrPaymentf("Payment #%v changed while reopening", payment.ID)
+	}
+	payment.Status = PaymentStatusPending.String()
+	return nil
+}
+
+// refundMismatchedPayment возвращает через провайдера оплату, сумма которой не
+// совпала с заказом. Заказ сначала отклоняется с отметкой о возврате, чтобы
+// повторное уведомление не вернуло деньги второй раз
+func (s *Service) refundMismatchedPayment(provider string, payment *db.Payment, paid int) error {
+	s.logAndReportError("Online payment amount mismatch", ErrPaymentf("Payment #%v: expected %v, got %v, refunding", payment.ID, payment.Amount, paid), map[string]interface{}{
+		"payment_id": payment.ID,
+		"provider":   provider,
+	})
+
+	reason := "Сумма оплаты не совпала с заказом"
+	res := s.repo.DB().Model(&db.Payment{}).Where("id = ? AND status = ? AND refunded_at IS NULL", payment.ID, payment.Status).
+		Updates(map[string]interface{}{
+			"status":          PaymentStatusRejected.String(),
+			"reject_reason":   reason,
+			"refunded_amount": paid,
+			"refunded_at":     time.Now(),
+		})
+	if res.Error != nil {
+		return ErrDatabasef("Failed to reject payment #%v: %v", payment.ID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+
+	online, err := s.onlinePayments(provider)
+	if err == nil {
+		err = online.Refund(payment.InvoiceID, paid)
+	}
+	if err != nil {
+		// Снимаем отметку, чтобы повторное уведомление провайдера снова попробовало вернуть деньги
+		if undoErr := s.repo.DB().Model(&db.Payment{}).Where("id = ?", payment.ID).Updates(map[string]interface{}{
+			"status":          payment.Status,
+			"reject_reason":   payment.RejectReason,
+			"refunded_amount": 0,
+			"refunded_at":     nil,
+		}).Error; undoErr != nil {
+			slog.Error("Failed to undo payment refund mark", "payment_id", payment.ID, "error", undoErr)
+		}
+		s.logAndReportError("Mismatched online payment refund failed", err, map[string]interface{}{
+			"payment_id": payment.ID,
+			"provider":   provider,
+			"amount":     paid,
+		})
+		return err
+	}
+
+	s.reply(payment.UserID, fmt.Sprintf("↩️ Оплата заказа #%d на %s не совпала с суммой заказа %s, деньги возвращены. Оформите заказ заново через /buy",
+		payment.ID, formatAmount(paid, payment.Currency), formatAmount(payment.Amount, payment.Currency)))
+	return nil
+}
+
+func (s *Service) handleOnlineSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	name := strings.TrimPrefix(callback.Data, CallbackBuyOnline.String())
+
+	online, err := s.onlinePayments(name)
+	if err != nil {
+		s.answerCallback(callback.ID, "Способ оплаты недоступен")
+		return
+	}
+
+	state.Step = BuyStepPayment
+
+	url, err := online.CreateInvoice(state.UserID, state.PlanID, state.Qty)
+	if err != nil {
+		s.logAndReportError("Online invoice creation failed", err, map[string]interface{}{
+			"user_id":  state.UserID,
+			"plan_id":  state.PlanID,
+			"provider": name,
+		})
+		s.answerCallback(callback.ID, "Ошибка создания платежа")
+		return
+	}
+
+	delete(buyStates, state.UserID)
+
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonURL("💳 Перейти к оплате", url)},
+	}
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID,
+		"💳 Оплатите заказ по ссылке ниже. Ключи придут автоматически сразу после оплаты.", keyboard)
+	s.answerCallback(callback.ID, "")
+}
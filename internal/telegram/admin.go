@@ -59,7 +59,7 @@ func (s *Service) handlePayQueue(msg *tgbotapi.Message) {
 	}
 
 	var payments []db.Payment
-	result := s.repo.DB().Where("status = 'pending'").
+	result := s.repo.DB().Where("status = 'pending' AND provider = ''").
 		Preload("User").
 		Preload("Plan").
 		Preload("Method").
@@ -89,10 +89,14 @@ func (s *Service) handlePayQueue(msg *tgbotapi.Message) {
 	for i, payment := range payments {
 		text += "🆔 #" + strconv.Itoa(int(payment.ID)) + "\n" +
 			"👤 @" + payment.User.Username + "\n" +
-			"💰 " + strconv.Itoa(payment.Amount) + " руб.\n" +
+			"💰 " + formatAmount(payment.Amount, payment.Currency) + "\n" +
 			"📦 " + payment.Plan.Name + " x" + strconv.Itoa(payment.Qty) + "\n" +
 			"💳 " + payment.Method.Bank + " (" + payment.Method.PhoneNumber + ")\n" +
-			"📅 " + payment.CreatedAt.Format("02.01.2006 15:04") + "\n\n"
+			"📅 " + payment.CreatedAt.Format("02.01.2006 15:04") + "\n"
+		if payment.DuplicateOf != nil {
+			text += "⚠️ Возможно повторный чек, см. заказ #" + strconv.Itoa(int(*payment.DuplicateOf)) + "\n"
+		}
+		text += "\n"
 
 		// Создаем кнопки для одобрения/отклонения
 		buttonRow := []tgbotapi.InlineKeyboardButton{
@@ -197,6 +201,11 @@ func (s *Service) sendUserInfo(chatID int64, userID int64) {
 		Limit(5).
 		Find(&payments)
 
+	balance, err := userBalance(s.repo.DB(), userID)
+	if err != nil {
+		slog.Error("Failed to fetch user balance", "user_id", userID, "error", err)
+	}
+
 	text := fmt.Sprintf(`👤 Информация о пользователе:
 
 🆔 ID: %d
@@ -204,6 +213,7 @@ func (s *Service) sendUserInfo(chatID int64, userID int64) {
 📞 Телефон: %s
 🔗 Реф. код: %s
 📅 Регистрация: %s
+💰 Баланс: %d руб.
 
 🔑 Подписки (%d):`,
 		user.TgID,
@@ -211,6 +221,7 @@ func (s *Service) sendUserInfo(chatID int64, userID int64) {
 		user.Phone,
 		user.RefCode,
 		user.CreatedAt.Format("02.01.2006"),
+		balance,
 		len(subscriptions),
 	)
 
@@ -229,20 +240,29 @@ func (s *Service) sendUserInfo(chatID int64, userID int64) {
 
 	text += fmt.Sprintf("\n\n💳 Последние платежи (%d):", len(payments))
 
+	var keyboard [][]tgbotapi.InlineKeyboardButton
 	for _, payment := range payments {
-		statusEmoji := "⏳"
-		switch payment.Status {
-		case "approved":
-			statusEmoji = "✅"
-		case "rejected":
-			statusEmoji = "❌"
+		text += fmt.Sprintf("\n%s #%d %s (%s) - %s",
+			PaymentStatus(payment.Status).Emoji(), payment.ID, formatAmount(payment.Amount, payment.Currency), payment.Plan.Name, payment.CreatedAt.Format("02.01"))
+
+		switch PaymentStatus(payment.Status) {
+		case PaymentStatusApproved:
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("↩️ Возврат #%d", payment.ID), CallbackPaymentRefund.WithID(payment.ID)),
+			})
+		case PaymentStatusRefunded:
+			text += fmt.Sprintf("\n   возвращено %s: %s", formatAmount(payment.RefundedAmount, payment.Currency), payment.RefundReason)
 		}
+	}
 
-		text += fmt.Sprintf("\n%s %d руб. (%s) - %s",
-			statusEmoji, payment.Amount, payment.Plan.Name, payment.CreatedAt.Format("02.01"))
+	if len(keyboard) == 0 {
+		s.reply(chatID, text)
+		return
 	}
 
-	s.reply(chatID, text)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(msg)
 }
 
 func (s *Service) handleAdminCallback(callback *tgbotapi.CallbackQuery) {
@@ -262,6 +282,9 @@ func (s *Service) handleAdminCallback(callback *tgbotapi.CallbackQuery) {
 	case "admin_users":
 		s.handleCallbackAdminUsers(callback)
 		return
+	case "user_stats":
+		s.handleCallbackUserStats(callback)
+		return
 	}
 
 	if data == CallbackAdminList.String() || data == CallbackAdminAdd.String() || data == CallbackAdminDisable.String() || data == CallbackAdminCashier.String() {
@@ -412,12 +435,7 @@ func (s *Service) handlePaymentCallback(callback *tgbotapi.CallbackQuery) {
 		slog.Info("Payment approved successfully", "payment_id", paymentID, "admin_id", callback.From.ID)
 		s.answerCallback(callback.ID, "✅ Платеж одобрен")
 
-		editMsg := tgbotapi.NewEditMessageText(
-			callback.Message.Chat.ID,
-			callback.Message.MessageID,
-			"✅ Платеж #"+strconv.FormatUint(paymentID, 10)+" одобрен администратором",
-		)
-		s.bot.Send(editMsg)
+		s.editCallbackMessage(callback, "✅ Платеж #"+strconv.FormatUint(paymentID, 10)+" одобрен администратором", nil)
 		return
 	}
 
@@ -434,29 +452,8 @@ func (s *Service) handlePaymentCallback(callback *tgbotapi.CallbackQuery) {
 			return
 		}
 
-		slog.Info("Rejecting payment", "payment_id", paymentID, "admin_id", callback.From.ID)
-
-		err = s.rejectPayment(uint(paymentID), callback.From.ID)
-		if err != nil {
-			s.logAndReportError("Payment rejection failed", err, map[string]interface{}{
-				"payment_id": paymentID,
-				"admin_id":   callback.From.ID,
-			})
-
-			s.answerCallback(callback.ID, "Ошибка отклонения платежа")
-			s.reply(callback.Message.Chat.ID, "🚨 Ошибка при отклонении платежа #"+strconv.FormatUint(paymentID, 10)+":\n"+err.Error())
-			return
-		}
-
-		slog.Info("Payment rejected successfully", "payment_id", paymentID, "admin_id", callback.From.ID)
-		s.answerCallback(callback.ID, "❌ Платеж отклонен")
-
-		editMsg := tgbotapi.NewEditMessageText(
-			callback.Message.Chat.ID,
-			callback.Message.MessageID,
-			"❌ Платеж #"+strconv.FormatUint(paymentID, 10)+" отклонен администратором",
-		)
-		s.bot.Send(editMsg)
+		// Отклонение завершается после выбора причины
+		s.showRejectReasons(callback, uint(paymentID))
 		return
 	}
 }
@@ -493,24 +490,67 @@ func (s *Service) approvePayment(paymentID uint, adminID int64) error {
 		return ErrPaymentf("Payment #%v already processed with status: %v", paymentID, payment.Status)
 	}
 
-	// Обновляем статус платежа
+	// Обновляем статус платежа. adminID == 0 означает автоматическое одобрение провайдером
 	updates := map[string]interface{}{
-		"status":      PaymentStatusApproved.String(),
-		"approved_by": adminID,
+		"status": PaymentStatusApproved.String(),
+	}
+	if adminID != 0 {
+		updates["approved_by"] = adminID
 	}
 
-	result := tx.Model(&payment).Updates(updates)
+	// Занимаем платеж по статусу: кассир, вебхук, SMS банка и cron могут
+	// обработать один заказ одновременно, ключи выдаются только один раз
+	result := tx.Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusPending).Updates(updates)
 	if result.Error != nil {
 		tx.Rollback()
 		return ErrDatabasef("Failed to update payment #%v status: %v", paymentID, result.Error)
 	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrPaymentf("Payment #%v already processed", paymentID)
+	}
+	payment.Status = PaymentStatusApproved.String()
+	if adminID != 0 {
+		payment.ApprovedBy = &adminID
+	}
 
 	slog.Info("Payment status updated", "payment_id", paymentID, "rows_affected", result.RowsAffected)
 
+	// Надбавка нужна была только для поиска перевода по сумме - возвращаем ее на баланс
+	if payment.Surcharge > 0 {
+		err := appendLedger(tx, &db.LedgerEntry{
+			UserID:    payment.UserID,
+			Amount:    payment.Surcharge,
+			Kind:      LedgerRefund.String(),
+			PaymentID: &payment.ID,
+			Comment:   fmt.Sprintf("надбавка к заказу #%d", payment.ID),
+		})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	var subs []db.Subscription
 	tx.Where("payment_id = ?", paymentID).Find(&subs)
 
-	if len(subs) == 0 {
+	// Смена тарифа переносит ключ на новый тариф, новые ключи не выдаются.
+	// Партнер получает ссылки активации вместо ключей, пиры создаются у клиентов
+	var changed *db.Subscription
+	wholesale := payment.Wholesale && len(subs) == 0
+	if payment.ChangeSubID != nil {
+		var err error
+		changed, err = applyPlanChange(tx, &payment, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else if wholesale {
+		if err := issuePartnerKeys(tx, &payment); err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else if len(subs) == 0 {
 		for i := 0; i < payment.Qty; i++ {
 			subscription, err := s.createSubscriptionForPayment(tx, &payment)
 			if err != nil {
@@ -535,11 +575,20 @@ func (s *Service) approvePayment(paymentID uint, adminID int64) error {
 		return ErrDatabasef("Failed to commit transaction for payment #%v: %v", paymentID, commitErr)
 	}
 
+	s.syncCashierNotices(paymentID, "✅ Одобрен: "+s.adminLabel(adminID))
+	if changed != nil {
+		s.reply(payment.UserID, planChangedText(changed))
+	}
+	if wholesale {
+		s.reply(payment.UserID, fmt.Sprintf("🤝 Заказ #%d оплачен: выпущено ключей - %d.\n\nСсылки активации для клиентов: /partner", payment.ID, payment.Qty))
+	}
+	s.rewardReferral(&payment)
+
 	slog.Info("Payment approval completed successfully", "payment_id", paymentID, "admin_id", adminID)
 	return nil
 }
 
-func (s *Service) rejectPayment(paymentID uint, adminID int64) error {
+func (s *Service) rejectPayment(paymentID uint, adminID int64, reason *db.RejectReason) error {
 	slog.Info("Starting payment rejection", "payment_id", paymentID, "admin_id", adminID)
 
 	tx := s.repo.DB().Begin()
@@ -562,32 +611,38 @@ func (s *Service) rejectPayment(paymentID uint, adminID int64) error {
 		return ErrDatabasef("Failed to fetch payment #%v: %v", paymentID, err)
 	}
 
-	if payment.Status != "pending" {
+	if payment.Status != PaymentStatusPending.String() {
 		tx.Rollback()
 		return ErrPaymentf("Payment #%v already processed with status: %v", paymentID, payment.Status)
 	}
 
-	// Обновляем статус платежа
+	// Обновляем статус, только если платеж все еще ждет проверки: его мог
+	// параллельно одобрить другой кассир или провайдер
+	res := tx.Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusPending).
+		Updates(map[string]interface{}{
+			"status":           PaymentStatusRejected.String(),
+			"approved_by":      adminID,
+			"reject_reason":    reason.Title,
+			"resubmit_allowed": reason.AllowResubmit,
+		})
+	if res.Error != nil {
+		tx.Rollback()
+		return ErrDatabasef("Failed to save rejected payment #%v: %v", paymentID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrPaymentf("Payment #%v already processed", paymentID)
+	}
 	payment.Status = PaymentStatusRejected.String()
 	payment.ApprovedBy = &adminID
+	payment.RejectReason = reason.Title
+	payment.ResubmitAllowed = reason.AllowResubmit
 
-	if err := tx.Save(&payment).Error; err != nil {
+	// Ключи, выданные по чеку до проверки, отзываем вместе с пирами
+	subscriptions, err := s.revokePaymentSubscriptions(tx, paymentID)
+	if err != nil {
 		tx.Rollback()
-		return ErrDatabasef("Failed to save rejected payment #%v: %v", paymentID, err)
-	}
-
-	// Отключаем связанные подписки если есть
-	var subscriptions []db.Subscription
-	tx.Where("payment_id = ?", paymentID).Find(&subscriptions)
-
-	for _, sub := range subscriptions {
-		slog.Info("Disabling subscription", "payment_id", paymentID, "subscription_id", sub.ID, "peer_id", sub.PeerID)
-
-		if err := s.disablePeer(sub.Interface, sub.PublicKey); err != nil {
-			slog.Error("Failed to disable peer", "peer_id", sub.PeerID, "error", err)
-		}
-
-		tx.Model(&sub).Update("active", false)
+		return err
 	}
 
 	commitErr := tx.Commit().Error
@@ -595,13 +650,25 @@ func (s *Service) rejectPayment(paymentID uint, adminID int64) error {
 		return ErrDatabasef("Failed to commit rejection transaction for payment #%v: %v", paymentID, commitErr)
 	}
 
+	s.syncCashierNotices(paymentID, fmt.Sprintf("❌ Отклонен: %s\nПричина: %s", s.adminLabel(adminID), reason.Title))
+
 	// Уведомляем пользователя об отклонении
+	userMsg := renderRejectMessage(reason, &payment)
 	if len(subscriptions) > 0 {
-		userMsg := fmt.Sprintf("❌ Ваш платеж #%d отклонен кассиром.\n\n🔴 Все связанные подписки отключены.\n💬 Обратитесь в поддержку для уточнения причин.", paymentID)
-		s.reply(payment.UserID, userMsg)
+		userMsg += fmt.Sprintf("\n\n🔴 Выданные по заказу ключи (%d) отключены и удалены.", len(subscriptions))
+	}
+
+	notice := tgbotapi.NewMessage(payment.UserID, userMsg)
+	if reason.AllowResubmit && payment.Provider == "" {
+		notice.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("📎 Отправить исправленный чек", CallbackPaymentResubmit.WithID(payment.ID)),
+			),
+		)
 	}
+	s.bot.Send(notice)
 
-	slog.Info("Payment rejection completed", "payment_id", paymentID, "admin_id", adminID, "disabled_subscriptions", len(subscriptions))
+	slog.Info("Payment rejection completed", "payment_id", paymentID, "admin_id", adminID, "reason", reason.Title, "disabled_subscriptions", len(subscriptions))
 	return nil
 }
 
@@ -677,7 +744,7 @@ func (s *Service) showDisableAdminList(callback *tgbotapi.CallbackQuery) {
 
 func (s *Service) showChangeCashierList(callback *tgbotapi.CallbackQuery) {
 	var admins []db.Admin
-	result := s.repo.DB().Where("disabled = false").Find(&admins)
+	result := s.repo.DB().Where("disabled = false AND role <> ?", RolePartner.String()).Find(&admins)
 	if result.Error != nil {
 		s.answerCallback(callback.ID, "Ошибка получения списка")
 		return
@@ -752,7 +819,7 @@ func (s *Service) setCashierRole(adminID int64) error {
 
 	// Проверяем что пользователь является админом
 	var admin db.Admin
-	result = tx.Where("tg_id = ? AND disabled = false", adminID).First(&admin)
+	result = tx.Where("tg_id = ? AND disabled = false AND role <> ?", adminID, RolePartner.String()).First(&admin)
 	if result.Error != nil {
 		tx.Rollback()
 		return fmt.Errorf("администратор не найден или отключен")
@@ -794,6 +861,7 @@ func (s *Service) handleAddAdmin(msg *tgbotapi.Message) {
 • admin - администратор
 • cashier - кассир
 • support - поддержка
+• partner - партнер (оптовые покупки, без админских прав)
 
 Пример: /add_admin @john_doe admin`)
 		return
@@ -804,7 +872,7 @@ func (s *Service) handleAddAdmin(msg *tgbotapi.Message) {
 
 	// Проверяем валидность роли
 	if !role.IsValid() {
-		s.reply(msg.Chat.ID, "Неверная роль. Доступные: super, admin, cashier, support")
+		s.reply(msg.Chat.ID, "Неверная роль. Доступные: super, admin, cashier, support, partner")
 		return
 	}
 
@@ -843,6 +911,17 @@ func (s *Service) handleAddAdmin(msg *tgbotapi.Message) {
 func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment) (*db.Subscription, error) {
 	slog.Info("Creating subscription for payment", "payment_id", payment.ID, "user_id", payment.UserID, "plan_id", payment.PlanID)
 
+	return s.createSubscriptionForPlan(tx, payment.UserID, &payment.Plan, &payment.ID)
+}
+
+// createSubscriptionForPlan выдает ключ по тарифу. paymentID может быть nil
+// для подписок без оплаты (пробный период).
+func (s *Service) createSubscriptionForPlan(tx *gorm.DB, userID int64, plan *db.Plan, paymentID *uint) (*db.Subscription, error) {
+	var logPaymentID uint
+	if paymentID != nil {
+		logPaymentID = *paymentID
+	}
+
 	ctx := context.Background()
 
 	wgConfig := wgagent.Config{
@@ -870,17 +949,17 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 		// Если WG Agent недоступен, создаем placeholder подписку
 		slog.Error("WG Agent unavailable, creating placeholder subscription",
 			"error", err,
-			"payment_id", payment.ID,
+			"payment_id", logPaymentID,
 			"wg_addr", s.cfg.WGAgentAddr,
 		)
 
 		s.logAndReportError("WG Agent connection failed", ErrWGAgentf("WG Agent unavailable: %v", err), map[string]interface{}{
-			"payment_id": payment.ID,
-			"user_id":    payment.UserID,
+			"payment_id": logPaymentID,
+			"user_id":    userID,
 			"wg_addr":    s.cfg.WGAgentAddr,
 		})
 
-		peerID = "user_" + strconv.FormatInt(payment.UserID, 10) + "_" + strconv.FormatInt(time.Now().Unix(), 10)
+		peerID = "user_" + strconv.FormatInt(userID, 10) + "_" + strconv.FormatInt(time.Now().Unix(), 10)
 		peerResp = &wgagent.GeneratePeerConfigResponse{
 			PrivateKey: "PLACEHOLDER_PRIVATE_KEY",
 			PublicKey:  "PLACEHOLDER_PUBLIC_KEY",
@@ -888,7 +967,7 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 		}
 	} else {
 		defer wgClient.Close()
-		slog.Info("WG Agent connected successfully", "payment_id", payment.ID)
+		slog.Info("WG Agent connected successfully", "payment_id", logPaymentID)
 
 		// Генерируем конфигурацию пира
 		peerReq := &wgagent.GeneratePeerConfigRequest{
@@ -898,22 +977,22 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 			AllowedIPs:     "0.0.0.0/0",
 		}
 
-		slog.Info("Generating peer config", "payment_id", payment.ID, "server_endpoint", s.cfg.WGServerEndpoint)
+		slog.Info("Generating peer config", "payment_id", logPaymentID, "server_endpoint", s.cfg.WGServerEndpoint)
 
 		peerResp, err = wgClient.GeneratePeerConfig(ctx, peerReq)
 		if err != nil {
 			s.logAndReportError("WG peer config generation failed", err, map[string]interface{}{
-				"payment_id": payment.ID,
-				"user_id":    payment.UserID,
+				"payment_id": logPaymentID,
+				"user_id":    userID,
 				"interface":  "wg0",
 			})
 			return nil, ErrWGAgentf("Failed to generate peer config: %v", err)
 		}
 
-		slog.Info("Peer config generated", "payment_id", payment.ID, "public_key", peerResp.PublicKey[:10]+"...")
+		slog.Info("Peer config generated", "payment_id", logPaymentID, "public_key", peerResp.PublicKey[:10]+"...")
 
 		// Добавляем пира к интерфейсу
-		peerID = "user_" + strconv.FormatInt(payment.UserID, 10) + "_" + strconv.FormatInt(time.Now().Unix(), 10)
+		peerID = "user_" + strconv.FormatInt(userID, 10) + "_" + strconv.FormatInt(time.Now().Unix(), 10)
 		addReq := &wgagent.AddPeerRequest{
 			Interface:  "wg0",
 			PublicKey:  peerResp.PublicKey,
@@ -922,29 +1001,29 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 			PeerID:     peerID,
 		}
 
-		slog.Info("Adding peer to interface", "payment_id", payment.ID, "peer_id", peerID, "allowed_ip", peerResp.AllowedIP)
+		slog.Info("Adding peer to interface", "payment_id", logPaymentID, "peer_id", peerID, "allowed_ip", peerResp.AllowedIP)
 
 		_, err = wgClient.AddPeer(ctx, addReq)
 		if err != nil {
 			s.logAndReportError("WG peer addition failed", err, map[string]interface{}{
-				"payment_id": payment.ID,
-				"user_id":    payment.UserID,
+				"payment_id": logPaymentID,
+				"user_id":    userID,
 				"peer_id":    peerID,
 				"public_key": peerResp.PublicKey,
 			})
 			return nil, ErrWGAgentf("Failed to add peer to interface: %v", err)
 		}
 
-		slog.Info("Peer added successfully", "payment_id", payment.ID, "peer_id", peerID)
+		slog.Info("Peer added successfully", "payment_id", logPaymentID, "peer_id", peerID)
 	}
 
 	// Создаем подписку
 	startDate := time.Now()
-	endDate := startDate.AddDate(0, 0, payment.Plan.DurationDays)
+	endDate := startDate.AddDate(0, 0, plan.DurationDays)
 
 	subscription := &db.Subscription{
-		UserID:     payment.UserID,
-		PlanID:     payment.PlanID,
+		UserID:     userID,
+		PlanID:     plan.ID,
 		PeerID:     peerID,
 		PrivKeyEnc: peerResp.PrivateKey,
 		PublicKey:  peerResp.PublicKey,
@@ -954,11 +1033,11 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 		StartDate:  startDate,
 		EndDate:    endDate,
 		Active:     peerResp.PrivateKey != "PLACEHOLDER_PRIVATE_KEY", // Отключаем если placeholder
-		PaymentID:  &payment.ID,
+		PaymentID:  paymentID,
 	}
 
 	slog.Info("Creating subscription in database",
-		"payment_id", payment.ID,
+		"payment_id", logPaymentID,
 		"peer_id", peerID,
 		"start_date", startDate.Format("2006-01-02"),
 		"end_date", endDate.Format("2006-01-02"),
@@ -967,14 +1046,14 @@ func (s *Service) createSubscriptionForPayment(tx *gorm.DB, payment *db.Payment)
 
 	if err := tx.Create(subscription).Error; err != nil {
 		s.logAndReportError("Subscription database creation failed", err, map[string]interface{}{
-			"payment_id": payment.ID,
-			"user_id":    payment.UserID,
+			"payment_id": logPaymentID,
+			"user_id":    userID,
 			"peer_id":    peerID,
 		})
 		return nil, ErrDatabasef("Failed to create subscription in database: %v", err)
 	}
 
-	slog.Info("Subscription created successfully", "subscription_id", subscription.ID, "payment_id", payment.ID)
+	slog.Info("Subscription created successfully", "subscription_id", subscription.ID, "payment_id", logPaymentID)
 	return subscription, nil
 }
 
@@ -1004,7 +1083,7 @@ func (s *Service) handleCallbackPayQueue(callback *tgbotapi.CallbackQuery) {
 	s.answerCallback(callback.ID, "")
 
 	var payments []db.Payment
-	result := s.repo.DB().Where("status = 'pending'").
+	result := s.repo.DB().Where("status = 'pending' AND provider = ''").
 		Preload("User").
 		Preload("Plan").
 		Preload("Method").
@@ -1031,10 +1110,14 @@ func (s *Service) handleCallbackPayQueue(callback *tgbotapi.CallbackQuery) {
 	for i, payment := range payments {
 		text += "🆔 #" + strconv.Itoa(int(payment.ID)) + "\n" +
 			"👤 @" + payment.User.Username + "\n" +
-			"💰 " + strconv.Itoa(payment.Amount) + " руб.\n" +
+			"💰 " + formatAmount(payment.Amount, payment.Currency) + "\n" +
 			"📦 " + payment.Plan.Name + " x" + strconv.Itoa(payment.Qty) + "\n" +
 			"💳 " + payment.Method.Bank + " (" + payment.Method.PhoneNumber + ")\n" +
-			"📅 " + payment.CreatedAt.Format("02.01.2006 15:04") + "\n\n"
+			"📅 " + payment.CreatedAt.Format("02.01.2006 15:04") + "\n"
+		if payment.DuplicateOf != nil {
+			text += "⚠️ Возможно повторный чек, см. заказ #" + strconv.Itoa(int(*payment.DuplicateOf)) + "\n"
+		}
+		text += "\n"
 
 		buttonRow := []tgbotapi.InlineKeyboardButton{
 			tgbotapi.NewInlineKeyboardButtonData(
@@ -1061,7 +1144,7 @@ func (s *Service) handleCallbackPayQueue(callback *tgbotapi.CallbackQuery) {
 	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
 }
 
-func (s *Service) handleCallbackAdminPlans(callback *tgbotapi.CallbackQuery) {
+func (s *Service) handleCallbackAdminMethods(callback *tgbotapi.CallbackQuery) {
 	if !s.isAdmin(callback.From.ID) {
 		s.answerCallback(callback.ID, "У вас нет прав администратора")
 		return
@@ -1069,18 +1152,18 @@ func (s *Service) handleCallbackAdminPlans(callback *tgbotapi.CallbackQuery) {
 
 	s.answerCallback(callback.ID, "")
 
-	text := "📋 Управление тарифами\n\nВыберите действие:"
+	text := "💳 Управление способами оплаты\n\nВыберите действие:"
 
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("📋 Показать тарифы", "show_all_plans")},
-		{tgbotapi.NewInlineKeyboardButtonData("🗑 Архивировать тариф", "archive_plan_list")},
+		{tgbotapi.NewInlineKeyboardButtonData("📋 Показать способы", "show_payment_methods")},
+		{tgbotapi.NewInlineKeyboardButtonData("🗑 Архивировать способ", "archive_method_list")},
 		{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад к админ панели", CallbackAdminPanel.String())},
 	}
 
 	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
 }
 
-func (s *Service) handleCallbackAdminMethods(callback *tgbotapi.CallbackQuery) {
+func (s *Service) handleCallbackAdminUsers(callback *tgbotapi.CallbackQuery) {
 	if !s.isAdmin(callback.From.ID) {
 		s.answerCallback(callback.ID, "У вас нет прав администратора")
 		return
@@ -1088,18 +1171,18 @@ func (s *Service) handleCallbackAdminMethods(callback *tgbotapi.CallbackQuery) {
 
 	s.answerCallback(callback.ID, "")
 
-	text := "💳 Управление способами оплаты\n\nВыберите действие:"
+	text := "👤 Управление пользователями\n\nВыберите действие:"
 
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("📋 Показать способы", "show_payment_methods")},
-		{tgbotapi.NewInlineKeyboardButtonData("🗑 Архивировать способ", "archive_method_list")},
+		{tgbotapi.NewInlineKeyboardButtonData("🔍 Найти пользователя", "search_users")},
+		{tgbotapi.NewInlineKeyboardButtonData("📊 Статистика", "user_stats")},
 		{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад к админ панели", CallbackAdminPanel.String())},
 	}
 
 	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
 }
 
-func (s *Service) handleCallbackAdminUsers(callback *tgbotapi.CallbackQuery) {
+func (s *Service) handleCallbackUserStats(callback *tgbotapi.CallbackQuery) {
 	if !s.isAdmin(callback.From.ID) {
 		s.answerCallback(callback.ID, "У вас нет прав администратора")
 		return
@@ -1107,11 +1190,31 @@ func (s *Service) handleCallbackAdminUsers(callback *tgbotapi.CallbackQuery) {
 
 	s.answerCallback(callback.ID, "")
 
-	text := "👤 Управление пользователями\n\nВыберите действие:"
+	var usersCount, activeSubs, trialSubs, approvedCount int64
+	s.repo.DB().Model(&db.User{}).Count(&usersCount)
+	s.repo.DB().Model(&db.Subscription{}).Where("active = true").Count(&activeSubs)
+	s.repo.DB().Model(&db.Subscription{}).
+		Where("plan_id IN (?)", s.repo.DB().Model(&db.Plan{}).Select("id").Where("is_trial = true")).
+		Count(&trialSubs)
+
+	// Выручка считается только по одобренным платежам, пробные периоды платежей не создают
+	s.repo.DB().Model(&db.Payment{}).Where("status = ?", PaymentStatusApproved.String()).Count(&approvedCount)
+	revenue, err := revenueByCurrency(s.repo.DB())
+	if err != nil {
+		slog.Error("Failed to fetch revenue", "error", err)
+	}
+
+	text := fmt.Sprintf(`📊 Статистика
+
+👥 Пользователей: %d
+🔑 Активных подписок: %d
+🎁 Пробных периодов выдано: %d
+
+💰 Одобренных платежей: %d
+%s`,
+		usersCount, activeSubs, trialSubs, approvedCount, s.revenueText(revenue))
 
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("🔍 Найти пользователя", "search_users")},
-		{tgbotapi.NewInlineKeyboardButtonData("📊 Статистика", "user_stats")},
 		{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад к админ панели", CallbackAdminPanel.String())},
 	}
 
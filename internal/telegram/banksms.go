@@ -0,0 +1,277 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// maxAmountSuffix - сколько рублей максимум добавляется к цене, чтобы сумма
+// ожидающего заказа была уникальной. Надбавка возвращается на баланс после одобрения
+const maxAmountSuffix = 99
+
+// uniqueAmountAttempts - сколько раз подбирать сумму заново, если ее успел
+// занять параллельный заказ
+const uniqueAmountAttempts = 3
+
+// bankMatchWindow - насколько раньше поступления мог быть создан заказ
+const bankMatchWindow = 24 * time.Hour
+
+var (
+	// Сумма с валютой: "1 503р", "1503,00 ₽", "+1503.00 RUB"
+	bankAmountRe = regexp.MustCompile(`(?i)(\+\s?)?(\d{1,3}(?:[ \x{00A0}]\d{3})+|\d+)(?:[.,](\d{2}))?\s?(₽|р\.?|руб\.?|rub|rur)?`)
+	bankTimeRe   = regexp.MustCompile(`\b([01]?\d|2[0-3]):([0-5]\d)\b`)
+	bankDateRe   = regexp.MustCompile(`\b(0[1-9]|[12]\d|3[01])\.(0[1-9]|1[0-2])(?:\.(\d{4}|\d{2}))?\b`)
+	// Поступление отличает уведомление о входящем переводе от прочих сообщений
+	bankIncomeRe  = regexp.MustCompile(`(?i)(зачислен|поступлен|пополнен|перевод от|входящий перевод|получен)`)
+	bankBalanceRe = regexp.MustCompile(`(?i)(баланс|остаток|доступно)[:\s]*$`)
+)
+
+// bankNotification - разобранное SMS/push уведомление банка о поступлении
+type bankNotification struct {
+	Amount int
+	// At нулевое, если в тексте нет времени
+	At time.Time
+}
+
+// parseBankSMS извлекает сумму и время поступления из текста уведомления банка.
+// Суммы после "Баланс"/"Остаток" пропускаются, копейки отбрасываются
+func parseBankSMS(text string, now time.Time) (*bankNotification, bool) {
+	if !bankIncomeRe.MatchString(text) {
+		return nil, false
+	}
+
+	// Время и дату вырезаем заранее, чтобы не принять их за сумму
+	clean := bankTimeRe.ReplaceAllString(text, " ")
+	clean = bankDateRe.ReplaceAllString(clean, " ")
+
+	amount := 0
+	for _, m := range bankAmountRe.FindAllStringSubmatchIndex(clean, -1) {
+		hasPlus := m[2] >= 0
+		hasCurrency := m[8] >= 0
+		if !hasPlus && !hasCurrency {
+			continue
+		}
+		if bankBalanceRe.MatchString(clean[:m[0]]) {
+			continue
+		}
+
+		digits := strings.NewReplacer(" ", "", "\u00a0", "").Replace(clean[m[4]:m[5]])
+		value, err := strconv.Atoi(digits)
+		if err != nil || value == 0 {
+			continue
+		}
+		amount = value
+		break
+	}
+
+	if amount == 0 {
+		return nil, false
+	}
+
+	n := &bankNotification{Amount: amount}
+
+	if tm := bankTimeRe.FindStringSubmatch(text); tm != nil {
+		hour, _ := strconv.Atoi(tm[1])
+		minute, _ := strconv.Atoi(tm[2])
+		day, month, year := now.Day(), now.Month(), now.Year()
+		if dm := bankDateRe.FindStringSubmatch(text); dm != nil {
+			day, _ = strconv.Atoi(dm[1])
+			m, _ := strconv.Atoi(dm[2])
+			month = time.Month(m)
+			if dm[3] != "" {
+				year, _ = strconv.Atoi(dm[3])
+				if year < 100 {
+					year += 2000
+				}
+			}
+		}
+		n.At = time.Date(year, month, day, hour, minute, 0, 0, now.Location())
+		// Время без даты после полуночи относится к вчерашнему дню
+		if n.At.After(now.Add(time.Minute)) {
+			n.At = n.At.AddDate(0, 0, -1)
+		}
+	}
+
+	return n, true
+}
+
+// uniqueAmount подбирает сумму не меньше base, которую не использует ни один
+// ожидающий ручной платеж. Если все варианты заняты, возвращает ошибку
+func uniqueAmount(tx *gorm.DB, base int) (int, error) {
+	var taken []int
+	err := tx.Model(&db.Payment{}).
+		Where("status = ? AND provider = '' AND currency = ? AND amount BETWEEN ? AND ?", PaymentStatusPending.String(), CurrencyRUB, base, base+maxAmountSuffix).
+		Pluck("amount", &taken).Error
+	if err != nil {
+		return 0, ErrDatabasef("Failed to fetch pending amounts: %v", err)
+	}
+
+	used := make(map[int]bool, len(taken))
+	for _, amount := range taken {
+		used[amount] = true
+	}
+
+	for suffix := 0; suffix <= maxAmountSuffix; suffix++ {
+		if !used[base+suffix] {
+			return base + suffix, nil
+		}
+	}
+
+	return 0, ErrPaymentf("No free unique amount left for %v", base)
+}
+
+// createUniquePayment сохраняет ручной рублевый заказ с уникальной суммой не
+// меньше base. Уникальность держит частичный индекс в базе, поэтому если
+// параллельный заказ успел занять ту же сумму, она подбирается заново
+func createUniquePayment(tx *gorm.DB, payment *db.Payment, base int) error {
+	for attempt := 1; attempt <= uniqueAmountAttempts; attempt++ {
+		amount, err := uniqueAmount(tx, base)
+		if err != nil {
+			return err
+		}
+		payment.Amount = amount
+		payment.Surcharge = amount - base
+
+		if err := tx.SavePoint("unique_amount").Error; err != nil {
+			return ErrDatabasef("Failed to create savepoint: %v", err)
+		}
+		err = tx.Create(payment).Error
+		if err == nil {
+			return nil
+		}
+		tx.RollbackTo("unique_amount")
+		payment.ID = 0
+		if !isUniqueViolation(err) {
+			return ErrDatabasef("Failed to create payment record: %v", err)
+		}
+		slog.Warn("Unique amount taken concurrently", "amount", amount, "attempt", attempt)
+	}
+	return ErrPaymentf("Failed to reserve unique amount for %v", base)
+}
+
+// isUniqueViolation - ошибка уникального индекса SQLite или PostgreSQL
+func isUniqueViolation(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed") || strings.Contains(err.Error(), "duplicate key")
+}
+
+// matchBankNotification ищет ожидающие ручные платежи с суммой из уведомления
+func (s *Service) matchBankNotification(n *bankNotification) ([]db.Payment, error) {
+	query := s.repo.DB().
+		Where("status = ? AND provider = '' AND currency = ? AND amount = ?", PaymentStatusPending.String(), CurrencyRUB, n.Amount).
+		Preload("User").
+		Preload("Plan").
+		Order("created_at ASC")
+
+	if !n.At.IsZero() {
+		query = query.Where("created_at BETWEEN ? AND ?", n.At.Add(-bankMatchWindow), n.At.Add(time.Hour))
+	}
+
+	var matches []db.Payment
+	if err := query.Find(&matches).Error; err != nil {
+		return nil, ErrDatabasef("Failed to match bank notification: %v", err)
+	}
+	return matches, nil
+}
+
+// handleBankNotification разбирает пересланное кассиром уведомление банка и
+// предлагает одобрить найденный заказ. Возвращает false для непересланных
+// сообщений и тех, что не похожи на уведомление о поступлении: подпись к чеку
+// или отзыв админа не должны перехватываться
+func (s *Service) handleBankNotification(msg *tgbotapi.Message) bool {
+	if msg.ForwardDate == 0 || !s.isAdmin(msg.From.ID) {
+		return false
+	}
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+
+	n, ok := parseBankSMS(text, time.Unix(int64(msg.ForwardDate), 0))
+	if !ok {
+		return false
+	}
+	s.replyBankMatches(msg, n)
+	return true
+}
+
+// handleBankSMS - /banksms <текст уведомления> для уведомлений, которые
+// нельзя переслать: push банка, скопированный с телефона
+func (s *Service) handleBankSMS(msg *tgbotapi.Message) {
+	if !s.isAdmin(msg.From.ID) {
+		s.reply(msg.Chat.ID, "Команда доступна только администраторам")
+		return
+	}
+
+	text := strings.TrimSpace(msg.CommandArguments())
+	if text == "" {
+		s.reply(msg.Chat.ID, "Использование: /banksms <текст SMS или push банка>\n\nSMS банка можно просто переслать боту")
+		return
+	}
+
+	n, ok := parseBankSMS(text, time.Now())
+	if !ok {
+		s.reply(msg.Chat.ID, "❌ Не похоже на уведомление о поступлении: нужна сумма и слово вроде «зачисление» или «перевод от»")
+		return
+	}
+	s.replyBankMatches(msg, n)
+}
+
+// replyBankMatches ищет заказы с суммой из уведомления и отправляет кассиру
+// кнопки одобрения
+func (s *Service) replyBankMatches(msg *tgbotapi.Message, n *bankNotification) {
+	slog.Info("Bank notification received", "admin_id", msg.From.ID, "amount", n.Amount, "at", n.At)
+
+	matches, err := s.matchBankNotification(n)
+	if err != nil {
+		s.logAndReportError("Bank notification matching failed", err, map[string]interface{}{
+			"admin_id": msg.From.ID,
+			"amount":   n.Amount,
+		})
+		s.reply(msg.Chat.ID, "Ошибка поиска платежа")
+		return
+	}
+
+	header := fmt.Sprintf("🏦 Поступление: %d руб.", n.Amount)
+	if !n.At.IsZero() {
+		header += " в " + n.At.Format("02.01.2006 15:04")
+	}
+
+	if len(matches) == 0 {
+		s.reply(msg.Chat.ID, header+"\n\n❓ Ожидающих заказов с такой суммой не найдено. Проверьте /payqueue")
+		return
+	}
+
+	text := header + "\n\n"
+	if len(matches) > 1 {
+		text += "⚠️ Найдено несколько заказов с этой суммой, сверьте чек:\n\n"
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, payment := range matches {
+		text += fmt.Sprintf("🆔 #%d 👤 @%s\n📦 %s x%d\n📅 %s\n\n",
+			payment.ID, payment.User.Username, payment.Plan.Name, payment.Qty,
+			payment.CreatedAt.Format("02.01.2006 15:04"))
+
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("✅ Одобрить #"+strconv.Itoa(int(payment.ID)), CallbackPaymentApprove.WithID(payment.ID)),
+		})
+	}
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	if _, err := s.bot.Send(reply); err != nil {
+		s.logAndReportError("Failed to send bank match", err, map[string]interface{}{
+			"chat_id": msg.Chat.ID,
+			"amount":  n.Amount,
+		})
+	}
+}
@@ -11,12 +11,16 @@ import (
 
 	"lime-bot/internal/config"
 	"lime-bot/internal/db"
+	"lime-bot/internal/payments"
 )
 
 type Service struct {
-	bot  *tgbotapi.BotAPI
-	repo *db.Repository
-	cfg  *config.Config
+	bot   *tgbotapi.BotAPI
+	repo  *db.Repository
+	cfg   *config.Config
+	stars Payments
+	// providers - онлайн-эквайринг с webhook-уведомлениями
+	providers *payments.Registry
 }
 
 func New(cfg *config.Config, repo *db.Repository) (*Service, error) {
@@ -45,6 +49,8 @@ func New(cfg *config.Config, repo *db.Repository) (*Service, error) {
 	slog.Info("Authorized as telegram bot", "username", bot.Self.UserName)
 
 	service := &Service{bot: bot, repo: repo, cfg: cfg}
+	service.stars = &starsPayments{s: service}
+	service.providers = newProviderRegistry(cfg)
 
 	// Устанавливаем меню команд
 	if err := service.setCommands(); err != nil {
@@ -113,9 +119,13 @@ func (s *Service) handleUpdate(upd tgbotapi.Update) {
 			}
 		}
 
-		if upd.Message.IsCommand() {
+		if upd.Message.SuccessfulPayment != nil {
+			s.handleSuccessfulPayment(upd.Message)
+		} else if upd.Message.IsCommand() {
 			s.handleCommand(upd.Message)
-		} else {
+		} else if upd.Message.Contact != nil {
+			s.handleContactMessage(upd.Message)
+		} else if !s.handleRejectReasonMessage(upd.Message) && !s.handleRefundReasonMessage(upd.Message) && !s.handlePlanEditMessage(upd.Message) && !s.handleBankNotification(upd.Message) {
 			s.handleReceiptMessage(upd.Message)
 			s.handleFeedbackMessage(upd.Message)
 		}
@@ -130,6 +140,15 @@ func (s *Service) handleUpdate(upd tgbotapi.Update) {
 		s.handleCallbackQuery(upd.CallbackQuery)
 		return
 	}
+
+	if upd.PreCheckoutQuery != nil {
+		slog.Debug("Received pre-checkout query",
+			"user_id", upd.PreCheckoutQuery.From.ID,
+			"payload", upd.PreCheckoutQuery.InvoicePayload,
+		)
+		s.handlePreCheckoutQuery(upd.PreCheckoutQuery)
+		return
+	}
 }
 
 func (s *Service) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
@@ -171,10 +190,21 @@ func (s *Service) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 		return
 	}
 
+	if strings.HasPrefix(data, CallbackBuyResume.String()) {
+		s.handleBuyResume(callback)
+		return
+	}
+
 	if strings.HasPrefix(data, CallbackBuyPlan.String()) ||
 		strings.HasPrefix(data, CallbackBuyPlatform.String()) ||
 		strings.HasPrefix(data, CallbackBuyQty.String()) ||
-		strings.HasPrefix(data, CallbackBuyMethod.String()) {
+		strings.HasPrefix(data, CallbackBuyMethod.String()) ||
+		strings.HasPrefix(data, CallbackBuyOnline.String()) ||
+		strings.HasPrefix(data, CallbackBuyEdit.String()) ||
+		data == CallbackBuyStars.String() ||
+		data == CallbackBuyBalance.String() ||
+		data == CallbackBuyBack.String() ||
+		data == CallbackBuyConfirm.String() {
 		s.handleBuyCallback(callback)
 		return
 	}
@@ -184,6 +214,93 @@ func (s *Service) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 		return
 	}
 
+	if strings.HasPrefix(data, CallbackAutoRenew.String()) {
+		s.handleAutoRenewToggle(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPaymentCancel.String()) {
+		s.handlePaymentCancel(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPaymentEdit.String()) {
+		s.handlePaymentEdit(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackReceiptOrder.String()) {
+		s.handleReceiptOrderCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackRejectReason.String()) {
+		s.handleRejectReasonCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPaymentResubmit.String()) {
+		s.handlePaymentResubmit(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackArchiveReason.String()) {
+		s.handleArchiveReasonCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPaymentInfo.String()) {
+		s.handlePaymentInfoCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPaymentRefund.String()) {
+		s.showRefundOptions(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackRefundAmount.String()) || strings.HasPrefix(data, CallbackRefundWallet.String()) {
+		s.handleRefundAmountCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackReferralApprove.String()) || strings.HasPrefix(data, CallbackReferralReject.String()) {
+		s.handleReferralReviewCallback(callback)
+		return
+	}
+
+	if data == CallbackPartnerPanel.String() ||
+		data == CallbackPartnerKeys.String() ||
+		data == CallbackPartnerUsers.String() ||
+		strings.HasPrefix(data, CallbackPartnerMonth.String()) {
+		s.handlePartnerCallback(callback)
+		return
+	}
+
+	if data == CallbackPlanNew.String() ||
+		strings.HasPrefix(data, CallbackPlanEdit.String()) ||
+		strings.HasPrefix(data, CallbackPlanField.String()) ||
+		strings.HasPrefix(data, CallbackPlanRecommended.String()) ||
+		strings.HasPrefix(data, CallbackPlanVisibility.String()) {
+		s.handlePlanAdminCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackSeatRemove.String()) {
+		s.handleSeatRemoveCallback(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackChangePlan.String()) {
+		s.showPlanChangeOptions(callback)
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackChangePlanTo.String()) {
+		s.handlePlanChangeSelect(callback)
+		return
+	}
+
 	if data == CallbackAdminList.String() ||
 		data == CallbackAdminAdd.String() ||
 		data == CallbackAdminDisable.String() ||
@@ -192,6 +309,7 @@ func (s *Service) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 		data == "admin_plans" ||
 		data == "admin_methods" ||
 		data == "admin_users" ||
+		data == "user_stats" ||
 		strings.HasPrefix(data, CallbackPaymentApprove.String()) ||
 		strings.HasPrefix(data, CallbackPaymentReject.String()) ||
 		strings.HasPrefix(data, CallbackInfoUser.String()) ||
@@ -309,6 +427,12 @@ func (s *Service) handleCommand(msg *tgbotapi.Message) {
 		s.handleAddPlan(msg)
 	case CmdArchivePlan:
 		s.handleArchivePlan(msg)
+	case CmdPlanStars:
+		s.handlePlanStars(msg)
+	case CmdReasons:
+		s.handleReasons(msg)
+	case CmdAddReason:
+		s.handleAddReason(msg)
 	case CmdAddPMethod:
 		s.handleAddPaymentMethod(msg)
 	case CmdListPMethods:
@@ -327,6 +451,8 @@ func (s *Service) handleCommand(msg *tgbotapi.Message) {
 		s.handleAdmins(msg)
 	case CmdPayQueue:
 		s.handlePayQueue(msg)
+	case CmdBankSMS:
+		s.handleBankSMS(msg)
 	case CmdInfo:
 		s.handleInfo(msg)
 	case CmdAddAdmin:
@@ -337,6 +463,40 @@ func (s *Service) handleCommand(msg *tgbotapi.Message) {
 		s.handleFeedback(msg)
 	case CmdSupport:
 		s.handleSupport(msg)
+	case CmdBalance:
+		s.handleBalance(msg)
+	case CmdTopUp:
+		s.handleTopUp(msg)
+	case CmdAdjust:
+		s.handleAdjust(msg)
+	case CmdRefReview:
+		s.handleReferralReview(msg)
+	case CmdRefCode:
+		s.handleRefCode(msg)
+	case CmdSetRefCode:
+		s.handleSetRefCode(msg)
+	case CmdCampaigns:
+		s.handleCampaigns(msg)
+	case CmdPartner:
+		s.handlePartner(msg)
+	case CmdPartnerPrice:
+		s.handlePartnerPrice(msg)
+	case CmdFamily:
+		s.handleFamily(msg)
+	case CmdPlanSeats:
+		s.handlePlanSeats(msg)
+	case CmdPlanDiscount:
+		s.handlePlanDiscount(msg)
+	case CmdPlanPrice:
+		s.handlePlanPrice(msg)
+	case CmdRate:
+		s.handleRate(msg)
+	case CmdPMethodLimit:
+		s.handlePaymentMethodLimit(msg)
+	case CmdPMethodQR:
+		s.handlePaymentMethodQR(msg)
+	case CmdCheckouts:
+		s.handleCheckouts(msg)
 	}
 }
 
@@ -364,24 +524,53 @@ func (s *Service) handleHelp(msg *tgbotapi.Message) {
 /plans - список тарифов
 /buy - купить подписку
 /mykeys - мои ключи
+/balance - баланс и история операций
 /ref - реферальная ссылка
+/refcode <код> - свой код реферальной ссылки
+/family - семейная подписка: приглашения и участники
 /feedback - отправить отзыв
 /support - служба поддержки
 /help - справка`
 
+	if s.isPartner(msg.From.ID) {
+		text += `
+
+🤝 Команды партнера:
+/buy - оптовая покупка ключей по партнерским ценам
+/partner - кабинет: ключи, клиенты и выписки`
+	}
+
 	if s.isAdmin(msg.From.ID) {
 		text += `
 
 ⚡ Администраторские команды:
-/addplan - добавить тариф
+/addplan - добавить тариф (trial - пробный)
 /archiveplan - архивировать тариф
-/addpmethod - добавить способ оплаты
+/planstars <id> <звезды> - цена тарифа в Telegram Stars
+/planseats <id> <мест> - сделать тариф семейным
+/plandiscount <id> [<от ключей> <процент>] - скидки за количество ключей
+/planprice <id> [<валюта> <цена>] - цена тарифа в USD, EUR, USDT
+/rate <валюта> <курс> - курс к рублю для сводной выручки
+Правка тарифов - ⚡ Админ панель → 📋 Управление тарифами
+/addpmethod - добавить способ оплаты (валюта - последним аргументом)
 /listpmethods - список способов оплаты
+/pmethodlimit <id> <в сутки> <заказов> [<с>-<до>] - лимиты способа оплаты
+/pmethodqr <id> <счет> <БИК> <корр. счет> - реквизиты для QR-кода оплаты
+/checkouts [дней] - брошенные оформления по шагам
 /archivepmethod - архивировать способ оплаты
 /disable <username> - отключить пользователя
 /enable <username> - включить пользователя
 /payqueue - очередь платежей
-/info <username> - информация о пользователе`
+/banksms <текст> - найти заказ по SMS банка (SMS можно просто переслать)
+/reasons - причины отклонения платежей
+/addreason - добавить причину отклонения
+/info <username> - информация о пользователе
+/topup <username> <сумма> - зачислить пополнение на баланс
+/adjust <username> <+/-сумма> <комментарий> - корректировка баланса
+/refreview - подозрительные приглашения на проверке
+/setrefcode <username> <код> - назначить код реферальной ссылки (партнерам)
+/campaigns [кампания] - статистика рекламных кампаний и реферальных кодов
+/partnerprice <username> <id тарифа> <цена> - оптовая цена для партнера`
 
 		if s.isSuperAdmin(msg.From.ID) {
 			text += `
@@ -396,30 +585,24 @@ func (s *Service) handleHelp(msg *tgbotapi.Message) {
 }
 
 func (s *Service) handlePlans(msg *tgbotapi.Message) {
-	var plans []db.Plan
-	result := s.repo.DB().Where("archived = false").Find(&plans)
-	if result.Error != nil {
+	text, err := s.plansText(msg.From.ID)
+	if err != nil {
 		s.reply(msg.Chat.ID, "Ошибка получения тарифов")
 		return
 	}
 
-	if len(plans) == 0 {
-		s.reply(msg.Chat.ID, "Тарифы пока не добавлены")
-		return
+	if !s.isAdmin(msg.Chat.ID) {
+		text += tgbotapi.EscapeText(tgbotapi.ModeMarkdown, s.getSupportUsers())
 	}
-
-	text := "📋 Доступные тарифы:\n\n"
-	for _, plan := range plans {
-		text += fmt.Sprintf("🔹 %s\n💰 %d руб.\n⏱ %d дней\n\n",
-			plan.Name, plan.PriceInt, plan.DurationDays)
-	}
-	s.reply(msg.Chat.ID, text)
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ParseMode = tgbotapi.ModeMarkdown
+	s.bot.Send(reply)
 }
 
 func (s *Service) handleAddPlan(msg *tgbotapi.Message) {
 	args := strings.Fields(msg.CommandArguments())
 	if len(args) < 3 {
-		s.reply(msg.Chat.ID, "Использование: /addplan <название> <цена> <дни>\nПример: /addplan Месяц 200 30")
+		s.reply(msg.Chat.ID, "Использование: /addplan <название> <цена> <дни> [trial]\nПример: /addplan Месяц 200 30\nПробный: /addplan Пробный 0 3 trial")
 		return
 	}
 
@@ -436,10 +619,16 @@ func (s *Service) handleAddPlan(msg *tgbotapi.Message) {
 		return
 	}
 
+	isTrial := len(args) > 3 && args[3] == "trial"
+	if isTrial {
+		price = 0
+	}
+
 	plan := &db.Plan{
 		Name:         name,
 		PriceInt:     price,
 		DurationDays: days,
+		IsTrial:      isTrial,
 	}
 
 	result := s.repo.DB().Create(plan)
@@ -451,9 +640,55 @@ func (s *Service) handleAddPlan(msg *tgbotapi.Message) {
 	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Тариф \"%s\" создан", name))
 }
 
+func formatPlanLine(plan *db.Plan) string {
+	if plan.IsTrial {
+		return fmt.Sprintf("🎁 %s\n💰 бесплатно, один раз\n⏱ %d дней\n\n", plan.Name, plan.DurationDays)
+	}
+	seats := ""
+	if plan.Seats > 1 {
+		seats = fmt.Sprintf("\n👨‍👩‍👧 %d мест, у каждого свой ключ", plan.Seats)
+	}
+	if plan.PriceStars > 0 {
+		return fmt.Sprintf("🔹 %s\n💰 %d руб. / %d ⭐\n⏱ %d дней%s\n\n", plan.Name, plan.PriceInt, plan.PriceStars, plan.DurationDays, seats)
+	}
+	return fmt.Sprintf("🔹 %s\n💰 %d руб.\n⏱ %d дней%s\n\n", plan.Name, plan.PriceInt, plan.DurationDays, seats)
+}
+
+func (s *Service) handlePlanStars(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		s.reply(msg.Chat.ID, "Использование: /planstars <id_тарифа> <звезды>\nПример: /planstars 1 150\n0 - отключить оплату звездами")
+		return
+	}
+
+	planID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID тарифа")
+		return
+	}
+
+	stars, err := strconv.Atoi(args[1])
+	if err != nil || stars < 0 {
+		s.reply(msg.Chat.ID, "Неверная цена в звездах")
+		return
+	}
+
+	result := s.repo.DB().Model(&db.Plan{}).Where("id = ? AND is_trial = false", planID).Update("price_stars", stars)
+	if result.Error != nil {
+		s.reply(msg.Chat.ID, "Ошибка обновления тарифа")
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.reply(msg.Chat.ID, "Тариф не найден")
+		return
+	}
+
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Цена тарифа #%d в Telegram Stars: %d ⭐", planID, stars))
+}
+
 func (s *Service) handleArchivePlan(msg *tgbotapi.Message) {
 	var plans []db.Plan
-	result := s.repo.DB().Where("archived = false").Find(&plans)
+	result := s.repo.DB().Where(db.PlanOnSale).Find(&plans)
 	if result.Error != nil {
 		s.reply(msg.Chat.ID, "Ошибка получения тарифов")
 		return
@@ -520,8 +755,9 @@ func (s *Service) isAdmin(userID int64) bool {
 		return true
 	}
 
+	// Партнеры хранятся вместе с админами, но админских прав не имеют
 	var admin db.Admin
-	result := s.repo.DB().Where("tg_id = ? AND disabled = false", userID).First(&admin)
+	result := s.repo.DB().Where("tg_id = ? AND disabled = false AND role <> ?", userID, RolePartner.String()).First(&admin)
 	return result.Error == nil
 }
 
@@ -612,6 +848,12 @@ func (s *Service) showMainMenu(chatID int64, userID int64) {
 		tgbotapi.NewInlineKeyboardButtonData("❓ Справка", CallbackShowHelp.String()),
 	})
 
+	if s.isPartner(userID) {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🤝 Партнерский кабинет", CallbackPartnerPanel.String()),
+		})
+	}
+
 	// Кнопки для админов
 	if s.isAdmin(userID) {
 		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
@@ -634,28 +876,18 @@ func (s *Service) showMainMenu(chatID int64, userID int64) {
 func (s *Service) handleCallbackPlans(callback *tgbotapi.CallbackQuery) {
 	s.answerCallback(callback.ID, "")
 
-	var plans []db.Plan
-	result := s.repo.DB().Where("archived = false").Find(&plans)
-	if result.Error != nil {
+	text, err := s.plansText(callback.From.ID)
+	if err != nil {
 		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, "Ошибка получения тарифов")
 		return
 	}
 
-	if len(plans) == 0 {
-		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, "Тарифы пока не добавлены")
-		return
-	}
-
-	text := "📋 Доступные тарифы:\n\n"
-	for _, plan := range plans {
-		text += fmt.Sprintf("🔹 %s\n💰 %d руб.\n⏱ %d дней\n\n", plan.Name, plan.PriceInt, plan.DurationDays)
-	}
-
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад в меню", CallbackMainMenu.String())},
-	}
-
-	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
+	editMsg := tgbotapi.NewEditMessageTextAndMarkup(callback.Message.Chat.ID, callback.Message.MessageID, text,
+		tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад в меню", CallbackMainMenu.String()),
+		)))
+	editMsg.ParseMode = tgbotapi.ModeMarkdown
+	s.bot.Send(editMsg)
 }
 
 func (s *Service) handleCallbackBuy(callback *tgbotapi.CallbackQuery) {
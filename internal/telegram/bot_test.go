@@ -1,11 +1,27 @@
 package telegram
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"lime-bot/internal/config"
 	"lime-bot/internal/db"
+	"lime-bot/internal/imagehash"
+	"lime-bot/internal/payments"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
 func TestMain(m *testing.M) {
@@ -241,3 +257,1812 @@ func TestErrorHelpers(t *testing.T) {
 		})
 	}
 }
+
+func TestStringify(t *testing.T) {
+	var payment uint = 42
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"text", "text"},
+		{errors.New("boom"), "boom"},
+		{int8(-3), "-3"},
+		{uint16(7), "7"},
+		{float32(1.5), "1.5"},
+		{payment, "42"},
+		{true, "true"},
+	}
+	for _, tt := range tests {
+		if got := stringify(tt.value); got != tt.want {
+			t.Errorf("stringify(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTrialEligibility(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	trial := db.Plan{Name: "Пробный", PriceInt: 0, DurationDays: 3, IsTrial: true}
+	repo.DB().Create(&trial)
+
+	if err := service.trialEligibility(123456789); err != nil {
+		t.Fatalf("expected new user to be eligible, got %v", err)
+	}
+
+	repo.DB().Create(&db.Subscription{
+		UserID: 123456789, PlanID: trial.ID, PeerID: "trial_peer", PrivKeyEnc: "k", PublicKey: "p",
+		Interface: "wg0", AllowedIP: "10.0.0.2", Platform: "android",
+	})
+
+	if err := service.trialEligibility(123456789); !errors.Is(err, errTrialAlreadyUsed) {
+		t.Errorf("expected errTrialAlreadyUsed, got %v", err)
+	}
+
+	service.cfg.TrialRequirePhone = true
+	repo.DB().Create(&db.User{TgID: 555, Username: "nophone"})
+	if err := service.trialEligibility(555); !errors.Is(err, errTrialPhoneRequired) {
+		t.Errorf("expected errTrialPhoneRequired, got %v", err)
+	}
+
+	repo.DB().Model(&db.User{}).Where("tg_id = ?", 123456789).Update("phone", "+79990000000")
+	repo.DB().Model(&db.User{}).Where("tg_id = ?", 555).Update("phone", "+79990000000")
+	if err := service.trialEligibility(555); !errors.Is(err, errTrialPhoneUsed) {
+		t.Errorf("expected errTrialPhoneUsed, got %v", err)
+	}
+}
+
+func TestStarsInvoiceCheck(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	payment := db.Payment{
+		UserID: 123456789, Amount: 300, Currency: CurrencyStars, PlanID: 1, Qty: 2,
+		Status: PaymentStatusPending.String(), Provider: PaymentProviderStars,
+	}
+	repo.DB().Create(&payment)
+	payload := starsPayload(payment.ID)
+
+	if id, err := parseStarsPayload(payload); err != nil || id != payment.ID {
+		t.Fatalf("parseStarsPayload(%q) = %d, %v", payload, id, err)
+	}
+	if _, err := parseStarsPayload("order_1"); err == nil {
+		t.Error("expected error for foreign payload")
+	}
+
+	if err := service.checkStarsInvoice(123456789, payload, CurrencyStars, 300); err != nil {
+		t.Errorf("expected valid invoice, got %v", err)
+	}
+	if err := service.checkStarsInvoice(123456789, payload, CurrencyStars, 150); err == nil {
+		t.Error("expected amount mismatch to be rejected")
+	}
+	if err := service.checkStarsInvoice(987654321, payload, CurrencyStars, 300); err == nil {
+		t.Error("expected foreign user to be rejected")
+	}
+}
+
+func TestLateStarsPayment(t *testing.T) {
+	service, repo := setupTestService(t)
+	client := &stubHTTPClient{}
+	service.bot = &tgbotapi.BotAPI{Client: client}
+	// MakeRequest собирает URL метода из адреса API
+	service.bot.SetAPIEndpoint(tgbotapi.APIEndpoint)
+	service.stars = &starsPayments{s: service}
+
+	userID := int64(123456789)
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "stars-peer", PrivKeyEnc: "key", PublicKey: "pub-stars",
+		Interface: "wg0", AllowedIP: "10.0.0.8", Platform: "android", StartDate: time.Now().AddDate(0, 0, -20),
+		EndDate: time.Now().AddDate(0, 0, 10), Active: true}
+	repo.DB().Create(&sub)
+
+	pay := func(payment *db.Payment) {
+		t.Helper()
+		repo.DB().Create(payment)
+		payment.InvoiceID = starsPayload(payment.ID)
+		repo.DB().Model(payment).Update("invoice_id", payment.InvoiceID)
+		service.handleSuccessfulPayment(&tgbotapi.Message{
+			From: &tgbotapi.User{ID: userID},
+			Chat: &tgbotapi.Chat{ID: userID},
+			SuccessfulPayment: &tgbotapi.SuccessfulPayment{
+				Currency: CurrencyStars, TotalAmount: payment.Amount, InvoicePayload: payment.InvoiceID, TelegramPaymentChargeID: "charge",
+			},
+		})
+	}
+
+	// Счет просрочился между pre_checkout_query и оплатой - заказ одобряется
+	late := db.Payment{UserID: userID, Amount: 150, Currency: CurrencyStars, PlanID: 2, Qty: 1, Status: PaymentStatusExpired.String(),
+		Provider: PaymentProviderStars, ChangeSubID: &sub.ID}
+	pay(&late)
+	var got db.Payment
+	repo.DB().First(&got, late.ID)
+	if got.Status != PaymentStatusApproved.String() {
+		t.Errorf("late stars payment status = %s, want approved", got.Status)
+	}
+
+	// Одобрить не удалось - звезды возвращаются автоматически
+	missing := uint(9999)
+	broken := db.Payment{UserID: userID, Amount: 150, Currency: CurrencyStars, PlanID: 2, Qty: 1, Status: PaymentStatusExpired.String(),
+		Provider: PaymentProviderStars, ChangeSubID: &missing}
+	requests := client.requests
+	pay(&broken)
+	got = db.Payment{}
+	repo.DB().First(&got, broken.ID)
+	if got.Status != PaymentStatusRefunded.String() || got.RefundedAmount != 150 {
+		t.Errorf("unapproved late stars payment: status=%s refunded=%d, want refunded 150", got.Status, got.RefundedAmount)
+	}
+	if client.requests == requests {
+		t.Error("expected refundStarPayment request")
+	}
+}
+
+func TestPaymentNotificationIgnoresProcessed(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	payment := db.Payment{
+		UserID: 123456789, Amount: 200, Currency: CurrencyRUB, PlanID: 1, Qty: 1,
+		Status: PaymentStatusApproved.String(), Provider: "acquiring", InvoiceID: "pay_1",
+	}
+	repo.DB().Create(&payment)
+
+	tests := []struct {
+		name string
+		n    *payments.Notification
+	}{
+		{"unknown payment", &payments.Notification{ProviderPaymentID: "pay_404", Status: payments.StatusSucceeded, Amount: 200}},
+		{"repeated success", &payments.Notification{ProviderPaymentID: "pay_1", Status: payments.StatusSucceeded, Amount: 200}},
+		{"late cancel", &payments.Notification{ProviderPaymentID: "pay_1", Status: payments.StatusCanceled}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := service.HandlePaymentNotification("acquiring", tt.n); err != nil {
+				t.Errorf("expected notification to be acknowledged, got %v", err)
+			}
+		})
+	}
+
+	var got db.Payment
+	repo.DB().First(&got, payment.ID)
+	if got.Status != PaymentStatusApproved.String() {
+		t.Errorf("status changed to %s", got.Status)
+	}
+}
+
+// stubProvider - онлайн-провайдер, который только запоминает возвраты
+type stubProvider struct {
+	refunds   []int
+	refundErr error
+}
+
+func (p *stubProvider) Name() string { return "acquiring" }
+
+func (p *stubProvider) CreatePayment(context.Context, payments.CreateRequest) (*payments.CreateResult, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *stubProvider) GetPayment(context.Context, string) (*payments.Notification, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *stubProvider) Refund(_ context.Context, _ string, amount int) error {
+	if p.refundErr != nil {
+		return p.refundErr
+	}
+	p.refunds = append(p.refunds, amount)
+	return nil
+}
+
+func (p *stubProvider) ParseWebhook([]byte, string) (*payments.Notification, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestPaymentNotificationAfterClose(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	provider := &stubProvider{}
+	service.providers = payments.NewRegistry()
+	service.providers.Register(provider)
+
+	userID := int64(123456789)
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "late-peer", PrivKeyEnc: "key", PublicKey: "pub-late",
+		Interface: "wg0", AllowedIP: "10.0.0.9", Platform: "android", StartDate: time.Now().AddDate(0, 0, -20),
+		EndDate: time.Now().AddDate(0, 0, 10), Active: true}
+	repo.DB().Create(&sub)
+
+	// Оплата пришла после просрочки заказа - заказ одобряется
+	late := db.Payment{UserID: userID, Amount: 433, Currency: CurrencyRUB, PlanID: 2, Qty: 1, Status: PaymentStatusExpired.String(),
+		Provider: "acquiring", InvoiceID: "pay_late", ChangeSubID: &sub.ID, ProrationCredit: 66}
+	repo.DB().Create(&late)
+	err := service.HandlePaymentNotification("acquiring", &payments.Notification{ProviderPaymentID: "pay_late", Status: payments.StatusSucceeded, Amount: 433})
+	if err != nil {
+		t.Fatalf("late payment: %v", err)
+	}
+	var got db.Payment
+	repo.DB().First(&got, late.ID)
+	if got.Status != PaymentStatusApproved.String() {
+		t.Errorf("late payment status = %s, want approved", got.Status)
+	}
+
+	// Сумма не совпала - деньги возвращаются один раз, заказ отклоняется
+	mismatch := db.Payment{UserID: userID, Amount: 200, Currency: CurrencyRUB, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String(),
+		Provider: "acquiring", InvoiceID: "pay_mismatch"}
+	repo.DB().Create(&mismatch)
+	n := &payments.Notification{ProviderPaymentID: "pay_mismatch", Status: payments.StatusSucceeded, Amount: 150}
+
+	provider.refundErr = errors.New("provider down")
+	if err := service.HandlePaymentNotification("acquiring", n); err == nil {
+		t.Error("expected failed refund to be retried")
+	}
+	got = db.Payment{}
+	repo.DB().First(&got, mismatch.ID)
+	if got.Status != PaymentStatusPending.String() || got.RefundedAt != nil {
+		t.Errorf("failed refund must leave payment pending, got %s refunded_at=%v", got.Status, got.RefundedAt)
+	}
+
+	provider.refundErr = nil
+	for i := 0; i < 2; i++ {
+		if err := service.HandlePaymentNotification("acquiring", n); err != nil {
+			t.Fatalf("mismatch notification %d: %v", i, err)
+		}
+	}
+	if len(provider.refunds) != 1 || provider.refunds[0] != 150 {
+		t.Errorf("refunds = %v, want [150]", provider.refunds)
+	}
+	got = db.Payment{}
+	repo.DB().First(&got, mismatch.ID)
+	if got.Status != PaymentStatusRejected.String() || got.RefundedAmount != 150 || got.RefundedAt == nil {
+		t.Errorf("unexpected mismatched payment: status=%s refunded=%d at=%v", got.Status, got.RefundedAmount, got.RefundedAt)
+	}
+}
+
+func TestParseBankSMS(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		text   string
+		ok     bool
+		amount int
+		at     string
+	}{
+		{"sber transfer", "СБЕРБАНК. Перевод от Иван И. 1 503р Баланс: 12 345.67р", true, 1503, ""},
+		{"card credit", "MIR-1234 14:05 зачисление 450р Баланс: 10000р", true, 450, "10.03.2026 14:05"},
+		{"push with kopecks", "Пополнение +1503,00 ₽ 09.03.2026 23:59", true, 1503, "09.03.2026 23:59"},
+		{"time after midnight", "Поступление 200 RUB 23:50", true, 200, "09.03.2026 23:50"},
+		{"purchase", "Покупка 500р в MAGNIT. Баланс: 1000р", false, 0, ""},
+		{"no amount", "Входящий перевод обработан", false, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, ok := parseBankSMS(tt.text, now)
+			if ok != tt.ok {
+				t.Fatalf("parseBankSMS(%q) ok = %v, want %v", tt.text, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if n.Amount != tt.amount {
+				t.Errorf("amount = %d, want %d", n.Amount, tt.amount)
+			}
+			got := ""
+			if !n.At.IsZero() {
+				got = n.At.Format("02.01.2006 15:04")
+			}
+			if got != tt.at {
+				t.Errorf("at = %q, want %q", got, tt.at)
+			}
+		})
+	}
+}
+
+func TestBankNotificationForwardedOnly(t *testing.T) {
+	service, _ := setupTestService(t)
+	client := &stubHTTPClient{}
+	service.bot = &tgbotapi.BotAPI{Client: client}
+	service.bot.SetAPIEndpoint(tgbotapi.APIEndpoint)
+
+	admin := &tgbotapi.User{ID: 123456789}
+	sms := "СБЕРБАНК. Перевод от Иван И. 1 503р Баланс: 12 345.67р"
+
+	// Подпись к своему чеку или отзыв админа остаются обычным сообщением
+	typed := &tgbotapi.Message{From: admin, Chat: &tgbotapi.Chat{ID: admin.ID}, Caption: sms}
+	if service.handleBankNotification(typed) {
+		t.Error("typed admin message must not be taken as a bank notification")
+	}
+
+	forwarded := &tgbotapi.Message{From: admin, Chat: &tgbotapi.Chat{ID: admin.ID}, Text: sms, ForwardDate: int(time.Now().Unix())}
+	if !service.handleBankNotification(forwarded) || client.requests != 1 {
+		t.Errorf("forwarded bank SMS must be matched, requests = %d", client.requests)
+	}
+
+	stranger := &tgbotapi.Message{From: &tgbotapi.User{ID: 987654321}, Chat: &tgbotapi.Chat{ID: 987654321}, Text: sms, ForwardDate: int(time.Now().Unix())}
+	if service.handleBankNotification(stranger) {
+		t.Error("bank SMS from a non-admin must be ignored")
+	}
+}
+
+func TestUniqueAmount(t *testing.T) {
+	_, repo := setupTestService(t)
+
+	for _, amount := range []int{300, 301} {
+		repo.DB().Create(&db.Payment{UserID: 123456789, MethodID: 1, Amount: amount, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()})
+	}
+	// Оплаченные заказы и онлайн-платежи сумму не резервируют
+	repo.DB().Create(&db.Payment{UserID: 123456789, MethodID: 1, Amount: 302, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()})
+	repo.DB().Create(&db.Payment{UserID: 123456789, Amount: 303, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String(), Provider: "acquiring"})
+
+	tests := []struct {
+		base int
+		want int
+	}{
+		{300, 302},
+		{301, 302},
+		{500, 500},
+	}
+
+	// Когда все надбавки заняты, заказ с неуникальной суммой не создается
+	for suffix := 0; suffix <= maxAmountSuffix; suffix++ {
+		repo.DB().Create(&db.Payment{UserID: 123456789, MethodID: 1, Amount: 1000 + suffix, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()})
+	}
+	if _, err := uniqueAmount(repo.DB(), 1000); err == nil {
+		t.Error("expected error when no unique amount is left")
+	}
+
+	for _, tt := range tests {
+		got, err := uniqueAmount(repo.DB(), tt.base)
+		if err != nil {
+			t.Fatalf("uniqueAmount(%d) failed: %v", tt.base, err)
+		}
+		if got != tt.want {
+			t.Errorf("uniqueAmount(%d) = %d, want %d", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestUniquePaymentSurcharge(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	userID := int64(123456789)
+
+	// Одинаковую сумму двум ожидающим ручным заказам не дает индекс
+	first := db.Payment{UserID: userID, MethodID: 1, Amount: 640, Currency: CurrencyRUB, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	if err := repo.DB().Create(&first).Error; err != nil {
+		t.Fatalf("create first payment: %v", err)
+	}
+	dup := db.Payment{UserID: userID, MethodID: 1, Amount: 640, Currency: CurrencyRUB, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	if err := repo.DB().Create(&dup).Error; err == nil || !isUniqueViolation(err) {
+		t.Fatalf("expected unique violation for duplicate pending amount, got %v", err)
+	}
+
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "surcharge-peer", PrivKeyEnc: "key", PublicKey: "pub-surcharge",
+		Interface: "wg0", AllowedIP: "10.0.0.7", Platform: "android", StartDate: time.Now().AddDate(0, 0, -20),
+		EndDate: time.Now().AddDate(0, 0, 10), Active: true}
+	repo.DB().Create(&sub)
+
+	payment := &db.Payment{UserID: userID, MethodID: 1, Currency: CurrencyRUB, PlanID: 2, Qty: 1, Status: PaymentStatusPending.String(),
+		ChangeSubID: &sub.ID, ProrationCredit: 66}
+	tx := repo.DB().Begin()
+	if err := createUniquePayment(tx, payment, 640); err != nil {
+		t.Fatalf("createUniquePayment: %v", err)
+	}
+	tx.Commit()
+	if payment.Amount != 641 || payment.Surcharge != 1 {
+		t.Fatalf("amount = %d, surcharge = %d, want 641 and 1", payment.Amount, payment.Surcharge)
+	}
+
+	if err := service.approvePayment(payment.ID, userID); err != nil {
+		t.Fatalf("approvePayment: %v", err)
+	}
+	// Повторное одобрение (второй кассир, вебхук) не зачисляет надбавку снова
+	if err := service.approvePayment(payment.ID, 987654321); err == nil {
+		t.Error("second approval must fail")
+	}
+	if balance, _ := userBalance(repo.DB(), userID); balance != 1 {
+		t.Errorf("balance after approval = %d, want surcharge 1", balance)
+	}
+	totals, err := revenueByCurrency(repo.DB())
+	if err != nil || len(totals) != 1 || totals[0].Total != 640 {
+		t.Errorf("revenue = %+v, %v, want 640 without surcharge", totals, err)
+	}
+}
+
+func TestPaymentStatusConstraint(t *testing.T) {
+	_, repo := setupTestService(t)
+
+	// Повторная миграция не должна оставлять старый список статусов
+	if err := repo.AutoMigrate(); err != nil {
+		t.Fatalf("repeated migration failed: %v", err)
+	}
+
+	for _, status := range []PaymentStatus{PaymentStatusExpired, PaymentStatusCanceled, PaymentStatusRefunding, PaymentStatusRefunded} {
+		payment := db.Payment{UserID: 123456789, MethodID: 1, Amount: 100, PlanID: 1, Qty: 1, Status: status.String()}
+		if err := repo.DB().Create(&payment).Error; err != nil {
+			t.Errorf("status %s rejected: %v", status, err)
+		}
+	}
+
+	bogus := db.Payment{UserID: 123456789, MethodID: 1, Amount: 100, PlanID: 1, Qty: 1, Status: "bogus"}
+	if err := repo.DB().Create(&bogus).Error; err == nil {
+		t.Error("expected unknown status to be rejected")
+	}
+}
+
+func TestChooseReceiptOrder(t *testing.T) {
+	service, _ := setupTestService(t)
+	defer delete(buyStates, 123456789)
+
+	pending := []db.Payment{{ID: 7}, {ID: 5}}
+
+	tests := []struct {
+		name    string
+		caption string
+		state   *BuyState
+		list    []db.Payment
+		want    uint
+	}{
+		{"caption order", "Оплата заказа #5", nil, pending, 5},
+		{"current purchase", "", &BuyState{PaymentID: 7, Step: BuyStepReceipt}, pending, 7},
+		{"foreign order in caption", "#99", nil, pending, 0},
+		{"single pending", "", nil, pending[:1], 7},
+		{"ambiguous", "", nil, pending, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delete(buyStates, 123456789)
+			if tt.state != nil {
+				buyStates[123456789] = tt.state
+			}
+
+			msg := &tgbotapi.Message{From: &tgbotapi.User{ID: 123456789}, Caption: tt.caption}
+			got := service.chooseReceiptOrder(msg, tt.list)
+
+			var gotID uint
+			if got != nil {
+				gotID = got.ID
+			}
+			if gotID != tt.want {
+				t.Errorf("chooseReceiptOrder() = %d, want %d", gotID, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssueOnReceipt(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	const known, newcomer = int64(111), int64(222)
+	repo.DB().Create(&db.Payment{UserID: known, MethodID: 1, Amount: 100, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()})
+
+	tests := []struct {
+		policy string
+		userID int64
+		want   bool
+	}{
+		{"approve_first", known, false},
+		{"trust_on_receipt", newcomer, true},
+		{"trust_known", known, true},
+		{"trust_known", newcomer, false},
+		{"typo", known, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			service.cfg.ApprovalPolicy = tt.policy
+			if got := service.issueOnReceipt(tt.userID); got != tt.want {
+				t.Errorf("issueOnReceipt(%d) with %s = %v, want %v", tt.userID, tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingHTTPClient отвечает успехом и запоминает вызванные методы Bot API
+type recordingHTTPClient struct {
+	calls []recordedCall
+}
+
+type recordedCall struct {
+	method string
+	params url.Values
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	req.ParseForm()
+	c.calls = append(c.calls, recordedCall{method: path.Base(req.URL.Path), params: req.PostForm})
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"ok":true,"result":{"message_id":%d}}`, len(c.calls)))),
+	}, nil
+}
+
+func (c *recordingHTTPClient) find(method string) []recordedCall {
+	var found []recordedCall
+	for _, call := range c.calls {
+		if call.method == method {
+			found = append(found, call)
+		}
+	}
+	return found
+}
+
+func TestCashierInlineApproval(t *testing.T) {
+	service, repo := setupTestService(t)
+	client := &recordingHTTPClient{}
+	service.bot = &tgbotapi.BotAPI{Client: client}
+	service.bot.SetAPIEndpoint(tgbotapi.APIEndpoint)
+
+	const first, second = int64(501), int64(502)
+	for _, id := range []int64{first, second} {
+		repo.DB().Create(&db.Admin{TgID: id, Role: RoleCashier.String()})
+		repo.DB().Create(&db.User{TgID: id, Username: fmt.Sprintf("cashier%d", id)})
+	}
+
+	userID := int64(123456789)
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "cashier-peer", PrivKeyEnc: "key", PublicKey: "pub-cashier",
+		Interface: "wg0", AllowedIP: "10.0.0.6", Platform: "android", StartDate: time.Now().AddDate(0, 0, -20),
+		EndDate: time.Now().AddDate(0, 0, 10), Active: true}
+	repo.DB().Create(&sub)
+	payment := db.Payment{UserID: userID, MethodID: 1, Amount: 433, Currency: CurrencyRUB, PlanID: 2, Qty: 1,
+		Status: PaymentStatusPending.String(), ReceiptFileID: "receipt-file", ChangeSubID: &sub.ID, ProrationCredit: 66}
+	repo.DB().Create(&payment)
+	repo.DB().Preload("User").Preload("Plan").First(&payment, payment.ID)
+
+	// Копия чека уходит каждому кассиру с кнопками одобрения
+	service.notifyCashiersAboutReceipt(&payment, false)
+	photos := client.find("sendPhoto")
+	if len(photos) != 2 {
+		t.Fatalf("sent %d receipt copies, want 2", len(photos))
+	}
+	for _, call := range photos {
+		if !strings.Contains(call.params.Get("reply_markup"), CallbackPaymentApprove.WithID(payment.ID)) {
+			t.Errorf("receipt copy to %s has no approve button", call.params.Get("chat_id"))
+		}
+	}
+	var notices []db.CashierNotice
+	repo.DB().Where("payment_id = ?", payment.ID).Find(&notices)
+	if len(notices) != 2 {
+		t.Fatalf("saved %d cashier notices, want 2", len(notices))
+	}
+
+	press := func(cashierID int64, messageID int) {
+		service.handlePaymentCallback(&tgbotapi.CallbackQuery{
+			ID:   "cb",
+			From: &tgbotapi.User{ID: cashierID},
+			Data: CallbackPaymentApprove.WithID(payment.ID),
+			Message: &tgbotapi.Message{MessageID: messageID, Chat: &tgbotapi.Chat{ID: cashierID},
+				Photo: []tgbotapi.PhotoSize{{FileID: "receipt-file"}}},
+		})
+	}
+
+	// Первый кассир одобряет - обе копии чека получают итог вместо кнопок
+	client.calls = nil
+	press(first, notices[0].MessageID)
+	var got db.Payment
+	repo.DB().First(&got, payment.ID)
+	if got.Status != PaymentStatusApproved.String() || got.ApprovedBy == nil || *got.ApprovedBy != first {
+		t.Fatalf("payment after inline approval: status=%s approved_by=%v", got.Status, got.ApprovedBy)
+	}
+	synced := make(map[string]bool)
+	for _, call := range client.find("editMessageCaption") {
+		if strings.Contains(call.params.Get("caption"), "✅ Одобрен: @cashier501") {
+			synced[call.params.Get("chat_id")+"/"+call.params.Get("message_id")] = true
+		}
+	}
+	for _, notice := range notices {
+		if !synced[fmt.Sprintf("%d/%d", notice.ChatID, notice.MessageID)] {
+			t.Errorf("cashier notice %d/%d not synced", notice.ChatID, notice.MessageID)
+		}
+	}
+
+	// Второй кассир нажимает на устаревшую копию - повторного одобрения нет
+	client.calls = nil
+	press(second, notices[1].MessageID)
+	got = db.Payment{}
+	repo.DB().First(&got, payment.ID)
+	if *got.ApprovedBy != first {
+		t.Errorf("approved_by changed to %d", *got.ApprovedBy)
+	}
+	if len(client.find("editMessageCaption")) != 0 {
+		t.Error("stale approval must not touch cashier notices")
+	}
+}
+
+func TestRenderRejectMessage(t *testing.T) {
+	_, repo := setupTestService(t)
+
+	var reasons []db.RejectReason
+	repo.DB().Order("id ASC").Find(&reasons)
+	if len(reasons) == 0 {
+		t.Fatal("expected default reject reasons to be seeded")
+	}
+
+	payment := &db.Payment{ID: 42, Amount: 301}
+	got := renderRejectMessage(&reasons[0], payment)
+	if !strings.Contains(got, "#42") || !strings.Contains(got, "301 руб.") {
+		t.Errorf("template placeholders not replaced: %q", got)
+	}
+
+	custom := renderRejectMessage(&db.RejectReason{Title: "чек от другого заказа", Template: customRejectTemplate}, payment)
+	if !strings.Contains(custom, "Причина: чек от другого заказа") {
+		t.Errorf("custom reason not rendered: %q", custom)
+	}
+
+	var locked int64
+	repo.DB().Model(&db.RejectReason{}).Where("allow_resubmit = false").Count(&locked)
+	if locked != 1 {
+		t.Errorf("expected only duplicate reason to forbid resubmit, got %d", locked)
+	}
+}
+
+func TestPaymentResubmitFlag(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	service.bot.SetAPIEndpoint(tgbotapi.APIEndpoint)
+	userID := int64(987654321)
+	defer delete(buyStates, userID)
+
+	var duplicate db.RejectReason
+	repo.DB().Where("allow_resubmit = false").First(&duplicate)
+
+	resubmit := func(paymentID uint) string {
+		service.handlePaymentResubmit(&tgbotapi.CallbackQuery{
+			ID:      "cb",
+			From:    &tgbotapi.User{ID: userID},
+			Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: userID}},
+			Data:    CallbackPaymentResubmit.WithID(paymentID),
+		})
+		var payment db.Payment
+		repo.DB().First(&payment, paymentID)
+		return payment.Status
+	}
+
+	// Переименование причины не открывает повторную отправку
+	locked := db.Payment{UserID: userID, MethodID: 1, Amount: 310, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	repo.DB().Create(&locked)
+	if err := service.rejectPayment(locked.ID, 123456789, &duplicate); err != nil {
+		t.Fatalf("rejectPayment: %v", err)
+	}
+	repo.DB().Model(&duplicate).Update("title", "Чек уже использован")
+	if status := resubmit(locked.ID); status != PaymentStatusRejected.String() {
+		t.Errorf("locked payment reopened: status = %s", status)
+	}
+
+	// Своя причина с тем же названием повторную отправку не запрещает
+	custom := db.Payment{UserID: userID, MethodID: 1, Amount: 320, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	repo.DB().Create(&custom)
+	reason := &db.RejectReason{Title: "Чек уже использован", Template: customRejectTemplate, AllowResubmit: true}
+	if err := service.rejectPayment(custom.ID, 123456789, reason); err != nil {
+		t.Fatalf("rejectPayment: %v", err)
+	}
+	if status := resubmit(custom.ID); status != PaymentStatusPending.String() {
+		t.Errorf("custom reason must allow resubmit: status = %s", status)
+	}
+}
+
+func TestFindReceiptDuplicate(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	base := uint64(0xF0F0F0F0F0F0F0F0)
+	original := db.Payment{UserID: 123456789, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1,
+		Status: PaymentStatusApproved.String(), ReceiptUniqueID: "uniq-1", ReceiptHash: imagehash.Format(base)}
+	repo.DB().Create(&original)
+	current := db.Payment{UserID: 987654321, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	repo.DB().Create(&current)
+
+	tests := []struct {
+		name     string
+		uniqueID string
+		hash     string
+		want     uint
+	}{
+		{"same file", "uniq-1", "", original.ID},
+		{"similar image", "uniq-2", imagehash.Format(base ^ 0b111), original.ID},
+		{"different image", "uniq-2", imagehash.Format(^base), 0},
+		{"no data", "", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.findReceiptDuplicate(current.ID, tt.uniqueID, tt.hash)
+			if err != nil {
+				t.Fatalf("findReceiptDuplicate failed: %v", err)
+			}
+			var gotID uint
+			if got != nil {
+				gotID = got.ID
+			}
+			if gotID != tt.want {
+				t.Errorf("findReceiptDuplicate() = %d, want %d", gotID, tt.want)
+			}
+		})
+	}
+
+	// Собственный чек заказа дубликатом не считается
+	if got, _ := service.findReceiptDuplicate(original.ID, "uniq-1", original.ReceiptHash); got != nil {
+		t.Errorf("payment matched itself: #%d", got.ID)
+	}
+}
+
+func TestPartialRefundAmount(t *testing.T) {
+	now := time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 30)
+
+	tests := []struct {
+		name string
+		subs []db.Subscription
+		want int
+	}{
+		{"no keys", nil, 300},
+		{"third used", []db.Subscription{{StartDate: start, EndDate: end, Active: true}}, 200},
+		{"expired", []db.Subscription{{StartDate: start.AddDate(0, -2, 0), EndDate: start, Active: true}}, 0},
+		{"one of two disabled", []db.Subscription{
+			{StartDate: start, EndDate: end, Active: true},
+			{StartDate: start, EndDate: end, Active: false},
+		}, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partialRefundAmount(300, tt.subs, now); got != tt.want {
+				t.Errorf("partialRefundAmount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundPaymentValidation(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	pending := db.Payment{UserID: 123456789, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()}
+	repo.DB().Create(&pending)
+	if err := service.refundPayment(pending.ID, 123456789, 300, "test", false); err == nil {
+		t.Error("expected refund of pending payment to fail")
+	}
+
+	approved := db.Payment{UserID: 123456789, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()}
+	repo.DB().Create(&approved)
+	if err := service.refundPayment(approved.ID, 123456789, 301, "test", false); err == nil {
+		t.Error("expected refund above paid amount to fail")
+	}
+
+	stars := db.Payment{UserID: 123456789, Amount: 150, Currency: CurrencyStars, PlanID: 1, Qty: 1,
+		Status: PaymentStatusApproved.String(), Provider: PaymentProviderStars, InvoiceID: "stars-1", ProviderChargeID: "charge"}
+	repo.DB().Create(&stars)
+	if err := (&starsPayments{s: service}).Refund("stars-1", 100); err == nil {
+		t.Error("expected partial stars refund to fail")
+	}
+
+	var check db.Payment
+	repo.DB().First(&check, approved.ID)
+	if check.Status != PaymentStatusApproved.String() {
+		t.Errorf("failed refund changed status to %s", check.Status)
+	}
+}
+
+func TestRefundClaimsPayment(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	provider := &stubProvider{}
+	service.providers = payments.NewRegistry()
+	service.providers.Register(provider)
+
+	payment := db.Payment{UserID: 123456789, Amount: 200, Currency: CurrencyRUB, PlanID: 1, Qty: 1,
+		Status: PaymentStatusApproved.String(), Provider: "acquiring", InvoiceID: "pay_refund"}
+	repo.DB().Create(&payment)
+	status := func() string {
+		var got db.Payment
+		repo.DB().First(&got, payment.ID)
+		return got.Status
+	}
+
+	// Провайдер отказал - платеж снова можно вернуть
+	provider.refundErr = errors.New("provider down")
+	if err := service.refundPayment(payment.ID, 123456789, 200, "test", false); err == nil {
+		t.Fatal("expected provider failure")
+	}
+	if got := status(); got != PaymentStatusApproved.String() {
+		t.Fatalf("status after failed provider refund = %s, want approved", got)
+	}
+
+	// Пока возврат занят другим админом, провайдер повторно не вызывается
+	provider.refundErr = nil
+	repo.DB().Model(&payment).Update("status", PaymentStatusRefunding.String())
+	if err := service.refundPayment(payment.ID, 987654321, 200, "test", false); err == nil {
+		t.Error("expected claimed payment to be rejected")
+	}
+	repo.DB().Model(&payment).Update("status", PaymentStatusApproved.String())
+
+	for i := 0; i < 2; i++ {
+		service.refundPayment(payment.ID, 123456789, 200, "test", false)
+	}
+	if len(provider.refunds) != 1 {
+		t.Errorf("provider refunds = %v, want exactly one", provider.refunds)
+	}
+	if got := status(); got != PaymentStatusRefunded.String() {
+		t.Errorf("status = %s, want refunded", got)
+	}
+}
+
+func TestRefundRenewal(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	userID := int64(123456789)
+
+	end := time.Now().AddDate(0, 0, 33).Truncate(time.Second)
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "renew-peer", PrivKeyEnc: "key", PublicKey: "pub-renew",
+		Interface: "wg0", AllowedIP: "10.0.0.7", Platform: "android", StartDate: time.Now().AddDate(0, 0, -27),
+		EndDate: end, Active: true, AutoRenew: true}
+	repo.DB().Create(&sub)
+	payment := db.Payment{UserID: userID, Amount: 200, Currency: CurrencyRUB, PlanID: 1, Qty: 1,
+		Status: PaymentStatusApproved.String(), Provider: PaymentProviderBalance, RenewSubID: &sub.ID}
+	repo.DB().Create(&payment)
+
+	if err := service.refundPayment(payment.ID, userID, 200, "test", true); err != nil {
+		t.Fatalf("refundPayment failed: %v", err)
+	}
+
+	var got db.Subscription
+	repo.DB().First(&got, sub.ID)
+	if !got.Active {
+		t.Error("renewal refund disabled the key")
+	}
+	if want := end.AddDate(0, 0, -30); !got.EndDate.Equal(want) {
+		t.Errorf("end date = %v, want %v", got.EndDate, want)
+	}
+	if balance, _ := userBalance(repo.DB(), userID); balance != 200 {
+		t.Errorf("balance after refund = %d, want 200", balance)
+	}
+}
+
+func TestWalletLedger(t *testing.T) {
+	_, repo := setupTestService(t)
+	userID := int64(123456789)
+
+	if err := appendLedger(repo.DB(), &db.LedgerEntry{UserID: userID, Amount: 500, Kind: LedgerTopUp.String()}); err != nil {
+		t.Fatalf("top-up failed: %v", err)
+	}
+	if err := appendLedger(repo.DB(), &db.LedgerEntry{UserID: userID, Amount: -600, Kind: LedgerAdjustment.String()}); !errors.Is(err, db.ErrInsufficientBalance) {
+		t.Errorf("expected insufficient balance, got %v", err)
+	}
+	if err := repo.DB().Create(&db.LedgerEntry{UserID: userID, Amount: 1, Kind: "gift"}).Error; err == nil {
+		t.Error("expected unknown ledger kind to violate constraint")
+	}
+
+	balance, err := userBalance(repo.DB(), userID)
+	if err != nil || balance != 500 {
+		t.Fatalf("userBalance() = %d, %v; want 500", balance, err)
+	}
+}
+
+func TestTopUpPermission(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	service.bot.SetAPIEndpoint(tgbotapi.APIEndpoint)
+
+	const support, cashier = int64(601), int64(602)
+	repo.DB().Create(&db.Admin{TgID: support, Role: RoleSupport.String()})
+	repo.DB().Create(&db.Admin{TgID: cashier, Role: RoleCashier.String()})
+
+	topUp := func(adminID int64) {
+		service.handleTopUp(&tgbotapi.Message{
+			From:     &tgbotapi.User{ID: adminID},
+			Chat:     &tgbotapi.Chat{ID: adminID},
+			Text:     "/topup testuser 300",
+			Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 6}},
+		})
+	}
+
+	topUp(support)
+	if balance, _ := userBalance(repo.DB(), 123456789); balance != 0 {
+		t.Fatalf("support topped up balance to %d", balance)
+	}
+
+	topUp(cashier)
+	if balance, _ := userBalance(repo.DB(), 123456789); balance != 300 {
+		t.Errorf("balance after cashier top-up = %d, want 300", balance)
+	}
+}
+
+func TestPayFromBalance(t *testing.T) {
+	service, repo := setupTestService(t)
+	userID := int64(123456789)
+
+	state := &BuyState{UserID: userID, PlanID: 1, Qty: 2}
+	if _, err := service.payFromBalance(state); !errors.Is(err, db.ErrInsufficientBalance) {
+		t.Fatalf("expected insufficient balance, got %v", err)
+	}
+
+	var orphan int64
+	repo.DB().Model(&db.Payment{}).Where("provider = ?", PaymentProviderBalance).Count(&orphan)
+	if orphan != 0 {
+		t.Errorf("failed purchase left %d payments", orphan)
+	}
+
+	appendLedger(repo.DB(), &db.LedgerEntry{UserID: userID, Amount: 450, Kind: LedgerTopUp.String()})
+	paymentID, err := service.payFromBalance(state)
+	if err != nil {
+		t.Fatalf("payFromBalance failed: %v", err)
+	}
+
+	var payment db.Payment
+	repo.DB().First(&payment, paymentID)
+	if payment.Amount != 400 || payment.Provider != PaymentProviderBalance {
+		t.Errorf("unexpected payment: amount %d, provider %q", payment.Amount, payment.Provider)
+	}
+
+	if balance, _ := userBalance(repo.DB(), userID); balance != 50 {
+		t.Errorf("balance after purchase = %d, want 50", balance)
+	}
+}
+
+func TestRenderMyKeysAutoRenew(t *testing.T) {
+	end := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	subs := []db.Subscription{
+		{ID: 1, PeerID: "peer-1", Platform: "android", EndDate: end, Active: true, AutoRenew: true, Plan: db.Plan{Name: "Месяц"}},
+		{ID: 2, PeerID: "peer-2", Platform: "ios", EndDate: end, Active: true, Plan: db.Plan{Name: "Месяц"}},
+		{ID: 3, PeerID: "peer-3", Platform: "linux", EndDate: end, Active: true, Plan: db.Plan{Name: "Пробный", IsTrial: true}},
+	}
+
+	text, keyboard := renderMyKeys(subs)
+	if strings.Count(text, "Автопродление с баланса") != 1 {
+		t.Errorf("expected one auto-renew mark in text: %q", text)
+	}
+
+	tests := []struct {
+		row   int
+		label string
+	}{
+		{0, "⏹ Выкл. автопродление"},
+		{1, "🔁 Вкл. автопродление"},
+		{2, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for _, btn := range keyboard[tt.row] {
+			if strings.HasPrefix(*btn.CallbackData, CallbackAutoRenew.String()) {
+				got = btn.Text
+				if *btn.CallbackData != CallbackAutoRenew.WithID(subs[tt.row].ID) {
+					t.Errorf("row %d: unexpected callback %q", tt.row, *btn.CallbackData)
+				}
+			}
+		}
+		if got != tt.label {
+			t.Errorf("row %d: toggle = %q, want %q", tt.row, got, tt.label)
+		}
+	}
+}
+
+// stubHTTPClient отвечает успехом на любой запрос к Bot API
+type stubHTTPClient struct {
+	requests int
+}
+
+func (c *stubHTTPClient) Do(*http.Request) (*http.Response, error) {
+	c.requests++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"ok":true,"result":{"message_id":1}}`)),
+	}, nil
+}
+
+func TestReferralReward(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+	service.cfg.ReferralBonusDays = 7
+	service.cfg.ReferralBonusAmount = 50
+	service.cfg.ReferralInviteeDiscount = 10
+
+	inviter, invitee := int64(111), int64(222)
+	repo.DB().Create(&db.User{TgID: inviter, Username: "inviter"})
+	repo.DB().Create(&db.User{TgID: invitee, Username: "invitee"})
+	repo.DB().Create(&db.Referral{InviterID: inviter, InviteeID: invitee})
+
+	end := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	sub := db.Subscription{UserID: inviter, PlanID: 1, PeerID: "inviter-peer", PrivKeyEnc: "k", PublicKey: "p",
+		Interface: "wg0", AllowedIP: "10.0.0.2/32", Platform: "android", StartDate: end.AddDate(0, -1, 0), EndDate: end, Active: true}
+	repo.DB().Create(&sub)
+
+	var plan db.Plan
+	repo.DB().First(&plan, 1)
+	if got := service.orderPrice(invitee, &plan, 1); got != 180 {
+		t.Errorf("first order price = %d, want 180", got)
+	}
+	if got := service.orderPrice(inviter, &plan, 1); got != 200 {
+		t.Errorf("price without referral = %d, want 200", got)
+	}
+
+	payment := db.Payment{UserID: invitee, MethodID: 1, Amount: 180, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()}
+	repo.DB().Create(&payment)
+
+	// Повторный вызов не должен начислять награду дважды
+	service.rewardReferral(&payment)
+	service.rewardReferral(&payment)
+
+	var referral db.Referral
+	repo.DB().First(&referral, "invitee_id = ?", invitee)
+	if referral.RewardStatus != ReferralRewardGranted || referral.BonusDays != 7 || referral.BonusAmount != 50 {
+		t.Errorf("unexpected referral reward: %+v", referral)
+	}
+
+	if balance, _ := userBalance(repo.DB(), inviter); balance != 50 {
+		t.Errorf("inviter balance = %d, want 50", balance)
+	}
+
+	repo.DB().First(&sub, sub.ID)
+	if want := end.AddDate(0, 0, 7); !sub.EndDate.Equal(want) {
+		t.Errorf("inviter subscription ends %s, want %s", sub.EndDate, want)
+	}
+
+	if got := service.orderPrice(invitee, &plan, 1); got != 200 {
+		t.Errorf("second order price = %d, want 200", got)
+	}
+}
+
+func TestReferralFraudChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		invitee int64
+		amount  int
+		setup   func(repo *db.Repository)
+		want    string
+	}{
+		{name: "clean referral", invitee: 222, amount: 200, want: ReferralRewardGranted},
+		{name: "below minimum payment", invitee: 222, amount: 50, want: ReferralRewardPending},
+		{name: "new telegram account", invitee: 7100000000, amount: 200, want: ReferralRewardReview},
+		{
+			name: "same phone", invitee: 222, amount: 200, want: ReferralRewardReview,
+			setup: func(repo *db.Repository) {
+				repo.DB().Model(&db.User{}).Where("tg_id IN ?", []int64{111, 222}).Update("phone", "+79990000000")
+			},
+		},
+		{
+			name: "circular referral", invitee: 222, amount: 200, want: ReferralRewardReview,
+			setup: func(repo *db.Repository) {
+				repo.DB().Create(&db.User{TgID: 333, Username: "middle"})
+				repo.DB().Create(&db.Referral{InviterID: 222, InviteeID: 333, CreatedAt: time.Now().Add(-time.Hour)})
+				repo.DB().Create(&db.Referral{InviterID: 333, InviteeID: 111, CreatedAt: time.Now().Add(-time.Hour)})
+			},
+		},
+		{
+			name: "daily cap reached", invitee: 222, amount: 200, want: ReferralRewardReview,
+			setup: func(repo *db.Repository) {
+				now := time.Now()
+				for i := int64(0); i < 2; i++ {
+					repo.DB().Create(&db.Referral{InviterID: 111, InviteeID: 500 + i, RewardStatus: ReferralRewardGranted, RewardedAt: &now})
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, repo := setupTestService(t)
+			service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+			service.cfg.ReferralBonusAmount = 50
+			service.cfg.ReferralMinPayment = 100
+			service.cfg.ReferralDailyCap = 2
+			service.cfg.ReferralNewAccountID = 7000000000
+
+			repo.DB().Create(&db.User{TgID: 111, Username: "inviter"})
+			repo.DB().Create(&db.User{TgID: tt.invitee, Username: "invitee"})
+			if tt.setup != nil {
+				tt.setup(repo)
+			}
+			referral := db.Referral{InviterID: 111, InviteeID: tt.invitee, CreatedAt: time.Now().Add(-time.Minute)}
+			repo.DB().Create(&referral)
+
+			payment := db.Payment{UserID: tt.invitee, MethodID: 1, Amount: tt.amount, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()}
+			repo.DB().Create(&payment)
+			service.rewardReferral(&payment)
+
+			repo.DB().First(&referral, referral.ID)
+			if referral.RewardStatus != tt.want {
+				t.Fatalf("reward status = %q (%s), want %q", referral.RewardStatus, referral.FraudReason, tt.want)
+			}
+			if tt.want != ReferralRewardReview {
+				return
+			}
+
+			// Админ одобряет подозрительное приглашение вручную
+			if err := service.grantReferralReward(&referral, *referral.RewardPaymentID, ReferralRewardReview); err != nil {
+				t.Fatalf("grant after review: %v", err)
+			}
+			repo.DB().First(&referral, referral.ID)
+			if referral.RewardStatus != ReferralRewardGranted {
+				t.Errorf("reward status after review = %q, want %q", referral.RewardStatus, ReferralRewardGranted)
+			}
+			if balance, _ := userBalance(repo.DB(), 111); balance < 50 {
+				t.Errorf("inviter balance = %d, want at least 50", balance)
+			}
+		})
+	}
+}
+
+func TestCheckRefCode(t *testing.T) {
+	service, repo := setupTestService(t)
+	repo.DB().Create(&db.User{TgID: 111, Username: "owner", RefCode: "taken_code"})
+	repo.DB().Create(&db.User{TgID: 222, Username: "other"})
+
+	tests := []struct {
+		name          string
+		code          string
+		userID        int64
+		allowReserved bool
+		wantOK        bool
+	}{
+		{name: "valid", code: "ivan_travel", userID: 222, wantOK: true},
+		{name: "too short", code: "abc", userID: 222},
+		{name: "uppercase", code: "Ivan", userID: 222},
+		{name: "cyrillic", code: "иван", userID: 222},
+		{name: "profanity", code: "super_pizdato", userID: 222},
+		{name: "profanity with digits", code: "hu1_vpn", userID: 222},
+		{name: "reserved for users", code: "lime_partner", userID: 222},
+		{name: "reserved allowed for admins", code: "lime_partner", userID: 222, allowReserved: true, wantOK: true},
+		{name: "taken by other user", code: "taken_code", userID: 222},
+		{name: "own code", code: "taken_code", userID: 111, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := service.checkRefCode(tt.code, tt.userID, tt.allowReserved)
+			if (reason == "") != tt.wantOK {
+				t.Errorf("checkRefCode(%q) = %q, want ok=%v", tt.code, reason, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCampaignStats(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	repo.DB().Create(&db.User{TgID: 111, Username: "first"})
+	repo.DB().Create(&db.User{TgID: 222, Username: "second"})
+	repo.DB().Create(&db.User{TgID: 333, Username: "organic"})
+	service.recordCampaign(111, "Blogger_Anna")
+	service.recordCampaign(222, "blogger_anna")
+	service.recordCampaign(333, "bad campaign!")
+	// Источник не перезаписывается повторной ссылкой
+	service.recordCampaign(111, "tg_channel")
+
+	repo.DB().Create(&db.Payment{UserID: 111, MethodID: 1, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()})
+	repo.DB().Create(&db.Payment{UserID: 111, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()})
+	repo.DB().Create(&db.Payment{UserID: 222, MethodID: 1, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusRejected.String()})
+
+	stats, err := service.campaignStats()
+	if err != nil {
+		t.Fatalf("campaignStats: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d campaigns, want 1: %+v", len(stats), stats)
+	}
+	want := campaignStat{Name: "blogger_anna", Users: 2, Paying: 1, Revenue: 500}
+	if stats[0] != want {
+		t.Errorf("campaign stats = %+v, want %+v", stats[0], want)
+	}
+}
+
+func TestPartnerWholesale(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+
+	partnerID := int64(555)
+	repo.DB().Create(&db.User{TgID: partnerID, Username: "reseller"})
+	if err := repo.DB().Create(&db.Admin{TgID: partnerID, Role: RolePartner.String()}).Error; err != nil {
+		t.Fatalf("partner role rejected by constraint: %v", err)
+	}
+	repo.DB().Create(&db.PartnerPrice{PartnerID: partnerID, PlanID: 1, PriceInt: 120})
+
+	if !service.isPartner(partnerID) || service.isAdmin(partnerID) {
+		t.Fatalf("partner must not get admin rights: isPartner=%v isAdmin=%v", service.isPartner(partnerID), service.isAdmin(partnerID))
+	}
+
+	var plan db.Plan
+	repo.DB().First(&plan, 1)
+	if got := service.orderPrice(partnerID, &plan, 10); got != 1200 {
+		t.Errorf("partner order price = %d, want 1200", got)
+	}
+
+	payment := db.Payment{UserID: partnerID, MethodID: 1, Amount: 1200, PlanID: 1, Qty: 10, Status: PaymentStatusApproved.String(), Wholesale: true}
+	repo.DB().Create(&payment)
+	if err := issuePartnerKeys(repo.DB(), &payment); err != nil {
+		t.Fatalf("issuePartnerKeys: %v", err)
+	}
+
+	// Ключ, активированный клиентом: подписка ссылается на заказ партнера,
+	// как в claimPartnerKey
+	customer := int64(777)
+	now := time.Now()
+	claim := func(paymentID uint) db.Subscription {
+		var key db.PartnerKey
+		repo.DB().Where("payment_id = ? AND claimed_by IS NULL", paymentID).First(&key)
+		sub := db.Subscription{UserID: customer, PlanID: 1, PaymentID: &paymentID, PeerID: "claimed-" + key.Code,
+			PrivKeyEnc: "PLACEHOLDER_PRIVATE_KEY", PublicKey: "PLACEHOLDER_PUBLIC_KEY", Interface: "wg0",
+			AllowedIP: "10.0.0.1", Platform: "generic", StartDate: now, EndDate: now.AddDate(0, 0, 30), Active: true}
+		repo.DB().Create(&sub)
+		repo.DB().Model(&key).Updates(map[string]interface{}{"claimed_by": customer, "claimed_at": now, "subscription_id": sub.ID})
+		return sub
+	}
+	assertActive := func(sub db.Subscription) {
+		t.Helper()
+		var got db.Subscription
+		if err := repo.DB().First(&got, sub.ID).Error; err != nil || !got.Active {
+			t.Errorf("claimed subscription #%d must stay active after refund: active=%v err=%v", sub.ID, got.Active, err)
+		}
+	}
+	claimedSub := claim(payment.ID)
+
+	statement, err := db.BuildPartnerStatement(repo.DB(), partnerID, now)
+	if err != nil {
+		t.Fatalf("BuildPartnerStatement: %v", err)
+	}
+	if len(statement.Orders) != 1 || statement.KeysBought != 10 || statement.Spent != 1200 || statement.Claimed != 1 || statement.Free != 9 {
+		t.Errorf("unexpected statement: orders=%d keys=%d spent=%d claimed=%d free=%d",
+			len(statement.Orders), statement.KeysBought, statement.Spent, statement.Claimed, statement.Free)
+	}
+
+	if err := service.refundPayment(payment.ID, 123456789, 1080, "опт не продан", false); err != nil {
+		t.Fatalf("refundPayment: %v", err)
+	}
+
+	var revoked, active int64
+	repo.DB().Model(&db.PartnerKey{}).Where("partner_id = ? AND revoked = true", partnerID).Count(&revoked)
+	repo.DB().Model(&db.PartnerKey{}).Where("partner_id = ? AND revoked = false", partnerID).Count(&active)
+	if revoked != 9 || active != 1 {
+		t.Errorf("after refund revoked=%d active=%d, want 9 and 1", revoked, active)
+	}
+	assertActive(claimedSub)
+
+	// Частичный возврат отзывает только оплаченное возвратом число ключей
+	partial := db.Payment{UserID: partnerID, MethodID: 1, Amount: 1200, PlanID: 1, Qty: 10, Status: PaymentStatusApproved.String(), Wholesale: true}
+	repo.DB().Create(&partial)
+	issuePartnerKeys(repo.DB(), &partial)
+	partialSub := claim(partial.ID)
+	if err := service.refundPayment(partial.ID, 123456789, 200, "два ключа", false); err != nil {
+		t.Fatalf("partial refundPayment: %v", err)
+	}
+	repo.DB().Model(&db.PartnerKey{}).Where("payment_id = ? AND revoked = true", partial.ID).Count(&revoked)
+	if revoked != 2 {
+		t.Errorf("partial refund revoked %d keys, want 2", revoked)
+	}
+	assertActive(partialSub)
+}
+
+func TestFamilySeats(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	plan := db.Plan{Name: "Семья", PriceInt: 500, DurationDays: 30, Seats: 3}
+	repo.DB().Create(&plan)
+
+	end := time.Now().AddDate(0, 0, 10)
+	owner := db.Subscription{UserID: 100, PlanID: plan.ID, PeerID: "owner", PrivKeyEnc: "key", PublicKey: "pub-owner",
+		Interface: "wg0", AllowedIP: "10.0.0.2", Platform: "generic", StartDate: time.Now(), EndDate: end, Active: true}
+	repo.DB().Create(&owner)
+	owner.Plan = plan
+
+	// Места с заглушками: при удалении не нужно обращаться к wg-agent
+	for userID, peerID := range map[int64]string{101: "seat-1", 102: "seat-2"} {
+		member := db.Subscription{UserID: userID, PlanID: plan.ID, PeerID: peerID, PrivKeyEnc: "PLACEHOLDER_PRIVATE_KEY",
+			PublicKey: "PLACEHOLDER_PUBLIC_KEY", Interface: "wg0", AllowedIP: "10.0.0.1", Platform: "generic",
+			StartDate: time.Now(), EndDate: end, SeatOf: &owner.ID}
+		repo.DB().Create(&member)
+	}
+
+	if free, err := freeSeats(repo.DB(), &owner); err != nil || free != 0 {
+		t.Fatalf("freeSeats = %d, %v; want 0", free, err)
+	}
+
+	members, _ := seatMembers(repo.DB(), owner.ID)
+	if _, err := service.removeSeatMember(999, members[0].ID); err == nil {
+		t.Error("stranger must not remove a seat")
+	}
+	if _, err := service.removeSeatMember(owner.UserID, members[0].ID); err != nil {
+		t.Fatalf("removeSeatMember: %v", err)
+	}
+	if free, _ := freeSeats(repo.DB(), &owner); free != 1 {
+		t.Errorf("freeSeats after removal = %d, want 1", free)
+	}
+
+	newEnd := end.AddDate(0, 0, 30)
+	if err := db.SyncSeatEndDates(repo.DB(), owner.ID, newEnd); err != nil {
+		t.Fatalf("SyncSeatEndDates: %v", err)
+	}
+	var kept, removed db.Subscription
+	repo.DB().First(&kept, members[1].ID)
+	repo.DB().First(&removed, members[0].ID)
+	if !kept.EndDate.Equal(newEnd) {
+		t.Errorf("member end date = %v, want %v", kept.EndDate, newEnd)
+	}
+	if removed.SeatOf != nil || removed.EndDate.Equal(newEnd) {
+		t.Errorf("removed member must leave the family: seat_of=%v end=%v", removed.SeatOf, removed.EndDate)
+	}
+}
+
+func TestPlanChangeProration(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	month := db.Plan{PriceInt: 300, DurationDays: 30}
+	halfYear := db.Plan{PriceInt: 1500, DurationDays: 180}
+
+	tests := []struct {
+		name     string
+		current  db.Plan
+		paid     int
+		used     int
+		left     int
+		target   db.Plan
+		credit   int
+		due      int
+		extraDay int
+	}{
+		{"upgrade mid-term", month, 300, 20, 10, halfYear, 100, 1400, 0},
+		{"expired", month, 300, 30, 0, halfYear, 0, 1500, 0},
+		{"downgrade keeps surplus as days", halfYear, 1500, 30, 150, month, 1250, 0, 95},
+		// Скидка за количество или оптовая цена уменьшают зачет
+		{"discounted key", month, 240, 20, 10, halfYear, 80, 1420, 0},
+		// Бонусные дни растягивают срок, зачет не превышает оплаченного
+		{"bonus days", month, 300, 5, 40, halfYear, 266, 1234, 0},
+		{"free key", month, 0, 20, 10, halfYear, 0, 1500, 0},
+	}
+	for _, tt := range tests {
+		sub := db.Subscription{Plan: tt.current, StartDate: now.AddDate(0, 0, -tt.used), EndDate: now.AddDate(0, 0, tt.left)}
+		credit := prorationCredit(&sub, tt.paid, now)
+		if credit != tt.credit {
+			t.Errorf("%s: credit = %d, want %d", tt.name, credit, tt.credit)
+		}
+		if due := planChangeDue(&tt.target, credit); due != tt.due {
+			t.Errorf("%s: due = %d, want %d", tt.name, due, tt.due)
+		}
+		want := now.AddDate(0, 0, tt.target.DurationDays+tt.extraDay)
+		if end := planChangeEndDate(&tt.target, credit, now); !end.Equal(want) {
+			t.Errorf("%s: end = %v, want %v", tt.name, end, want)
+		}
+	}
+}
+
+func TestKeyPaidAmount(t *testing.T) {
+	_, repo := setupTestService(t)
+
+	// Ключ из заказа на 5 штук со скидкой и надбавкой к сумме
+	payment := db.Payment{UserID: 123456789, MethodID: 1, Amount: 837, Surcharge: 37, Currency: CurrencyRUB, PlanID: 1, Qty: 5,
+		Status: PaymentStatusApproved.String()}
+	repo.DB().Create(&payment)
+	sub := db.Subscription{PaymentID: &payment.ID, Plan: db.Plan{PriceInt: 200}}
+	if paid, err := db.KeyPaidAmount(repo.DB(), &sub); err != nil || paid != 160 {
+		t.Errorf("KeyPaidAmount() = %d, %v; want 160", paid, err)
+	}
+
+	// После смены тарифа или продления сумма записана в подписке
+	sub.PaidAmount = 499
+	if paid, _ := db.KeyPaidAmount(repo.DB(), &sub); paid != 499 {
+		t.Errorf("KeyPaidAmount() = %d, want recorded 499", paid)
+	}
+
+	trial := db.Subscription{Plan: db.Plan{PriceInt: 200}}
+	if paid, _ := db.KeyPaidAmount(repo.DB(), &trial); paid != 0 {
+		t.Errorf("trial key paid = %d, want 0", paid)
+	}
+}
+
+func TestApprovePlanChange(t *testing.T) {
+	service, repo := setupTestService(t)
+	service.bot = &tgbotapi.BotAPI{Client: &stubHTTPClient{}}
+
+	userID := int64(123456789)
+	original := db.Payment{UserID: userID, MethodID: 1, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()}
+	repo.DB().Create(&original)
+	end := time.Now().AddDate(0, 0, 10).Truncate(24 * time.Hour)
+	sub := db.Subscription{UserID: userID, PlanID: 1, PeerID: "upgrade-peer", PrivKeyEnc: "key", PublicKey: "pub-upgrade",
+		Interface: "wg0", AllowedIP: "10.0.0.5", Platform: "android", StartDate: time.Now().AddDate(0, 0, -20),
+		EndDate: end, Active: true, PaymentID: &original.ID}
+	repo.DB().Create(&sub)
+
+	payment := db.Payment{UserID: userID, MethodID: 1, Amount: 433, PlanID: 2, Qty: 1, Status: PaymentStatusPending.String(),
+		ChangeSubID: &sub.ID, ProrationCredit: 66}
+	repo.DB().Create(&payment)
+
+	if err := service.approvePayment(payment.ID, userID); err != nil {
+		t.Fatalf("approvePayment: %v", err)
+	}
+
+	var subs []db.Subscription
+	repo.DB().Where("user_id = ?", userID).Find(&subs)
+	if len(subs) != 1 {
+		t.Fatalf("plan change must keep the key, got %d subscriptions", len(subs))
+	}
+	// Ключ остается привязанным к исходному заказу
+	if subs[0].PlanID != 2 || subs[0].PeerID != "upgrade-peer" || subs[0].PaymentID == nil || *subs[0].PaymentID != original.ID {
+		t.Errorf("unexpected subscription after change: plan=%d peer=%s payment=%v", subs[0].PlanID, subs[0].PeerID, subs[0].PaymentID)
+	}
+	if days := subs[0].EndDate.Sub(time.Now()).Hours() / 24; days < 88 || days > 90 {
+		t.Errorf("end date %v is not 90 days from now", subs[0].EndDate)
+	}
+	if subs[0].PaidAmount != 66+433 {
+		t.Errorf("paid amount after change = %d, want credit plus top-up %d", subs[0].PaidAmount, 66+433)
+	}
+
+	// Возврат доплаты откатывает смену тарифа, ключ не отключается
+	if err := service.refundPayment(payment.ID, userID, 433, "передумал", true); err != nil {
+		t.Fatalf("refundPayment: %v", err)
+	}
+	var got db.Subscription
+	repo.DB().First(&got, sub.ID)
+	if !got.Active || got.PlanID != 1 || !got.EndDate.Equal(end) || got.PaidAmount != 200 {
+		t.Errorf("after refund: active=%v plan=%d end=%v paid=%d, want active plan 1 until %v paid 200",
+			got.Active, got.PlanID, got.EndDate, got.PaidAmount, end)
+	}
+}
+
+func TestVolumeDiscount(t *testing.T) {
+	service, repo := setupTestService(t)
+	repo.DB().Create(&db.PlanDiscount{PlanID: 1, MinQty: 2, Percent: 10})
+	repo.DB().Create(&db.PlanDiscount{PlanID: 1, MinQty: 5, Percent: 20})
+
+	var plan db.Plan
+	repo.DB().First(&plan, 1)
+
+	tests := []struct {
+		qty      int
+		price    int
+		discount int
+	}{
+		{1, 200, 0},
+		{2, 360, 10},
+		{3, 540, 10},
+		{5, 800, 20},
+		{10, 1600, 20},
+	}
+	for _, tt := range tests {
+		if got := service.orderPrice(42, &plan, tt.qty); got != tt.price {
+			t.Errorf("qty %d: price = %d, want %d", tt.qty, got, tt.price)
+		}
+
+		payment := db.Payment{UserID: 42, Qty: tt.qty}
+		service.recordListPrice(&payment, &plan)
+		if payment.ListAmount != plan.PriceInt*tt.qty || payment.VolumeDiscount != tt.discount {
+			t.Errorf("qty %d: list=%d discount=%d, want %d and %d", tt.qty, payment.ListAmount, payment.VolumeDiscount, plan.PriceInt*tt.qty, tt.discount)
+		}
+	}
+
+	if got := volumeDiscountText(service.planDiscounts(1)); got != "от 2 шт. −10%, от 5 шт. −20%" {
+		t.Errorf("unexpected discount text %q", got)
+	}
+}
+
+func TestPlanVersioning(t *testing.T) {
+	service, repo := setupTestService(t)
+	repo.DB().Create(&db.Subscription{UserID: 42, PlanID: 1, PeerID: "peer_v", PrivKeyEnc: "k", PublicKey: "p", AllowedIP: "10.0.0.9/32", StartDate: time.Now(), EndDate: time.Now().AddDate(0, 0, 30), Active: true})
+	repo.DB().Create(&db.PlanDiscount{PlanID: 1, MinQty: 2, Percent: 10})
+
+	plan, err := updatePlanTerms(repo.DB(), 1, func(p *db.Plan) { p.PriceInt = 250 })
+	if err != nil {
+		t.Fatalf("updatePlanTerms: %v", err)
+	}
+	if plan.ID == 1 || plan.Version != 2 || plan.PreviousID == nil || *plan.PreviousID != 1 || plan.PriceInt != 250 {
+		t.Fatalf("expected new version of plan 1, got %+v", plan)
+	}
+
+	// Прежняя версия снята с продажи, но не архивирована: подписки на ней продлеваются
+	var old db.Plan
+	repo.DB().First(&old, 1)
+	if old.Archived || old.OnSale() || old.SupersededBy == nil || *old.SupersededBy != plan.ID || old.PriceInt != 200 {
+		t.Errorf("old version should be superseded with its price, got %+v", old)
+	}
+	if latest, err := db.LatestPlanVersion(repo.DB(), &old); err != nil || latest.ID != plan.ID {
+		t.Errorf("LatestPlanVersion() = %+v, %v; want plan %d", latest, err, plan.ID)
+	}
+	if _, err := updatePlanTerms(repo.DB(), 1, func(p *db.Plan) { p.PriceInt = 300 }); err == nil {
+		t.Error("superseded version must not be edited")
+	}
+	var sub db.Subscription
+	repo.DB().Where("peer_id = ?", "peer_v").First(&sub)
+	if sub.PlanID != 1 {
+		t.Errorf("subscription moved to plan %d", sub.PlanID)
+	}
+	if got := service.volumeDiscount(plan.ID, 2); got != 10 {
+		t.Errorf("discount should move to the new version, got %d", got)
+	}
+
+	// Тариф без покупок правится на месте
+	plan, err = updatePlanTerms(repo.DB(), 2, func(p *db.Plan) { p.Name = "Квартал" })
+	if err != nil || plan.ID != 2 || plan.Version != 1 || plan.Name != "Квартал" {
+		t.Errorf("expected in-place edit of plan 2, got %+v, %v", plan, err)
+	}
+
+	repo.DB().Model(&db.Plan{}).Where("id = ?", 2).Update("visibility", PlanPartnerOnly.String())
+	visible, err := service.visiblePlans(42)
+	if err != nil {
+		t.Fatalf("visiblePlans: %v", err)
+	}
+	if len(visible) != 1 || visible[0].Version != 2 {
+		t.Errorf("expected only the new public version, got %+v", visible)
+	}
+	repo.DB().First(plan, 2)
+	if service.planAvailable(42, plan) {
+		t.Error("partner-only plan should not be available to a regular user")
+	}
+}
+
+func TestMultiCurrency(t *testing.T) {
+	service, repo := setupTestService(t)
+	repo.DB().Create(&db.PlanPrice{PlanID: 1, Currency: CurrencyUSD, Amount: 250})
+	repo.DB().Create(&db.PlanDiscount{PlanID: 1, MinQty: 2, Percent: 10})
+
+	var plan db.Plan
+	repo.DB().First(&plan, 1)
+
+	if got := service.orderPriceIn(42, &plan, 2, CurrencyUSD); got != 450 {
+		t.Errorf("USD price for 2 keys = %d, want 450", got)
+	}
+	if got := service.orderPriceIn(42, &plan, 1, CurrencyEUR); got != 0 {
+		t.Errorf("plan without EUR price should not be sold in EUR, got %d", got)
+	}
+	if got := formatAmount(450, CurrencyUSD); got != "4.50 $" {
+		t.Errorf("formatAmount = %q", got)
+	}
+	if got, want := service.orderPriceText(42, &plan, 2), formatAmount(service.orderPrice(42, &plan, 2), CurrencyRUB)+" / 4.50 $"; got != want {
+		t.Errorf("qty button price = %q, want %q", got, want)
+	}
+	keyboard, err := service.planKeyboard(42)
+	if err != nil || len(keyboard) == 0 {
+		t.Fatalf("planKeyboard: %v", err)
+	}
+	found := false
+	for _, row := range keyboard {
+		if *row[0].CallbackData == CallbackBuyPlan.WithID(plan.ID) {
+			found = strings.Contains(row[0].Text, formatAmount(plan.PriceInt, CurrencyRUB)+" / 2.50 $")
+		}
+	}
+	if !found {
+		t.Errorf("plan button must list RUB and USD prices: %+v", keyboard)
+	}
+
+	for _, tt := range []struct {
+		value    string
+		currency string
+		want     int
+		ok       bool
+	}{
+		{"2.5", CurrencyUSD, 250, true},
+		{"3,99", CurrencyEUR, 399, true},
+		{"10", CurrencyUSDT, 1000, true},
+		{"1.999", CurrencyUSD, 0, false},
+		{"1.5", CurrencyRUB, 0, false},
+	} {
+		got, err := parseAmount(tt.value, tt.currency)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseAmount(%q, %s) = %d, %v", tt.value, tt.currency, got, err)
+		}
+	}
+
+	repo.DB().Create(&db.Payment{UserID: 42, MethodID: 1, Amount: 200, Currency: CurrencyRUB, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()})
+	repo.DB().Create(&db.Payment{UserID: 42, MethodID: 1, Amount: 450, Currency: CurrencyUSD, PlanID: 1, Qty: 2, Status: PaymentStatusApproved.String()})
+	repo.DB().Create(&db.ExchangeRate{Currency: CurrencyUSD, Rate: 90})
+
+	totals, err := revenueByCurrency(repo.DB())
+	if err != nil || len(totals) != 2 || totals[0].Currency != CurrencyRUB || totals[1].Total != 450 {
+		t.Fatalf("unexpected revenue %+v, %v", totals, err)
+	}
+	if text := service.revenueText(totals); !strings.Contains(text, "4.50 $") || !strings.Contains(text, "≈ 605 руб.") {
+		t.Errorf("unexpected revenue text %q", text)
+	}
+}
+
+func TestMethodLimitsAndRotation(t *testing.T) {
+	service, repo := setupTestService(t)
+	now := time.Now()
+	price := func(currency string) int {
+		if currency == CurrencyRUB {
+			return 200
+		}
+		return 0
+	}
+	optionIDs := func() []uint {
+		options, err := service.availableMethods(price, now)
+		if err != nil {
+			t.Fatalf("availableMethods: %v", err)
+		}
+		var ids []uint
+		for _, option := range options {
+			ids = append(ids, option.Method.ID)
+		}
+		return ids
+	}
+
+	repo.DB().Create(&db.Payment{UserID: 42, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()})
+	if ids := optionIDs(); len(ids) != 2 {
+		t.Fatalf("expected both active methods without limits, got %v", ids)
+	}
+
+	service.cfg.MethodRotation = RotationLeastUsed.String()
+	if ids := optionIDs(); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("least_used should pick method 2, got %v", ids)
+	}
+	service.cfg.MethodRotation = RotationRoundRobin.String()
+	if ids := optionIDs(); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("round_robin should pick the method after 1, got %v", ids)
+	}
+	service.cfg.MethodRotation = RotationAll.String()
+
+	repo.DB().Model(&db.PaymentMethod{}).Where("id = ?", 1).Update("daily_limit", 400)
+	if ids := optionIDs(); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("method 1 over its daily limit should be hidden, got %v", ids)
+	}
+	repo.DB().Model(&db.PaymentMethod{}).Where("id = ?", 2).Update("max_pending", 1)
+	repo.DB().Create(&db.Payment{UserID: 43, MethodID: 2, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String()})
+	if ids := optionIDs(); len(ids) != 0 {
+		t.Errorf("methods at their limits should be hidden, got %v", ids)
+	}
+
+	night := &db.PaymentMethod{ActiveFrom: 22, ActiveTo: 6}
+	for hour, want := range map[int]bool{23: true, 3: true, 6: false, 12: false} {
+		at := time.Date(2026, 1, 1, hour, 0, 0, 0, time.Local)
+		if got := methodActiveAt(night, at); got != want {
+			t.Errorf("methodActiveAt(22-6, %d:00) = %v, want %v", hour, got, want)
+		}
+	}
+}
+
+func TestPaymentQRPayload(t *testing.T) {
+	method := &db.PaymentMethod{
+		Bank:        "Сбер|банк",
+		OwnerName:   "Иван И.",
+		Currency:    CurrencyRUB,
+		Account:     "40817810099910004312",
+		BIC:         "044525225",
+		CorrAccount: "30101810400000000225",
+	}
+	payment := &db.Payment{ID: 42, Amount: 517, Currency: CurrencyRUB}
+
+	want := "ST00012|Name=Иван И.|PersonalAcc=40817810099910004312|BankName=Сбер банк|BIC=044525225|" +
+		"CorrespAcc=30101810400000000225|Sum=51700|Purpose=Оплата заказа #42"
+	if got := paymentQRPayload(payment, method); got != want {
+		t.Errorf("unexpected payload:\n%s\n%s", got, want)
+	}
+	if data, err := qrcode.Encode(want, qrcode.Medium, -paymentQRScale); err != nil {
+		t.Errorf("payload does not render: %v", err)
+	} else if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("rendered QR is not a PNG: %v", err)
+	}
+
+	if !paymentQRSupported(method) {
+		t.Error("RUB method with requisites should support QR")
+	}
+	method.Currency = CurrencyUSD
+	if paymentQRSupported(method) {
+		t.Error("non-RUB method should not support QR")
+	}
+	method.Currency, method.BIC = CurrencyRUB, ""
+	if paymentQRSupported(method) {
+		t.Error("method without BIC should not support QR")
+	}
+}
+
+func TestCreatedSince(t *testing.T) {
+	_, repo := setupTestService(t)
+	since := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// Строкой "14:59+03:00" позже "12:00+00:00", а "07:01-05:00" - раньше
+	before := db.Payment{UserID: 1, MethodID: 1, Amount: 100, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String(),
+		CreatedAt: since.Add(-time.Minute).In(time.FixedZone("MSK", 3*3600))}
+	after := db.Payment{UserID: 1, MethodID: 1, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String(),
+		CreatedAt: since.Add(time.Minute).In(time.FixedZone("EST", -5*3600))}
+	legacy := db.Payment{UserID: 1, MethodID: 1, Amount: 300, PlanID: 1, Qty: 1, Status: PaymentStatusApproved.String()}
+	for _, payment := range []*db.Payment{&before, &after, &legacy} {
+		repo.DB().Create(payment)
+	}
+	// Формат CURRENT_TIMESTAMP: UTC без пояса и долей секунды
+	repo.DB().Exec("UPDATE payments SET created_at = '2026-03-10 12:00:30' WHERE id = ?", legacy.ID)
+
+	var got []db.Payment
+	repo.DB().Scopes(db.CreatedSince(since)).Order("id ASC").Find(&got)
+	if len(got) != 2 || got[0].ID != after.ID || got[1].ID != legacy.ID {
+		t.Errorf("CreatedSince returned %+v, want payments #%d and #%d", got, after.ID, legacy.ID)
+	}
+
+	got = nil
+	repo.DB().Scopes(db.CreatedBetween(since.Add(-time.Hour), since.Add(time.Minute))).Order("id ASC").Find(&got)
+	if len(got) != 2 || got[0].ID != before.ID || got[1].ID != legacy.ID {
+		t.Errorf("CreatedBetween returned %d payments, want #%d and #%d", len(got), before.ID, legacy.ID)
+	}
+}
+
+func TestCheckoutSummary(t *testing.T) {
+	service, repo := setupTestService(t)
+
+	var plan db.Plan
+	repo.DB().First(&plan, 1)
+	state := &BuyState{
+		UserID:   42,
+		PlanID:   plan.ID,
+		Platform: PlatformAndroid,
+		Qty:      2,
+		MethodID: 1,
+		Pay:      CallbackBuyMethod.WithID(1),
+	}
+
+	summary, ok := service.checkoutSummary(state, &plan)
+	if !ok {
+		t.Fatal("transfer by active method should be confirmable")
+	}
+	for _, want := range []string{"Тариф: Тест 1 месяц", "Количество: 2", "Итого: 400 руб."} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary should contain %q:\n%s", want, summary)
+		}
+	}
+
+	state.Pay, state.MethodID = CallbackBuyStars.String(), 0
+	if _, ok := service.checkoutSummary(state, &plan); ok {
+		t.Error("stars should not be confirmable for plan without stars price")
+	}
+
+	state.Pay, state.MethodID = CallbackBuyMethod.WithID(1), 1
+	repo.DB().Model(&db.PaymentMethod{}).Where("id = ?", 1).Update("archived", true)
+	if _, ok := service.checkoutSummary(state, &plan); ok {
+		t.Error("archived method should not be confirmable")
+	}
+
+	state.resetFrom(BuyStepQty)
+	if state.Platform != PlatformAndroid || state.Qty != 0 || state.Pay != "" || state.MethodID != 0 {
+		t.Errorf("resetFrom(qty) should keep platform and clear later choices, got %+v", state)
+	}
+
+	if BuyStepMethod.Next() != BuyStepConfirm || BuyStepConfirm.Prev() != BuyStepMethod || BuyStepReceipt.Prev() != BuyStepConfirm {
+		t.Error("confirm step should sit between method and payment")
+	}
+}
+
+func TestAbandonedCheckouts(t *testing.T) {
+	service, repo := setupTestService(t)
+	now := time.Now()
+	delays := []time.Duration{time.Hour, 24 * time.Hour}
+
+	state := service.startCheckout(42)
+	if state.CheckoutID == 0 || buyStates[42] != state {
+		t.Fatal("checkout should be saved and stored in buyStates")
+	}
+	defer delete(buyStates, 42)
+	state.PlanID, state.Platform, state.Step = 1, PlatformAndroid, BuyStepQty
+	service.saveCheckout(state)
+	repo.DB().Model(&db.Checkout{}).Where("id = ?", state.CheckoutID).UpdateColumn("updated_at", now.Add(-2*time.Hour))
+
+	// Заказ с приложенным чеком завершает оформление
+	payment := &db.Payment{UserID: 43, MethodID: 1, Amount: 200, PlanID: 1, Qty: 1, Status: PaymentStatusPending.String(), ReceiptFileID: "file"}
+	repo.DB().Create(payment)
+	paid := &db.Checkout{UserID: 43, Step: BuyStepReceipt.String(), PlanID: 1, PaymentID: &payment.ID}
+	repo.DB().Create(paid)
+	repo.DB().Model(paid).UpdateColumn("updated_at", now.Add(-2*time.Hour))
+
+	due, err := db.DueCheckoutReminders(repo.DB(), delays, 3, now)
+	if err != nil {
+		t.Fatalf("DueCheckoutReminders: %v", err)
+	}
+	if len(due) != 1 || due[0].ID != state.CheckoutID || due[0].Step != BuyStepQty.String() || due[0].Platform != PlatformAndroid.String() {
+		t.Fatalf("expected reminder for abandoned qty step only, got %+v", due)
+	}
+
+	repo.DB().Create(&db.CheckoutReminder{UserID: 42, CheckoutID: state.CheckoutID, Step: due[0].Step})
+	if due, _ := db.DueCheckoutReminders(repo.DB(), delays, 3, now); len(due) != 0 {
+		t.Errorf("second reminder should wait for the next delay, got %d", len(due))
+	}
+	later := now.Add(23 * time.Hour)
+	if due, _ := db.DueCheckoutReminders(repo.DB(), delays, 1, later); len(due) != 0 {
+		t.Errorf("per-user cap should stop the second reminder, got %d", len(due))
+	}
+	if due, _ := db.DueCheckoutReminders(repo.DB(), delays, 3, later); len(due) != 1 {
+		t.Errorf("second reminder should be due after 24h idle, got %d", len(due))
+	}
+
+	funnel, err := db.BuildCheckoutFunnel(repo.DB(), now.AddDate(0, 0, -7), time.Hour, now)
+	if err != nil {
+		t.Fatalf("BuildCheckoutFunnel: %v", err)
+	}
+	if funnel.Started != 2 || funnel.Completed != 1 || funnel.Abandoned["qty"] != 1 || funnel.Stopped["receipt"] != 1 || funnel.Reminders != 1 {
+		t.Errorf("unexpected funnel: %+v", funnel)
+	}
+	reached := checkoutFunnelReached(funnel)
+	if reached[BuyStepPlan] != 2 || reached[BuyStepQty] != 2 || reached[BuyStepConfirm] != 1 || reached[BuyStepPayment] != 0 {
+		t.Errorf("unexpected reached steps: %+v", reached)
+	}
+	if text := checkoutFunnelText(funnel); !strings.Contains(text, BuyStepQty.DisplayName()+": 2 → 1 (50%)") {
+		t.Errorf("funnel text must show 50%% abandoned on qty step:\n%s", text)
+	}
+}
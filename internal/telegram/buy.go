@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -25,42 +26,106 @@ type BuyState struct {
 	MethodID  uint
 	PaymentID uint
 	Step      BuyStep
+
+	// ChangeSubID - смена тарифа ключа из /mykeys, Credit - зачет за оставшиеся дни
+	ChangeSubID uint
+	Credit      int
+
+	// Pay - данные кнопки выбранного способа оплаты: заказ по нему
+	// оформляется только после подтверждения
+	Pay string
+	// Editing - шаг открыт кнопкой правки с экрана подтверждения,
+	// после выбора возвращаемся к нему
+	Editing bool
+	// CheckoutID - запись оформления для напоминаний о брошенной покупке
+	CheckoutID uint
 }
 
 var buyStates = make(map[int64]*BuyState)
 
-func (s *Service) handleBuy(msg *tgbotapi.Message) {
+// resetFrom сбрасывает выбор на шаге step и всех следующих
+func (state *BuyState) resetFrom(step BuyStep) {
+	switch step {
+	case BuyStepPlan:
+		state.PlanID = 0
+		fallthrough
+	case BuyStepPlatform:
+		state.Platform = ""
+		fallthrough
+	case BuyStepQty:
+		state.Qty = 0
+		fallthrough
+	case BuyStepMethod:
+		state.MethodID = 0
+		state.Pay = ""
+	}
+}
 
-	var plans []db.Plan
-	result := s.repo.DB().Where("archived = false").Find(&plans)
-	if result.Error != nil {
+func (s *Service) handleBuy(msg *tgbotapi.Message) {
+	keyboard, err := s.planKeyboard(msg.From.ID)
+	if err != nil {
 		s.reply(msg.Chat.ID, "Ошибка получения тарифов")
 		return
 	}
 
-	if len(plans) == 0 {
+	if len(keyboard) == 0 {
 		s.reply(msg.Chat.ID, "Тарифы пока не добавлены")
 		return
 	}
 
+	s.startCheckout(msg.From.ID)
+
+	msgConfig := tgbotapi.NewMessage(msg.Chat.ID, "Выберите тариф:")
+	msgConfig.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(msgConfig)
+}
+
+// planKeyboard - тарифы, которые пользователь может купить, и выход в меню
+func (s *Service) planKeyboard(userID int64) ([][]tgbotapi.InlineKeyboardButton, error) {
+	plans, err := s.visiblePlans(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Создаем клавиатуру с тарифами
+	partner := s.isPartner(userID)
 	var keyboard [][]tgbotapi.InlineKeyboardButton
 	for _, plan := range plans {
-		btn := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("%s - %d руб. (%d дней)", plan.Name, plan.PriceInt, plan.DurationDays),
-			CallbackBuyPlan.WithID(plan.ID),
-		)
+		price := formatAmount(plan.PriceInt, CurrencyRUB)
+		if prices := s.planPrices(plan.ID); len(prices) > 0 {
+			price += " / " + planPricesText(prices)
+		}
+		label := fmt.Sprintf("%s - %s (%d дней)", plan.Name, price, plan.DurationDays)
+		if partner {
+			// Партнеру пробный тариф не нужен, цена - оптовая
+			if plan.IsTrial {
+				continue
+			}
+			label = fmt.Sprintf("%s - %s за ключ (%d дней)", plan.Name, s.orderPriceText(userID, &plan, 1), plan.DurationDays)
+		} else if plan.IsTrial {
+			// Пробный тариф показываем только тем, кто его еще не использовал
+			if err := s.trialEligibility(userID); err != nil && !errors.Is(err, errTrialPhoneRequired) {
+				continue
+			}
+			label = fmt.Sprintf("🎁 %s - бесплатно (%d дней)", plan.Name, plan.DurationDays)
+		}
+		if plan.Seats > 1 {
+			label += fmt.Sprintf(" 👨‍👩‍👧 %d мест", plan.Seats)
+		}
+		if plan.Recommended {
+			label = "🔥 " + label
+		}
+		btn := tgbotapi.NewInlineKeyboardButtonData(label, CallbackBuyPlan.WithID(plan.ID))
 		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{btn})
 	}
 
-	buyStates[msg.From.ID] = &BuyState{
-		UserID: msg.From.ID,
-		Step:   BuyStepPlan,
+	if len(keyboard) == 0 {
+		return nil, nil
 	}
-
-	msgConfig := tgbotapi.NewMessage(msg.Chat.ID, "Выберите тариф:")
-	msgConfig.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
-	s.bot.Send(msgConfig)
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад в меню", CallbackMainMenu.String()),
+	})
+	return keyboard, nil
 }
 
 func (s *Service) handleBuyCallback(callback *tgbotapi.CallbackQuery) {
@@ -73,6 +138,12 @@ func (s *Service) handleBuyCallback(callback *tgbotapi.CallbackQuery) {
 		return
 	}
 
+	// Кнопки старых экранов не должны создавать второй заказ
+	if state.PaymentID != 0 {
+		s.answerCallback(callback.ID, fmt.Sprintf("Заказ #%d уже оформлен, изменить его можно кнопкой под инструкцией", state.PaymentID))
+		return
+	}
+
 	if strings.HasPrefix(data, CallbackBuyPlan.String()) {
 		s.handlePlanSelection(callback, state)
 	} else if strings.HasPrefix(data, CallbackBuyPlatform.String()) {
@@ -81,7 +152,19 @@ func (s *Service) handleBuyCallback(callback *tgbotapi.CallbackQuery) {
 		s.handleQtySelection(callback, state)
 	} else if strings.HasPrefix(data, CallbackBuyMethod.String()) {
 		s.handleMethodSelection(callback, state)
+	} else if strings.HasPrefix(data, CallbackBuyOnline.String()) ||
+		data == CallbackBuyStars.String() ||
+		data == CallbackBuyBalance.String() {
+		s.handlePayChoice(callback, state)
+	} else if strings.HasPrefix(data, CallbackBuyEdit.String()) {
+		s.handleBuyEdit(callback, state)
+	} else if data == CallbackBuyBack.String() {
+		s.handleBuyBack(callback, state)
+	} else if data == CallbackBuyConfirm.String() {
+		s.handleBuyConfirm(callback, state)
 	}
+
+	s.saveCheckout(state)
 }
 
 func (s *Service) handlePlanSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
@@ -92,36 +175,23 @@ func (s *Service) handlePlanSelection(callback *tgbotapi.CallbackQuery, state *B
 		return
 	}
 
-	state.PlanID = uint(planID)
-	state.Step = BuyStepPlatform
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, planID).Error; err != nil || !s.planAvailable(callback.From.ID, &plan) {
+		s.answerCallback(callback.ID, "Тариф не найден")
+		return
+	}
 
-	// Выбор платформы
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData(
-			PlatformAndroid.Emoji()+" "+PlatformAndroid.DisplayName(),
-			CallbackBuyPlatform.WithID(PlatformAndroid.String()))},
-		{tgbotapi.NewInlineKeyboardButtonData(
-			PlatformIOS.Emoji()+" "+PlatformIOS.DisplayName(),
-			CallbackBuyPlatform.WithID(PlatformIOS.String()))},
-		{tgbotapi.NewInlineKeyboardButtonData(
-			PlatformWindows.Emoji()+" "+PlatformWindows.DisplayName(),
-			CallbackBuyPlatform.WithID(PlatformWindows.String()))},
-		{tgbotapi.NewInlineKeyboardButtonData(
-			PlatformLinux.Emoji()+" "+PlatformLinux.DisplayName(),
-			CallbackBuyPlatform.WithID(PlatformLinux.String()))},
-		{tgbotapi.NewInlineKeyboardButtonData(
-			PlatformMacOS.Emoji()+" "+PlatformMacOS.DisplayName(),
-			CallbackBuyPlatform.WithID(PlatformMacOS.String()))},
-	}
-
-	editMsg := tgbotapi.NewEditMessageText(
-		callback.Message.Chat.ID,
-		callback.Message.MessageID,
-		"Выберите платформу:",
-	)
-	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	s.bot.Send(editMsg)
-	s.answerCallback(callback.ID, "")
+	if plan.IsTrial {
+		if err := s.trialEligibility(callback.From.ID); err != nil && !errors.Is(err, errTrialPhoneRequired) {
+			s.answerCallback(callback.ID, "Пробный период уже использован")
+			return
+		}
+		// Пробный период выдается при выборе платформы
+		state.Platform = ""
+	}
+
+	state.PlanID = uint(planID)
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
 }
 
 func (s *Service) handlePlatformSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
@@ -134,24 +204,16 @@ func (s *Service) handlePlatformSelection(callback *tgbotapi.CallbackQuery, stat
 	}
 
 	state.Platform = platform
-	state.Step = BuyStepQty
 
-	// Выбор количества ключей
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("1 ключ", CallbackBuyQty.WithID("1"))},
-		{tgbotapi.NewInlineKeyboardButtonData("2 ключа", CallbackBuyQty.WithID("2"))},
-		{tgbotapi.NewInlineKeyboardButtonData("3 ключа", CallbackBuyQty.WithID("3"))},
-		{tgbotapi.NewInlineKeyboardButtonData("5 ключей", CallbackBuyQty.WithID("5"))},
+	// Пробный период не требует выбора количества, оплаты и чека
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, state.PlanID).Error; err == nil && plan.IsTrial {
+		s.answerCallback(callback.ID, "")
+		s.activateTrial(callback.Message.Chat.ID, state)
+		return
 	}
 
-	editMsg := tgbotapi.NewEditMessageText(
-		callback.Message.Chat.ID,
-		callback.Message.MessageID,
-		"Выберите количество ключей:",
-	)
-	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	s.bot.Send(editMsg)
-	s.answerCallback(callback.ID, "")
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
 }
 
 func (s *Service) handleQtySelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
@@ -162,60 +224,201 @@ func (s *Service) handleQtySelection(callback *tgbotapi.CallbackQuery, state *Bu
 		return
 	}
 
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, state.PlanID).Error; err != nil {
+		s.answerCallback(callback.ID, "Тариф не найден")
+		return
+	}
+	if plan.MaxQty > 0 && qty > plan.MaxQty {
+		s.answerCallback(callback.ID, fmt.Sprintf("По этому тарифу не больше %d ключей за заказ", plan.MaxQty))
+		return
+	}
+
 	state.Qty = qty
-	state.Step = BuyStepMethod
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
+}
 
-	// Получаем способы оплаты
-	var methods []db.PaymentMethod
-	result := s.repo.DB().Where("archived = false").Find(&methods)
-	if result.Error != nil {
-		s.answerCallback(callback.ID, "Ошибка получения способов оплаты")
+func (s *Service) handleMethodSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	methodIDStr := strings.TrimPrefix(callback.Data, CallbackBuyMethod.String())
+	methodID, err := strconv.ParseUint(methodIDStr, 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID метода")
 		return
 	}
 
-	if len(methods) == 0 {
-		s.answerCallback(callback.ID, "Способы оплаты не настроены")
+	// Лимит способа мог закончиться, пока покупатель выбирал
+	var method db.PaymentMethod
+	var plan db.Plan
+	if s.repo.DB().First(&method, methodID).Error != nil || s.repo.DB().First(&plan, state.PlanID).Error != nil ||
+		!s.methodAvailable(&method, s.statePriceIn(state, &plan, method.Currency), time.Now()) {
+		s.answerCallback(callback.ID, "Этот способ оплаты сейчас недоступен, выберите другой")
 		return
 	}
 
+	state.MethodID = uint(methodID)
+	state.Pay = callback.Data
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
+}
+
+// handlePayChoice запоминает онлайн-оплату, звезды или баланс до подтверждения
+func (s *Service) handlePayChoice(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	state.MethodID = 0
+	state.Pay = callback.Data
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
+}
+
+// showPlanStep - экран выбора тарифа
+func (s *Service) showPlanStep(callback *tgbotapi.CallbackQuery, state *BuyState) string {
+	keyboard, err := s.planKeyboard(state.UserID)
+	if err != nil || len(keyboard) == 0 {
+		return "Тарифы сейчас недоступны"
+	}
+
+	state.Step = BuyStepPlan
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, "Выберите тариф:", keyboard)
+	return ""
+}
+
+// showPlatformStep - экран выбора платформы
+func (s *Service) showPlatformStep(callback *tgbotapi.CallbackQuery, state *BuyState) string {
+	state.Step = BuyStepPlatform
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, platform := range []Platform{PlatformAndroid, PlatformIOS, PlatformWindows, PlatformLinux, PlatformMacOS} {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData(
+			platform.Emoji()+" "+platform.DisplayName(),
+			CallbackBuyPlatform.WithID(platform.String()))})
+	}
+	keyboard = append(keyboard, buyBackRow())
+
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, "Выберите платформу:", keyboard)
+	return ""
+}
+
+// showQtyStep - экран выбора количества ключей с ценой заказа и скидкой за количество
+func (s *Service) showQtyStep(callback *tgbotapi.CallbackQuery, state *BuyState, plan *db.Plan) string {
+	state.Step = BuyStepQty
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, option := range []struct {
+		qty   int
+		label string
+	}{{1, "1 ключ"}, {2, "2 ключа"}, {3, "3 ключа"}, {5, "5 ключей"}} {
+		if plan.MaxQty > 0 && option.qty > plan.MaxQty {
+			continue
+		}
+		label := fmt.Sprintf("%s - %s", option.label, s.orderPriceText(state.UserID, plan, option.qty))
+		if discount := s.volumeDiscount(plan.ID, option.qty); discount > 0 {
+			label += fmt.Sprintf(" (−%d%%)", discount)
+		}
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, CallbackBuyQty.WithID(option.qty)),
+		})
+	}
+	if s.isPartner(state.UserID) {
+		keyboard = nil
+		for _, qty := range partnerQtyOptions {
+			if plan.MaxQty > 0 && qty > plan.MaxQty {
+				continue
+			}
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d ключей", qty), CallbackBuyQty.WithID(qty)),
+			})
+		}
+	}
+	// Лимит тарифа меньше всех вариантов - предлагаем ровно лимит
+	if len(keyboard) == 0 && plan.MaxQty > 0 {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d шт. - %s", plan.MaxQty, s.orderPriceText(state.UserID, plan, plan.MaxQty)), CallbackBuyQty.WithID(plan.MaxQty)),
+		})
+	}
+	keyboard = append(keyboard, buyBackRow())
+
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, "Выберите количество ключей:", keyboard)
+	return ""
+}
+
+// showMethodStep - экран выбора способа оплаты
+func (s *Service) showMethodStep(callback *tgbotapi.CallbackQuery, state *BuyState, plan *db.Plan) string {
+	var online []string
+	if s.providers != nil {
+		online = s.providers.Names()
+	}
+
+	balance, err := userBalance(s.repo.DB(), state.UserID)
+	if err != nil {
+		slog.Error("Failed to fetch balance for purchase", "user_id", state.UserID, "error", err)
+	}
+	price := s.orderPrice(state.UserID, plan, state.Qty)
+	payableFromBalance := price > 0 && balance >= price
+
+	// Переводы в валюте показываются, только если у тарифа есть цена в ней
+	options, err := s.availableMethods(func(currency string) int {
+		return s.orderPriceIn(state.UserID, plan, state.Qty, currency)
+	}, time.Now())
+	if err != nil {
+		s.logAndReportError("Payment methods fetch failed", err, map[string]interface{}{
+			"user_id": state.UserID,
+			"plan_id": plan.ID,
+		})
+		return "Ошибка получения способов оплаты"
+	}
+
+	if len(options) == 0 && len(online) == 0 && plan.PriceStars == 0 && !payableFromBalance {
+		return "Сейчас нет доступных способов оплаты, попробуйте позже"
+	}
+
+	state.Step = BuyStepMethod
+
 	// Создаем клавиатуру с методами оплаты
 	var keyboard [][]tgbotapi.InlineKeyboardButton
-	for _, method := range methods {
+	if payableFromBalance {
 		btn := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("%s (%s)", method.Bank, method.PhoneNumber),
-			CallbackBuyMethod.WithID(method.ID),
+			fmt.Sprintf("💰 С баланса (%d из %d руб.)", price, balance),
+			CallbackBuyBalance.String(),
 		)
 		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{btn})
 	}
 
-	editMsg := tgbotapi.NewEditMessageText(
-		callback.Message.Chat.ID,
-		callback.Message.MessageID,
-		"Выберите способ оплаты:",
-	)
-	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	s.bot.Send(editMsg)
-	s.answerCallback(callback.ID, "")
-}
+	for _, option := range options {
+		label := fmt.Sprintf("%s (%s)", option.Method.Bank, option.Method.PhoneNumber)
+		if option.Method.Currency != CurrencyRUB {
+			label += " - " + formatAmount(option.Price, option.Method.Currency)
+		}
+		btn := tgbotapi.NewInlineKeyboardButtonData(label, CallbackBuyMethod.WithID(option.Method.ID))
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{btn})
+	}
 
-func (s *Service) handleMethodSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
-	methodIDStr := strings.TrimPrefix(callback.Data, CallbackBuyMethod.String())
-	methodID, err := strconv.ParseUint(methodIDStr, 10, 32)
-	if err != nil {
-		s.answerCallback(callback.ID, "Неверный ID метода")
-		return
+	for _, name := range online {
+		btn := tgbotapi.NewInlineKeyboardButtonData("💳 Онлайн-оплата картой", CallbackBuyOnline.WithID(name))
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{btn})
 	}
 
-	state.MethodID = uint(methodID)
+	if plan.PriceStars > 0 {
+		btn := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("⭐ Telegram Stars (%d ⭐)", plan.PriceStars*state.Qty),
+			CallbackBuyStars.String(),
+		)
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{btn})
+	}
+	keyboard = append(keyboard, buyBackRow())
+
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID,
+		s.orderSummary(state.UserID, plan, state.Qty)+"\n\nВыберите способ оплаты:", keyboard)
+	return ""
+}
 
-	// Переходим к оплате
-	err = s.processPurchase(callback, state)
+// confirmMethodPurchase создает заказ на перевод после подтверждения
+func (s *Service) confirmMethodPurchase(callback *tgbotapi.CallbackQuery, state *BuyState, summary string) {
+	err := s.processPurchase(callback, state)
 	if err != nil {
 		s.answerCallback(callback.ID, fmt.Sprintf("Ошибка обработки покупки: %v", err))
 		return
 	}
 
 	state.Step = BuyStepReceipt
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+		fmt.Sprintf("%s\n\n✅ Заказ #%d оформлен, инструкции по оплате ниже", summary, state.PaymentID))
 	s.answerCallback(callback.ID, "Следуйте инструкциям по оплате")
 }
 
@@ -283,28 +486,48 @@ func (s *Service) processPurchase(callback *tgbotapi.CallbackQuery, state *BuySt
 
 	slog.Info("Payment method fetched", "method_id", method.ID, "bank", method.Bank)
 
-	// Создаем запись о платеже
-	totalAmount := plan.PriceInt * state.Qty
+	price := s.statePriceIn(state, &plan, method.Currency)
+	if price <= 0 {
+		tx.Rollback()
+		priceErr := ErrPaymentf("Plan #%v has no price in %v", plan.ID, method.Currency)
+		s.logAndReportError("Plan price missing for method currency", priceErr, map[string]interface{}{
+			"user_id":   state.UserID,
+			"plan_id":   plan.ID,
+			"method_id": method.ID,
+		})
+		return priceErr
+	}
+
 	payment := &db.Payment{
 		UserID:   state.UserID,
 		MethodID: state.MethodID,
-		Amount:   totalAmount,
+		Amount:   price,
+		Currency: method.Currency,
 		PlanID:   state.PlanID,
 		Qty:      state.Qty,
 		Status:   PaymentStatusPending.String(),
 	}
-
-	slog.Info("Creating payment record", "amount", totalAmount, "qty", state.Qty, "user_id", state.UserID)
-
-	if err := tx.Create(payment).Error; err != nil {
+	state.applyChange(payment)
+	s.recordListPrice(payment, &plan)
+
+	slog.Info("Creating payment record", "amount", price, "qty", state.Qty, "user_id", state.UserID)
+
+	// Рублевая сумма уникальна среди ожидающих заказов, чтобы кассир мог
+	// сопоставить поступление по SMS банка
+	var err error
+	if method.Currency == CurrencyRUB {
+		err = createUniquePayment(tx, payment, price)
+	} else if err = tx.Create(payment).Error; err != nil {
+		err = ErrDatabasef("Failed to create payment record: %v", err)
+	}
+	if err != nil {
 		tx.Rollback()
-		paymentErr := ErrDatabasef("Failed to create payment record: %v", err)
-		s.logAndReportError("Payment creation failed", paymentErr, map[string]interface{}{
+		s.logAndReportError("Payment creation failed", err, map[string]interface{}{
 			"user_id": state.UserID,
-			"amount":  totalAmount,
+			"amount":  price,
 			"plan_id": state.PlanID,
 		})
-		return paymentErr
+		return err
 	}
 
 	// Сохраняем изменения
@@ -317,7 +540,7 @@ func (s *Service) processPurchase(callback *tgbotapi.CallbackQuery, state *BuySt
 		return commitErr
 	}
 
-	slog.Info("Payment created successfully", "payment_id", payment.ID, "user_id", state.UserID, "amount", totalAmount)
+	slog.Info("Payment created successfully", "payment_id", payment.ID, "user_id", state.UserID, "amount", payment.Amount)
 
 	state.PaymentID = payment.ID
 
@@ -494,7 +717,7 @@ func (s *Service) sendSubscriptionToUserWithData(chatID int64, subscription *db.
 func (s *Service) sendPaymentInfo(chatID int64, payment *db.Payment, method *db.PaymentMethod, plan *db.Plan) {
 	text := fmt.Sprintf(`💳 Информация о платеже:
 
-💰 Сумма: %d руб.
+💰 Сумма: %s
 📦 Тариф: %s
 🔢 Количество: %d
 📱 Способ оплаты: %s (%s)
@@ -503,7 +726,7 @@ func (s *Service) sendPaymentInfo(chatID int64, payment *db.Payment, method *db.
 📞 Телефон: %s
 
 Статус: ⏳ Ожидает подтверждения`,
-		payment.Amount,
+		formatAmount(payment.Amount, payment.Currency),
 		plan.Name,
 		payment.Qty,
 		method.Bank,
@@ -518,7 +741,7 @@ func (s *Service) sendPaymentInfo(chatID int64, payment *db.Payment, method *db.
 func (s *Service) sendPaymentInstructions(chatID int64, payment *db.Payment, method *db.PaymentMethod, plan *db.Plan) {
 	text := fmt.Sprintf(`💳 Инструкции по оплате:
 
-💰 Сумма: %d руб.
+💰 Сумма: %s
 📦 Тариф: %s
 🔢 Количество: %d
 
@@ -530,62 +753,274 @@ func (s *Service) sendPaymentInstructions(chatID int64, payment *db.Payment, met
 📋 Номер заказа: #%d
 
 ⚠️ ВАЖНО:
-1. Переведите точную сумму: %d руб.
+1. Переведите точную сумму: %s
 2. После оплаты отправьте скриншот или PDF чек
 3. Укажите номер заказа #%d в сообщении
 4. Ключи будут выданы после проверки платежа
 
 ⏰ Ожидайте подтверждения от администратора`,
-		payment.Amount,
+		formatAmount(payment.Amount, payment.Currency),
 		plan.Name,
 		payment.Qty,
 		method.Bank,
 		method.PhoneNumber,
 		method.OwnerName,
 		payment.ID,
-		payment.Amount,
+		formatAmount(payment.Amount, payment.Currency),
 		payment.ID,
 	)
 
-	s.reply(chatID, text)
+	if payment.Surcharge > 0 {
+		text += fmt.Sprintf("\n\nℹ️ К цене %s добавлено %s — по этой сумме платеж найдут автоматически. После подтверждения надбавка вернется на ваш баланс",
+			formatAmount(payment.Amount-payment.Surcharge, payment.Currency), formatAmount(payment.Surcharge, payment.Currency))
+	}
+
+	text += "\n\n⌛ Заказ без чека отменяется через " + formatTTL(s.cfg.PendingPaymentTTL)
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отменить заказ", CallbackPaymentCancel.WithID(payment.ID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Изменить заказ", CallbackPaymentEdit.WithID(payment.ID)),
+		),
+	)
+	s.bot.Send(msg)
+
+	s.sendPaymentQR(chatID, payment, method)
 }
 
+// formatTTL выводит срок жизни заказа в часах или минутах
+func formatTTL(ttl time.Duration) string {
+	if ttl >= time.Hour {
+		return fmt.Sprintf("%d ч.", int(ttl.Hours()))
+	}
+	return fmt.Sprintf("%d мин.", int(ttl.Minutes()))
+}
+
+// handlePaymentCancel отменяет свой заказ, пока к нему не приложен чек
+func (s *Service) handlePaymentCancel(callback *tgbotapi.CallbackQuery) {
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackPaymentCancel.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный номер заказа")
+		return
+	}
+
+	canceled, err := s.cancelPendingPayment(uint(paymentID), callback.From.ID)
+	if err != nil {
+		s.answerCallback(callback.ID, "Ошибка отмены заказа")
+		return
+	}
+	if !canceled {
+		s.answerCallback(callback.ID, "Заказ уже оплачен или отменен")
+		return
+	}
+
+	if state, ok := buyStates[callback.From.ID]; ok && state.PaymentID == uint(paymentID) {
+		delete(buyStates, callback.From.ID)
+	}
+
+	slog.Info("Payment canceled by user", "payment_id", paymentID, "user_id", callback.From.ID)
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+		fmt.Sprintf("🚫 Заказ #%d отменен. Оформить новый - /buy", paymentID))
+	s.answerCallback(callback.ID, "Заказ отменен")
+}
+
+// cancelPendingPayment отменяет заказ пользователя без чека. false - заказ
+// уже оплачен, отменен или принадлежит другому
+func (s *Service) cancelPendingPayment(paymentID uint, userID int64) (bool, error) {
+	res := s.repo.DB().Model(&db.Payment{}).
+		Where("id = ? AND user_id = ? AND status = ? AND receipt_file_id = ''", paymentID, userID, PaymentStatusPending).
+		Update("status", PaymentStatusCanceled.String())
+	if res.Error != nil {
+		err := ErrDatabasef("Failed to cancel payment #%v: %v", paymentID, res.Error)
+		s.logAndReportError("Payment cancel failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"user_id":    userID,
+		})
+		return false, err
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// pendingReceipts хранит чек, для которого пользователь еще не выбрал заказ
+var pendingReceipts = make(map[int64]receiptFile)
+
+var receiptOrderRe = regexp.MustCompile(`#(\d+)`)
+
 func (s *Service) handleReceiptMessage(msg *tgbotapi.Message) {
-	// Проверить только наличие pending платежа, а не состояние buyStates
-	var payment db.Payment
-	result := s.repo.DB().Where("user_id = ? AND status = ?", msg.From.ID, PaymentStatusPending).
-		Preload("Plan").Preload("User").First(&payment)
+	// Получить файл чека
+	file, ok := receiptFromMessage(msg)
+	if !ok {
+		return
+	}
 
-	if result.Error != nil {
+	// Чек принимается только к заказам, к которым его еще не прикладывали
+	var pending []db.Payment
+	result := s.repo.DB().Where("user_id = ? AND status = ? AND provider = '' AND receipt_file_id = ''", msg.From.ID, PaymentStatusPending).
+		Order("created_at DESC").Find(&pending)
+
+	if result.Error != nil || len(pending) == 0 {
 		return // Нет pending платежа
 	}
 
-	// Получить FileID чека
-	var fileID string
-	if msg.Photo != nil && len(msg.Photo) > 0 {
-		fileID = msg.Photo[len(msg.Photo)-1].FileID
-	} else if msg.Document != nil {
-		fileID = msg.Document.FileID
-	} else {
+	payment := s.chooseReceiptOrder(msg, pending)
+	if payment == nil {
+		pendingReceipts[msg.From.ID] = file
+		s.askReceiptOrder(msg.Chat.ID, pending)
+		return
+	}
+
+	s.attachReceipt(msg.Chat.ID, payment.ID, file)
+}
+
+// chooseReceiptOrder определяет заказ для чека: номер в подписи, текущая
+// покупка или единственный ожидающий заказ. nil - нужно спросить пользователя
+func (s *Service) chooseReceiptOrder(msg *tgbotapi.Message, pending []db.Payment) *db.Payment {
+	find := func(id uint) *db.Payment {
+		for i := range pending {
+			if pending[i].ID == id {
+				return &pending[i]
+			}
+		}
+		return nil
+	}
+
+	if m := receiptOrderRe.FindStringSubmatch(msg.Caption); m != nil {
+		if id, err := strconv.ParseUint(m[1], 10, 32); err == nil {
+			if payment := find(uint(id)); payment != nil {
+				return payment
+			}
+		}
+	}
+
+	if state, ok := buyStates[msg.From.ID]; ok && state.Step == BuyStepReceipt {
+		if payment := find(state.PaymentID); payment != nil {
+			return payment
+		}
+	}
+
+	if len(pending) == 1 {
+		return &pending[0]
+	}
+	return nil
+}
+
+func (s *Service) askReceiptOrder(chatID int64, pending []db.Payment) {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, payment := range pending {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("📋 Заказ #%d - %s (%s)", payment.ID, formatAmount(payment.Amount, payment.Currency), payment.CreatedAt.Format("02.01 15:04")),
+				CallbackReceiptOrder.WithID(payment.ID),
+			),
+		})
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "📎 У вас несколько неоплаченных заказов. К какому относится этот чек?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(msg)
+}
+
+func (s *Service) handleReceiptOrderCallback(callback *tgbotapi.CallbackQuery) {
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackReceiptOrder.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный номер заказа")
+		return
+	}
+
+	file, ok := pendingReceipts[callback.From.ID]
+	if !ok {
+		s.answerCallback(callback.ID, "Чек не найден, отправьте его еще раз")
 		return
 	}
 
+	var payment db.Payment
+	err = s.repo.DB().Where("id = ? AND user_id = ? AND status = ? AND provider = '' AND receipt_file_id = ''",
+		paymentID, callback.From.ID, PaymentStatusPending).First(&payment).Error
+	if err != nil {
+		s.answerCallback(callback.ID, "Заказ уже оплачен или отменен")
+		return
+	}
+
+	delete(pendingReceipts, callback.From.ID)
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, fmt.Sprintf("📎 Чек прикреплен к заказу #%d", payment.ID))
+	s.answerCallback(callback.ID, "")
+	s.attachReceipt(callback.Message.Chat.ID, payment.ID, file)
+}
+
+// attachReceipt сохраняет чек к заказу и сразу выдает ключи
+func (s *Service) attachReceipt(chatID int64, paymentID uint, file receiptFile) {
+	var payment db.Payment
+	if err := s.repo.DB().Preload("Plan").Preload("User").First(&payment, paymentID).Error; err != nil {
+		s.reply(chatID, "Ошибка БД")
+		return
+	}
+
+	// Хэш считается до транзакции: скачивание файла может занять время
+	var hash string
+	if file.Image {
+		var err error
+		if hash, err = s.receiptHash(file.FileID); err != nil {
+			slog.Warn("Failed to hash receipt image", "payment_id", payment.ID, "error", err)
+		}
+	}
+
+	duplicate, err := s.findReceiptDuplicate(payment.ID, file.UniqueID, hash)
+	if err != nil {
+		slog.Error("Duplicate receipt check failed", "payment_id", payment.ID, "error", err)
+	}
+	if duplicate != nil {
+		slog.Warn("Possible duplicate receipt", "payment_id", payment.ID, "original_payment_id", duplicate.ID, "same_user", duplicate.UserID == payment.UserID)
+		payment.DuplicateOf = &duplicate.ID
+	}
+
 	// Начинаем транзакцию
 	tx := s.repo.DB().Begin()
 	if tx.Error != nil {
-		s.reply(msg.Chat.ID, "Ошибка БД")
+		s.reply(chatID, "Ошибка БД")
 		return
 	}
 
-	// Сохранить чек в БД
-	payment.ReceiptFileID = fileID
-	if err := tx.Save(&payment).Error; err != nil {
-		tx.Rollback()
-		s.logAndReportError("Failed to save receipt", err, map[string]interface{}{
-			"payment_id": payment.ID,
-			"user_id":    msg.From.ID,
+	// Сохранить чек в БД. Условие на статус не даст приложить чек к отмененному заказу
+	res := tx.Model(&db.Payment{}).
+		Where("id = ? AND status = ? AND receipt_file_id = ''", payment.ID, PaymentStatusPending).
+		Updates(map[string]interface{}{
+			"receipt_file_id":   file.FileID,
+			"receipt_unique_id": file.UniqueID,
+			"receipt_hash":      hash,
+			"duplicate_of":      payment.DuplicateOf,
 		})
-		s.reply(msg.Chat.ID, "Ошибка сохранения чека")
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		if res.Error != nil {
+			s.logAndReportError("Failed to save receipt", res.Error, map[string]interface{}{
+				"payment_id": payment.ID,
+				"user_id":    payment.UserID,
+			})
+		}
+		s.reply(chatID, "Ошибка сохранения чека")
+		return
+	}
+	payment.ReceiptFileID = file.FileID
+	payment.ReceiptUniqueID = file.UniqueID
+	payment.ReceiptHash = hash
+
+	// Похожий на повторный чек всегда ждет решения кассира, смена тарифа
+	// применяется только после одобрения
+	if duplicate != nil || payment.ChangeSubID != nil || !s.issueOnReceipt(payment.UserID) {
+		if err := tx.Commit().Error; err != nil {
+			s.reply(chatID, "Ошибка БД")
+			return
+		}
+
+		if state, ok := buyStates[payment.UserID]; ok && state.PaymentID == payment.ID {
+			delete(buyStates, payment.UserID)
+		}
+
+		s.reply(chatID, "✅ Чек получен! Ключи придут сюда сразу после проверки кассиром.")
+		s.notifyCashiersAboutReceipt(&payment, false)
 		return
 	}
 
@@ -596,55 +1031,55 @@ func (s *Service) handleReceiptMessage(msg *tgbotapi.Message) {
 		subscription, err := s.createSubscriptionForPayment(tx, &payment)
 		if err != nil {
 			tx.Rollback()
-			s.handleError(msg.Chat.ID, err)
+			s.handleError(chatID, err)
 			return
 		}
 		// Отправляем ключи пользователю
-		s.sendSubscriptionToUser(msg.Chat.ID, subscription)
+		s.sendSubscriptionToUser(chatID, subscription)
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		s.reply(msg.Chat.ID, "Ошибка БД")
+		s.reply(chatID, "Ошибка БД")
 		return
 	}
 
-	s.reply(msg.Chat.ID, "✅ Чек получен! Ваши ключи выше. Ожидайте подтверждения кассира.")
+	if state, ok := buyStates[payment.UserID]; ok && state.PaymentID == payment.ID {
+		delete(buyStates, payment.UserID)
+	}
+
+	s.reply(chatID, "✅ Чек получен! Ваши ключи выше. Ожидайте подтверждения кассира.")
 
 	// Уведомить кассиров о новом чеке для проверки
-	s.notifyCashiersAboutReceipt(&payment)
+	s.notifyCashiersAboutReceipt(&payment, true)
 }
 
-func (s *Service) notifyCashiersAboutReceipt(payment *db.Payment) {
-	slog.Info("Notifying cashiers about new receipt", "payment_id", payment.ID, "user_id", payment.UserID)
-
-	// Найти всех кассиров
-	var cashiers []db.Admin
-	s.repo.DB().Where("role = ? AND disabled = false", RoleCashier.String()).Find(&cashiers)
-
-	// Если нет кассиров, уведомить всех админов
-	if len(cashiers) == 0 {
-		slog.Info("No cashiers found, notifying all admins", "payment_id", payment.ID)
-		s.repo.DB().Where("role IN (?, ?) AND disabled = false", RoleAdmin.String(), RoleSuper.String()).Find(&cashiers)
+// issueOnReceipt решает по политике одобрения, выдавать ли ключи до проверки чека
+func (s *Service) issueOnReceipt(userID int64) bool {
+	// Партнерские ключи выпускаются только после одобрения оплаты
+	if s.isPartner(userID) {
+		return false
 	}
 
-	if len(cashiers) == 0 {
-		slog.Warn("No admins found to notify about receipt", "payment_id", payment.ID)
-		return
+	policy := ApprovalPolicy(s.cfg.ApprovalPolicy)
+	if !policy.IsValid() {
+		slog.Warn("Unknown approval policy, falling back to approve_first", "policy", s.cfg.ApprovalPolicy)
+		policy = ApprovalApproveFirst
 	}
 
-	text := fmt.Sprintf(`💳 Новый чек для проверки!
-
-📋 Заказ #%d  
-👤 Пользователь: @%s
-💰 Сумма: %d руб.
-📦 Тариф: %s
-
-Проверьте в /payqueue`, payment.ID, payment.User.Username, payment.Amount, payment.Plan.Name)
-
-	for _, cashier := range cashiers {
-		slog.Info("Notifying cashier about receipt", "payment_id", payment.ID, "cashier_id", cashier.TgID)
-		s.reply(cashier.TgID, text)
+	switch policy {
+	case ApprovalTrustOnReceipt:
+		return true
+	case ApprovalTrustKnown:
+		var approved int64
+		if err := s.repo.DB().Model(&db.Payment{}).
+			Where("user_id = ? AND status = ?", userID, PaymentStatusApproved).
+			Count(&approved).Error; err != nil {
+			slog.Error("Failed to count approved payments", "user_id", userID, "error", err)
+			return false
+		}
+		return approved > 0
 	}
+	return false
 }
 
 func (s *Service) generateWireguardConfig(subscription *db.Subscription) string {
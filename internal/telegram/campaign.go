@@ -0,0 +1,159 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// campaignPattern - допустимое имя кампании в ссылке start=src_<кампания>
+var campaignPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// campaignStat - итоги рекламной кампании или реферального кода
+type campaignStat struct {
+	Name    string
+	Users   int64
+	Paying  int64
+	Revenue int
+}
+
+// recordCampaign запоминает кампанию, с которой пришел новый пользователь.
+// Уже записанный источник не перезаписывается
+func (s *Service) recordCampaign(userID int64, campaign string) {
+	campaign = strings.ToLower(campaign)
+	if !campaignPattern.MatchString(campaign) {
+		slog.Warn("Invalid campaign in start link", "user_id", userID, "campaign", campaign)
+		return
+	}
+
+	err := s.repo.DB().Model(&db.User{}).Where("tg_id = ? AND (source = '' OR source IS NULL)", userID).Update("source", campaign).Error
+	if err != nil {
+		s.logAndReportError("Campaign record failed", ErrDatabasef("Failed to save user source: %v", err), map[string]interface{}{
+			"user_id":  userID,
+			"campaign": campaign,
+		})
+		return
+	}
+	slog.Info("User came from campaign", "user_id", userID, "campaign", campaign)
+}
+
+// campaignStats считает пользователей, плательщиков и выручку в рублях по кампаниям
+func (s *Service) campaignStats() ([]campaignStat, error) {
+	var stats []campaignStat
+	err := s.repo.DB().Raw(`SELECT u.source AS name,
+			COUNT(DISTINCT u.tg_id) AS users,
+			COUNT(DISTINCT p.user_id) AS paying,
+			COALESCE(SUM(CASE WHEN p.currency = ? THEN p.amount ELSE 0 END), 0) AS revenue
+		FROM users u
+		LEFT JOIN payments p ON p.user_id = u.tg_id AND p.status = ?
+		WHERE u.source <> ''
+		GROUP BY u.source
+		ORDER BY revenue DESC, users DESC`, CurrencyRUB, PaymentStatusApproved.String()).Scan(&stats).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to calculate campaign stats: %v", err)
+	}
+	return stats, nil
+}
+
+// refCodeStats - то же по реферальным кодам: кого привели партнеры и блогеры
+func (s *Service) refCodeStats(limit int) ([]campaignStat, error) {
+	var stats []campaignStat
+	err := s.repo.DB().Raw(`SELECT COALESCE(NULLIF(u.ref_code, ''), CAST(r.inviter_id AS TEXT)) AS name,
+			COUNT(DISTINCT r.invitee_id) AS users,
+			COUNT(DISTINCT p.user_id) AS paying,
+			COALESCE(SUM(CASE WHEN p.currency = ? THEN p.amount ELSE 0 END), 0) AS revenue
+		FROM referrals r
+		JOIN users u ON u.tg_id = r.inviter_id
+		LEFT JOIN payments p ON p.user_id = r.invitee_id AND p.status = ?
+		GROUP BY r.inviter_id
+		ORDER BY paying DESC, revenue DESC
+		LIMIT ?`, CurrencyRUB, PaymentStatusApproved.String(), limit).Scan(&stats).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to calculate referral stats: %v", err)
+	}
+	return stats, nil
+}
+
+// handleCampaigns показывает итоги кампаний, а с именем кампании - ее плательщиков
+func (s *Service) handleCampaigns(msg *tgbotapi.Message) {
+	if campaign := strings.ToLower(strings.TrimSpace(msg.CommandArguments())); campaign != "" {
+		s.showCampaignPayers(msg.Chat.ID, campaign)
+		return
+	}
+
+	stats, err := s.campaignStats()
+	if err == nil {
+		var refStats []campaignStat
+		refStats, err = s.refCodeStats(10)
+		if err == nil {
+			s.reply(msg.Chat.ID, s.campaignsText(stats, refStats))
+			return
+		}
+	}
+
+	s.logAndReportError("Campaign stats failed", err, map[string]interface{}{
+		"admin_id": msg.From.ID,
+	})
+	s.reply(msg.Chat.ID, "Ошибка получения статистики кампаний")
+}
+
+func (s *Service) campaignsText(stats, refStats []campaignStat) string {
+	text := "📣 Рекламные кампании\n"
+	if len(stats) == 0 {
+		text += "\nПока никто не пришел по ссылкам кампаний"
+	}
+	for _, stat := range stats {
+		text += fmt.Sprintf("\n• %s: 👥 %d, 💳 %d, 💰 %d руб.", stat.Name, stat.Users, stat.Paying, stat.Revenue)
+	}
+
+	if len(refStats) > 0 {
+		text += "\n\n🔗 Реферальные коды\n"
+		for _, stat := range refStats {
+			text += fmt.Sprintf("\n• %s: 👥 %d, 💳 %d, 💰 %d руб.", stat.Name, stat.Users, stat.Paying, stat.Revenue)
+		}
+	}
+
+	text += fmt.Sprintf("\n\n👥 - пришло, 💳 - оплатили\nСсылка кампании: https://t.me/%s?start=src_<кампания>\nПлательщики кампании: /campaigns <кампания>", s.bot.Self.UserName)
+	return text
+}
+
+func (s *Service) showCampaignPayers(chatID int64, campaign string) {
+	var payers []struct {
+		TgID     int64
+		Username string
+		Payments int64
+		Revenue  int
+	}
+	err := s.repo.DB().Raw(`SELECT u.tg_id, u.username,
+			COUNT(p.id) AS payments,
+			COALESCE(SUM(CASE WHEN p.currency = ? THEN p.amount ELSE 0 END), 0) AS revenue
+		FROM users u
+		JOIN payments p ON p.user_id = u.tg_id AND p.status = ?
+		WHERE u.source = ?
+		GROUP BY u.tg_id, u.username
+		ORDER BY revenue DESC
+		LIMIT 50`, CurrencyRUB, PaymentStatusApproved.String(), campaign).Scan(&payers).Error
+	if err != nil {
+		s.logAndReportError("Campaign payers fetch failed", ErrDatabasef("Failed to fetch campaign payers: %v", err), map[string]interface{}{
+			"campaign": campaign,
+		})
+		s.reply(chatID, "Ошибка получения плательщиков кампании")
+		return
+	}
+
+	if len(payers) == 0 {
+		s.reply(chatID, fmt.Sprintf("По кампании %s оплат пока нет", campaign))
+		return
+	}
+
+	text := fmt.Sprintf("💳 Плательщики кампании %s:\n", campaign)
+	for _, payer := range payers {
+		text += fmt.Sprintf("\n• @%s (%d): заказов %d, %d руб.", payer.Username, payer.TgID, payer.Payments, payer.Revenue)
+	}
+	s.reply(chatID, text)
+}
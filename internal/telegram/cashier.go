@@ -0,0 +1,153 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// receiptCashiers возвращает кассиров, а если их нет - всех активных админов
+func (s *Service) receiptCashiers() []db.Admin {
+	var cashiers []db.Admin
+	s.repo.DB().Where("role = ? AND disabled = false", RoleCashier.String()).Find(&cashiers)
+
+	if len(cashiers) == 0 {
+		slog.Info("No cashiers found, notifying all admins")
+		s.repo.DB().Where("role IN (?, ?) AND disabled = false", RoleAdmin.String(), RoleSuper.String()).Find(&cashiers)
+	}
+	return cashiers
+}
+
+func (s *Service) notifyCashiersAboutReceipt(payment *db.Payment, keysIssued bool) {
+	slog.Info("Notifying cashiers about new receipt", "payment_id", payment.ID, "user_id", payment.UserID)
+
+	cashiers := s.receiptCashiers()
+	if len(cashiers) == 0 {
+		slog.Warn("No admins found to notify about receipt", "payment_id", payment.ID)
+		return
+	}
+
+	caption := fmt.Sprintf(`💳 Новый чек для проверки!
+
+📋 Заказ #%d
+👤 Пользователь: @%s
+💰 Сумма: %s
+📦 Тариф: %s x%d`, payment.ID, payment.User.Username, formatAmount(payment.Amount, payment.Currency), payment.Plan.Name, payment.Qty)
+	caption += discountCaption(payment)
+
+	if payment.RejectReason != "" {
+		caption += "\n\n🔁 Повторный чек. Ранее отклонен: " + payment.RejectReason
+	}
+
+	if warning := s.duplicateWarning(payment); warning != "" {
+		caption += "\n\n" + warning
+	}
+
+	if keysIssued {
+		caption += "\n\n🔑 Ключи уже выданы. При отклонении они будут отключены автоматически"
+	} else {
+		caption += "\n\n⏳ Ключи будут выданы после одобрения"
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Одобрить", CallbackPaymentApprove.WithID(payment.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отклонить", CallbackPaymentReject.WithID(payment.ID)),
+		),
+	)
+	if payment.DuplicateOf != nil {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🔍 Исходный заказ #%d", *payment.DuplicateOf), CallbackPaymentInfo.WithID(*payment.DuplicateOf)),
+		))
+	}
+
+	for _, cashier := range cashiers {
+		slog.Info("Notifying cashier about receipt", "payment_id", payment.ID, "cashier_id", cashier.TgID)
+
+		sent, err := s.sendReceiptCopy(cashier.TgID, payment.ReceiptFileID, caption, &keyboard)
+		if err != nil {
+			slog.Error("Failed to send receipt to cashier", "payment_id", payment.ID, "cashier_id", cashier.TgID, "error", err)
+			continue
+		}
+
+		notice := &db.CashierNotice{PaymentID: payment.ID, ChatID: cashier.TgID, MessageID: sent.MessageID}
+		if err := s.repo.DB().Create(notice).Error; err != nil {
+			slog.Error("Failed to save cashier notice", "payment_id", payment.ID, "cashier_id", cashier.TgID, "error", err)
+		}
+	}
+}
+
+// sendReceiptCopy пересылает чек кассиру. Тип файла не хранится, поэтому
+// сначала пробуем как фото, а при ошибке отправляем документом
+func (s *Service) sendReceiptCopy(chatID int64, fileID, caption string, keyboard *tgbotapi.InlineKeyboardMarkup) (tgbotapi.Message, error) {
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(fileID))
+	photo.Caption = caption
+	if keyboard != nil {
+		photo.ReplyMarkup = keyboard
+	}
+	if sent, err := s.bot.Send(photo); err == nil {
+		return sent, nil
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileID(fileID))
+	doc.Caption = caption
+	if keyboard != nil {
+		doc.ReplyMarkup = keyboard
+	}
+	return s.bot.Send(doc)
+}
+
+// syncCashierNotices заменяет кнопки во всех копиях чека итогом проверки,
+// чтобы другой кассир не взялся за уже обработанный платеж
+func (s *Service) syncCashierNotices(paymentID uint, result string) {
+	var notices []db.CashierNotice
+	if err := s.repo.DB().Where("payment_id = ?", paymentID).Find(&notices).Error; err != nil {
+		slog.Error("Failed to fetch cashier notices", "payment_id", paymentID, "error", err)
+		return
+	}
+
+	for _, notice := range notices {
+		edit := tgbotapi.NewEditMessageCaption(notice.ChatID, notice.MessageID,
+			fmt.Sprintf("📋 Заказ #%d\n%s", paymentID, result))
+		if _, err := s.bot.Send(edit); err != nil {
+			slog.Warn("Failed to update cashier notice", "payment_id", paymentID, "chat_id", notice.ChatID, "error", err)
+		}
+	}
+}
+
+// adminLabel возвращает @username админа для истории решений
+func (s *Service) adminLabel(adminID int64) string {
+	if adminID == 0 {
+		return "автоматически"
+	}
+
+	var user db.User
+	if err := s.repo.DB().First(&user, "tg_id = ?", adminID).Error; err == nil && user.Username != "" {
+		return "@" + user.Username
+	}
+	return "ID " + strconv.FormatInt(adminID, 10)
+}
+
+// editCallbackMessage редактирует сообщение с кнопкой: у копий чека меняется
+// подпись, у обычных сообщений - текст
+func (s *Service) editCallbackMessage(callback *tgbotapi.CallbackQuery, text string, keyboard [][]tgbotapi.InlineKeyboardButton) {
+	msg := callback.Message
+	if msg.Photo == nil && msg.Document == nil {
+		if keyboard == nil {
+			s.editMessageText(msg.Chat.ID, msg.MessageID, text)
+		} else {
+			s.editMessageTextWithKeyboard(msg.Chat.ID, msg.MessageID, text, keyboard)
+		}
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageCaption(msg.Chat.ID, msg.MessageID, text)
+	if keyboard != nil {
+		edit.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	}
+	s.bot.Send(edit)
+}
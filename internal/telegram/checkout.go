@@ -0,0 +1,265 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// buyBackRow - кнопка возврата на предыдущий шаг покупки
+func buyBackRow() []tgbotapi.InlineKeyboardButton {
+	return []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", CallbackBuyBack.String()),
+	}
+}
+
+// continueCheckout показывает первый шаг, на котором еще ничего не выбрано,
+// а если выбрано все - подтверждение заказа. Возвращает текст для ответа на callback
+func (s *Service) continueCheckout(callback *tgbotapi.CallbackQuery, state *BuyState) string {
+	state.Editing = false
+
+	var plan db.Plan
+	if state.PlanID == 0 || s.repo.DB().First(&plan, state.PlanID).Error != nil {
+		state.resetFrom(BuyStepPlan)
+		return s.showPlanStep(callback, state)
+	}
+
+	switch {
+	case state.Platform == "":
+		return s.showPlatformStep(callback, state)
+	case state.Qty == 0 || (plan.MaxQty > 0 && state.Qty > plan.MaxQty):
+		return s.showQtyStep(callback, state, &plan)
+	case state.Pay == "":
+		return s.showMethodStep(callback, state, &plan)
+	}
+	return s.showConfirmStep(callback, state, &plan)
+}
+
+// showBuyStep показывает экран шага step с уже сделанным выбором
+func (s *Service) showBuyStep(callback *tgbotapi.CallbackQuery, state *BuyState, step BuyStep) string {
+	if step == BuyStepPlan {
+		return s.showPlanStep(callback, state)
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, state.PlanID).Error; err != nil {
+		state.resetFrom(BuyStepPlan)
+		return s.showPlanStep(callback, state)
+	}
+
+	switch step {
+	case BuyStepPlatform:
+		return s.showPlatformStep(callback, state)
+	case BuyStepQty:
+		return s.showQtyStep(callback, state, &plan)
+	case BuyStepMethod:
+		return s.showMethodStep(callback, state, &plan)
+	}
+	return s.showConfirmStep(callback, state, &plan)
+}
+
+// payChoice описывает выбранный способ оплаты и сумму в его валюте.
+// ok = false, если способ больше не подходит к заказу
+func (s *Service) payChoice(state *BuyState, plan *db.Plan) (label, total string, ok bool) {
+	price := s.statePrice(state, plan)
+	switch {
+	case state.Pay == CallbackBuyBalance.String():
+		balance, err := userBalance(s.repo.DB(), state.UserID)
+		return "💰 С баланса", formatAmount(price, CurrencyRUB), err == nil && price > 0 && balance >= price
+	case state.Pay == CallbackBuyStars.String():
+		return "⭐ Telegram Stars", formatAmount(plan.PriceStars*state.Qty, CurrencyStars), state.ChangeSubID == 0 && plan.PriceStars > 0
+	case strings.HasPrefix(state.Pay, CallbackBuyOnline.String()):
+		_, err := s.onlinePayments(strings.TrimPrefix(state.Pay, CallbackBuyOnline.String()))
+		return "💳 Онлайн-оплата картой", formatAmount(price, CurrencyRUB), state.ChangeSubID == 0 && err == nil
+	case strings.HasPrefix(state.Pay, CallbackBuyMethod.String()):
+		var method db.PaymentMethod
+		if err := s.repo.DB().First(&method, state.MethodID).Error; err != nil {
+			return "", "", false
+		}
+		amount := s.statePriceIn(state, plan, method.Currency)
+		return fmt.Sprintf("%s (%s)", method.Bank, method.PhoneNumber), formatAmount(amount, method.Currency),
+			s.methodAvailable(&method, amount, time.Now())
+	}
+	return "", "", false
+}
+
+// checkoutSummary - сводка заказа перед подтверждением
+func (s *Service) checkoutSummary(state *BuyState, plan *db.Plan) (string, bool) {
+	label, total, ok := s.payChoice(state, plan)
+	if !ok {
+		return "", false
+	}
+
+	if state.ChangeSubID != 0 {
+		return fmt.Sprintf("🧾 Проверьте заказ\n\n🔄 Смена тарифа на %s (%d дней)\n📉 Зачет за оставшиеся дни: %d руб.\n💳 Оплата: %s\n💰 Доплата: %s",
+			plan.Name, plan.DurationDays, state.Credit, label, total), true
+	}
+
+	text := fmt.Sprintf("🧾 Проверьте заказ\n\n📦 Тариф: %s (%d дней)\n%s Платформа: %s\n🔢 Количество: %d",
+		plan.Name, plan.DurationDays, state.Platform.Emoji(), state.Platform.DisplayName(), state.Qty)
+	// Звезды оплачиваются по своей цене без скидки за количество
+	if state.Pay != CallbackBuyStars.String() && !s.isPartner(state.UserID) {
+		if discount := s.volumeDiscount(plan.ID, state.Qty); discount > 0 {
+			text += fmt.Sprintf("\n📉 Скидка за количество: %d%%", discount)
+		}
+	}
+	text += fmt.Sprintf("\n💳 Оплата: %s\n💰 Итого: %s", label, total)
+	return text, true
+}
+
+// showConfirmStep - сводка заказа с правкой каждого поля и подтверждением.
+// Если выбранный способ оплаты перестал подходить, просим выбрать другой
+func (s *Service) showConfirmStep(callback *tgbotapi.CallbackQuery, state *BuyState, plan *db.Plan) string {
+	summary, ok := s.checkoutSummary(state, plan)
+	if !ok {
+		if state.ChangeSubID != 0 {
+			return "Этот способ оплаты сейчас недоступен, вернитесь назад и выберите другой"
+		}
+		state.resetFrom(BuyStepMethod)
+		if notice := s.showMethodStep(callback, state, plan); notice != "" {
+			return notice
+		}
+		return "Выбранный способ оплаты сейчас недоступен, выберите другой"
+	}
+
+	state.Step = BuyStepConfirm
+
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("✅ Подтвердить заказ", CallbackBuyConfirm.String())},
+	}
+	// При смене тарифа ключ, тариф и количество уже выбраны в /mykeys
+	if state.ChangeSubID == 0 {
+		keyboard = append(keyboard,
+			[]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Тариф", CallbackBuyEdit.WithID(BuyStepPlan)),
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Платформа", CallbackBuyEdit.WithID(BuyStepPlatform)),
+			},
+			[]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Количество", CallbackBuyEdit.WithID(BuyStepQty)),
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Оплата", CallbackBuyEdit.WithID(BuyStepMethod)),
+			},
+		)
+	}
+	keyboard = append(keyboard, buyBackRow())
+
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, summary, keyboard)
+	return ""
+}
+
+// handleBuyEdit открывает шаг с экрана подтверждения. После выбора
+// покупатель вернется к подтверждению, остальные поля сохраняются
+func (s *Service) handleBuyEdit(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	step := BuyStep(strings.TrimPrefix(callback.Data, CallbackBuyEdit.String()))
+	switch step {
+	case BuyStepPlan, BuyStepPlatform, BuyStepQty, BuyStepMethod:
+	default:
+		s.answerCallback(callback.ID, "Неверный шаг")
+		return
+	}
+	if state.Step != BuyStepConfirm || state.ChangeSubID != 0 {
+		s.answerCallback(callback.ID, "Экран устарел, проверьте заказ еще раз")
+		return
+	}
+
+	state.Editing = true
+	s.answerCallback(callback.ID, s.showBuyStep(callback, state, step))
+}
+
+// handleBuyBack возвращает на предыдущий шаг покупки. Выбор на этом шаге и
+// следующих сбрасывается, а из правки возвращаемся к подтверждению
+func (s *Service) handleBuyBack(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	if state.Editing {
+		s.answerCallback(callback.ID, s.continueCheckout(callback, state))
+		return
+	}
+
+	// Смена тарифа начинается с выбора оплаты доплаты
+	if state.ChangeSubID != 0 {
+		state.resetFrom(BuyStepMethod)
+		s.backToPlanChange(callback, state)
+		return
+	}
+
+	prev := state.Step.Prev()
+	state.resetFrom(prev)
+	s.answerCallback(callback.ID, s.showBuyStep(callback, state, prev))
+}
+
+// handleBuyConfirm оформляет заказ выбранным способом после проверки сводки
+func (s *Service) handleBuyConfirm(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	if state.Step != BuyStepConfirm {
+		s.answerCallback(callback.ID, "Экран устарел, проверьте заказ еще раз")
+		return
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, state.PlanID).Error; err != nil ||
+		(state.ChangeSubID == 0 && !s.planAvailable(state.UserID, &plan)) {
+		s.answerCallback(callback.ID, "Тариф больше недоступен, выберите другой")
+		return
+	}
+
+	// Цена или лимит способа могли измениться, пока покупатель смотрел сводку
+	summary, ok := s.checkoutSummary(state, &plan)
+	if !ok {
+		s.answerCallback(callback.ID, s.showConfirmStep(callback, state, &plan))
+		return
+	}
+
+	slog.Info("Checkout confirmed", "user_id", state.UserID, "plan_id", plan.ID, "qty", state.Qty, "pay", state.Pay)
+
+	// Дальше работают обработчики способа, как при выборе кнопкой
+	choice := *callback
+	choice.Data = state.Pay
+	switch {
+	case strings.HasPrefix(state.Pay, CallbackBuyMethod.String()):
+		s.confirmMethodPurchase(&choice, state, summary)
+	case strings.HasPrefix(state.Pay, CallbackBuyOnline.String()):
+		s.handleOnlineSelection(&choice, state)
+	case state.Pay == CallbackBuyStars.String():
+		s.handleStarsSelection(&choice, state)
+	case state.Pay == CallbackBuyBalance.String():
+		s.handleBalanceSelection(&choice, state)
+	}
+}
+
+// handlePaymentEdit отменяет заказ без чека и возвращает покупателя к
+// подтверждению с прежним выбором
+func (s *Service) handlePaymentEdit(callback *tgbotapi.CallbackQuery) {
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackPaymentEdit.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный номер заказа")
+		return
+	}
+
+	canceled, err := s.cancelPendingPayment(uint(paymentID), callback.From.ID)
+	if err != nil {
+		s.answerCallback(callback.ID, "Ошибка изменения заказа")
+		return
+	}
+	if !canceled {
+		s.answerCallback(callback.ID, "Заказ уже оплачен или отменен")
+		return
+	}
+
+	slog.Info("Payment canceled for editing", "payment_id", paymentID, "user_id", callback.From.ID)
+
+	state, ok := buyStates[callback.From.ID]
+	if !ok || state.PaymentID != uint(paymentID) {
+		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+			fmt.Sprintf("🚫 Заказ #%d отменен. Оформить новый - /buy", paymentID))
+		s.answerCallback(callback.ID, "Заказ отменен")
+		return
+	}
+
+	state.PaymentID = 0
+	state.Step = BuyStepConfirm
+	s.answerCallback(callback.ID, s.continueCheckout(callback, state))
+	s.saveCheckout(state)
+}
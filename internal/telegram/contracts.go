@@ -28,9 +28,14 @@ type WGAgentClient interface {
 
 
 type Payments interface {
-	
-	CreateInvoice(userID int64, planID uint) (paymentURL string, err error)
+	// CreateInvoice создает pending-платеж и выставляет счет. paymentURL пустой,
+	// если счет отправлен прямо в чат (Telegram Stars).
+	CreateInvoice(userID int64, planID uint, qty int) (paymentURL string, err error)
 
 	
 	VerifyPayment(invoiceID string) (paid bool, err error)
+
+	// Refund возвращает amount по счету. Провайдер может не поддерживать
+	// частичный возврат и тогда вернет ошибку
+	Refund(invoiceID string, amount int) error
 }
@@ -0,0 +1,371 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	CurrencyRUB   = "RUB"
+	CurrencyUSD   = "USD"
+	CurrencyEUR   = "EUR"
+	CurrencyUSDT  = "USDT"
+	CurrencyStars = "XTR"
+)
+
+// currencies - все валюты в порядке вывода в отчетах
+var currencies = []string{CurrencyRUB, CurrencyUSD, CurrencyEUR, CurrencyUSDT, CurrencyStars}
+
+// methodCurrencies - валюты ручных переводов. Звезды принимаются только через Telegram
+var methodCurrencies = []string{CurrencyRUB, CurrencyUSD, CurrencyEUR, CurrencyUSDT}
+
+func isCurrency(currency string, allowed []string) bool {
+	for _, c := range allowed {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// currencyScale - сколько минимальных единиц в единице валюты. Рубли и звезды
+// хранятся целыми, остальные валюты - в центах
+func currencyScale(currency string) int {
+	switch currency {
+	case CurrencyUSD, CurrencyEUR, CurrencyUSDT:
+		return 100
+	}
+	return 1
+}
+
+// amountValue - сумма без обозначения валюты: 200 или 2.50
+func amountValue(amount int, currency string) string {
+	scale := currencyScale(currency)
+	if scale == 1 {
+		return strconv.Itoa(amount)
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/scale, amount%scale)
+}
+
+func formatAmount(amount int, currency string) string {
+	switch currency {
+	case CurrencyStars:
+		return fmt.Sprintf("%d ⭐", amount)
+	case CurrencyUSD:
+		return amountValue(amount, currency) + " $"
+	case CurrencyEUR:
+		return amountValue(amount, currency) + " €"
+	case CurrencyUSDT:
+		return amountValue(amount, currency) + " USDT"
+	}
+	return fmt.Sprintf("%d руб.", amount)
+}
+
+// parseAmount разбирает сумму из сообщения админа в минимальные единицы валюты
+func parseAmount(value, currency string) (int, error) {
+	value = strings.Replace(value, ",", ".", 1)
+	whole, fraction, hasFraction := strings.Cut(value, ".")
+	scale := currencyScale(currency)
+	if hasFraction && (scale == 1 || len(fraction) == 0 || len(fraction) > 2) {
+		return 0, ErrValidationf("Invalid amount %v for %v", value, currency)
+	}
+
+	units, err := strconv.Atoi(whole)
+	if err != nil || units < 0 {
+		return 0, ErrValidationf("Invalid amount %v for %v", value, currency)
+	}
+	cents := 0
+	if hasFraction {
+		fraction += strings.Repeat("0", 2-len(fraction))
+		if cents, err = strconv.Atoi(fraction); err != nil || cents < 0 {
+			return 0, ErrValidationf("Invalid amount %v for %v", value, currency)
+		}
+	}
+	return units*scale + cents, nil
+}
+
+// planPrice - цена одного ключа тарифа в валюте. 0 - в этой валюте тариф не продается
+func (s *Service) planPrice(plan *db.Plan, currency string) int {
+	switch currency {
+	case CurrencyRUB, "":
+		return plan.PriceInt
+	case CurrencyStars:
+		return plan.PriceStars
+	}
+
+	var price db.PlanPrice
+	err := s.repo.DB().Where("plan_id = ? AND currency = ?", plan.ID, currency).Limit(1).Find(&price).Error
+	if err != nil {
+		slog.Error("Failed to fetch plan price", "plan_id", plan.ID, "currency", currency, "error", err)
+		return 0
+	}
+	return price.Amount
+}
+
+func (s *Service) planPrices(planID uint) []db.PlanPrice {
+	var prices []db.PlanPrice
+	s.repo.DB().Where("plan_id = ?", planID).Find(&prices)
+	sort.Slice(prices, func(i, j int) bool {
+		return currencyOrder(prices[i].Currency) < currencyOrder(prices[j].Currency)
+	})
+	return prices
+}
+
+func currencyOrder(currency string) int {
+	for i, c := range currencies {
+		if c == currency {
+			return i
+		}
+	}
+	return len(currencies)
+}
+
+func planPricesText(prices []db.PlanPrice) string {
+	var parts []string
+	for _, price := range prices {
+		parts = append(parts, formatAmount(price.Amount, price.Currency))
+	}
+	return strings.Join(parts, " / ")
+}
+
+// orderPriceText - цена заказа во всех валютах тарифа для кнопок оформления
+func (s *Service) orderPriceText(userID int64, plan *db.Plan, qty int) string {
+	text := formatAmount(s.orderPrice(userID, plan, qty), CurrencyRUB)
+	for _, price := range s.planPrices(plan.ID) {
+		if amount := s.orderPriceIn(userID, plan, qty, price.Currency); amount > 0 {
+			text += " / " + formatAmount(amount, price.Currency)
+		}
+	}
+	return text
+}
+
+// orderPriceIn - цена заказа в валюте способа оплаты с теми же скидками, что
+// и в рублях. Оптовые цены партнеров заданы только в рублях
+func (s *Service) orderPriceIn(userID int64, plan *db.Plan, qty int, currency string) int {
+	if currency == CurrencyRUB || currency == "" {
+		return s.orderPrice(userID, plan, qty)
+	}
+	if s.isPartner(userID) && s.partnerPrice(userID, plan.ID) > 0 {
+		return 0
+	}
+
+	price := s.planPrice(plan, currency) * qty
+	if discount := s.volumeDiscount(plan.ID, qty); discount > 0 {
+		price -= price * discount / 100
+	}
+	if discount := s.inviteeDiscount(userID); discount > 0 {
+		price -= price * discount / 100
+	}
+	return price
+}
+
+// statePriceIn - цена заказа в процессе покупки в валюте способа оплаты.
+// Доплата за смену тарифа считается от рублевого зачета и принимается только в рублях
+func (s *Service) statePriceIn(state *BuyState, plan *db.Plan, currency string) int {
+	if currency == CurrencyRUB || currency == "" {
+		return s.statePrice(state, plan)
+	}
+	if state.ChangeSubID != 0 {
+		return 0
+	}
+	return s.orderPriceIn(state.UserID, plan, state.Qty, currency)
+}
+
+// currencyTotal - выручка в одной валюте
+type currencyTotal struct {
+	Currency string
+	Total    int
+}
+
+// revenueByCurrency суммирует одобренные платежи по валютам. Надбавка для
+// уникальной суммы не выручка: она вернулась на баланс покупателя
+func revenueByCurrency(tx *gorm.DB) ([]currencyTotal, error) {
+	var totals []currencyTotal
+	err := tx.Model(&db.Payment{}).
+		Select("COALESCE(currency, ?) AS currency, COALESCE(SUM(amount - surcharge), 0) AS total", CurrencyRUB).
+		Where("status = ?", PaymentStatusApproved.String()).
+		Group("currency").Scan(&totals).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to sum revenue by currency: %v", err)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return currencyOrder(totals[i].Currency) < currencyOrder(totals[j].Currency)
+	})
+	return totals, nil
+}
+
+func (s *Service) exchangeRates() map[string]float64 {
+	var rates []db.ExchangeRate
+	if err := s.repo.DB().Find(&rates).Error; err != nil {
+		slog.Error("Failed to fetch exchange rates", "error", err)
+	}
+	result := make(map[string]float64, len(rates))
+	for _, rate := range rates {
+		result[rate.Currency] = rate.Rate
+	}
+	return result
+}
+
+// toRubles переводит сумму в рубли по курсу. false - курса для валюты нет
+func toRubles(amount int, currency string, rates map[string]float64) (int, bool) {
+	if currency == CurrencyRUB || currency == "" {
+		return amount, true
+	}
+	rate, ok := rates[currency]
+	if !ok {
+		return 0, false
+	}
+	return int(math.Round(float64(amount) / float64(currencyScale(currency)) * rate)), true
+}
+
+// revenueText - выручка по валютам и, если заданы курсы, итог в рублях
+func (s *Service) revenueText(totals []currencyTotal) string {
+	if len(totals) == 0 {
+		return "💵 Выручка: 0 руб."
+	}
+
+	rates := s.exchangeRates()
+	text := "💵 Выручка:"
+	converted, complete := 0, true
+	for _, total := range totals {
+		text += "\n• " + formatAmount(total.Total, total.Currency)
+		rubles, ok := toRubles(total.Total, total.Currency, rates)
+		complete = complete && ok
+		converted += rubles
+	}
+	if len(totals) > 1 && len(rates) > 0 {
+		text += fmt.Sprintf("\n≈ %d руб. по курсу", converted)
+		if !complete {
+			text += " (валюты без курса не учтены)"
+		}
+	}
+	return text
+}
+
+// handlePlanPrice задает цену тарифа в валюте
+func (s *Service) handlePlanPrice(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		s.reply(msg.Chat.ID, "Использование: /planprice <id_тарифа> [<валюта> <цена>]\nВалюты: USD, EUR, USDT\nПример: /planprice 1 USD 2.50\n0 - не продавать в валюте, без валюты - показать цены\nРубли меняются в карточке тарифа, звезды - /planstars")
+		return
+	}
+
+	planID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID тарифа")
+		return
+	}
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND is_trial = false AND "+db.PlanOnSale, planID).First(&plan).Error; err != nil {
+		s.reply(msg.Chat.ID, "Тариф не найден")
+		return
+	}
+
+	if len(args) < 3 {
+		text := fmt.Sprintf("💱 Цены тарифа %s: %s", plan.Name, formatAmount(plan.PriceInt, CurrencyRUB))
+		if prices := s.planPrices(plan.ID); len(prices) > 0 {
+			text += " / " + planPricesText(prices)
+		}
+		if plan.PriceStars > 0 {
+			text += " / " + formatAmount(plan.PriceStars, CurrencyStars)
+		}
+		s.reply(msg.Chat.ID, text)
+		return
+	}
+
+	currency := strings.ToUpper(args[1])
+	if currency == CurrencyRUB || currency == CurrencyStars || !isCurrency(currency, currencies) {
+		s.reply(msg.Chat.ID, "Валюта должна быть USD, EUR или USDT")
+		return
+	}
+	amount, err := parseAmount(args[2], currency)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверная цена")
+		return
+	}
+
+	if amount == 0 {
+		err = s.repo.DB().Where("plan_id = ? AND currency = ?", plan.ID, currency).Delete(&db.PlanPrice{}).Error
+	} else {
+		price := db.PlanPrice{PlanID: plan.ID, Currency: currency}
+		err = s.repo.DB().Where(price).Assign(db.PlanPrice{Amount: amount}).FirstOrCreate(&price).Error
+	}
+	if err != nil {
+		s.logAndReportError("Plan price update failed", ErrDatabasef("Failed to save %v price for plan #%v: %v", currency, plan.ID, err), map[string]interface{}{
+			"admin_id": msg.From.ID,
+			"plan_id":  plan.ID,
+			"currency": currency,
+			"amount":   amount,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения цены")
+		return
+	}
+
+	slog.Info("Plan price updated", "admin_id", msg.From.ID, "plan_id", plan.ID, "currency", currency, "amount", amount)
+	if amount == 0 {
+		s.reply(msg.Chat.ID, fmt.Sprintf("✅ Тариф %s больше не продается в %s", plan.Name, currency))
+		return
+	}
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Цена тарифа %s: %s", plan.Name, formatAmount(amount, currency)))
+}
+
+// handleRate задает курс валюты к рублю для сводной выручки
+func (s *Service) handleRate(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		text := "Использование: /rate <валюта> <рублей за единицу>\nПример: /rate USD 92.5\n0 - удалить курс"
+		var rates []db.ExchangeRate
+		s.repo.DB().Order("currency").Find(&rates)
+		for _, rate := range rates {
+			text += fmt.Sprintf("\n• 1 %s = %.2f руб. (%s)", rate.Currency, rate.Rate, rate.UpdatedAt.Format("02.01.2006"))
+		}
+		s.reply(msg.Chat.ID, text)
+		return
+	}
+
+	currency := strings.ToUpper(args[0])
+	if currency == CurrencyRUB || !isCurrency(currency, currencies) {
+		s.reply(msg.Chat.ID, "Валюта должна быть USD, EUR, USDT или XTR")
+		return
+	}
+	rate, err := strconv.ParseFloat(strings.Replace(args[1], ",", ".", 1), 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		s.reply(msg.Chat.ID, "Неверный курс")
+		return
+	}
+
+	if rate == 0 {
+		err = s.repo.DB().Delete(&db.ExchangeRate{}, "currency = ?", currency).Error
+	} else {
+		err = s.repo.DB().Save(&db.ExchangeRate{Currency: currency, Rate: rate}).Error
+	}
+	if err != nil {
+		s.logAndReportError("Exchange rate update failed", ErrDatabasef("Failed to save %v rate: %v", currency, err), map[string]interface{}{
+			"admin_id": msg.From.ID,
+			"currency": currency,
+			"rate":     rate,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения курса")
+		return
+	}
+
+	slog.Info("Exchange rate updated", "admin_id", msg.From.ID, "currency", currency, "rate", rate)
+	if rate == 0 {
+		s.reply(msg.Chat.ID, fmt.Sprintf("✅ Курс %s удален", currency))
+		return
+	}
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Курс: 1 %s = %.2f руб.", currency, rate))
+}
@@ -0,0 +1,139 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxVolumeDiscount - потолок скидки за количество, чтобы опечатка админа не
+// сделала ключи бесплатными
+const maxVolumeDiscount = 90
+
+// volumeDiscount возвращает скидку в процентах за qty ключей тарифа
+func (s *Service) volumeDiscount(planID uint, qty int) int {
+	var rule db.PlanDiscount
+	err := s.repo.DB().Where("plan_id = ? AND min_qty <= ?", planID, qty).
+		Order("min_qty DESC").Limit(1).Find(&rule).Error
+	if err != nil {
+		slog.Error("Failed to fetch volume discount", "plan_id", planID, "qty", qty, "error", err)
+		return 0
+	}
+	return rule.Percent
+}
+
+func (s *Service) planDiscounts(planID uint) []db.PlanDiscount {
+	var rules []db.PlanDiscount
+	s.repo.DB().Where("plan_id = ?", planID).Order("min_qty ASC").Find(&rules)
+	return rules
+}
+
+func volumeDiscountText(rules []db.PlanDiscount) string {
+	var parts []string
+	for _, rule := range rules {
+		parts = append(parts, fmt.Sprintf("от %d шт. −%d%%", rule.MinQty, rule.Percent))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// recordListPrice сохраняет в заказе цену по прайсу, скидку за количество и
+// признак оптового заказа
+func (s *Service) recordListPrice(payment *db.Payment, plan *db.Plan) {
+	payment.ListAmount = s.planPrice(plan, payment.Currency) * payment.Qty
+	payment.Wholesale = payment.ChangeSubID == nil && s.isPartner(payment.UserID)
+	// Партнер платит оптовую цену, а доплата за смену тарифа считается от зачета
+	if payment.ChangeSubID == nil && !payment.Wholesale {
+		payment.VolumeDiscount = s.volumeDiscount(plan.ID, payment.Qty)
+	}
+}
+
+// orderSummary - цена за ключ и итог заказа перед выбором способа оплаты
+func (s *Service) orderSummary(userID int64, plan *db.Plan, qty int) string {
+	total := s.orderPrice(userID, plan, qty)
+	text := fmt.Sprintf("🧾 %s × %d\n💰 За ключ: %d руб.\n💳 Итого: %d руб.", plan.Name, qty, total/qty, total)
+	if list := plan.PriceInt * qty; list != total {
+		text += fmt.Sprintf(" вместо %d руб.", list)
+		if discount := s.volumeDiscount(plan.ID, qty); discount > 0 && !s.isPartner(userID) {
+			text += fmt.Sprintf("\n📉 Скидка за количество: %d%%", discount)
+		}
+	}
+	return text
+}
+
+// discountCaption - строка о скидке для карточек заказа у кассиров
+func discountCaption(payment *db.Payment) string {
+	if payment.VolumeDiscount == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n📉 Скидка за количество %d%%, по прайсу %s", payment.VolumeDiscount, formatAmount(payment.ListAmount, payment.Currency))
+}
+
+func (s *Service) handlePlanDiscount(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		s.reply(msg.Chat.ID, "Использование: /plandiscount <id_тарифа> [<от_ключей> <процент>]\nПример: /plandiscount 1 5 20 - от 5 ключей скидка 20%\n0% - удалить правило, без количества - показать правила")
+		return
+	}
+
+	planID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID тарифа")
+		return
+	}
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND is_trial = false", planID).First(&plan).Error; err != nil {
+		s.reply(msg.Chat.ID, "Тариф не найден")
+		return
+	}
+
+	if len(args) < 3 {
+		rules := s.planDiscounts(plan.ID)
+		if len(rules) == 0 {
+			s.reply(msg.Chat.ID, fmt.Sprintf("У тарифа %s нет скидок за количество", plan.Name))
+			return
+		}
+		s.reply(msg.Chat.ID, fmt.Sprintf("📉 Скидки тарифа %s: %s", plan.Name, volumeDiscountText(rules)))
+		return
+	}
+
+	minQty, err := strconv.Atoi(args[1])
+	if err != nil || minQty < 2 {
+		s.reply(msg.Chat.ID, "Количество должно быть не меньше 2")
+		return
+	}
+	percent, err := strconv.Atoi(args[2])
+	if err != nil || percent < 0 || percent > maxVolumeDiscount {
+		s.reply(msg.Chat.ID, fmt.Sprintf("Процент должен быть от 0 до %d", maxVolumeDiscount))
+		return
+	}
+
+	if percent == 0 {
+		err = s.repo.DB().Where("plan_id = ? AND min_qty = ?", plan.ID, minQty).Delete(&db.PlanDiscount{}).Error
+	} else {
+		rule := db.PlanDiscount{PlanID: plan.ID, MinQty: minQty}
+		err = s.repo.DB().Where(rule).Assign(db.PlanDiscount{Percent: percent}).FirstOrCreate(&rule).Error
+	}
+	if err != nil {
+		s.logAndReportError("Plan discount update failed", ErrDatabasef("Failed to save discount for plan #%v: %v", plan.ID, err), map[string]interface{}{
+			"admin_id": msg.From.ID,
+			"plan_id":  plan.ID,
+			"min_qty":  minQty,
+			"percent":  percent,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения скидки")
+		return
+	}
+
+	slog.Info("Plan discount updated", "admin_id", msg.From.ID, "plan_id", plan.ID, "min_qty", minQty, "percent", percent)
+
+	text := fmt.Sprintf("У тарифа %s больше нет скидок за количество", plan.Name)
+	if rules := s.planDiscounts(plan.ID); len(rules) > 0 {
+		text = fmt.Sprintf("✅ Скидки тарифа %s: %s", plan.Name, volumeDiscountText(rules))
+	}
+	s.reply(msg.Chat.ID, text)
+}
@@ -0,0 +1,189 @@
+package telegram
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+	"lime-bot/internal/imagehash"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// receiptHashThreshold - максимальное расстояние Хэмминга, при котором
+// изображения считаются одним и тем же чеком
+const receiptHashThreshold = 6
+
+// receiptHashScanLimit ограничивает число последних чеков для сравнения хэшей
+const receiptHashScanLimit = 5000
+
+// receiptFile - присланный чек. UniqueID одинаков у одного и того же файла
+// даже при пересылке другим пользователем
+type receiptFile struct {
+	FileID   string
+	UniqueID string
+	Image    bool
+}
+
+func receiptFromMessage(msg *tgbotapi.Message) (receiptFile, bool) {
+	if len(msg.Photo) > 0 {
+		photo := msg.Photo[len(msg.Photo)-1]
+		return receiptFile{FileID: photo.FileID, UniqueID: photo.FileUniqueID, Image: true}, true
+	}
+	if msg.Document != nil {
+		return receiptFile{
+			FileID:   msg.Document.FileID,
+			UniqueID: msg.Document.FileUniqueID,
+			Image:    strings.HasPrefix(msg.Document.MimeType, "image/"),
+		}, true
+	}
+	return receiptFile{}, false
+}
+
+// receiptHash скачивает изображение чека и считает его перцептивный хэш
+func (s *Service) receiptHash(fileID string) (string, error) {
+	url, err := s.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download receipt: status %d", resp.StatusCode)
+	}
+
+	hash, err := imagehash.FromReader(io.LimitReader(resp.Body, 20<<20))
+	if err != nil {
+		return "", err
+	}
+	return imagehash.Format(hash), nil
+}
+
+// findReceiptDuplicate ищет другой заказ с тем же файлом или похожим
+// изображением чека. nil - совпадений нет
+func (s *Service) findReceiptDuplicate(paymentID uint, uniqueID, hash string) (*db.Payment, error) {
+	if uniqueID != "" {
+		var original db.Payment
+		err := s.repo.DB().Where("receipt_unique_id = ? AND id <> ?", uniqueID, paymentID).
+			Order("id ASC").Limit(1).Find(&original).Error
+		if err != nil {
+			return nil, ErrDatabasef("Failed to search receipt by unique id: %v", err)
+		}
+		if original.ID != 0 {
+			return &original, nil
+		}
+	}
+
+	if hash == "" {
+		return nil, nil
+	}
+	target, err := imagehash.Parse(hash)
+	if err != nil {
+		return nil, nil
+	}
+
+	var candidates []db.Payment
+	err = s.repo.DB().Select("id", "user_id", "receipt_hash").
+		Where("receipt_hash <> '' AND id <> ?", paymentID).
+		Order("id DESC").Limit(receiptHashScanLimit).Find(&candidates).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to load receipt hashes: %v", err)
+	}
+
+	best, bestDistance := uint(0), receiptHashThreshold+1
+	for _, candidate := range candidates {
+		other, err := imagehash.Parse(candidate.ReceiptHash)
+		if err != nil {
+			continue
+		}
+		if d := imagehash.Distance(target, other); d < bestDistance {
+			best, bestDistance = candidate.ID, d
+		}
+	}
+
+	if best == 0 {
+		return nil, nil
+	}
+
+	var original db.Payment
+	if err := s.repo.DB().First(&original, best).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch original payment #%v: %v", best, err)
+	}
+	return &original, nil
+}
+
+// duplicateWarning описывает для кассира, на какой заказ похож чек
+func (s *Service) duplicateWarning(payment *db.Payment) string {
+	if payment.DuplicateOf == nil {
+		return ""
+	}
+
+	var original db.Payment
+	if err := s.repo.DB().Preload("User").First(&original, *payment.DuplicateOf).Error; err != nil {
+		return fmt.Sprintf("⚠️ ВОЗМОЖНО ПОВТОРНЫЙ ЧЕК: похож на заказ #%d", *payment.DuplicateOf)
+	}
+
+	match := "похожее изображение"
+	if original.ReceiptUniqueID != "" && original.ReceiptUniqueID == payment.ReceiptUniqueID {
+		match = "тот же файл"
+	}
+
+	who := "тот же пользователь"
+	if original.UserID != payment.UserID {
+		who = "другой пользователь @" + original.User.Username
+	}
+
+	status := PaymentStatus(original.Status)
+	return fmt.Sprintf("⚠️ ВОЗМОЖНО ПОВТОРНЫЙ ЧЕК: %s, что в заказе #%d (%s, %s %s)",
+		match, original.ID, who, status.Emoji(), status.DisplayName())
+}
+
+// handlePaymentInfoCallback показывает кассиру исходный заказ с его чеком
+func (s *Service) handlePaymentInfoCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.isAdmin(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackPaymentInfo.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID платежа")
+		return
+	}
+
+	var payment db.Payment
+	if err := s.repo.DB().Preload("User").Preload("Plan").First(&payment, paymentID).Error; err != nil {
+		s.answerCallback(callback.ID, "Платеж не найден")
+		return
+	}
+
+	status := PaymentStatus(payment.Status)
+	caption := fmt.Sprintf("📋 Заказ #%d\n👤 @%s\n💰 %s\n📦 %s x%d\n📅 %s\n%s %s",
+		payment.ID, payment.User.Username, formatAmount(payment.Amount, payment.Currency),
+		payment.Plan.Name, payment.Qty, payment.CreatedAt.Format("02.01.2006 15:04"),
+		status.Emoji(), status.DisplayName())
+	caption += discountCaption(&payment)
+	if payment.RejectReason != "" {
+		caption += "\nПричина отклонения: " + payment.RejectReason
+	}
+
+	s.answerCallback(callback.ID, "")
+
+	if payment.ReceiptFileID == "" {
+		s.reply(callback.Message.Chat.ID, caption+"\n\nЧек не приложен")
+		return
+	}
+	if _, err := s.sendReceiptCopy(callback.Message.Chat.ID, payment.ReceiptFileID, caption, nil); err != nil {
+		s.reply(callback.Message.Chat.ID, caption+"\n\nНе удалось отправить чек")
+	}
+}
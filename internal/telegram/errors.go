@@ -2,6 +2,7 @@ package telegram
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"runtime"
 	"strconv"
@@ -197,16 +198,10 @@ func stringify(v interface{}) string {
 	switch val := v.(type) {
 	case string:
 		return val
-	case int, int8, int16, int32, int64:
-		return strconv.FormatInt(int64(val.(int64)), 10)
-	case uint, uint8, uint16, uint32, uint64:
-		return strconv.FormatUint(uint64(val.(uint64)), 10)
-	case float32, float64:
-		return strconv.FormatFloat(float64(val.(float64)), 'f', -1, 64)
-	case bool:
-		return strconv.FormatBool(val)
+	case error:
+		return val.Error()
 	default:
-		return "unknown"
+		return fmt.Sprint(val)
 	}
 }
 
@@ -0,0 +1,365 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+	"lime-bot/internal/gates/wgagent"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+var errNoFreeSeats = errors.New("no free seats")
+
+func (s *Service) seatLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=seat_%s", s.bot.Self.UserName, code)
+}
+
+// ownerSeatSubscriptions - активные подписки пользователя на семейных тарифах,
+// в которые он может приглашать
+func (s *Service) ownerSeatSubscriptions(userID int64) ([]db.Subscription, error) {
+	var subs []db.Subscription
+	err := s.repo.DB().Preload("Plan").
+		Where("user_id = ? AND active = true AND seat_of IS NULL", userID).
+		Where("plan_id IN (?)", s.repo.DB().Model(&db.Plan{}).Select("id").Where("seats > 1")).
+		Order("id ASC").Find(&subs).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to fetch seat subscriptions of user %v: %v", userID, err)
+	}
+	return subs, nil
+}
+
+// seatMembers - занятые места подписки владельца. Место с заглушкой вместо
+// пира тоже считается занятым, пока его не уберут
+func seatMembers(tx *gorm.DB, ownerSubID uint) ([]db.Subscription, error) {
+	var members []db.Subscription
+	if err := tx.Where("seat_of = ?", ownerSubID).Order("id ASC").Find(&members).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch seats of subscription #%v: %v", ownerSubID, err)
+	}
+	return members, nil
+}
+
+// freeSeats - сколько еще участников можно пригласить. Владелец занимает одно место
+func freeSeats(tx *gorm.DB, owner *db.Subscription) (int, error) {
+	var used int64
+	if err := tx.Model(&db.Subscription{}).Where("seat_of = ?", owner.ID).Count(&used).Error; err != nil {
+		return 0, ErrDatabasef("Failed to count seats of subscription #%v: %v", owner.ID, err)
+	}
+	free := owner.Plan.Seats - 1 - int(used)
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// seatInviteCode возвращает код приглашения, создавая его при первом обращении
+func (s *Service) seatInviteCode(owner *db.Subscription) (string, error) {
+	if owner.InviteCode != "" {
+		return owner.InviteCode, nil
+	}
+	code := generateClaimCode()
+	if err := s.repo.DB().Model(&db.Subscription{}).Where("id = ?", owner.ID).Update("invite_code", code).Error; err != nil {
+		return "", ErrDatabasef("Failed to save invite code of subscription #%v: %v", owner.ID, err)
+	}
+	owner.InviteCode = code
+	return code, nil
+}
+
+func (s *Service) handleFamily(msg *tgbotapi.Message) {
+	text, keyboard := s.familyPanel(msg.From.ID)
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	if len(keyboard) > 0 {
+		reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	}
+	s.bot.Send(reply)
+}
+
+// familyPanel описывает места семейных подписок владельца: ссылку приглашения,
+// участников и их последнее подключение
+func (s *Service) familyPanel(ownerID int64) (string, [][]tgbotapi.InlineKeyboardButton) {
+	owned, err := s.ownerSeatSubscriptions(ownerID)
+	if err != nil {
+		s.logAndReportError("Family panel failed", err, map[string]interface{}{
+			"user_id": ownerID,
+		})
+		return "Ошибка получения семейных подписок", nil
+	}
+
+	if len(owned) == 0 {
+		text := "👨‍👩‍👧 У вас нет семейных подписок.\n\nСемейный тариф дает несколько мест: у каждого участника свой ключ, срок общий. Выберите тариф с местами в /buy"
+		var seat db.Subscription
+		s.repo.DB().Where("user_id = ? AND active = true AND seat_of IS NOT NULL", ownerID).Limit(1).Find(&seat)
+		if seat.ID != 0 {
+			var owner db.Subscription
+			s.repo.DB().Preload("User").Where("id = ?", *seat.SeatOf).Limit(1).Find(&owner)
+			text = fmt.Sprintf("👨‍👩‍👧 Вы участник семейной подписки @%s до %s. Ключ доступен в /mykeys",
+				owner.User.Username, seat.EndDate.Format("02.01.2006"))
+		}
+		return text, nil
+	}
+
+	text := "👨‍👩‍👧 Семейные подписки\n"
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for i := range owned {
+		owner := &owned[i]
+		members, err := seatMembers(s.repo.DB(), owner.ID)
+		if err != nil {
+			s.logAndReportError("Family seats fetch failed", err, map[string]interface{}{
+				"subscription_id": owner.ID,
+			})
+			continue
+		}
+
+		text += fmt.Sprintf("\n%s до %s, занято мест: %d из %d\n• Вы (%s): %s",
+			owner.Plan.Name, owner.EndDate.Format("02.01.2006"), len(members)+1, owner.Plan.Seats,
+			owner.PeerID, s.lastHandshakeText(owner))
+
+		for j := range members {
+			member := &members[j]
+			var user db.User
+			s.repo.DB().Where("tg_id = ?", member.UserID).Limit(1).Find(&user)
+			text += fmt.Sprintf("\n• @%s (%s): %s", user.Username, member.PeerID, s.lastHandshakeText(member))
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("❌ Убрать @"+user.Username, CallbackSeatRemove.WithID(member.ID)),
+			})
+		}
+
+		if len(members)+1 < owner.Plan.Seats {
+			code, err := s.seatInviteCode(owner)
+			if err != nil {
+				s.logAndReportError("Seat invite code failed", err, map[string]interface{}{
+					"subscription_id": owner.ID,
+				})
+				continue
+			}
+			text += "\n🔗 Приглашение: " + s.seatLink(code)
+		}
+		text += "\n"
+	}
+	text += "\nПерешлите ссылку тому, кого хотите пригласить. Убранный участник теряет доступ, место освобождается"
+	return text, keyboard
+}
+
+// lastHandshakeText - последнее подключение ключа по данным wg-agent
+func (s *Service) lastHandshakeText(sub *db.Subscription) string {
+	if sub.PrivKeyEnc == "PLACEHOLDER_PRIVATE_KEY" {
+		return "ключ еще не выдан"
+	}
+	if !sub.Active {
+		return "отключен"
+	}
+	handshake, err := s.peerLastHandshake(sub.Interface, sub.PublicKey)
+	if err != nil {
+		return "нет данных"
+	}
+	if handshake.IsZero() {
+		return "еще не подключался"
+	}
+	return "подключался " + handshake.Format("02.01.2006 15:04")
+}
+
+func (s *Service) peerLastHandshake(interfaceName, publicKey string) (time.Time, error) {
+	wgConfig := wgagent.Config{
+		Addr:     s.cfg.WGAgentAddr,
+		CertFile: s.cfg.WGClientCert,
+		KeyFile:  s.cfg.WGClientKey,
+		CAFile:   s.cfg.WGCACert,
+	}
+
+	if s.cfg.WGClientCert == "" || s.cfg.WGClientKey == "" || s.cfg.WGCACert == "" {
+		wgConfig = wgagent.Config{
+			Addr: s.cfg.WGAgentAddr,
+		}
+	}
+
+	wgClient, err := wgagent.NewClient(wgConfig)
+	if err != nil {
+		return time.Time{}, ErrWGAgentf("Failed to create WG client for peer info: %v", err)
+	}
+	defer wgClient.Close()
+
+	info, err := wgClient.GetPeerInfo(context.Background(), &wgagent.GetPeerInfoRequest{
+		Interface: interfaceName,
+		PublicKey: publicKey,
+	})
+	if err != nil {
+		return time.Time{}, ErrWGAgentf("Failed to get peer info: %v", err)
+	}
+	if info.LastHandshakeUnix == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(info.LastHandshakeUnix, 0), nil
+}
+
+// joinSeat занимает место в семейной подписке по ссылке start=seat_<код>.
+// У участника свой пир, а дата окончания совпадает с подпиской владельца
+func (s *Service) joinSeat(chatID, userID int64, code string) {
+	var owner db.Subscription
+	err := s.repo.DB().Preload("Plan").
+		Where("invite_code = ? AND active = true AND seat_of IS NULL", code).First(&owner).Error
+	if err != nil || owner.Plan.Seats < 2 || time.Now().After(owner.EndDate) {
+		s.reply(chatID, "❌ Приглашение не найдено или подписка уже закончилась")
+		return
+	}
+	if owner.UserID == userID {
+		s.reply(chatID, "Это ваша семейная подписка. Отправьте ссылку тому, кого хотите пригласить")
+		return
+	}
+
+	var existing int64
+	s.repo.DB().Model(&db.Subscription{}).Where("seat_of = ? AND user_id = ?", owner.ID, userID).Count(&existing)
+	if existing > 0 {
+		s.reply(chatID, "Вы уже участник этой подписки. Ключ доступен в /mykeys")
+		return
+	}
+
+	var sub *db.Subscription
+	err = s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		free, err := freeSeats(tx, &owner)
+		if err != nil {
+			return err
+		}
+		if free == 0 {
+			return errNoFreeSeats
+		}
+
+		sub, err = s.createSubscriptionForPlan(tx, userID, &owner.Plan, owner.PaymentID)
+		if err != nil {
+			return err
+		}
+		sub.SeatOf = &owner.ID
+		sub.EndDate = owner.EndDate
+		err = tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Updates(map[string]interface{}{
+			"seat_of":  owner.ID,
+			"end_date": owner.EndDate,
+		}).Error
+		if err != nil {
+			return ErrDatabasef("Failed to attach subscription #%v to seat of #%v: %v", sub.ID, owner.ID, err)
+		}
+		return nil
+	})
+	if errors.Is(err, errNoFreeSeats) {
+		s.reply(chatID, "❌ Свободных мест в этой подписке не осталось")
+		return
+	}
+	if err != nil {
+		s.logAndReportError("Seat join failed", err, map[string]interface{}{
+			"owner_subscription_id": owner.ID,
+			"user_id":               userID,
+		})
+		s.handleError(chatID, err)
+		return
+	}
+
+	slog.Info("Seat taken", "owner_subscription_id", owner.ID, "owner_id", owner.UserID, "user_id", userID, "subscription_id", sub.ID)
+
+	if sub.PrivKeyEnc == "PLACEHOLDER_PRIVATE_KEY" {
+		s.sendPlaceholderNotification(userID, sub)
+	} else {
+		s.sendSubscriptionToUserWithData(userID, sub, "", "")
+	}
+
+	var user db.User
+	s.repo.DB().Where("tg_id = ?", userID).Limit(1).Find(&user)
+	s.reply(owner.UserID, fmt.Sprintf("👨‍👩‍👧 @%s занял место в подписке %s. Участники: /family", user.Username, owner.Plan.Name))
+}
+
+// removeSeatMember убирает участника из подписки владельца: пир отключается
+// и удаляется, место освобождается
+func (s *Service) removeSeatMember(ownerID int64, memberSubID uint) (*db.Subscription, error) {
+	var member db.Subscription
+	err := s.repo.DB().
+		Where("id = ? AND seat_of IN (?)", memberSubID, s.repo.DB().Model(&db.Subscription{}).Select("id").Where("user_id = ?", ownerID)).
+		First(&member).Error
+	if err != nil {
+		return nil, ErrSubscriptionf("Seat #%v not found for owner %v: %v", memberSubID, ownerID, err)
+	}
+
+	if member.Active && member.PrivKeyEnc != "PLACEHOLDER_PRIVATE_KEY" {
+		if err := s.disablePeer(member.Interface, member.PublicKey); err != nil {
+			slog.Error("Failed to disable peer", "peer_id", member.PeerID, "error", err)
+		}
+		if err := s.removePeer(member.Interface, member.PublicKey); err != nil {
+			slog.Error("Failed to remove peer", "peer_id", member.PeerID, "error", err)
+		}
+	}
+
+	err = s.repo.DB().Model(&db.Subscription{}).Where("id = ?", member.ID).Updates(map[string]interface{}{
+		"active":     false,
+		"auto_renew": false,
+		"seat_of":    nil,
+	}).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to free seat #%v: %v", member.ID, err)
+	}
+
+	slog.Info("Seat freed", "owner_id", ownerID, "subscription_id", member.ID, "member_id", member.UserID)
+	return &member, nil
+}
+
+func (s *Service) handleSeatRemoveCallback(callback *tgbotapi.CallbackQuery) {
+	subID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackSeatRemove.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID места")
+		return
+	}
+
+	member, err := s.removeSeatMember(callback.From.ID, uint(subID))
+	if err != nil {
+		s.logAndReportError("Seat removal failed", err, map[string]interface{}{
+			"owner_id":        callback.From.ID,
+			"subscription_id": subID,
+		})
+		s.answerCallback(callback.ID, "Участник не найден")
+		return
+	}
+
+	s.answerCallback(callback.ID, "Участник убран, место свободно")
+	s.reply(member.UserID, "👨‍👩‍👧 Владелец семейной подписки убрал вас из нее. Ключ "+member.PeerID+" отключен")
+
+	text, keyboard := s.familyPanel(callback.From.ID)
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
+}
+
+func (s *Service) handlePlanSeats(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		s.reply(msg.Chat.ID, "Использование: /planseats <id_тарифа> <мест>\nПример: /planseats 2 5\n0 - обычный тариф без мест")
+		return
+	}
+
+	planID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID тарифа")
+		return
+	}
+
+	seats, err := strconv.Atoi(args[1])
+	if err != nil || seats < 0 || seats == 1 {
+		s.reply(msg.Chat.ID, "Неверное количество мест: 0 или от 2, включая владельца")
+		return
+	}
+
+	result := s.repo.DB().Model(&db.Plan{}).Where("id = ? AND is_trial = false", planID).Update("seats", seats)
+	if result.Error != nil {
+		s.reply(msg.Chat.ID, "Ошибка обновления тарифа")
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.reply(msg.Chat.ID, "Тариф не найден")
+		return
+	}
+
+	if seats == 0 {
+		s.reply(msg.Chat.ID, fmt.Sprintf("✅ Тариф #%d больше не семейный. Уже занятые места сохраняются", planID))
+		return
+	}
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Тариф #%d теперь семейный: %d мест, включая владельца", planID, seats))
+}
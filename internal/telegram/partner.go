@@ -0,0 +1,368 @@
+package telegram
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// partnerQtyOptions - варианты количества ключей в оптовом заказе
+var partnerQtyOptions = []int{10, 25, 50, 100}
+
+// partnerListLimit ограничивает списки ключей и клиентов в кабинете
+const partnerListLimit = 20
+
+// errPartnerKeyClaimed - ключ активировали между проверкой и обновлением
+var errPartnerKeyClaimed = errors.New("partner key already claimed")
+
+// isPartner проверяет, что пользователь - активный партнер
+func (s *Service) isPartner(userID int64) bool {
+	var admin db.Admin
+	err := s.repo.DB().Where("tg_id = ? AND role = ? AND disabled = false", userID, RolePartner.String()).First(&admin).Error
+	return err == nil
+}
+
+// partnerPrice возвращает оптовую цену тарифа для партнера, 0 - цена не задана
+func (s *Service) partnerPrice(partnerID int64, planID uint) int {
+	var price db.PartnerPrice
+	s.repo.DB().Where("partner_id = ? AND plan_id = ?", partnerID, planID).Limit(1).Find(&price)
+	return price.PriceInt
+}
+
+func generateClaimCode() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func (s *Service) claimLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=claim_%s", s.bot.Self.UserName, code)
+}
+
+// issuePartnerKeys выпускает ключи по оптовому заказу. Пиры не создаются до
+// активации, поэтому срок подписки начинается у клиента с момента активации
+func issuePartnerKeys(tx *gorm.DB, payment *db.Payment) error {
+	for i := 0; i < payment.Qty; i++ {
+		key := &db.PartnerKey{
+			PartnerID: payment.UserID,
+			PaymentID: payment.ID,
+			PlanID:    payment.PlanID,
+			Code:      generateClaimCode(),
+		}
+		if err := tx.Create(key).Error; err != nil {
+			return ErrDatabasef("Failed to create partner key %v of %v for payment #%v: %v", i+1, payment.Qty, payment.ID, err)
+		}
+	}
+	return nil
+}
+
+// partnerKeysForRefund - сколько ключей оптового заказа покрывает сумма
+// возврата. Частично возвращенный ключ тоже отзывается
+func partnerKeysForRefund(payment *db.Payment, amount int) int {
+	paid := payment.Amount - payment.Surcharge
+	if paid <= 0 || amount >= paid {
+		return payment.Qty
+	}
+	return (amount*payment.Qty + paid - 1) / paid
+}
+
+// revokePartnerKeys отзывает неактивированные ключи оптового заказа в счет
+// возврата суммы amount. Активированные клиентами ключи не трогаются
+func revokePartnerKeys(tx *gorm.DB, payment *db.Payment, amount int) error {
+	count := partnerKeysForRefund(payment, amount)
+	if count == 0 {
+		return nil
+	}
+
+	var ids []uint
+	err := tx.Model(&db.PartnerKey{}).Where("payment_id = ? AND claimed_by IS NULL AND revoked = false", payment.ID).
+		Order("id DESC").Limit(count).Pluck("id", &ids).Error
+	if err != nil {
+		return ErrDatabasef("Failed to fetch partner keys for payment #%v: %v", payment.ID, err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := tx.Model(&db.PartnerKey{}).Where("id IN ?", ids).Update("revoked", true).Error; err != nil {
+		return ErrDatabasef("Failed to revoke partner keys for payment #%v: %v", payment.ID, err)
+	}
+	return nil
+}
+
+// handlePartnerPrice задает оптовую цену тарифа для партнера. Цена 0 удаляет ее
+func (s *Service) handlePartnerPrice(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) != 3 {
+		s.reply(msg.Chat.ID, "Использование: /partnerprice <username> <id тарифа> <цена>\nПример: /partnerprice reseller 1 120\nЦена 0 возвращает розничную цену")
+		return
+	}
+
+	planID, err1 := strconv.ParseUint(args[1], 10, 32)
+	price, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil || price < 0 {
+		s.reply(msg.Chat.ID, "ID тарифа и цена должны быть неотрицательными числами")
+		return
+	}
+
+	var user db.User
+	if err := s.repo.DB().Where("username = ?", strings.TrimPrefix(args[0], "@")).First(&user).Error; err != nil {
+		s.reply(msg.Chat.ID, "Пользователь не найден: "+args[0])
+		return
+	}
+	if !s.isPartner(user.TgID) {
+		s.reply(msg.Chat.ID, fmt.Sprintf("@%s не партнер. Назначьте роль: /add_admin @%s partner", user.Username, user.Username))
+		return
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, planID).Error; err != nil {
+		s.reply(msg.Chat.ID, "Тариф не найден")
+		return
+	}
+
+	query := s.repo.DB().Where("partner_id = ? AND plan_id = ?", user.TgID, plan.ID)
+	if price == 0 {
+		err := query.Delete(&db.PartnerPrice{}).Error
+		if err != nil {
+			s.handleError(msg.Chat.ID, ErrDatabasef("Failed to delete partner price: %v", err))
+			return
+		}
+		s.reply(msg.Chat.ID, fmt.Sprintf("✅ @%s покупает %s по розничной цене %d руб.", user.Username, plan.Name, plan.PriceInt))
+		return
+	}
+
+	partnerPrice := db.PartnerPrice{PartnerID: user.TgID, PlanID: plan.ID}
+	if err := query.Assign(db.PartnerPrice{PriceInt: price}).FirstOrCreate(&partnerPrice).Error; err != nil {
+		s.handleError(msg.Chat.ID, ErrDatabasef("Failed to save partner price: %v", err))
+		return
+	}
+
+	slog.Info("Partner price set", "partner_id", user.TgID, "plan_id", plan.ID, "price", price, "admin_id", msg.From.ID)
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Цена %s для @%s: %d руб. (розница %d руб.)", plan.Name, user.Username, price, plan.PriceInt))
+}
+
+// claimPartnerKey активирует ключ партнера на пользователя, перешедшего по ссылке
+func (s *Service) claimPartnerKey(chatID, userID int64, code string) {
+	var key db.PartnerKey
+	if err := s.repo.DB().Preload("Plan").Where("code = ?", code).First(&key).Error; err != nil {
+		s.reply(chatID, "❌ Ссылка активации не найдена")
+		return
+	}
+	if key.Revoked {
+		s.reply(chatID, "❌ Этот ключ отозван. Обратитесь к тому, кто выдал вам ссылку")
+		return
+	}
+	if key.ClaimedBy != nil {
+		if *key.ClaimedBy == userID {
+			s.reply(chatID, "Вы уже активировали этот ключ. Он доступен в /mykeys")
+		} else {
+			s.reply(chatID, "❌ Этот ключ уже активирован")
+		}
+		return
+	}
+
+	var sub *db.Subscription
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&db.PartnerKey{}).Where("id = ? AND claimed_by IS NULL AND revoked = false", key.ID).
+			Updates(map[string]interface{}{
+				"claimed_by": userID,
+				"claimed_at": time.Now(),
+			})
+		if res.Error != nil {
+			return ErrDatabasef("Failed to claim partner key #%v: %v", key.ID, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return errPartnerKeyClaimed
+		}
+
+		var err error
+		sub, err = s.createSubscriptionForPlan(tx, userID, &key.Plan, &key.PaymentID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&db.PartnerKey{}).Where("id = ?", key.ID).Update("subscription_id", sub.ID).Error; err != nil {
+			return ErrDatabasef("Failed to link partner key #%v: %v", key.ID, err)
+		}
+		return nil
+	})
+	if errors.Is(err, errPartnerKeyClaimed) {
+		s.reply(chatID, "❌ Этот ключ уже активирован")
+		return
+	}
+	if err != nil {
+		s.logAndReportError("Partner key claim failed", err, map[string]interface{}{
+			"key_id":     key.ID,
+			"partner_id": key.PartnerID,
+			"user_id":    userID,
+		})
+		s.handleError(chatID, err)
+		return
+	}
+
+	slog.Info("Partner key claimed", "key_id", key.ID, "partner_id", key.PartnerID, "user_id", userID, "subscription_id", sub.ID)
+
+	if sub.PrivKeyEnc == "PLACEHOLDER_PRIVATE_KEY" {
+		s.sendPlaceholderNotification(userID, sub)
+	} else {
+		s.sendSubscriptionToUserWithData(userID, sub, "", "")
+	}
+
+	var user db.User
+	s.repo.DB().Where("tg_id = ?", userID).Limit(1).Find(&user)
+	s.reply(key.PartnerID, fmt.Sprintf("🔑 Ключ %s (%s) активировал @%s", key.Code, key.Plan.Name, user.Username))
+}
+
+func (s *Service) handlePartner(msg *tgbotapi.Message) {
+	if !s.isPartner(msg.From.ID) {
+		s.reply(msg.Chat.ID, "Кабинет доступен только партнерам")
+		return
+	}
+
+	text, keyboard := s.partnerPanel(msg.From.ID)
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(reply)
+}
+
+// partnerPanel описывает кабинет партнера: ключи, цены и выписки
+func (s *Service) partnerPanel(partnerID int64) (string, [][]tgbotapi.InlineKeyboardButton) {
+	var counts struct {
+		Total   int64
+		Claimed int64
+		Revoked int64
+	}
+	s.repo.DB().Model(&db.PartnerKey{}).
+		Select("COUNT(*) AS total, COUNT(claimed_by) AS claimed, COALESCE(SUM(CASE WHEN revoked AND claimed_by IS NULL THEN 1 ELSE 0 END), 0) AS revoked").
+		Where("partner_id = ?", partnerID).Scan(&counts)
+	free := counts.Total - counts.Claimed - counts.Revoked
+
+	text := fmt.Sprintf("🤝 Партнерский кабинет\n\n🔑 Куплено ключей: %d\n✅ Активировано клиентами: %d\n🆓 Свободно: %d",
+		counts.Total, counts.Claimed, free)
+	if counts.Revoked > 0 {
+		text += fmt.Sprintf("\n↩️ Отозвано возвратом: %d", counts.Revoked)
+	}
+
+	var prices []db.PartnerPrice
+	s.repo.DB().Preload("Plan").Where("partner_id = ?", partnerID).Find(&prices)
+	if len(prices) > 0 {
+		text += "\n\n💰 Ваши цены:"
+		for _, price := range prices {
+			text += fmt.Sprintf("\n• %s - %d руб. (розница %d руб.)", price.Plan.Name, price.PriceInt, price.Plan.PriceInt)
+		}
+	}
+	text += "\n\nКупить ключи оптом: /buy"
+
+	now := time.Now()
+	prev := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		{
+			tgbotapi.NewInlineKeyboardButtonData("🆓 Свободные ключи", CallbackPartnerKeys.String()),
+			tgbotapi.NewInlineKeyboardButtonData("👥 Клиенты", CallbackPartnerUsers.String()),
+		},
+		{
+			tgbotapi.NewInlineKeyboardButtonData("📄 Выписка "+now.Format("01.2006"), CallbackPartnerMonth.WithID(now.Format("2006-01"))),
+			tgbotapi.NewInlineKeyboardButtonData("📄 Выписка "+prev.Format("01.2006"), CallbackPartnerMonth.WithID(prev.Format("2006-01"))),
+		},
+	}
+	return text, keyboard
+}
+
+// handlePartnerCallback обслуживает кабинет. Все выборки ограничены ключами
+// самого партнера
+func (s *Service) handlePartnerCallback(callback *tgbotapi.CallbackQuery) {
+	partnerID := callback.From.ID
+	if !s.isPartner(partnerID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	back := [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", CallbackPartnerPanel.String())},
+	}
+	chatID, messageID := callback.Message.Chat.ID, callback.Message.MessageID
+
+	switch {
+	case callback.Data == CallbackPartnerPanel.String():
+		text, keyboard := s.partnerPanel(partnerID)
+		s.editMessageTextWithKeyboard(chatID, messageID, text, keyboard)
+
+	case callback.Data == CallbackPartnerKeys.String():
+		freeKeys := func() *gorm.DB {
+			return s.repo.DB().Model(&db.PartnerKey{}).Where("partner_id = ? AND claimed_by IS NULL AND revoked = false", partnerID)
+		}
+		var keys []db.PartnerKey
+		var total int64
+		freeKeys().Count(&total)
+		freeKeys().Preload("Plan").Order("id ASC").Limit(partnerListLimit).Find(&keys)
+
+		if len(keys) == 0 {
+			s.editMessageTextWithKeyboard(chatID, messageID, "🆓 Свободных ключей нет. Купить ключи: /buy", back)
+			break
+		}
+		text := "🆓 Свободные ключи. Отправьте ссылку клиенту - ключ активируется при переходе:\n"
+		for _, key := range keys {
+			text += fmt.Sprintf("\n%s: %s", key.Plan.Name, s.claimLink(key.Code))
+		}
+		if total > int64(len(keys)) {
+			text += fmt.Sprintf("\n\n...и еще %d", total-int64(len(keys)))
+		}
+		s.editMessageTextWithKeyboard(chatID, messageID, text, back)
+
+	case callback.Data == CallbackPartnerUsers.String():
+		var keys []db.PartnerKey
+		s.repo.DB().Preload("Plan").Preload("Claimer").Preload("Subscription").
+			Where("partner_id = ? AND claimed_by IS NOT NULL", partnerID).
+			Order("claimed_at DESC").Limit(partnerListLimit).Find(&keys)
+
+		if len(keys) == 0 {
+			s.editMessageTextWithKeyboard(chatID, messageID, "👥 Клиенты еще не активировали ключи", back)
+			break
+		}
+		text := "👥 Последние активации:\n"
+		for _, key := range keys {
+			var username string
+			if key.Claimer != nil {
+				username = key.Claimer.Username
+			}
+			text += fmt.Sprintf("\n• @%s - %s", username, key.Plan.Name)
+			if key.Subscription != nil {
+				status := "🟢"
+				if !key.Subscription.Active {
+					status = "🔴"
+				}
+				text += fmt.Sprintf(" %s до %s", status, key.Subscription.EndDate.Format("02.01.2006"))
+			}
+		}
+		s.editMessageTextWithKeyboard(chatID, messageID, text, back)
+
+	default:
+		month, err := time.ParseInLocation("2006-01", strings.TrimPrefix(callback.Data, CallbackPartnerMonth.String()), time.Local)
+		if err != nil {
+			s.answerCallback(callback.ID, "Неверный месяц")
+			return
+		}
+		statement, err := db.BuildPartnerStatement(s.repo.DB(), partnerID, month)
+		if err != nil {
+			s.logAndReportError("Partner statement failed", ErrDatabasef("Failed to build partner statement: %v", err), map[string]interface{}{
+				"partner_id": partnerID,
+				"month":      month.Format("2006-01"),
+			})
+			s.answerCallback(callback.ID, "Ошибка формирования выписки")
+			return
+		}
+		s.editMessageTextWithKeyboard(chatID, messageID, statement.Text(), back)
+	}
+
+	s.answerCallback(callback.ID, "")
+}
@@ -2,7 +2,9 @@ package telegram
 
 import (
 	"fmt"
+	"log/slog"
 	"strings"
+	"time"
 
 	"lime-bot/internal/db"
 
@@ -12,10 +14,17 @@ import (
 func (s *Service) handleAddPaymentMethod(msg *tgbotapi.Message) {
 	args := strings.Fields(msg.CommandArguments())
 	if len(args) < 3 {
-		s.reply(msg.Chat.ID, "Использование: /addpmethod <телефон> <банк> <имя_владельца>\nПример: /addpmethod +79991234567 Сбербанк \"Иван Иванов\"")
+		s.reply(msg.Chat.ID, "Использование: /addpmethod <телефон> <банк> <имя_владельца> [валюта]\nПример: /addpmethod +79991234567 Сбербанк \"Иван Иванов\"\nВалюта: RUB (по умолчанию), USD, EUR или USDT")
 		return
 	}
 
+	// Валюта необязательна и указывается последней, после имени владельца
+	currency := CurrencyRUB
+	if last := strings.ToUpper(args[len(args)-1]); len(args) > 3 && isCurrency(last, methodCurrencies) {
+		currency = last
+		args = args[:len(args)-1]
+	}
+
 	phone := args[0]
 	bank := args[1]
 	ownerName := strings.Join(args[2:], " ")
@@ -27,6 +36,7 @@ func (s *Service) handleAddPaymentMethod(msg *tgbotapi.Message) {
 		PhoneNumber: phone,
 		Bank:        bank,
 		OwnerName:   ownerName,
+		Currency:    currency,
 	}
 
 	result := s.repo.DB().Create(method)
@@ -35,7 +45,7 @@ func (s *Service) handleAddPaymentMethod(msg *tgbotapi.Message) {
 		return
 	}
 
-	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Способ оплаты добавлен:\n📱 %s\n🏦 %s\n👤 %s", phone, bank, ownerName))
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Способ оплаты добавлен:\n📱 %s\n🏦 %s\n👤 %s\n💱 %s", phone, bank, ownerName, currency))
 }
 
 func (s *Service) handleListPaymentMethods(msg *tgbotapi.Message) {
@@ -51,11 +61,26 @@ func (s *Service) handleListPaymentMethods(msg *tgbotapi.Message) {
 		return
 	}
 
+	now := time.Now()
+	ids := make([]uint, 0, len(methods))
+	for _, method := range methods {
+		ids = append(ids, method.ID)
+	}
+	usages, err := s.methodUsages(ids, now)
+	if err != nil {
+		slog.Error("Failed to fetch payment method usage", "error", err)
+	}
+
 	text := "💳 Доступные способы оплаты:\n\n"
-	for i, method := range methods {
-		text += fmt.Sprintf("%d. 📱 %s\n🏦 %s\n👤 %s\n\n",
-			i+1, method.PhoneNumber, method.Bank, method.OwnerName)
+	for _, method := range methods {
+		qr := "нет"
+		if paymentQRSupported(&method) {
+			qr = "счет " + method.Account
+		}
+		text += fmt.Sprintf("#%d. 📱 %s\n🏦 %s\n👤 %s\n💱 %s\n📊 %s\n🔳 QR: %s\n\n",
+			method.ID, method.PhoneNumber, method.Bank, method.OwnerName, method.Currency, methodLimitsText(&method, usages[method.ID], now), qr)
 	}
+	text += "Лимиты: /pmethodlimit, реквизиты для QR: /pmethodqr"
 
 	s.reply(msg.Chat.ID, text)
 }
@@ -0,0 +1,364 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// prorationCredit - доля фактически оплаченной суммы paid, приходящаяся на
+// оставшиеся полные дни срока ключа. Бонусные дни растягивают срок и
+// уменьшают стоимость дня, поэтому зачет не превышает оплаченного
+func prorationCredit(sub *db.Subscription, paid int, now time.Time) int {
+	total := int(sub.EndDate.Sub(sub.StartDate).Hours() / 24)
+	if paid <= 0 || total <= 0 || !sub.EndDate.After(now) {
+		return 0
+	}
+	days := int(sub.EndDate.Sub(now).Hours() / 24)
+	if days > total {
+		days = total
+	}
+	return paid * days / total
+}
+
+// planChangeCredit - зачет за оставшиеся дни ключа при смене тарифа
+func (s *Service) planChangeCredit(sub *db.Subscription, now time.Time) int {
+	paid, err := db.KeyPaidAmount(s.repo.DB(), sub)
+	if err != nil {
+		slog.Error("Failed to fetch paid amount for plan change", "subscription_id", sub.ID, "error", err)
+		return 0
+	}
+	return prorationCredit(sub, paid, now)
+}
+
+// planChangeDue - доплата за переход на тариф с учетом зачета
+func planChangeDue(plan *db.Plan, credit int) int {
+	if due := plan.PriceInt - credit; due > 0 {
+		return due
+	}
+	return 0
+}
+
+// planChangeEndDate - новая дата окончания: полный срок нового тарифа от
+// момента смены, а зачет сверх его цены переводится в дополнительные дни
+func planChangeEndDate(plan *db.Plan, credit int, now time.Time) time.Time {
+	end := now.AddDate(0, 0, plan.DurationDays)
+	if surplus := credit - plan.PriceInt; surplus > 0 && plan.PriceInt > 0 {
+		end = end.AddDate(0, 0, surplus*plan.DurationDays/plan.PriceInt)
+	}
+	return end
+}
+
+// statePrice - цена заказа в процессе покупки. При смене тарифа это доплата
+func (s *Service) statePrice(state *BuyState, plan *db.Plan) int {
+	if state.ChangeSubID != 0 {
+		return planChangeDue(plan, state.Credit)
+	}
+	return s.orderPrice(state.UserID, plan, state.Qty)
+}
+
+// applyChange помечает платеж как доплату за смену тарифа
+func (state *BuyState) applyChange(payment *db.Payment) {
+	if state.ChangeSubID == 0 {
+		return
+	}
+	subID := state.ChangeSubID
+	payment.ChangeSubID = &subID
+	payment.ProrationCredit = state.Credit
+}
+
+// changeablePlanSubscription загружает ключ владельца, тариф которого можно сменить
+func changeablePlanSubscription(tx *gorm.DB, subID uint, userID int64) (*db.Subscription, error) {
+	var sub db.Subscription
+	err := tx.Preload("Plan").
+		Where("id = ? AND user_id = ? AND active = true AND seat_of IS NULL", subID, userID).First(&sub).Error
+	if err != nil {
+		return nil, ErrSubscriptionf("Subscription #%v of user %v is not available for plan change: %v", subID, userID, err)
+	}
+	return &sub, nil
+}
+
+// checkPlanSeats не дает перейти на тариф, в который не помещаются участники семьи
+func checkPlanSeats(tx *gorm.DB, sub *db.Subscription, plan *db.Plan) error {
+	var members int64
+	if err := tx.Model(&db.Subscription{}).Where("seat_of = ?", sub.ID).Count(&members).Error; err != nil {
+		return ErrDatabasef("Failed to count seats of subscription #%v: %v", sub.ID, err)
+	}
+	if members > 0 && int(members)+1 > plan.Seats {
+		return ErrValidationf("Plan #%v has %v seats, subscription #%v has %v members", plan.ID, plan.Seats, sub.ID, members)
+	}
+	return nil
+}
+
+// changeSubscriptionPlan переводит ключ на новый тариф без перевыпуска пира.
+// Подписка остается привязанной к исходному заказу: по нему выдаются места
+// семьи и возвращаются деньги за ключ. Оплатой нового срока считается зачет
+// плюс доплата paid
+func changeSubscriptionPlan(tx *gorm.DB, sub *db.Subscription, plan *db.Plan, credit, paid int, now time.Time) error {
+	if err := checkPlanSeats(tx, sub, plan); err != nil {
+		return err
+	}
+
+	end := planChangeEndDate(plan, credit, now)
+	updates := map[string]interface{}{
+		"plan_id":     plan.ID,
+		"start_date":  now,
+		"end_date":    end,
+		"paid_amount": credit + paid,
+	}
+	if err := tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Updates(updates).Error; err != nil {
+		return ErrDatabasef("Failed to change plan of subscription #%v: %v", sub.ID, err)
+	}
+	if err := db.SyncSeatEndDates(tx, sub.ID, end); err != nil {
+		return ErrDatabasef("Failed to sync seats: %v", err)
+	}
+
+	slog.Info("Subscription plan changed", "subscription_id", sub.ID, "from_plan", sub.PlanID, "to_plan", plan.ID, "credit", credit, "end_date", end.Format("2006-01-02"))
+	sub.PlanID = plan.ID
+	sub.Plan = *plan
+	sub.StartDate = now
+	sub.EndDate = end
+	sub.PaidAmount = credit + paid
+	return nil
+}
+
+// applyPlanChange применяет оплаченную смену тарифа при одобрении платежа.
+// Прежние тариф и срок сохраняются в платеже для отката при возврате
+func applyPlanChange(tx *gorm.DB, payment *db.Payment, now time.Time) (*db.Subscription, error) {
+	sub, err := changeablePlanSubscription(tx, *payment.ChangeSubID, payment.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	prevPaid, err := db.KeyPaidAmount(tx, sub)
+	if err != nil {
+		return nil, ErrDatabasef("Failed to fetch paid amount of subscription #%v: %v", sub.ID, err)
+	}
+	payment.PrevPlanID = &sub.PlanID
+	payment.PrevStartDate = &sub.StartDate
+	payment.PrevEndDate = &sub.EndDate
+	payment.PrevPaidAmount = prevPaid
+	err = tx.Model(&db.Payment{}).Where("id = ?", payment.ID).Updates(map[string]interface{}{
+		"prev_plan_id":     sub.PlanID,
+		"prev_start_date":  sub.StartDate,
+		"prev_end_date":    sub.EndDate,
+		"prev_paid_amount": prevPaid,
+	}).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to save previous plan of subscription #%v: %v", sub.ID, err)
+	}
+
+	if err := changeSubscriptionPlan(tx, sub, &payment.Plan, payment.ProrationCredit, payment.Amount-payment.Surcharge, now); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// rollbackPlanChange возвращает ключ на тариф и срок до оплаченной смены.
+// Если после нее тариф меняли снова или прежний не записан, ключ не трогается
+// и возвращается nil
+func rollbackPlanChange(tx *gorm.DB, payment *db.Payment) (*db.Subscription, error) {
+	if payment.PrevPlanID == nil || payment.PrevStartDate == nil || payment.PrevEndDate == nil {
+		slog.Warn("Plan change has no previous plan, keeping subscription", "payment_id", payment.ID, "subscription_id", *payment.ChangeSubID)
+		return nil, nil
+	}
+
+	var sub db.Subscription
+	if err := tx.First(&sub, *payment.ChangeSubID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch subscription #%v: %v", *payment.ChangeSubID, err)
+	}
+	if sub.PlanID != payment.PlanID {
+		slog.Warn("Subscription plan changed again, keeping it", "payment_id", payment.ID, "subscription_id", sub.ID, "plan_id", sub.PlanID)
+		return nil, nil
+	}
+
+	err := tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Updates(map[string]interface{}{
+		"plan_id":     *payment.PrevPlanID,
+		"start_date":  *payment.PrevStartDate,
+		"end_date":    *payment.PrevEndDate,
+		"paid_amount": payment.PrevPaidAmount,
+	}).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to roll back plan of subscription #%v: %v", sub.ID, err)
+	}
+	if err := db.SyncSeatEndDates(tx, sub.ID, *payment.PrevEndDate); err != nil {
+		return nil, ErrDatabasef("Failed to sync seats: %v", err)
+	}
+
+	if err := tx.Preload("Plan").First(&sub, sub.ID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch subscription #%v: %v", sub.ID, err)
+	}
+	slog.Info("Subscription plan change rolled back", "subscription_id", sub.ID, "payment_id", payment.ID, "plan_id", sub.PlanID, "end_date", sub.EndDate.Format("2006-01-02"))
+	return &sub, nil
+}
+
+func planChangedText(sub *db.Subscription) string {
+	return fmt.Sprintf("🔄 Тариф ключа %s сменен на «%s». Действует до %s.\n\nКлюч прежний, настраивать ничего не нужно",
+		sub.PeerID, sub.Plan.Name, sub.EndDate.Format("02.01.2006"))
+}
+
+// showPlanChangeOptions показывает тарифы для перехода с доплатой или без нее
+func (s *Service) showPlanChangeOptions(callback *tgbotapi.CallbackQuery) {
+	subID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackChangePlan.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID подписки")
+		return
+	}
+
+	sub, err := changeablePlanSubscription(s.repo.DB(), uint(subID), callback.From.ID)
+	if err != nil {
+		s.answerCallback(callback.ID, "Тариф этого ключа сменить нельзя")
+		return
+	}
+
+	visible, err := s.visiblePlans(callback.From.ID)
+	var plans []db.Plan
+	for _, plan := range visible {
+		if !plan.IsTrial && plan.ID != sub.PlanID {
+			plans = append(plans, plan)
+		}
+	}
+	if err != nil || len(plans) == 0 {
+		s.answerCallback(callback.ID, "Других тарифов нет")
+		return
+	}
+
+	now := time.Now()
+	credit := s.planChangeCredit(sub, now)
+	text := fmt.Sprintf("🔄 Смена тарифа ключа %s\n\nСейчас: %s до %s\nЗачет за оставшиеся дни: %d руб.\n\nКлюч останется прежним, срок нового тарифа начнется с момента смены:",
+		sub.PeerID, sub.Plan.Name, sub.EndDate.Format("02.01.2006"), credit)
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, plan := range plans {
+		label := fmt.Sprintf("%s - доплата %d руб.", plan.Name, planChangeDue(&plan, credit))
+		if planChangeDue(&plan, credit) == 0 {
+			label = fmt.Sprintf("%s - без доплаты, до %s", plan.Name, planChangeEndDate(&plan, credit, now).Format("02.01.2006"))
+		}
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, CallbackChangePlanTo.WithID(fmt.Sprintf("%d_%d", sub.ID, plan.ID))),
+		})
+	}
+
+	s.answerCallback(callback.ID, "")
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
+}
+
+// handlePlanChangeSelect переводит ключ на выбранный тариф сразу, если доплата
+// не нужна, иначе предлагает оплатить разницу
+func (s *Service) handlePlanChangeSelect(callback *tgbotapi.CallbackQuery) {
+	parts := strings.Split(strings.TrimPrefix(callback.Data, CallbackChangePlanTo.String()), "_")
+	if len(parts) != 2 {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+	subID, err1 := strconv.ParseUint(parts[0], 10, 32)
+	planID, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+
+	sub, err := changeablePlanSubscription(s.repo.DB(), uint(subID), callback.From.ID)
+	if err != nil {
+		s.answerCallback(callback.ID, "Тариф этого ключа сменить нельзя")
+		return
+	}
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND is_trial = false", planID).First(&plan).Error; err != nil || !s.planAvailable(callback.From.ID, &plan) {
+		s.answerCallback(callback.ID, "Тариф не найден")
+		return
+	}
+	if err := checkPlanSeats(s.repo.DB(), sub, &plan); err != nil {
+		s.answerCallback(callback.ID, "В этом тарифе меньше мест, чем участников семьи. Сначала уберите лишних в /family")
+		return
+	}
+
+	now := time.Now()
+	credit := s.planChangeCredit(sub, now)
+	due := planChangeDue(&plan, credit)
+
+	if due == 0 {
+		err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+			return changeSubscriptionPlan(tx, sub, &plan, credit, 0, now)
+		})
+		if err != nil {
+			s.logAndReportError("Plan change failed", err, map[string]interface{}{
+				"subscription_id": sub.ID,
+				"plan_id":         plan.ID,
+				"user_id":         callback.From.ID,
+			})
+			s.answerCallback(callback.ID, "Ошибка смены тарифа")
+			return
+		}
+		s.answerCallback(callback.ID, "")
+		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, planChangedText(sub))
+		return
+	}
+
+	state := &BuyState{
+		UserID:      callback.From.ID,
+		PlanID:      plan.ID,
+		Platform:    Platform(sub.Platform),
+		Qty:         1,
+		Step:        BuyStepMethod,
+		ChangeSubID: sub.ID,
+		Credit:      credit,
+	}
+
+	methods, err := s.availableMethods(func(currency string) int {
+		if currency == CurrencyRUB {
+			return due
+		}
+		return 0
+	}, now)
+	if err != nil {
+		slog.Error("Failed to fetch payment methods for plan change", "user_id", state.UserID, "error", err)
+	}
+
+	balance, err := userBalance(s.repo.DB(), state.UserID)
+	if err != nil {
+		slog.Error("Failed to fetch balance for plan change", "user_id", state.UserID, "error", err)
+	}
+
+	// Онлайн-оплата и звезды выставляют счет на полный тариф, поэтому доплата
+	// принимается только с баланса или рублевым переводом
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if balance >= due {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("💰 С баланса (%d из %d руб.)", due, balance), CallbackBuyBalance.String()),
+		})
+	}
+	for _, option := range methods {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s (%s)", option.Method.Bank, option.Method.PhoneNumber), CallbackBuyMethod.WithID(option.Method.ID)),
+		})
+	}
+	if len(keyboard) == 0 {
+		s.answerCallback(callback.ID, "Способы оплаты не настроены")
+		return
+	}
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", CallbackChangePlan.WithID(sub.ID)),
+	})
+
+	buyStates[callback.From.ID] = state
+	s.answerCallback(callback.ID, "")
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID,
+		fmt.Sprintf("🔄 %s → %s\n\n💰 %d руб. - зачет %d руб. = доплата %d руб.\n\nВыберите способ оплаты:",
+			sub.Plan.Name, plan.Name, plan.PriceInt, credit, due),
+		keyboard)
+}
+
+// backToPlanChange возвращает к выбору оплаты доплаты за смену тарифа
+func (s *Service) backToPlanChange(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	choice := *callback
+	choice.Data = CallbackChangePlanTo.WithID(fmt.Sprintf("%d_%d", state.ChangeSubID, state.PlanID))
+	s.handlePlanChangeSelect(&choice)
+}
@@ -0,0 +1,431 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// Поля тарифа, которые админ меняет сообщением из карточки тарифа
+const (
+	planFieldName        = "name"
+	planFieldPrice       = "price"
+	planFieldDays        = "days"
+	planFieldDescription = "desc"
+	planFieldOrder       = "order"
+	planFieldMaxQty      = "maxqty"
+)
+
+// planEdit - поле тарифа, новое значение которого админ пришлет сообщением
+type planEdit struct {
+	PlanID uint
+	Field  string
+}
+
+// planEditStates хранит правки тарифов, ожидающие значения от админа
+var planEditStates = make(map[int64]planEdit)
+
+var planFieldPrompts = map[string]string{
+	planFieldName:        "новое название",
+	planFieldPrice:       "новую цену в рублях",
+	planFieldDays:        "новый срок в днях",
+	planFieldDescription: "описание в Markdown (- удалить описание)",
+	planFieldOrder:       "порядок в списке: меньшее число выше",
+	planFieldMaxQty:      "сколько ключей можно купить за раз (0 - без ограничения)",
+}
+
+// visiblePlans - тарифы, которые пользователь видит в /plans и /buy
+func (s *Service) visiblePlans(userID int64) ([]db.Plan, error) {
+	visibility := []string{PlanPublic.String()}
+	if s.isPartner(userID) {
+		visibility = append(visibility, PlanPartnerOnly.String())
+	}
+
+	var plans []db.Plan
+	err := s.repo.DB().Where(db.PlanOnSale+" AND visibility IN ?", visibility).
+		Order("sort_order ASC, id ASC").Find(&plans).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to fetch plans: %v", err)
+	}
+	return plans, nil
+}
+
+// planAvailable - можно ли купить тариф: скрытый продается по ссылке,
+// партнерский - только партнерам
+func (s *Service) planAvailable(userID int64, plan *db.Plan) bool {
+	if !plan.OnSale() {
+		return false
+	}
+	return PlanVisibility(plan.Visibility) != PlanPartnerOnly || s.isPartner(userID)
+}
+
+// plansText - список тарифов для /plans в Markdown
+func (s *Service) plansText(userID int64) (string, error) {
+	plans, err := s.visiblePlans(userID)
+	if err != nil {
+		return "", err
+	}
+	if len(plans) == 0 {
+		return "Тарифы пока не добавлены", nil
+	}
+
+	text := "📋 Доступные тарифы:\n\n"
+	for _, plan := range plans {
+		// Название - текст админа, описание - уже Markdown
+		plan.Name = tgbotapi.EscapeText(tgbotapi.ModeMarkdown, plan.Name)
+		if plan.Recommended {
+			plan.Name += " 🔥 Рекомендуем"
+		}
+		text += formatPlanLine(&plan)
+		extra := ""
+		if plan.Description != "" {
+			extra += plan.Description + "\n"
+		}
+		if prices := s.planPrices(plan.ID); len(prices) > 0 {
+			extra += "💱 " + planPricesText(prices) + "\n"
+		}
+		if rules := s.planDiscounts(plan.ID); len(rules) > 0 {
+			extra += "📉 Скидки: " + volumeDiscountText(rules) + "\n"
+		}
+		if extra != "" {
+			text = strings.TrimSuffix(text, "\n") + extra + "\n"
+		}
+	}
+	return text, nil
+}
+
+// updatePlanTerms меняет название, цену или срок тарифа. Если тариф уже
+// покупали, создается новая версия, а старая снимается с продажи: подписки
+// остаются на ней и продлеваются по условиям покупки. Возвращает актуальную
+// версию тарифа
+func updatePlanTerms(tx *gorm.DB, planID uint, change func(plan *db.Plan)) (*db.Plan, error) {
+	var plan db.Plan
+	if err := tx.First(&plan, planID).Error; err != nil {
+		return nil, ErrPlanNotFoundf("Plan #%v not found: %v", planID, err)
+	}
+	if !plan.OnSale() {
+		return nil, ErrValidationf("Plan #%v is archived or superseded", planID)
+	}
+
+	var subscriptions, payments int64
+	if err := tx.Model(&db.Subscription{}).Where("plan_id = ?", plan.ID).Count(&subscriptions).Error; err != nil {
+		return nil, ErrDatabasef("Failed to count subscriptions of plan #%v: %v", plan.ID, err)
+	}
+	if err := tx.Model(&db.Payment{}).Where("plan_id = ?", plan.ID).Count(&payments).Error; err != nil {
+		return nil, ErrDatabasef("Failed to count payments of plan #%v: %v", plan.ID, err)
+	}
+
+	if subscriptions == 0 && payments == 0 {
+		change(&plan)
+		if err := tx.Save(&plan).Error; err != nil {
+			return nil, ErrDatabasef("Failed to update plan #%v: %v", plan.ID, err)
+		}
+		return &plan, nil
+	}
+
+	next := plan
+	next.ID = 0
+	next.CreatedAt = time.Time{}
+	next.Version = plan.Version + 1
+	next.PreviousID = &plan.ID
+	change(&next)
+	if err := tx.Create(&next).Error; err != nil {
+		return nil, ErrDatabasef("Failed to create version %v of plan #%v: %v", next.Version, plan.ID, err)
+	}
+	if err := tx.Model(&db.Plan{}).Where("id = ?", plan.ID).Update("superseded_by", next.ID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to supersede plan #%v: %v", plan.ID, err)
+	}
+
+	// Настройки будущих продаж переходят на новую версию
+	if err := tx.Model(&db.PartnerPrice{}).Where("plan_id = ?", plan.ID).Update("plan_id", next.ID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to move partner prices of plan #%v: %v", plan.ID, err)
+	}
+	if err := tx.Model(&db.PlanDiscount{}).Where("plan_id = ?", plan.ID).Update("plan_id", next.ID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to move discounts of plan #%v: %v", plan.ID, err)
+	}
+	if err := tx.Model(&db.PlanPrice{}).Where("plan_id = ?", plan.ID).Update("plan_id", next.ID).Error; err != nil {
+		return nil, ErrDatabasef("Failed to move currency prices of plan #%v: %v", plan.ID, err)
+	}
+
+	slog.Info("Plan version created", "plan_id", plan.ID, "new_plan_id", next.ID, "version", next.Version)
+	return &next, nil
+}
+
+// handleCallbackAdminPlans - список тарифов в админ-панели
+func (s *Service) handleCallbackAdminPlans(callback *tgbotapi.CallbackQuery) {
+	if !s.isAdmin(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав администратора")
+		return
+	}
+
+	s.answerCallback(callback.ID, "")
+
+	var plans []db.Plan
+	if err := s.repo.DB().Where(db.PlanOnSale).Order("sort_order ASC, id ASC").Find(&plans).Error; err != nil {
+		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, "Ошибка получения тарифов")
+		return
+	}
+
+	text := "📋 Управление тарифами\n\nВыберите тариф для редактирования:"
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, plan := range plans {
+		label := fmt.Sprintf("%s - %d руб., %d дн.", plan.Name, plan.PriceInt, plan.DurationDays)
+		if PlanVisibility(plan.Visibility) != PlanPublic {
+			label += " (" + PlanVisibility(plan.Visibility).DisplayName() + ")"
+		}
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, CallbackPlanEdit.WithID(plan.ID)),
+		})
+	}
+	keyboard = append(keyboard,
+		[]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("➕ Новый тариф", CallbackPlanNew.String())},
+		[]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("🔙 Назад к админ панели", CallbackAdminPanel.String())},
+	)
+
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
+}
+
+// planCard - карточка тарифа в админ-панели
+func (s *Service) planCard(plan *db.Plan) (string, [][]tgbotapi.InlineKeyboardButton) {
+	visibility := PlanVisibility(plan.Visibility)
+	text := fmt.Sprintf("📦 %s (#%d, версия %d)\n\n💰 Цена: %d руб.\n⏱ Срок: %d дн.\n👁 Видимость: %s\n🔢 Порядок: %d",
+		plan.Name, plan.ID, plan.Version, plan.PriceInt, plan.DurationDays, visibility.DisplayName(), plan.SortOrder)
+	if plan.MaxQty > 0 {
+		text += fmt.Sprintf("\n🔑 Ключей за заказ: до %d", plan.MaxQty)
+	}
+	if plan.Recommended {
+		text += "\n🔥 Рекомендуемый"
+	}
+	if plan.IsTrial {
+		text += "\n🎁 Пробный"
+	}
+	if plan.Description != "" {
+		text += "\n\n📝 " + plan.Description
+	}
+	if visibility == PlanHidden {
+		text += fmt.Sprintf("\n\n🔗 Ссылка на покупку: https://t.me/%s?start=plan_%d", s.bot.Self.UserName, plan.ID)
+	}
+	text += "\n\nИзменение названия, цены или срока купленного тарифа создает новую версию, подписки остаются на прежних условиях"
+
+	field := func(label, name string) tgbotapi.InlineKeyboardButton {
+		return tgbotapi.NewInlineKeyboardButtonData(label, CallbackPlanField.WithID(fmt.Sprintf("%d_%s", plan.ID, name)))
+	}
+	recommended := "🔥 Рекомендовать"
+	if plan.Recommended {
+		recommended = "🔥 Не рекомендовать"
+	}
+
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		{field("✏️ Название", planFieldName), field("💰 Цена", planFieldPrice), field("⏱ Срок", planFieldDays)},
+		{field("📝 Описание", planFieldDescription), field("🔢 Порядок", planFieldOrder), field("🔑 Лимит", planFieldMaxQty)},
+		{
+			tgbotapi.NewInlineKeyboardButtonData(recommended, CallbackPlanRecommended.WithID(plan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("👁 Видимость: "+visibility.Next().DisplayName(), CallbackPlanVisibility.WithID(plan.ID)),
+		},
+		{tgbotapi.NewInlineKeyboardButtonData("🗑 В архив", CallbackArchivePlan.WithID(plan.ID))},
+		{tgbotapi.NewInlineKeyboardButtonData("🔙 К тарифам", CallbackAdminPlans.String())},
+	}
+	return text, keyboard
+}
+
+// handlePlanAdminCallback обрабатывает кнопки карточки тарифа
+func (s *Service) handlePlanAdminCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.isAdmin(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав администратора")
+		return
+	}
+
+	data := callback.Data
+	if data == CallbackPlanNew.String() {
+		s.answerCallback(callback.ID, "")
+		s.reply(callback.Message.Chat.ID, "Новый тариф: /addplan <название> <цена> <дни> [trial]\nПример: /addplan Месяц 200 30\n\nОстальные настройки - в карточке тарифа после создания")
+		return
+	}
+
+	if strings.HasPrefix(data, CallbackPlanField.String()) {
+		parts := strings.SplitN(strings.TrimPrefix(data, CallbackPlanField.String()), "_", 2)
+		planID, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || len(parts) != 2 || planFieldPrompts[parts[1]] == "" {
+			s.answerCallback(callback.ID, "Неверные данные")
+			return
+		}
+		planEditStates[callback.From.ID] = planEdit{PlanID: uint(planID), Field: parts[1]}
+		s.answerCallback(callback.ID, "")
+		s.reply(callback.Message.Chat.ID, fmt.Sprintf("✏️ Тариф #%d: отправьте %s одним сообщением", planID, planFieldPrompts[parts[1]]))
+		return
+	}
+
+	var prefix CallbackPrefix
+	for _, p := range []CallbackPrefix{CallbackPlanEdit, CallbackPlanRecommended, CallbackPlanVisibility} {
+		if strings.HasPrefix(data, p.String()) {
+			prefix = p
+		}
+	}
+	planID, err := strconv.ParseUint(strings.TrimPrefix(data, prefix.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID тарифа")
+		return
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND "+db.PlanOnSale, planID).First(&plan).Error; err != nil {
+		s.answerCallback(callback.ID, "Тариф не найден")
+		return
+	}
+
+	switch prefix {
+	case CallbackPlanRecommended:
+		plan.Recommended = !plan.Recommended
+		err = s.repo.DB().Model(&plan).Update("recommended", plan.Recommended).Error
+	case CallbackPlanVisibility:
+		plan.Visibility = PlanVisibility(plan.Visibility).Next().String()
+		err = s.repo.DB().Model(&plan).Update("visibility", plan.Visibility).Error
+	}
+	if err != nil {
+		s.logAndReportError("Plan update failed", ErrDatabasef("Failed to update plan #%v: %v", plan.ID, err), map[string]interface{}{
+			"plan_id":  plan.ID,
+			"admin_id": callback.From.ID,
+		})
+		s.answerCallback(callback.ID, "Ошибка сохранения")
+		return
+	}
+
+	s.answerCallback(callback.ID, "")
+	text, keyboard := s.planCard(&plan)
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
+}
+
+// handlePlanEditMessage принимает новое значение поля тарифа.
+// Возвращает false, если админ не редактирует тариф
+func (s *Service) handlePlanEditMessage(msg *tgbotapi.Message) bool {
+	edit, ok := planEditStates[msg.From.ID]
+	if !ok || msg.Text == "" {
+		return false
+	}
+	delete(planEditStates, msg.From.ID)
+
+	plan, err := s.applyPlanEdit(msg.Chat.ID, edit, strings.TrimSpace(msg.Text))
+	if err != nil {
+		var botErr *BotError
+		if errors.As(err, &botErr) && botErr.Code == ErrValidationError {
+			s.reply(msg.Chat.ID, "❌ "+botErr.Message)
+			return true
+		}
+		s.logAndReportError("Plan edit failed", err, map[string]interface{}{
+			"plan_id":  edit.PlanID,
+			"field":    edit.Field,
+			"admin_id": msg.From.ID,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения тарифа")
+		return true
+	}
+
+	slog.Info("Plan edited", "plan_id", plan.ID, "field", edit.Field, "admin_id", msg.From.ID)
+	text, keyboard := s.planCard(plan)
+	if plan.ID != edit.PlanID {
+		text = fmt.Sprintf("✅ Создана версия %d тарифа, прежняя #%d в архиве\n\n", plan.Version, edit.PlanID) + text
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(reply)
+	return true
+}
+
+func (s *Service) applyPlanEdit(chatID int64, edit planEdit, value string) (*db.Plan, error) {
+	switch edit.Field {
+	case planFieldName, planFieldPrice, planFieldDays:
+		number, err := strconv.Atoi(value)
+		if edit.Field != planFieldName && (err != nil || number <= 0) {
+			return nil, ErrValidationf("Нужно положительное число")
+		}
+		var plan *db.Plan
+		err = s.repo.DB().Transaction(func(tx *gorm.DB) error {
+			var err error
+			plan, err = updatePlanTerms(tx, edit.PlanID, func(p *db.Plan) {
+				switch edit.Field {
+				case planFieldName:
+					p.Name = value
+				case planFieldPrice:
+					p.PriceInt = number
+				case planFieldDays:
+					p.DurationDays = number
+				}
+			})
+			return err
+		})
+		return plan, err
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND "+db.PlanOnSale, edit.PlanID).First(&plan).Error; err != nil {
+		return nil, ErrPlanNotFoundf("Plan #%v not found: %v", edit.PlanID, err)
+	}
+
+	var column string
+	var update interface{}
+	switch edit.Field {
+	case planFieldDescription:
+		if value == "-" {
+			value = ""
+		}
+		// Описание с ошибкой разметки Telegram не отправит, поэтому проверяем
+		// его пробной отправкой админу
+		if value != "" {
+			preview := tgbotapi.NewMessage(chatID, value)
+			preview.ParseMode = tgbotapi.ModeMarkdown
+			if _, err := s.bot.Send(preview); err != nil {
+				return nil, ErrValidationf("Telegram не принял разметку описания: %v", err)
+			}
+		}
+		column, update, plan.Description = "description", value, value
+	case planFieldOrder:
+		order, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, ErrValidationf("Нужно целое число")
+		}
+		column, update, plan.SortOrder = "sort_order", order, order
+	case planFieldMaxQty:
+		maxQty, err := strconv.Atoi(value)
+		if err != nil || maxQty < 0 {
+			return nil, ErrValidationf("Нужно число от 0")
+		}
+		column, update, plan.MaxQty = "max_qty", maxQty, maxQty
+	default:
+		return nil, ErrValidationf("Неизвестное поле %s", edit.Field)
+	}
+
+	if err := s.repo.DB().Model(&plan).Update(column, update).Error; err != nil {
+		return nil, ErrDatabasef("Failed to update plan #%v %v: %v", plan.ID, column, err)
+	}
+	return &plan, nil
+}
+
+// startPlanPurchase открывает покупку тарифа по ссылке start=plan_<id>,
+// в том числе скрытого из списков
+func (s *Service) startPlanPurchase(chatID, userID int64, planIDStr string) {
+	planID, err := strconv.ParseUint(planIDStr, 10, 32)
+	var plan db.Plan
+	if err != nil || s.repo.DB().First(&plan, planID).Error != nil || plan.IsTrial || !s.planAvailable(userID, &plan) {
+		s.reply(chatID, "❌ Тариф недоступен. Актуальные тарифы: /buy")
+		return
+	}
+
+	s.startCheckout(userID)
+
+	card := plan
+	card.Name = tgbotapi.EscapeText(tgbotapi.ModeMarkdown, plan.Name)
+	msg := tgbotapi.NewMessage(chatID, formatPlanLine(&card)+plan.Description)
+	msg.ParseMode = tgbotapi.ModeMarkdown
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("💳 Купить", CallbackBuyPlan.WithID(plan.ID)),
+	))
+	s.bot.Send(msg)
+}
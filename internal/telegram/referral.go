@@ -0,0 +1,546 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// Статусы награды за приглашение
+const (
+	ReferralRewardPending  = "pending"
+	ReferralRewardReview   = "review"
+	ReferralRewardGranted  = "rewarded"
+	ReferralRewardRejected = "rejected"
+)
+
+// referralChainDepth ограничивает глубину поиска циклов в цепочке приглашений
+const referralChainDepth = 10
+
+// refCodePattern - допустимый вид собственного реферального кода. Вместе с
+// префиксом ref_ код должен укладываться в 64 символа параметра start
+var refCodePattern = regexp.MustCompile(`^[a-z0-9_]{4,32}$`)
+
+// refCodeReserved - слова, которые пользователь не может занять сам: ссылки
+// с ними выглядят официальными. Админ назначает такие коды партнерам
+var refCodeReserved = []string{"admin", "support", "lime", "official", "vpn", "bot"}
+
+// refCodeProfanity - корни нецензурных слов в латинице
+var refCodeProfanity = []string{
+	"hui", "huy", "xuy", "xui", "pizd", "pisd", "blya", "blia", "ebal", "eban", "ebat",
+	"mudak", "mudil", "pidor", "pidar", "gandon", "zalup", "shlyu", "suka", "suchk", "dermo",
+	"fuck", "shit", "bitch", "cunt", "dick", "cock", "nigg", "porn", "whore",
+}
+
+// checkRefCode проверяет собственный реферальный код. Возвращает причину
+// отказа для пользователя или пустую строку
+func (s *Service) checkRefCode(code string, ownerID int64, allowReserved bool) string {
+	if !refCodePattern.MatchString(code) {
+		return "Код должен состоять из 4-32 латинских букв, цифр или _"
+	}
+
+	// Цифры, похожие на буквы, и подчеркивания не должны помогать обойти фильтр
+	normalized := strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "_", "").Replace(code)
+	for _, root := range refCodeProfanity {
+		if strings.Contains(code, root) || strings.Contains(normalized, root) {
+			return "Код содержит недопустимые слова"
+		}
+	}
+	if !allowReserved {
+		for _, word := range refCodeReserved {
+			if strings.Contains(normalized, word) {
+				return "Этот код зарезервирован, выберите другой"
+			}
+		}
+	}
+
+	var taken int64
+	s.repo.DB().Model(&db.User{}).Where("LOWER(ref_code) = ? AND tg_id <> ?", code, ownerID).Count(&taken)
+	if taken > 0 {
+		return "Код уже занят, выберите другой"
+	}
+	return ""
+}
+
+// orderPrice возвращает цену заказа: для партнера - по оптовой цене, иначе
+// со скидкой за количество и скидкой приглашенному на первый заказ
+func (s *Service) orderPrice(userID int64, plan *db.Plan, qty int) int {
+	if s.isPartner(userID) {
+		if price := s.partnerPrice(userID, plan.ID); price > 0 {
+			return price * qty
+		}
+	}
+
+	price := plan.PriceInt * qty
+	if discount := s.volumeDiscount(plan.ID, qty); discount > 0 {
+		price -= price * discount / 100
+	}
+	if discount := s.inviteeDiscount(userID); discount > 0 {
+		price -= price * discount / 100
+	}
+	return price
+}
+
+// inviteeDiscount возвращает скидку в процентах, если пользователь пришел по
+// реферальной ссылке и еще ни разу не платил
+func (s *Service) inviteeDiscount(userID int64) int {
+	discount := s.cfg.ReferralInviteeDiscount
+	if discount <= 0 {
+		return 0
+	}
+	if discount > 100 {
+		discount = 100
+	}
+
+	var invited int64
+	s.repo.DB().Model(&db.Referral{}).Where("invitee_id = ? AND reward_status <> ?", userID, ReferralRewardRejected).Count(&invited)
+	if invited == 0 {
+		return 0
+	}
+
+	var paid int64
+	s.repo.DB().Model(&db.Payment{}).
+		Where("user_id = ? AND status IN ?", userID, []string{PaymentStatusApproved.String(), PaymentStatusRefunded.String()}).
+		Count(&paid)
+	if paid > 0 {
+		return 0
+	}
+	return discount
+}
+
+// rewardReferral начисляет награду пригласившему, когда приглашенный оплатил
+// не меньше ReferralMinPayment. Подозрительные приглашения уходят на проверку
+// админу вместо начисления. Повторные вызовы ничего не делают
+func (s *Service) rewardReferral(payment *db.Payment) {
+	if s.cfg.ReferralBonusDays <= 0 && s.cfg.ReferralBonusAmount <= 0 {
+		return
+	}
+
+	var referral db.Referral
+	err := s.repo.DB().Where("invitee_id = ? AND reward_status = ?", payment.UserID, ReferralRewardPending).
+		Order("id ASC").Limit(1).Find(&referral).Error
+	if err != nil || referral.ID == 0 {
+		return
+	}
+
+	if !s.referralPaid(&referral) {
+		return
+	}
+
+	if reason := s.referralFraudReason(&referral); reason != "" {
+		s.holdReferral(&referral, payment.ID, reason)
+		return
+	}
+
+	if err := s.grantReferralReward(&referral, payment.ID, ReferralRewardPending); err != nil {
+		s.logAndReportError("Referral reward failed", err, map[string]interface{}{
+			"referral_id": referral.ID,
+			"inviter_id":  referral.InviterID,
+			"payment_id":  payment.ID,
+		})
+	}
+}
+
+// referralPaid проверяет, что приглашенный после перехода по ссылке оплатил
+// достаточно. Оплата звездами засчитывается, только если минимум не задан
+func (s *Service) referralPaid(referral *db.Referral) bool {
+	// CURRENT_TIMESTAMP хранится без долей секунды: оплата в ту же секунду,
+	// что и переход по ссылке, засчитывается
+	var payments []db.Payment
+	s.repo.DB().Select("amount", "currency").
+		Where("user_id = ? AND status = ?", referral.InviteeID, PaymentStatusApproved.String()).
+		Scopes(db.CreatedSince(referral.CreatedAt.Truncate(time.Second))).
+		Find(&payments)
+
+	total := 0
+	for _, payment := range payments {
+		if payment.Currency == CurrencyRUB {
+			total += payment.Amount
+		}
+	}
+
+	return len(payments) > 0 && total >= s.cfg.ReferralMinPayment
+}
+
+// referralFraudReason проверяет приглашение на признаки накрутки.
+// Пустая строка - подозрений нет
+func (s *Service) referralFraudReason(referral *db.Referral) string {
+	var inviter, invitee db.User
+	s.repo.DB().Where("tg_id = ?", referral.InviterID).Limit(1).Find(&inviter)
+	s.repo.DB().Where("tg_id = ?", referral.InviteeID).Limit(1).Find(&invitee)
+
+	// ID в Telegram выдаются по возрастанию, большой ID - недавно созданный аккаунт
+	if s.cfg.ReferralNewAccountID > 0 && referral.InviteeID >= s.cfg.ReferralNewAccountID {
+		return "новый аккаунт Telegram"
+	}
+
+	if inviter.Phone != "" && inviter.Phone == invitee.Phone {
+		return "совпадает телефон с пригласившим"
+	}
+
+	if s.referralCircular(referral) {
+		return "циклическое приглашение"
+	}
+
+	if s.cfg.ReferralDailyCap > 0 {
+		now := time.Now()
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		var today int64
+		s.repo.DB().Model(&db.Referral{}).
+			Where("inviter_id = ? AND reward_status = ? AND rewarded_at >= ?", referral.InviterID, ReferralRewardGranted, dayStart).
+			Count(&today)
+		if today >= int64(s.cfg.ReferralDailyCap) {
+			return fmt.Sprintf("превышен лимит %d наград в сутки", s.cfg.ReferralDailyCap)
+		}
+	}
+
+	return ""
+}
+
+// referralCircular проверяет, не пригласил ли приглашенный сам пригласившего -
+// напрямую или через цепочку других приглашений
+func (s *Service) referralCircular(referral *db.Referral) bool {
+	current := referral.InviterID
+	for i := 0; i < referralChainDepth; i++ {
+		var parent db.Referral
+		s.repo.DB().Where("invitee_id = ? AND reward_status <> ?", current, ReferralRewardRejected).
+			Order("id ASC").Limit(1).Find(&parent)
+		if parent.ID == 0 {
+			return false
+		}
+		if parent.InviterID == referral.InviteeID {
+			return true
+		}
+		current = parent.InviterID
+	}
+	return false
+}
+
+// holdReferral отправляет приглашение на проверку и уведомляет админов
+func (s *Service) holdReferral(referral *db.Referral, paymentID uint, reason string) {
+	res := s.repo.DB().Model(&db.Referral{}).Where("id = ? AND reward_status = ?", referral.ID, ReferralRewardPending).
+		Updates(map[string]interface{}{
+			"reward_status":     ReferralRewardReview,
+			"reward_payment_id": paymentID,
+			"fraud_reason":      reason,
+		})
+	if res.Error != nil {
+		s.logAndReportError("Referral hold failed", ErrDatabasef("Failed to hold referral #%v: %v", referral.ID, res.Error), map[string]interface{}{
+			"referral_id": referral.ID,
+			"payment_id":  paymentID,
+		})
+		return
+	}
+	if res.RowsAffected == 0 {
+		return
+	}
+
+	slog.Warn("Referral held for review", "referral_id", referral.ID, "inviter_id", referral.InviterID,
+		"invitee_id", referral.InviteeID, "reason", reason)
+
+	referral.RewardStatus = ReferralRewardReview
+	referral.RewardPaymentID = &paymentID
+	referral.FraudReason = reason
+	text, keyboard := s.referralReviewCard(referral)
+
+	var admins []db.Admin
+	s.repo.DB().Where("role IN (?, ?) AND disabled = false", RoleAdmin.String(), RoleSuper.String()).Find(&admins)
+	for _, admin := range admins {
+		msg := tgbotapi.NewMessage(admin.TgID, "🕵️ Приглашение отправлено на проверку\n\n"+text)
+		msg.ReplyMarkup = keyboard
+		s.bot.Send(msg)
+	}
+}
+
+// referralReviewCard описывает приглашение на проверке для админа
+func (s *Service) referralReviewCard(referral *db.Referral) (string, tgbotapi.InlineKeyboardMarkup) {
+	var inviter, invitee db.User
+	s.repo.DB().Where("tg_id = ?", referral.InviterID).Limit(1).Find(&inviter)
+	s.repo.DB().Where("tg_id = ?", referral.InviteeID).Limit(1).Find(&invitee)
+
+	var invited int64
+	s.repo.DB().Model(&db.Referral{}).Where("inviter_id = ?", referral.InviterID).Count(&invited)
+
+	text := fmt.Sprintf("👥 Приглашение #%d\n👤 Пригласил: @%s (%d), всего приглашений: %d\n🆕 Приглашенный: @%s (%d)\n📅 Переход по ссылке: %s\n⚠️ Причина: %s",
+		referral.ID, inviter.Username, referral.InviterID, invited, invitee.Username, referral.InviteeID,
+		referral.CreatedAt.Format("02.01.2006 15:04"), referral.FraudReason)
+	if referral.RewardPaymentID != nil {
+		text += fmt.Sprintf("\n💳 Заказ #%d", *referral.RewardPaymentID)
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Начислить", CallbackReferralApprove.WithID(referral.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🚫 Отказать", CallbackReferralReject.WithID(referral.ID)),
+		),
+	)
+	return text, keyboard
+}
+
+// handleReferralReview показывает приглашения, ожидающие решения
+func (s *Service) handleReferralReview(msg *tgbotapi.Message) {
+	if !s.canRefund(msg.From.ID) {
+		s.reply(msg.Chat.ID, "Проверка приглашений доступна только администраторам")
+		return
+	}
+
+	var referrals []db.Referral
+	s.repo.DB().Where("reward_status = ?", ReferralRewardReview).Order("id ASC").Limit(10).Find(&referrals)
+	if len(referrals) == 0 {
+		s.reply(msg.Chat.ID, "✅ Подозрительных приглашений нет")
+		return
+	}
+
+	for i := range referrals {
+		text, keyboard := s.referralReviewCard(&referrals[i])
+		reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+		reply.ReplyMarkup = keyboard
+		s.bot.Send(reply)
+	}
+}
+
+func (s *Service) handleReferralReviewCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.canRefund(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	approve := strings.HasPrefix(callback.Data, CallbackReferralApprove.String())
+	idStr := strings.TrimPrefix(callback.Data, CallbackReferralReject.String())
+	if approve {
+		idStr = strings.TrimPrefix(callback.Data, CallbackReferralApprove.String())
+	}
+	referralID, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID приглашения")
+		return
+	}
+
+	var referral db.Referral
+	if err := s.repo.DB().First(&referral, referralID).Error; err != nil {
+		s.answerCallback(callback.ID, "Приглашение не найдено")
+		return
+	}
+	if referral.RewardStatus != ReferralRewardReview {
+		s.answerCallback(callback.ID, "Приглашение уже обработано")
+		return
+	}
+
+	if !approve {
+		res := s.repo.DB().Model(&db.Referral{}).Where("id = ? AND reward_status = ?", referral.ID, ReferralRewardReview).
+			Updates(map[string]interface{}{
+				"reward_status": ReferralRewardRejected,
+				"reviewed_by":   callback.From.ID,
+			})
+		if res.Error != nil || res.RowsAffected == 0 {
+			s.answerCallback(callback.ID, "Приглашение уже обработано")
+			return
+		}
+		slog.Info("Referral reward denied", "referral_id", referral.ID, "admin_id", callback.From.ID)
+		s.answerCallback(callback.ID, "")
+		s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+			fmt.Sprintf("🚫 Награда за приглашение #%d не начислена (%s)", referral.ID, referral.FraudReason))
+		return
+	}
+
+	var paymentID uint
+	if referral.RewardPaymentID != nil {
+		paymentID = *referral.RewardPaymentID
+	}
+	referral.ReviewedBy = &callback.From.ID
+	if err := s.grantReferralReward(&referral, paymentID, ReferralRewardReview); err != nil {
+		s.logAndReportError("Referral reward failed", err, map[string]interface{}{
+			"referral_id": referral.ID,
+			"admin_id":    callback.From.ID,
+		})
+		s.answerCallback(callback.ID, "Ошибка начисления награды")
+		return
+	}
+
+	s.answerCallback(callback.ID, "")
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+		fmt.Sprintf("✅ Награда за приглашение #%d начислена", referral.ID))
+}
+
+// grantReferralReward начисляет награду по приглашению в статусе from и
+// уведомляет пригласившего. Если статус уже сменился, ничего не делает
+func (s *Service) grantReferralReward(referral *db.Referral, paymentID uint, from string) error {
+	var extended *db.Subscription
+	granted := false
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		updates := map[string]interface{}{
+			"reward_status":     ReferralRewardGranted,
+			"reward_payment_id": paymentID,
+			"rewarded_at":       now,
+		}
+		if referral.ReviewedBy != nil {
+			updates["reviewed_by"] = *referral.ReviewedBy
+		}
+		res := tx.Model(&db.Referral{}).Where("id = ? AND reward_status = ?", referral.ID, from).Updates(updates)
+		if res.Error != nil {
+			return ErrDatabasef("Failed to mark referral #%v rewarded: %v", referral.ID, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		granted = true
+
+		if s.cfg.ReferralBonusAmount > 0 {
+			err := appendLedger(tx, &db.LedgerEntry{
+				UserID:    referral.InviterID,
+				Amount:    s.cfg.ReferralBonusAmount,
+				Kind:      LedgerReferral.String(),
+				PaymentID: &paymentID,
+				Comment:   fmt.Sprintf("приглашенный оплатил заказ #%d", paymentID),
+			})
+			if err != nil {
+				return err
+			}
+			referral.BonusAmount = s.cfg.ReferralBonusAmount
+		}
+
+		// Дни добавляются к подписке, которая закончится позже всех. Без активной
+		// подписки дни не начисляются, остается только бонус на баланс
+		if s.cfg.ReferralBonusDays > 0 {
+			var sub db.Subscription
+			err := tx.Where("user_id = ? AND active = true AND seat_of IS NULL", referral.InviterID).
+				Where("plan_id NOT IN (?)", tx.Model(&db.Plan{}).Select("id").Where("is_trial = true")).
+				Order("end_date DESC").Limit(1).Find(&sub).Error
+			if err != nil {
+				return ErrDatabasef("Failed to fetch inviter subscription: %v", err)
+			}
+			if sub.ID != 0 {
+				sub.EndDate = sub.EndDate.AddDate(0, 0, s.cfg.ReferralBonusDays)
+				if err := tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Update("end_date", sub.EndDate).Error; err != nil {
+					return ErrDatabasef("Failed to extend subscription #%v: %v", sub.ID, err)
+				}
+				if err := db.SyncSeatEndDates(tx, sub.ID, sub.EndDate); err != nil {
+					return ErrDatabasef("Failed to extend seats: %v", err)
+				}
+				referral.BonusDays = s.cfg.ReferralBonusDays
+				extended = &sub
+			}
+		}
+
+		return tx.Model(&db.Referral{}).Where("id = ?", referral.ID).Updates(map[string]interface{}{
+			"bonus_days":   referral.BonusDays,
+			"bonus_amount": referral.BonusAmount,
+		}).Error
+	})
+	if err != nil || !granted {
+		return err
+	}
+
+	if referral.BonusDays == 0 && referral.BonusAmount == 0 {
+		slog.Info("Referral reward skipped: nothing to grant", "referral_id", referral.ID, "inviter_id", referral.InviterID)
+		return nil
+	}
+
+	slog.Info("Referral reward granted", "referral_id", referral.ID, "inviter_id", referral.InviterID,
+		"bonus_days", referral.BonusDays, "bonus_amount", referral.BonusAmount)
+
+	text := "🎉 Ваш приглашенный друг оплатил подписку!"
+	if referral.BonusAmount > 0 {
+		text += fmt.Sprintf("\n💰 На баланс зачислено %d руб.", referral.BonusAmount)
+	}
+	if extended != nil {
+		text += fmt.Sprintf("\n📅 Подписка %s продлена на %d дн. (до %s)",
+			extended.PeerID, referral.BonusDays, extended.EndDate.Format("02.01.2006"))
+	}
+	s.reply(referral.InviterID, text)
+	return nil
+}
+
+// referralRulesText описывает текущие условия реферальной программы
+func (s *Service) referralRulesText() string {
+	var rewards []string
+	if s.cfg.ReferralBonusDays > 0 {
+		rewards = append(rewards, fmt.Sprintf("+%d дн. к подписке", s.cfg.ReferralBonusDays))
+	}
+	if s.cfg.ReferralBonusAmount > 0 {
+		rewards = append(rewards, fmt.Sprintf("%d руб. на баланс", s.cfg.ReferralBonusAmount))
+	}
+
+	var lines []string
+	if len(rewards) > 0 {
+		lines = append(lines, "🎁 За каждого друга, оплатившего подписку: "+strings.Join(rewards, " и "))
+		if s.cfg.ReferralMinPayment > 0 {
+			lines = append(lines, fmt.Sprintf("💳 Награда начисляется, когда друг оплатит от %d руб.", s.cfg.ReferralMinPayment))
+		}
+	}
+	if s.cfg.ReferralInviteeDiscount > 0 {
+		lines = append(lines, fmt.Sprintf("🏷 Другу - скидка %d%% на первый заказ", s.cfg.ReferralInviteeDiscount))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleRefCode позволяет выбрать собственный код для реферальной ссылки
+func (s *Service) handleRefCode(msg *tgbotapi.Message) {
+	code := strings.ToLower(strings.TrimSpace(msg.CommandArguments()))
+	if code == "" {
+		s.reply(msg.Chat.ID, "Использование: /refcode <код>\nПример: /refcode ivan_travel\n\nСсылка станет вида https://t.me/"+s.bot.Self.UserName+"?start=ref_ivan_travel")
+		return
+	}
+
+	if reason := s.checkRefCode(code, msg.From.ID, false); reason != "" {
+		s.reply(msg.Chat.ID, "❌ "+reason)
+		return
+	}
+
+	s.setRefCode(msg, msg.From.ID, code)
+}
+
+// handleSetRefCode назначает код пользователю, например партнеру. Админу
+// доступны зарезервированные слова
+func (s *Service) handleSetRefCode(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) != 2 {
+		s.reply(msg.Chat.ID, "Использование: /setrefcode <username> <код>\nПример: /setrefcode blogger lime_blogger")
+		return
+	}
+
+	var user db.User
+	if err := s.repo.DB().Where("username = ?", strings.TrimPrefix(args[0], "@")).First(&user).Error; err != nil {
+		s.reply(msg.Chat.ID, "Пользователь не найден: "+args[0])
+		return
+	}
+
+	code := strings.ToLower(args[1])
+	if reason := s.checkRefCode(code, user.TgID, true); reason != "" {
+		s.reply(msg.Chat.ID, "❌ "+reason)
+		return
+	}
+
+	s.setRefCode(msg, user.TgID, code)
+}
+
+func (s *Service) setRefCode(msg *tgbotapi.Message, userID int64, code string) {
+	res := s.repo.DB().Model(&db.User{}).Where("tg_id = ?", userID).Update("ref_code", code)
+	if res.Error != nil || res.RowsAffected == 0 {
+		err := res.Error
+		if err == nil {
+			err = ErrUserNotFoundf("User %v not found", userID)
+		} else {
+			err = ErrDatabasef("Failed to update ref code: %v", err)
+		}
+		s.logAndReportError("Ref code update failed", err, map[string]interface{}{
+			"user_id":  userID,
+			"admin_id": msg.From.ID,
+			"code":     code,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения кода")
+		return
+	}
+
+	slog.Info("Ref code changed", "user_id", userID, "changed_by", msg.From.ID, "code", code)
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Реферальная ссылка: https://t.me/%s?start=ref_%s\n\nСтарая ссылка больше не работает.", s.bot.Self.UserName, code))
+}
@@ -0,0 +1,421 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// refundRequest - возврат, для которого админ пишет причину
+type refundRequest struct {
+	PaymentID uint
+	Amount    int
+	ToWallet  bool
+}
+
+// refundStates хранит возвраты, ожидающие причины от админа
+var refundStates = make(map[int64]refundRequest)
+
+// adminRole возвращает роль активного админа, пустую - если это не админ
+func (s *Service) adminRole(userID int64) AdminRole {
+	if superAdminID, err := strconv.ParseInt(s.cfg.SuperAdminID, 10, 64); err == nil && superAdminID == userID {
+		return RoleSuper
+	}
+
+	var admin db.Admin
+	if err := s.repo.DB().Where("tg_id = ? AND disabled = false", userID).First(&admin).Error; err != nil {
+		return ""
+	}
+	return AdminRole(admin.Role)
+}
+
+// canRefund проверяет, может ли админ возвращать деньги
+func (s *Service) canRefund(userID int64) bool {
+	return s.adminRole(userID).CanRefund()
+}
+
+// partialRefundAmount считает сумму возврата за неиспользованные дни подписок,
+// выданных по платежу. Если ключи не выдавались, возвращается вся сумма
+func partialRefundAmount(amount int, subscriptions []db.Subscription, now time.Time) int {
+	var total, unused time.Duration
+	for _, sub := range subscriptions {
+		total += sub.EndDate.Sub(sub.StartDate)
+		if sub.Active && sub.EndDate.After(now) {
+			left := sub.EndDate.Sub(now)
+			if left > sub.EndDate.Sub(sub.StartDate) {
+				left = sub.EndDate.Sub(sub.StartDate)
+			}
+			unused += left
+		}
+	}
+
+	if total <= 0 {
+		return amount
+	}
+	return int(int64(amount) * int64(unused) / int64(total))
+}
+
+// paymentRefunder возвращает Payments провайдера, через которого прошел платеж.
+// nil - ручной перевод или оплата с баланса, провайдера для возврата нет
+func (s *Service) paymentRefunder(payment *db.Payment) (Payments, error) {
+	switch payment.Provider {
+	case "", PaymentProviderBalance:
+		return nil, nil
+	case PaymentProviderStars:
+		return s.stars, nil
+	}
+	return s.onlinePayments(payment.Provider)
+}
+
+// showRefundOptions предлагает полный возврат или возврат за неиспользованные дни
+func (s *Service) showRefundOptions(callback *tgbotapi.CallbackQuery) {
+	if !s.canRefund(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackPaymentRefund.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID платежа")
+		return
+	}
+
+	var payment db.Payment
+	if err := s.repo.DB().Preload("Plan").First(&payment, paymentID).Error; err != nil {
+		s.answerCallback(callback.ID, "Платеж не найден")
+		return
+	}
+	if payment.Status != PaymentStatusApproved.String() {
+		s.answerCallback(callback.ID, "Вернуть можно только одобренный платеж")
+		return
+	}
+
+	var subscriptions []db.Subscription
+	s.repo.DB().Where("payment_id = ?", payment.ID).Find(&subscriptions)
+	// Надбавку к сумме пользователь уже получил на баланс при одобрении
+	paid := payment.Amount - payment.Surcharge
+	partial := partialRefundAmount(paid, subscriptions, time.Now())
+	partialLabel := "За неиспользованные дни"
+
+	text := fmt.Sprintf("↩️ Возврат по заказу #%d\n\n📦 %s x%d\n💰 Оплачено: %s\n🔑 Ключей по заказу: %d\n\nВсе ключи заказа будут отключены.",
+		payment.ID, payment.Plan.Name, payment.Qty, formatAmount(paid, payment.Currency), len(subscriptions))
+	if payment.ChangeSubID != nil {
+		text = fmt.Sprintf("↩️ Возврат доплаты за смену тарифа #%d\n\n📦 %s\n💰 Оплачено: %s\n\nКлюч вернется на прежний тариф и срок, если тариф не меняли снова.",
+			payment.ID, payment.Plan.Name, formatAmount(paid, payment.Currency))
+	}
+	if payment.RenewSubID != nil {
+		text = fmt.Sprintf("↩️ Возврат автопродления #%d\n\n📦 %s\n💰 Оплачено: %s\n\nПодписка будет сокращена на срок продления, ключ останется активным.",
+			payment.ID, payment.Plan.Name, formatAmount(paid, payment.Currency))
+	}
+	if payment.Wholesale {
+		// Оптовый заказ можно вернуть за ключи, которые клиенты еще не активировали
+		var unclaimed int64
+		s.repo.DB().Model(&db.PartnerKey{}).Where("payment_id = ? AND claimed_by IS NULL AND revoked = false", payment.ID).Count(&unclaimed)
+		partial = paid * int(unclaimed) / payment.Qty
+		partialLabel = "За неактивированные ключи"
+		text = fmt.Sprintf("↩️ Возврат оптового заказа #%d\n\n📦 %s x%d\n💰 Оплачено: %s\n🔑 Не активировано: %d\n\nВ счет возврата отзываются неактивированные ключи.",
+			payment.ID, payment.Plan.Name, payment.Qty, formatAmount(paid, payment.Currency), unclaimed)
+	}
+
+	type refundOption struct {
+		label  string
+		amount int
+	}
+	options := []refundOption{{"Полный возврат", paid}}
+	// Telegram Stars возвращаются только целиком
+	if partial < paid && payment.Provider != PaymentProviderStars {
+		options = append(options, refundOption{partialLabel, partial})
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, option := range options {
+		data := fmt.Sprintf("%d_%d", payment.ID, option.amount)
+		var row []tgbotapi.InlineKeyboardButton
+		// Оплаченное с баланса возвращается только на баланс, ручной перевод - на выбор
+		if payment.Provider != PaymentProviderBalance {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+				option.label+": "+formatAmount(option.amount, payment.Currency), CallbackRefundAmount.WithID(data)))
+		}
+		if (payment.Provider == "" || payment.Provider == PaymentProviderBalance) && payment.Currency == CurrencyRUB {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+				"💰 На баланс: "+formatAmount(option.amount, payment.Currency), CallbackRefundWallet.WithID(data)))
+		}
+		keyboard = append(keyboard, row)
+	}
+
+	s.answerCallback(callback.ID, "")
+	reply := tgbotapi.NewMessage(callback.Message.Chat.ID, text)
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(reply)
+}
+
+func (s *Service) handleRefundAmountCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.canRefund(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	toWallet := strings.HasPrefix(callback.Data, CallbackRefundWallet.String())
+	data := strings.TrimPrefix(callback.Data, CallbackRefundAmount.String())
+	if toWallet {
+		data = strings.TrimPrefix(callback.Data, CallbackRefundWallet.String())
+	}
+
+	parts := strings.SplitN(data, "_", 2)
+	if len(parts) != 2 {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+	paymentID, err1 := strconv.ParseUint(parts[0], 10, 32)
+	amount, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || amount < 0 {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+
+	refundStates[callback.From.ID] = refundRequest{PaymentID: uint(paymentID), Amount: amount, ToWallet: toWallet}
+	s.answerCallback(callback.ID, "")
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID,
+		fmt.Sprintf("✏️ Напишите причину возврата по заказу #%d одним сообщением. Ее получит пользователь", paymentID))
+}
+
+// handleRefundReasonMessage принимает причину возврата и выполняет его.
+// Возвращает false, если админ не оформляет возврат
+func (s *Service) handleRefundReasonMessage(msg *tgbotapi.Message) bool {
+	req, ok := refundStates[msg.From.ID]
+	if !ok || msg.Text == "" {
+		return false
+	}
+	delete(refundStates, msg.From.ID)
+
+	if err := s.refundPayment(req.PaymentID, msg.From.ID, req.Amount, strings.TrimSpace(msg.Text), req.ToWallet); err != nil {
+		s.logAndReportError("Payment refund failed", err, map[string]interface{}{
+			"payment_id": req.PaymentID,
+			"admin_id":   msg.From.ID,
+			"amount":     req.Amount,
+		})
+		s.reply(msg.Chat.ID, fmt.Sprintf("🚨 Ошибка возврата по заказу #%d:\n%s", req.PaymentID, err.Error()))
+		return true
+	}
+
+	s.reply(msg.Chat.ID, fmt.Sprintf("↩️ Возврат по заказу #%d оформлен, ключи отключены", req.PaymentID))
+	return true
+}
+
+// refundPayment возвращает деньги по одобренному платежу и отзывает выданные
+// по нему ключи. Для Stars и онлайн-оплаты возврат проводится через провайдера,
+// при toWallet и для оплаты с баланса сумма зачисляется на баланс
+func (s *Service) refundPayment(paymentID uint, adminID int64, amount int, reason string, toWallet bool) error {
+	slog.Info("Starting payment refund", "payment_id", paymentID, "admin_id", adminID, "amount", amount)
+
+	var payment db.Payment
+	if err := s.repo.DB().First(&payment, paymentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentf("Payment #%v not found", paymentID)
+		}
+		return ErrDatabasef("Failed to fetch payment #%v: %v", paymentID, err)
+	}
+
+	if payment.Status != PaymentStatusApproved.String() {
+		return ErrPaymentf("Payment #%v cannot be refunded with status: %v", paymentID, payment.Status)
+	}
+	if amount > payment.Amount-payment.Surcharge {
+		return ErrPaymentf("Refund amount %v exceeds payment #%v amount %v", amount, paymentID, payment.Amount-payment.Surcharge)
+	}
+
+	toWallet = toWallet || payment.Provider == PaymentProviderBalance
+	// Баланс ведется в рублях
+	if toWallet && payment.Currency != CurrencyRUB {
+		return ErrPaymentf("Payment #%v in %v cannot be refunded to balance", paymentID, payment.Currency)
+	}
+
+	var refunder Payments
+	if !toWallet {
+		var err error
+		if refunder, err = s.paymentRefunder(&payment); err != nil {
+			return ErrPaymentf("Provider %v unavailable for refund: %v", payment.Provider, err)
+		}
+	}
+
+	// Сначала занимаем платеж: второй админ не сможет вернуть деньги повторно
+	res := s.repo.DB().Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusApproved).
+		Updates(map[string]interface{}{
+			"status":      PaymentStatusRefunding.String(),
+			"refunded_by": adminID,
+		})
+	if res.Error != nil {
+		return ErrDatabasef("Failed to claim payment #%v for refund: %v", paymentID, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrPaymentf("Payment #%v already processed", paymentID)
+	}
+
+	// Возврат у провайдера до отзыва ключей: пиров после удаления уже не
+	// восстановить, поэтому при отказе провайдера платеж и ключи остаются как были
+	if refunder != nil && amount > 0 {
+		if err := refunder.Refund(payment.InvoiceID, amount); err != nil {
+			s.releaseRefundClaim(paymentID)
+			return err
+		}
+	}
+	providerRefunded := refunder != nil && amount > 0
+
+	tx := s.repo.DB().Begin()
+	if tx.Error != nil {
+		return s.failRefund(paymentID, providerRefunded, ErrDatabasef("Failed to begin transaction: %v", tx.Error))
+	}
+
+	now := time.Now()
+	res = tx.Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusRefunding).
+		Updates(map[string]interface{}{
+			"status":          PaymentStatusRefunded.String(),
+			"refunded_amount": amount,
+			"refund_reason":   reason,
+			"refunded_at":     now,
+		})
+	if res.Error != nil {
+		tx.Rollback()
+		return s.failRefund(paymentID, providerRefunded, ErrDatabasef("Failed to mark payment #%v refunded: %v", paymentID, res.Error))
+	}
+
+	if toWallet && amount > 0 {
+		err := appendLedger(tx, &db.LedgerEntry{
+			UserID:    payment.UserID,
+			Amount:    amount,
+			Kind:      LedgerRefund.String(),
+			PaymentID: &payment.ID,
+			AdminID:   &adminID,
+			Comment:   reason,
+		})
+		if err != nil {
+			tx.Rollback()
+			return s.failRefund(paymentID, providerRefunded, err)
+		}
+	}
+
+	// Доплата за смену тарифа и автопродление не выдавали ключей: возврат
+	// откатывает смену или продление, а ключ остается. Ключи оптового заказа
+	// уже активированы клиентами партнера - в счет возврата отзываются только
+	// неактивированные
+	var subscriptions []db.Subscription
+	var restored *db.Subscription
+	var renewalEnd *time.Time
+	var err error
+	switch {
+	case payment.ChangeSubID != nil:
+		restored, err = rollbackPlanChange(tx, &payment)
+	case payment.RenewSubID != nil:
+		var end time.Time
+		if end, err = rollbackRenewal(tx, &payment); err == nil {
+			renewalEnd = &end
+		}
+	case payment.Wholesale:
+		err = revokePartnerKeys(tx, &payment, amount)
+	default:
+		subscriptions, err = s.revokePaymentSubscriptions(tx, paymentID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return s.failRefund(paymentID, providerRefunded, err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return s.failRefund(paymentID, providerRefunded, ErrDatabasef("Failed to commit refund transaction for payment #%v: %v", paymentID, err))
+	}
+
+	userMsg := fmt.Sprintf("↩️ По заказу #%d оформлен возврат %s.\n\nПричина: %s",
+		payment.ID, formatAmount(amount, payment.Currency), reason)
+	switch {
+	case toWallet:
+		userMsg += "\n\n💰 Сумма зачислена на ваш баланс: /balance"
+	case refunder == nil:
+		userMsg += "\n\nДеньги вернет администратор переводом на ваши реквизиты."
+	}
+	if len(subscriptions) > 0 {
+		userMsg += fmt.Sprintf("\n\n🔴 Выданные по заказу ключи (%d) отключены.", len(subscriptions))
+	}
+	if renewalEnd != nil {
+		userMsg += "\n\n🔁 Автопродление отменено, подписка действует до " + renewalEnd.Format("02.01.2006") + "."
+	}
+	if restored != nil {
+		userMsg += fmt.Sprintf("\n\n🔄 Смена тарифа отменена: ключ %s снова на тарифе «%s» до %s.",
+			restored.PeerID, restored.Plan.Name, restored.EndDate.Format("02.01.2006"))
+	}
+	s.reply(payment.UserID, userMsg)
+
+	slog.Info("Payment refund completed", "payment_id", paymentID, "admin_id", adminID, "amount", amount, "disabled_subscriptions", len(subscriptions))
+	return nil
+}
+
+// rollbackRenewal отменяет автопродление, оплаченное платежом: дата окончания
+// подписки и мест семейного тарифа сдвигается назад на срок тарифа, а из
+// оплаты срока вычитается сумма продления
+func rollbackRenewal(tx *gorm.DB, payment *db.Payment) (time.Time, error) {
+	var sub db.Subscription
+	if err := tx.Preload("Plan").First(&sub, *payment.RenewSubID).Error; err != nil {
+		return time.Time{}, ErrDatabasef("Failed to fetch renewed subscription #%v: %v", *payment.RenewSubID, err)
+	}
+
+	var plan db.Plan
+	if err := tx.First(&plan, payment.PlanID).Error; err != nil {
+		return time.Time{}, ErrDatabasef("Failed to fetch plan #%v: %v", payment.PlanID, err)
+	}
+
+	paid, err := db.KeyPaidAmount(tx, &sub)
+	if err != nil {
+		return time.Time{}, ErrDatabasef("Failed to fetch paid amount of subscription #%v: %v", sub.ID, err)
+	}
+	paid -= payment.Amount
+	if paid < 0 {
+		paid = 0
+	}
+
+	end := sub.EndDate.AddDate(0, 0, -plan.DurationDays)
+	err = tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Updates(map[string]interface{}{
+		"end_date":    end,
+		"paid_amount": paid,
+	}).Error
+	if err != nil {
+		return time.Time{}, ErrDatabasef("Failed to roll back renewal of subscription #%v: %v", sub.ID, err)
+	}
+	if err := db.SyncSeatEndDates(tx, sub.ID, end); err != nil {
+		return time.Time{}, ErrDatabasef("Failed to roll back seats of subscription #%v: %v", sub.ID, err)
+	}
+	return end, nil
+}
+
+// releaseRefundClaim возвращает платеж в одобренные, если деньги не ушли
+func (s *Service) releaseRefundClaim(paymentID uint) {
+	err := s.repo.DB().Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusRefunding).
+		Updates(map[string]interface{}{
+			"status":      PaymentStatusApproved.String(),
+			"refunded_by": nil,
+		}).Error
+	if err != nil {
+		slog.Error("Failed to release refund claim", "payment_id", paymentID, "error", err)
+	}
+}
+
+// failRefund завершает неудачный возврат. Если провайдер уже вернул деньги,
+// платеж остается в статусе refunding, чтобы его не одобрили и не вернули
+// повторно, а админу уходит отчет для ручного завершения
+func (s *Service) failRefund(paymentID uint, providerRefunded bool, err error) error {
+	if !providerRefunded {
+		s.releaseRefundClaim(paymentID)
+		return err
+	}
+
+	s.logAndReportError("Refund left unfinished after provider refund", err, map[string]interface{}{
+		"payment_id": paymentID,
+		"status":     PaymentStatusRefunding.String(),
+	})
+	return err
+}
@@ -0,0 +1,280 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// customRejectTemplate используется, когда кассир пишет причину вручную
+const customRejectTemplate = "❌ Платеж по заказу #{order} отклонен.\n\nПричина: {reason}"
+
+// rejectStates хранит платеж, для которого кассир пишет причину отклонения
+var rejectStates = make(map[int64]uint)
+
+// renderRejectMessage подставляет данные заказа в шаблон причины
+func renderRejectMessage(reason *db.RejectReason, payment *db.Payment) string {
+	return strings.NewReplacer(
+		"{order}", strconv.Itoa(int(payment.ID)),
+		// Старые шаблоны сами дописывают рубли после суммы
+		"{amount} руб.", formatAmount(payment.Amount, payment.Currency),
+		"{amount}", formatAmount(payment.Amount, payment.Currency),
+		"{reason}", reason.Title,
+	).Replace(reason.Template)
+}
+
+// showRejectReasons предлагает кассиру выбрать причину вместо мгновенного отклонения
+func (s *Service) showRejectReasons(callback *tgbotapi.CallbackQuery, paymentID uint) {
+	var reasons []db.RejectReason
+	if err := s.repo.DB().Where("archived = false").Order("id ASC").Find(&reasons).Error; err != nil {
+		s.answerCallback(callback.ID, "Ошибка получения причин")
+		return
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, reason := range reasons {
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(reason.Title, CallbackRejectReason.WithID(fmt.Sprintf("%d_%d", paymentID, reason.ID))),
+		})
+	}
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("✏️ Другое", CallbackRejectReason.WithID(fmt.Sprintf("%d_0", paymentID))),
+	})
+
+	s.editCallbackMessage(callback, fmt.Sprintf("❌ Причина отклонения платежа #%d:", paymentID), keyboard)
+	s.answerCallback(callback.ID, "")
+}
+
+func (s *Service) handleRejectReasonCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.isAdmin(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(callback.Data, CallbackRejectReason.String()), "_", 2)
+	if len(parts) != 2 {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+	paymentID, err1 := strconv.ParseUint(parts[0], 10, 32)
+	reasonID, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		s.answerCallback(callback.ID, "Неверные данные")
+		return
+	}
+
+	if reasonID == 0 {
+		rejectStates[callback.From.ID] = uint(paymentID)
+		s.editCallbackMessage(callback,
+			fmt.Sprintf("✏️ Напишите причину отклонения платежа #%d одним сообщением. Ее получит пользователь", paymentID), nil)
+		s.answerCallback(callback.ID, "")
+		return
+	}
+
+	var reason db.RejectReason
+	if err := s.repo.DB().First(&reason, reasonID).Error; err != nil {
+		s.answerCallback(callback.ID, "Причина не найдена")
+		return
+	}
+
+	if err := s.rejectPayment(uint(paymentID), callback.From.ID, &reason); err != nil {
+		s.logAndReportError("Payment rejection failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"admin_id":   callback.From.ID,
+			"reason":     reason.Title,
+		})
+		s.answerCallback(callback.ID, "Ошибка отклонения платежа")
+		s.reply(callback.Message.Chat.ID, "🚨 Ошибка при отклонении платежа #"+strconv.FormatUint(paymentID, 10)+":\n"+err.Error())
+		return
+	}
+
+	s.answerCallback(callback.ID, "❌ Платеж отклонен")
+	s.editCallbackMessage(callback, fmt.Sprintf("❌ Платеж #%d отклонен: %s", paymentID, reason.Title), nil)
+}
+
+// handleRejectReasonMessage принимает причину, написанную кассиром вручную.
+// Возвращает false, если кассир не в режиме ввода причины
+func (s *Service) handleRejectReasonMessage(msg *tgbotapi.Message) bool {
+	paymentID, ok := rejectStates[msg.From.ID]
+	if !ok || msg.Text == "" {
+		return false
+	}
+	delete(rejectStates, msg.From.ID)
+
+	reason := &db.RejectReason{
+		Title:         strings.TrimSpace(msg.Text),
+		Template:      customRejectTemplate,
+		AllowResubmit: true,
+	}
+
+	if err := s.rejectPayment(paymentID, msg.From.ID, reason); err != nil {
+		s.logAndReportError("Payment rejection failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"admin_id":   msg.From.ID,
+		})
+		s.reply(msg.Chat.ID, fmt.Sprintf("🚨 Ошибка при отклонении платежа #%d:\n%s", paymentID, err.Error()))
+		return true
+	}
+
+	s.reply(msg.Chat.ID, fmt.Sprintf("❌ Платеж #%d отклонен, пользователь уведомлен", paymentID))
+	return true
+}
+
+// handlePaymentResubmit снова открывает отклоненный заказ для исправленного чека
+func (s *Service) handlePaymentResubmit(callback *tgbotapi.CallbackQuery) {
+	paymentID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackPaymentResubmit.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный номер заказа")
+		return
+	}
+
+	var payment db.Payment
+	err = s.repo.DB().Where("id = ? AND user_id = ? AND status = ? AND provider = ''",
+		paymentID, callback.From.ID, PaymentStatusRejected).First(&payment).Error
+	if err != nil {
+		s.answerCallback(callback.ID, "Заказ недоступен для повторной отправки")
+		return
+	}
+
+	// Кнопка показывается только для таких причин, но данные callback можно подделать
+	if !payment.ResubmitAllowed {
+		s.answerCallback(callback.ID, "По этому заказу повторная отправка недоступна")
+		return
+	}
+
+	tx := s.repo.DB().Begin()
+	if tx.Error != nil {
+		s.answerCallback(callback.ID, "Ошибка БД")
+		return
+	}
+
+	// Отозванные ключи больше не относятся к заказу, после одобрения выдадутся новые
+	if err := tx.Model(&db.Subscription{}).Where("payment_id = ? AND active = false", payment.ID).
+		Update("payment_id", nil).Error; err != nil {
+		tx.Rollback()
+		s.answerCallback(callback.ID, "Ошибка БД")
+		return
+	}
+
+	// created_at обновляется, чтобы у пользователя был полный срок на отправку чека
+	res := tx.Model(&db.Payment{}).Where("id = ? AND status = ?", payment.ID, PaymentStatusRejected).
+		Updates(map[string]interface{}{
+			"status":            PaymentStatusPending.String(),
+			"receipt_file_id":   "",
+			"receipt_unique_id": "",
+			"receipt_hash":      "",
+			"duplicate_of":      nil,
+			"approved_by":       nil,
+			"created_at":        time.Now(),
+		})
+	if res.Error != nil && isUniqueViolation(res.Error) {
+		// Сумму заказа уже занял другой ожидающий заказ, по SMS их не различить
+		tx.Rollback()
+		s.answerCallback(callback.ID, "Сейчас повторная отправка недоступна, напишите в поддержку")
+		return
+	}
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		s.answerCallback(callback.ID, "Заказ недоступен для повторной отправки")
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		s.answerCallback(callback.ID, "Ошибка БД")
+		return
+	}
+
+	buyStates[callback.From.ID] = &BuyState{
+		UserID:    callback.From.ID,
+		PlanID:    payment.PlanID,
+		Qty:       payment.Qty,
+		MethodID:  payment.MethodID,
+		PaymentID: payment.ID,
+		Step:      BuyStepReceipt,
+	}
+
+	slog.Info("Payment reopened for resubmission", "payment_id", payment.ID, "user_id", callback.From.ID)
+	s.answerCallback(callback.ID, "")
+	s.reply(callback.Message.Chat.ID, fmt.Sprintf("📎 Отправьте исправленный чек для заказа #%d (фото или PDF)", payment.ID))
+}
+
+func (s *Service) handleReasons(msg *tgbotapi.Message) {
+	var reasons []db.RejectReason
+	if err := s.repo.DB().Where("archived = false").Order("id ASC").Find(&reasons).Error; err != nil {
+		s.reply(msg.Chat.ID, "Ошибка получения причин отклонения")
+		return
+	}
+
+	if len(reasons) == 0 {
+		s.reply(msg.Chat.ID, "Причины отклонения не настроены. Добавьте: /addreason")
+		return
+	}
+
+	text := "📝 Причины отклонения платежей:\n\n"
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, reason := range reasons {
+		resubmit := "📎 можно прислать новый чек"
+		if !reason.AllowResubmit {
+			resubmit = "🚫 без повторной отправки"
+		}
+		text += fmt.Sprintf("#%d %s (%s)\n%s\n\n", reason.ID, reason.Title, resubmit, reason.Template)
+
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🗄 Архивировать: "+reason.Title, CallbackArchiveReason.WithID(reason.ID)),
+		})
+	}
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	s.bot.Send(reply)
+}
+
+func (s *Service) handleAddReason(msg *tgbotapi.Message) {
+	parts := strings.Split(msg.CommandArguments(), "|")
+	if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		s.reply(msg.Chat.ID, "Использование: /addreason <название> | <текст для пользователя> [| noresubmit]\n"+
+			"В тексте можно использовать {order} и {amount}\n"+
+			"Пример: /addreason Чужая карта | ❌ Заказ #{order}: перевод с карты другого человека. Отправьте чек со своей карты")
+		return
+	}
+
+	reason := &db.RejectReason{
+		Title:         strings.TrimSpace(parts[0]),
+		Template:      strings.TrimSpace(parts[1]),
+		AllowResubmit: !(len(parts) > 2 && strings.TrimSpace(parts[2]) == "noresubmit"),
+	}
+
+	if err := s.repo.DB().Create(reason).Error; err != nil {
+		s.reply(msg.Chat.ID, "Ошибка создания причины")
+		return
+	}
+
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Причина #%d добавлена: %s", reason.ID, reason.Title))
+}
+
+func (s *Service) handleArchiveReasonCallback(callback *tgbotapi.CallbackQuery) {
+	if !s.isAdmin(callback.From.ID) {
+		s.answerCallback(callback.ID, "У вас нет прав")
+		return
+	}
+
+	reasonID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackArchiveReason.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID причины")
+		return
+	}
+
+	if err := s.repo.DB().Model(&db.RejectReason{}).Where("id = ?", reasonID).Update("archived", true).Error; err != nil {
+		s.answerCallback(callback.ID, "Ошибка архивирования")
+		return
+	}
+
+	s.answerCallback(callback.ID, "🗄 Причина архивирована")
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, fmt.Sprintf("🗄 Причина #%d архивирована. Список: /reasons", reasonID))
+}
@@ -0,0 +1,275 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// paymentOption - способ оплаты с ценой заказа в его валюте
+type paymentOption struct {
+	Method db.PaymentMethod
+	Price  int
+}
+
+// methodUsage - нагрузка на способ оплаты: сумма заказов с начала суток и
+// число неоплаченных заказов
+type methodUsage struct {
+	Today   int
+	Pending int
+}
+
+// dayStart - начало суток, с которого считается дневной лимит
+func dayStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// methodActiveAt - принимает ли способ переводы в этот час
+func methodActiveAt(method *db.PaymentMethod, now time.Time) bool {
+	if method.ActiveFrom == method.ActiveTo {
+		return true
+	}
+	hour := now.Hour()
+	if method.ActiveFrom < method.ActiveTo {
+		return hour >= method.ActiveFrom && hour < method.ActiveTo
+	}
+	// Окно через полночь, например 22-6
+	return hour >= method.ActiveFrom || hour < method.ActiveTo
+}
+
+// methodFits - можно ли выставить на способ заказ на amount прямо сейчас
+func methodFits(method *db.PaymentMethod, usage methodUsage, amount int, now time.Time) bool {
+	if !methodActiveAt(method, now) {
+		return false
+	}
+	if method.MaxPending > 0 && usage.Pending >= method.MaxPending {
+		return false
+	}
+	return method.DailyLimit == 0 || usage.Today+amount <= method.DailyLimit
+}
+
+// methodUsages считает нагрузку на способы оплаты. Неоплаченные и одобренные
+// заказы занимают дневной лимит, отклоненные и отмененные его освобождают
+func (s *Service) methodUsages(methodIDs []uint, now time.Time) (map[uint]methodUsage, error) {
+	usages := make(map[uint]methodUsage, len(methodIDs))
+	if len(methodIDs) == 0 {
+		return usages, nil
+	}
+
+	var payments []db.Payment
+	since := dayStart(now)
+	// Неоплаченные заказы считаются за любой день, одобренные - только за сегодня
+	err := s.repo.DB().Select("method_id", "amount", "status", "created_at").
+		Where("provider = '' AND method_id IN ? AND (status = ? OR (status = ? AND "+db.TimeSince(s.repo.DB(), "created_at")+"))",
+			methodIDs, PaymentStatusPending.String(), PaymentStatusApproved.String(), since).
+		Find(&payments).Error
+	if err != nil {
+		return nil, ErrDatabasef("Failed to fetch payment method usage: %v", err)
+	}
+
+	for _, payment := range payments {
+		usage := usages[payment.MethodID]
+		if payment.Status == PaymentStatusPending.String() {
+			usage.Pending++
+		}
+		if !payment.CreatedAt.Before(since) {
+			usage.Today += payment.Amount
+		}
+		usages[payment.MethodID] = usage
+	}
+	return usages, nil
+}
+
+// availableMethods - способы ручного перевода, которыми можно оплатить заказ
+// сейчас. price возвращает сумму заказа в валюте способа, 0 - в этой валюте
+// заказ не оплачивается. Способы вне часов работы или сверх лимита скрываются
+// до следующего окна, а при ротации на валюту остается один способ
+func (s *Service) availableMethods(price func(currency string) int, now time.Time) ([]paymentOption, error) {
+	var methods []db.PaymentMethod
+	if err := s.repo.DB().Where("archived = false").Order("id ASC").Find(&methods).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch payment methods: %v", err)
+	}
+
+	ids := make([]uint, 0, len(methods))
+	for _, method := range methods {
+		ids = append(ids, method.ID)
+	}
+	usages, err := s.methodUsages(ids, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var options []paymentOption
+	for _, method := range methods {
+		amount := price(method.Currency)
+		if amount > 0 && methodFits(&method, usages[method.ID], amount, now) {
+			options = append(options, paymentOption{Method: method, Price: amount})
+		}
+	}
+
+	rotation := MethodRotation(s.cfg.MethodRotation)
+	if !rotation.IsValid() {
+		slog.Warn("Unknown method rotation, showing all methods", "rotation", s.cfg.MethodRotation)
+		rotation = RotationAll
+	}
+	if rotation == RotationAll {
+		return options, nil
+	}
+
+	byCurrency := make(map[string][]paymentOption)
+	var order []string
+	for _, option := range options {
+		if _, ok := byCurrency[option.Method.Currency]; !ok {
+			order = append(order, option.Method.Currency)
+		}
+		byCurrency[option.Method.Currency] = append(byCurrency[option.Method.Currency], option)
+	}
+
+	var rotated []paymentOption
+	for _, currency := range order {
+		candidates := byCurrency[currency]
+		if rotation == RotationLeastUsed {
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return usages[candidates[i].Method.ID].Today < usages[candidates[j].Method.ID].Today
+			})
+			rotated = append(rotated, candidates[0])
+			continue
+		}
+		rotated = append(rotated, s.nextInRotation(candidates))
+	}
+	return rotated, nil
+}
+
+// nextInRotation выбирает способ, следующий за тем, на который выставлен
+// последний заказ в этой валюте
+func (s *Service) nextInRotation(candidates []paymentOption) paymentOption {
+	var last db.Payment
+	err := s.repo.DB().Select("method_id").
+		Where("provider = '' AND currency = ?", candidates[0].Method.Currency).
+		Order("id DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		slog.Error("Failed to fetch last payment method", "error", err)
+		return candidates[0]
+	}
+	for _, option := range candidates {
+		if option.Method.ID > last.MethodID {
+			return option
+		}
+	}
+	return candidates[0]
+}
+
+// methodAvailable перепроверяет выбранный способ перед созданием заказа:
+// клавиатура могла устареть, пока покупатель выбирал
+func (s *Service) methodAvailable(method *db.PaymentMethod, amount int, now time.Time) bool {
+	if method.Archived || amount <= 0 {
+		return false
+	}
+	usages, err := s.methodUsages([]uint{method.ID}, now)
+	if err != nil {
+		slog.Error("Failed to check payment method limits", "method_id", method.ID, "error", err)
+		return false
+	}
+	return methodFits(method, usages[method.ID], amount, now)
+}
+
+// methodLimitsText - лимиты способа и их использование для админа
+func methodLimitsText(method *db.PaymentMethod, usage methodUsage, now time.Time) string {
+	var parts []string
+	if method.DailyLimit > 0 {
+		parts = append(parts, fmt.Sprintf("за сутки %s из %s",
+			formatAmount(usage.Today, method.Currency), formatAmount(method.DailyLimit, method.Currency)))
+	}
+	if method.MaxPending > 0 {
+		parts = append(parts, fmt.Sprintf("ожидают оплаты %d из %d", usage.Pending, method.MaxPending))
+	}
+	if method.ActiveFrom != method.ActiveTo {
+		parts = append(parts, fmt.Sprintf("часы %d-%d", method.ActiveFrom, method.ActiveTo))
+	}
+	if len(parts) == 0 {
+		return "без лимитов"
+	}
+
+	text := strings.Join(parts, ", ")
+	if !methodFits(method, usage, 0, now) || (method.DailyLimit > 0 && usage.Today >= method.DailyLimit) {
+		text += " - скрыт до следующего окна"
+	}
+	return text
+}
+
+// handlePaymentMethodLimit задает лимиты способа оплаты
+func (s *Service) handlePaymentMethodLimit(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 3 {
+		s.reply(msg.Chat.ID, "Использование: /pmethodlimit <id_способа> <сумма_в_сутки> <заказов_без_оплаты> [<с>-<до>]\nПример: /pmethodlimit 1 50000 5 9-21\n0 - без ограничения, без часов - круглосуточно. ID способов - в /listpmethods")
+		return
+	}
+
+	methodID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID способа оплаты")
+		return
+	}
+	var method db.PaymentMethod
+	if err := s.repo.DB().Where("id = ? AND archived = false", methodID).First(&method).Error; err != nil {
+		s.reply(msg.Chat.ID, "Способ оплаты не найден")
+		return
+	}
+
+	dailyLimit, err := parseAmount(args[1], method.Currency)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверная сумма в сутки")
+		return
+	}
+	maxPending, err := strconv.Atoi(args[2])
+	if err != nil || maxPending < 0 {
+		s.reply(msg.Chat.ID, "Неверное число заказов")
+		return
+	}
+
+	from, to := 0, 0
+	if len(args) > 3 {
+		fromStr, toStr, ok := strings.Cut(args[3], "-")
+		from, err = strconv.Atoi(fromStr)
+		var toErr error
+		to, toErr = strconv.Atoi(toStr)
+		if !ok || err != nil || toErr != nil || from < 0 || from > 23 || to < 0 || to > 24 {
+			s.reply(msg.Chat.ID, "Часы указываются как 9-21, от 0 до 24")
+			return
+		}
+		to %= 24
+	}
+
+	method.DailyLimit, method.MaxPending, method.ActiveFrom, method.ActiveTo = dailyLimit, maxPending, from, to
+	err = s.repo.DB().Model(&method).Updates(map[string]interface{}{
+		"daily_limit": dailyLimit,
+		"max_pending": maxPending,
+		"active_from": from,
+		"active_to":   to,
+	}).Error
+	if err != nil {
+		s.logAndReportError("Payment method limit update failed", ErrDatabasef("Failed to save limits of method #%v: %v", method.ID, err), map[string]interface{}{
+			"admin_id":  msg.From.ID,
+			"method_id": method.ID,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения лимитов")
+		return
+	}
+
+	slog.Info("Payment method limits updated", "admin_id", msg.From.ID, "method_id", method.ID,
+		"daily_limit", dailyLimit, "max_pending", maxPending, "active_from", from, "active_to", to)
+
+	now := time.Now()
+	usages, err := s.methodUsages([]uint{method.ID}, now)
+	if err != nil {
+		slog.Error("Failed to fetch payment method usage", "method_id", method.ID, "error", err)
+	}
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ %s (%s): %s", method.Bank, method.PhoneNumber, methodLimitsText(&method, usages[method.ID], now)))
+}
@@ -0,0 +1,141 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// paymentQRScale - пикселей на модуль QR-кода: около 500 px для версии 10
+const paymentQRScale = 8
+
+// Платежный QR собирается по ГОСТ Р 56042-2014 из банковских реквизитов, а не
+// как QR СБП по номеру телефона. QR СБП (qr.nspk.ru) регистрирует банк
+// получателя через API НСПК, локально его не сформировать, а формата перевода
+// по телефону, который понимали бы все банковские приложения, нет. Способам
+// оплаты только с телефоном QR не выдается, им хватает текстовой инструкции
+
+// paymentQRSupported - можно ли выдать QR для способа: только рубли и только
+// с заполненными реквизитами
+func paymentQRSupported(method *db.PaymentMethod) bool {
+	return method.Currency == CurrencyRUB && method.Account != "" && method.BIC != "" && method.CorrAccount != ""
+}
+
+// paymentQRPayload собирает платежную строку ГОСТ Р 56042-2014 в UTF-8 с
+// точной суммой в копейках и номером заказа в назначении платежа
+func paymentQRPayload(payment *db.Payment, method *db.PaymentMethod) string {
+	// Вертикальная черта разделяет поля и не может встречаться в значениях
+	clean := func(value string) string {
+		return strings.TrimSpace(strings.ReplaceAll(value, "|", " "))
+	}
+	fields := []string{
+		"ST00012",
+		"Name=" + clean(method.OwnerName),
+		"PersonalAcc=" + method.Account,
+		"BankName=" + clean(method.Bank),
+		"BIC=" + method.BIC,
+		"CorrespAcc=" + method.CorrAccount,
+		fmt.Sprintf("Sum=%d", payment.Amount*100),
+		fmt.Sprintf("Purpose=Оплата заказа #%d", payment.ID),
+	}
+	return strings.Join(fields, "|")
+}
+
+// sendPaymentQR отправляет QR-код для оплаты из банковского приложения.
+// Ошибки только логируются: текстовой инструкции достаточно для оплаты
+func (s *Service) sendPaymentQR(chatID int64, payment *db.Payment, method *db.PaymentMethod) {
+	if payment.Currency != CurrencyRUB || !paymentQRSupported(method) {
+		return
+	}
+
+	// Отрицательный размер - масштаб в пикселях на модуль
+	data, err := qrcode.Encode(paymentQRPayload(payment, method), qrcode.Medium, -paymentQRScale)
+	if err != nil {
+		slog.Error("Failed to render payment QR", "payment_id", payment.ID, "method_id", method.ID, "error", err)
+		return
+	}
+
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: "payment.png", Bytes: data})
+	photo.Caption = fmt.Sprintf("📲 Отсканируйте QR в приложении банка - получатель, сумма %s и номер заказа #%d подставятся сами",
+		formatAmount(payment.Amount, payment.Currency), payment.ID)
+	if _, err := s.bot.Send(photo); err != nil {
+		slog.Error("Failed to send payment QR", "payment_id", payment.ID, "error", err)
+	}
+}
+
+// digitsOnly - строка из length цифр
+func digitsOnly(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	_, err := strconv.ParseUint(value, 10, 64)
+	return err == nil
+}
+
+// handlePaymentMethodQR задает реквизиты способа оплаты для QR-кода
+func (s *Service) handlePaymentMethodQR(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) != 2 && len(args) != 4 {
+		s.reply(msg.Chat.ID, "Использование: /pmethodqr <id_способа> <расчетный_счет> <БИК> <корр_счет>\nПример: /pmethodqr 1 40817810099910004312 044525225 30101810400000000225\n/pmethodqr <id_способа> off - не выдавать QR. QR выдается только для рублевых способов")
+		return
+	}
+
+	methodID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		s.reply(msg.Chat.ID, "Неверный ID способа оплаты")
+		return
+	}
+	var method db.PaymentMethod
+	if err := s.repo.DB().Where("id = ? AND archived = false", methodID).First(&method).Error; err != nil {
+		s.reply(msg.Chat.ID, "Способ оплаты не найден")
+		return
+	}
+	if method.Currency != CurrencyRUB {
+		s.reply(msg.Chat.ID, "QR-код по ГОСТ доступен только для рублевых способов")
+		return
+	}
+
+	account, bic, corrAccount := "", "", ""
+	if len(args) == 4 {
+		account, bic, corrAccount = args[1], args[2], args[3]
+		if !digitsOnly(account, 20) || !digitsOnly(corrAccount, 20) {
+			s.reply(msg.Chat.ID, "Счета должны состоять из 20 цифр")
+			return
+		}
+		if !digitsOnly(bic, 9) {
+			s.reply(msg.Chat.ID, "БИК должен состоять из 9 цифр")
+			return
+		}
+	} else if args[1] != "off" {
+		s.reply(msg.Chat.ID, "Укажите реквизиты или off")
+		return
+	}
+
+	err = s.repo.DB().Model(&method).Updates(map[string]interface{}{
+		"account":      account,
+		"bic":          bic,
+		"corr_account": corrAccount,
+	}).Error
+	if err != nil {
+		s.logAndReportError("Payment method QR update failed", ErrDatabasef("Failed to save requisites of method #%v: %v", method.ID, err), map[string]interface{}{
+			"admin_id":  msg.From.ID,
+			"method_id": method.ID,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения реквизитов")
+		return
+	}
+
+	slog.Info("Payment method requisites updated", "admin_id", msg.From.ID, "method_id", method.ID, "enabled", account != "")
+
+	if account == "" {
+		s.reply(msg.Chat.ID, fmt.Sprintf("✅ %s (%s): QR-код отключен", method.Bank, method.PhoneNumber))
+		return
+	}
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ %s (%s): покупатели получат QR-код для оплаты на счет %s", method.Bank, method.PhoneNumber, account))
+}
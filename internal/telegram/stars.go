@@ -0,0 +1,299 @@
+package telegram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	PaymentProviderStars = "stars"
+
+	starsPayloadPrefix = "stars_"
+)
+
+// starsPayments принимает оплату в Telegram Stars через sendInvoice
+type starsPayments struct {
+	s *Service
+}
+
+var _ Payments = (*starsPayments)(nil)
+
+func starsPayload(paymentID uint) string {
+	return starsPayloadPrefix + strconv.FormatUint(uint64(paymentID), 10)
+}
+
+func parseStarsPayload(payload string) (uint, error) {
+	if !strings.HasPrefix(payload, starsPayloadPrefix) {
+		return 0, fmt.Errorf("not a stars payload: %q", payload)
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(payload, starsPayloadPrefix), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stars payload %q: %w", payload, err)
+	}
+	return uint(id), nil
+}
+
+func (p *starsPayments) CreateInvoice(userID int64, planID uint, qty int) (string, error) {
+	var plan db.Plan
+	if err := p.s.repo.DB().First(&plan, planID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrPlanNotFoundf("Plan #%v not found", planID)
+		}
+		return "", ErrDatabasef("Failed to fetch plan #%v: %v", planID, err)
+	}
+
+	if plan.PriceStars <= 0 {
+		return "", ErrPaymentf("Plan #%v has no Stars price", planID)
+	}
+
+	payment := &db.Payment{
+		UserID:   userID,
+		Amount:   plan.PriceStars * qty,
+		Currency: CurrencyStars,
+		PlanID:   plan.ID,
+		Qty:      qty,
+		Status:   PaymentStatusPending.String(),
+		Provider: PaymentProviderStars,
+		// Звезды не дают оптовую цену, но партнер получает ссылки активации
+		Wholesale: p.s.isPartner(userID),
+	}
+	if err := p.s.repo.DB().Create(payment).Error; err != nil {
+		return "", ErrDatabasef("Failed to create stars payment: %v", err)
+	}
+
+	payment.InvoiceID = starsPayload(payment.ID)
+	if err := p.s.repo.DB().Model(payment).Update("invoice_id", payment.InvoiceID).Error; err != nil {
+		return "", ErrDatabasef("Failed to save stars invoice id: %v", err)
+	}
+
+	prices, err := json.Marshal([]tgbotapi.LabeledPrice{
+		{Label: fmt.Sprintf("%s x%d", plan.Name, qty), Amount: payment.Amount},
+	})
+	if err != nil {
+		return "", ErrPaymentf("Failed to encode invoice prices: %v", err)
+	}
+
+	// Собираем параметры вручную: для Stars provider_token должен быть пустым,
+	// а чаевые не поддерживаются
+	params := tgbotapi.Params{
+		"chat_id":        strconv.FormatInt(userID, 10),
+		"title":          "Lime VPN: " + plan.Name,
+		"description":    fmt.Sprintf("Подписка на %d дней, ключей: %d", plan.DurationDays, qty),
+		"payload":        payment.InvoiceID,
+		"provider_token": "",
+		"currency":       CurrencyStars,
+		"prices":         string(prices),
+	}
+
+	if _, err := p.s.bot.MakeRequest("sendInvoice", params); err != nil {
+		return "", ErrNetworkf("Failed to send stars invoice: %v", err)
+	}
+
+	slog.Info("Stars invoice sent", "payment_id", payment.ID, "user_id", userID, "amount", payment.Amount)
+	return "", nil
+}
+
+func (p *starsPayments) VerifyPayment(invoiceID string) (bool, error) {
+	var payment db.Payment
+	if err := p.s.repo.DB().Where("invoice_id = ? AND provider = ?", invoiceID, PaymentProviderStars).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, ErrPaymentf("Stars invoice %v not found", invoiceID)
+		}
+		return false, ErrDatabasef("Failed to fetch stars invoice %v: %v", invoiceID, err)
+	}
+	return payment.Status == PaymentStatusApproved.String(), nil
+}
+
+// Refund возвращает звезды пользователю через refundStarPayment.
+// Telegram возвращает только всю сумму, частичный возврат недоступен
+func (p *starsPayments) Refund(invoiceID string, amount int) error {
+	var payment db.Payment
+	if err := p.s.repo.DB().Where("invoice_id = ? AND provider = ?", invoiceID, PaymentProviderStars).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentf("Stars invoice %v not found", invoiceID)
+		}
+		return ErrDatabasef("Failed to fetch stars invoice %v: %v", invoiceID, err)
+	}
+
+	if amount != payment.Amount {
+		return ErrPaymentf("Stars payment #%v can only be refunded in full", payment.ID)
+	}
+
+	if payment.ProviderChargeID == "" {
+		return ErrPaymentf("Stars payment #%v has no charge id", payment.ID)
+	}
+
+	params := tgbotapi.Params{
+		"user_id":                    strconv.FormatInt(payment.UserID, 10),
+		"telegram_payment_charge_id": payment.ProviderChargeID,
+	}
+	if _, err := p.s.bot.MakeRequest("refundStarPayment", params); err != nil {
+		return ErrNetworkf("Failed to refund stars payment: %v", err)
+	}
+
+	slog.Info("Stars payment refunded", "payment_id", payment.ID, "user_id", payment.UserID)
+	return nil
+}
+
+func (s *Service) handleStarsSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	state.Step = BuyStepPayment
+
+	if _, err := s.stars.CreateInvoice(state.UserID, state.PlanID, state.Qty); err != nil {
+		s.logAndReportError("Stars invoice creation failed", err, map[string]interface{}{
+			"user_id": state.UserID,
+			"plan_id": state.PlanID,
+		})
+		s.answerCallback(callback.ID, "Ошибка создания счета")
+		return
+	}
+
+	delete(buyStates, state.UserID)
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, "⭐ Счет на оплату в Telegram Stars отправлен ниже")
+	s.answerCallback(callback.ID, "")
+}
+
+func (s *Service) handlePreCheckoutQuery(query *tgbotapi.PreCheckoutQuery) {
+	answer := tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, OK: true}
+
+	if err := s.checkStarsInvoice(query.From.ID, query.InvoicePayload, query.Currency, query.TotalAmount); err != nil {
+		slog.Warn("Pre-checkout rejected", "user_id", query.From.ID, "payload", query.InvoicePayload, "error", err)
+		answer.OK = false
+		answer.ErrorMessage = "Счет устарел или уже оплачен. Оформите заказ заново через /buy"
+	}
+
+	if _, err := s.bot.Request(answer); err != nil {
+		s.logAndReportError("Pre-checkout answer failed", err, map[string]interface{}{
+			"user_id": query.From.ID,
+			"payload": query.InvoicePayload,
+		})
+	}
+}
+
+// checkStarsInvoice проверяет, что счет принадлежит пользователю, еще не оплачен и сумма совпадает
+func (s *Service) checkStarsInvoice(userID int64, payload, currency string, amount int) error {
+	paymentID, err := parseStarsPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	var payment db.Payment
+	if err := s.repo.DB().First(&payment, paymentID).Error; err != nil {
+		return err
+	}
+
+	if payment.UserID != userID || payment.Status != PaymentStatusPending.String() ||
+		payment.Currency != currency || payment.Amount != amount {
+		return ErrPaymentf("Stars invoice %v does not match payment #%v", payload, paymentID)
+	}
+
+	return nil
+}
+
+func (s *Service) handleSuccessfulPayment(msg *tgbotapi.Message) {
+	sp := msg.SuccessfulPayment
+	slog.Info("Successful payment received", "user_id", msg.From.ID, "payload", sp.InvoicePayload, "amount", sp.TotalAmount)
+
+	paymentID, err := parseStarsPayload(sp.InvoicePayload)
+	if err != nil {
+		s.logAndReportError("Unknown successful payment payload", err, map[string]interface{}{
+			"user_id": msg.From.ID,
+			"payload": sp.InvoicePayload,
+		})
+		return
+	}
+
+	// Сохраняем charge id до выдачи ключей, чтобы возврат был возможен при любой ошибке дальше
+	if err := s.repo.DB().Model(&db.Payment{}).Where("id = ?", paymentID).
+		Update("provider_charge_id", sp.TelegramPaymentChargeID).Error; err != nil {
+		s.logAndReportError("Failed to save stars charge id", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"charge_id":  sp.TelegramPaymentChargeID,
+		})
+	}
+
+	var payment db.Payment
+	if err := s.repo.DB().First(&payment, paymentID).Error; err != nil {
+		s.logAndReportError("Stars payment fetch failed", ErrDatabasef("Failed to fetch payment #%v: %v", paymentID, err), map[string]interface{}{
+			"payment_id": paymentID,
+			"user_id":    msg.From.ID,
+		})
+		s.handleError(msg.Chat.ID, err)
+		return
+	}
+
+	// Заказ мог просрочиться или отмениться между pre_checkout_query и оплатой.
+	// Звезды уже списаны: выдаем ключи, а если не получилось - возвращаем звезды
+	late := payment.Status == PaymentStatusExpired.String() || payment.Status == PaymentStatusCanceled.String()
+	if late {
+		s.logAndReportError("Stars payment succeeded after close", ErrPaymentf("Payment #%v paid with status %v, approving", payment.ID, payment.Status), map[string]interface{}{
+			"payment_id": payment.ID,
+			"user_id":    msg.From.ID,
+		})
+		if err := reopenPayment(s.repo.DB(), &payment); err != nil {
+			s.refundLateStarPayment(msg.Chat.ID, paymentID, err)
+			return
+		}
+	}
+
+	if err := s.approvePayment(paymentID, 0); err != nil {
+		if late {
+			s.refundLateStarPayment(msg.Chat.ID, paymentID, err)
+			return
+		}
+		s.logAndReportError("Stars payment auto-approval failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"user_id":    msg.From.ID,
+		})
+		s.handleError(msg.Chat.ID, err)
+		return
+	}
+
+	s.reply(msg.Chat.ID, "✅ Оплата в Telegram Stars получена! Ваши ключи выше.")
+}
+
+// refundLateStarPayment возвращает звезды за заказ, который закрылся до оплаты
+// и не смог быть одобрен, и помечает заказ возвращенным
+func (s *Service) refundLateStarPayment(chatID int64, paymentID uint, cause error) {
+	ctx := map[string]interface{}{
+		"payment_id": paymentID,
+		"user_id":    chatID,
+	}
+	s.logAndReportError("Late stars payment approval failed", cause, ctx)
+
+	var payment db.Payment
+	if err := s.repo.DB().First(&payment, paymentID).Error; err != nil {
+		s.logAndReportError("Late stars payment refund failed", ErrDatabasef("Failed to fetch payment #%v: %v", paymentID, err), ctx)
+		s.handleError(chatID, err)
+		return
+	}
+
+	if err := s.stars.Refund(payment.InvoiceID, payment.Amount); err != nil {
+		s.logAndReportError("Late stars payment refund failed", err, ctx)
+		s.handleError(chatID, err)
+		return
+	}
+
+	now := time.Now()
+	err := s.repo.DB().Model(&db.Payment{}).Where("id = ? AND status <> ?", paymentID, PaymentStatusApproved).
+		Updates(map[string]interface{}{
+			"status":          PaymentStatusRefunded.String(),
+			"refunded_amount": payment.Amount,
+			"refund_reason":   "Заказ закрылся до оплаты",
+			"refunded_at":     now,
+		}).Error
+	if err != nil {
+		slog.Error("Failed to mark late stars payment refunded", "payment_id", paymentID, "error", err)
+	}
+
+	s.reply(chatID, fmt.Sprintf("↩️ Заказ #%d закрылся до оплаты, звезды возвращены. Оформите новый заказ через /buy", paymentID))
+}
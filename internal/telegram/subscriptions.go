@@ -30,6 +30,16 @@ func (s *Service) handleMyKeys(msg *tgbotapi.Message) {
 		return
 	}
 
+	text, keyboard := renderMyKeys(subscriptions)
+
+	msgConfig := tgbotapi.NewMessage(msg.Chat.ID, text)
+	if len(keyboard) > 0 {
+		msgConfig.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	}
+	s.bot.Send(msgConfig)
+}
+
+func renderMyKeys(subscriptions []db.Subscription) (string, [][]tgbotapi.InlineKeyboardButton) {
 	text := "🔑 Ваши активные подписки:\n\n"
 	for i, sub := range subscriptions {
 		status := "🟢 Активен"
@@ -37,9 +47,19 @@ func (s *Service) handleMyKeys(msg *tgbotapi.Message) {
 			status = "🔴 Отключен"
 		}
 
-		text += fmt.Sprintf("📱 %d. %s (%s)\n📋 ID: %s\n⏰ До: %s\n%s\n\n",
+		renew := ""
+		if sub.AutoRenew {
+			renew = "\n🔁 Автопродление с баланса"
+		}
+		if sub.SeatOf != nil {
+			renew = "\n👨‍👩‍👧 Место в семейной подписке"
+		} else if sub.Plan.Seats > 1 {
+			renew += "\n👨‍👩‍👧 Семейная подписка: /family"
+		}
+
+		text += fmt.Sprintf("📱 %d. %s (%s)\n📋 ID: %s\n⏰ До: %s\n%s%s\n\n",
 			i+1, sub.Plan.Name, sub.Platform, sub.PeerID,
-			sub.EndDate.Format("02.01.2006"), status)
+			sub.EndDate.Format("02.01.2006"), status, renew)
 	}
 
 	var keyboard [][]tgbotapi.InlineKeyboardButton
@@ -54,14 +74,55 @@ func (s *Service) handleMyKeys(msg *tgbotapi.Message) {
 				fmt.Sprintf("sub_qr_%s", sub.PeerID),
 			),
 		}
+		// Пробный период не продлевается, место в семье продлевает владелец
+		if !sub.Plan.IsTrial && sub.SeatOf == nil {
+			label := "🔁 Вкл. автопродление"
+			if sub.AutoRenew {
+				label = "⏹ Выкл. автопродление"
+			}
+			buttonRow = append(buttonRow, tgbotapi.NewInlineKeyboardButtonData(label, CallbackAutoRenew.WithID(sub.ID)))
+		}
+		if sub.SeatOf == nil {
+			buttonRow = append(buttonRow, tgbotapi.NewInlineKeyboardButtonData("🔄 Тариф", CallbackChangePlan.WithID(sub.ID)))
+		}
 		keyboard = append(keyboard, buttonRow)
 	}
 
-	msgConfig := tgbotapi.NewMessage(msg.Chat.ID, text)
-	if len(keyboard) > 0 {
-		msgConfig.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	return text, keyboard
+}
+
+// handleAutoRenewToggle включает или выключает автопродление ключа из /mykeys
+func (s *Service) handleAutoRenewToggle(callback *tgbotapi.CallbackQuery) {
+	subID, err := strconv.ParseUint(strings.TrimPrefix(callback.Data, CallbackAutoRenew.String()), 10, 32)
+	if err != nil {
+		s.answerCallback(callback.ID, "Неверный ID подписки")
+		return
 	}
-	s.bot.Send(msgConfig)
+
+	var sub db.Subscription
+	err = s.repo.DB().Preload("Plan").
+		Where("id = ? AND user_id = ? AND active = true", subID, callback.From.ID).First(&sub).Error
+	if err != nil || sub.Plan.IsTrial || sub.SeatOf != nil {
+		s.answerCallback(callback.ID, "Подписка недоступна для автопродления")
+		return
+	}
+
+	if err := s.repo.DB().Model(&db.Subscription{}).Where("id = ?", sub.ID).Update("auto_renew", !sub.AutoRenew).Error; err != nil {
+		s.answerCallback(callback.ID, "Ошибка сохранения")
+		return
+	}
+
+	if sub.AutoRenew {
+		s.answerCallback(callback.ID, "Автопродление выключено")
+	} else {
+		s.answerCallback(callback.ID, fmt.Sprintf("Автопродление включено: %d руб. спишется с баланса за %d дн. до окончания",
+			sub.Plan.PriceInt, s.cfg.AutoRenewDays))
+	}
+
+	var subscriptions []db.Subscription
+	s.repo.DB().Where("user_id = ? AND active = true", callback.From.ID).Preload("Plan").Find(&subscriptions)
+	text, keyboard := renderMyKeys(subscriptions)
+	s.editMessageTextWithKeyboard(callback.Message.Chat.ID, callback.Message.MessageID, text, keyboard)
 }
 
 func (s *Service) handleDisable(msg *tgbotapi.Message) {
@@ -361,3 +422,81 @@ func (s *Service) enablePeer(interfaceName, publicKey string) error {
 	slog.Info("Peer enabled successfully", "interface", interfaceName, "public_key", publicKey[:10]+"...")
 	return nil
 }
+
+func (s *Service) removePeer(interfaceName, publicKey string) error {
+	slog.Info("Removing peer", "interface", interfaceName, "public_key", publicKey[:10]+"...")
+
+	ctx := context.Background()
+
+	wgConfig := wgagent.Config{
+		Addr:     s.cfg.WGAgentAddr,
+		CertFile: s.cfg.WGClientCert,
+		KeyFile:  s.cfg.WGClientKey,
+		CAFile:   s.cfg.WGCACert,
+	}
+
+	if s.cfg.WGClientCert == "" || s.cfg.WGClientKey == "" || s.cfg.WGCACert == "" {
+		slog.Warn("WG certificates not configured for remove operation")
+		wgConfig = wgagent.Config{
+			Addr: s.cfg.WGAgentAddr,
+		}
+	}
+
+	wgClient, err := wgagent.NewClient(wgConfig)
+	if err != nil {
+		wgErr := ErrWGAgentf("Failed to create WG client for remove: %v", err)
+		s.logAndReportError("WG client creation failed for remove", wgErr, map[string]interface{}{
+			"interface":  interfaceName,
+			"public_key": publicKey,
+			"wg_addr":    s.cfg.WGAgentAddr,
+		})
+		return wgErr
+	}
+	defer wgClient.Close()
+
+	req := &wgagent.RemovePeerRequest{
+		Interface: interfaceName,
+		PublicKey: publicKey,
+	}
+
+	err = wgClient.RemovePeer(ctx, req)
+	if err != nil {
+		wgErr := ErrWGAgentf("Failed to remove peer: %v", err)
+		s.logAndReportError("Peer remove operation failed", wgErr, map[string]interface{}{
+			"interface":  interfaceName,
+			"public_key": publicKey,
+		})
+		return wgErr
+	}
+
+	slog.Info("Peer removed successfully", "interface", interfaceName, "public_key", publicKey[:10]+"...")
+	return nil
+}
+
+// revokePaymentSubscriptions отключает и удаляет пиров, выданных по платежу,
+// и деактивирует их подписки. Ошибки WG Agent не прерывают отзыв остальных ключей
+func (s *Service) revokePaymentSubscriptions(tx *gorm.DB, paymentID uint) ([]db.Subscription, error) {
+	var subscriptions []db.Subscription
+	if err := tx.Where("payment_id = ? AND active = true", paymentID).Find(&subscriptions).Error; err != nil {
+		return nil, ErrDatabasef("Failed to fetch subscriptions for payment #%v: %v", paymentID, err)
+	}
+
+	for _, sub := range subscriptions {
+		slog.Info("Revoking subscription", "payment_id", paymentID, "subscription_id", sub.ID, "peer_id", sub.PeerID)
+
+		if sub.PrivKeyEnc != "PLACEHOLDER_PRIVATE_KEY" {
+			if err := s.disablePeer(sub.Interface, sub.PublicKey); err != nil {
+				slog.Error("Failed to disable peer", "peer_id", sub.PeerID, "error", err)
+			}
+			if err := s.removePeer(sub.Interface, sub.PublicKey); err != nil {
+				slog.Error("Failed to remove peer", "peer_id", sub.PeerID, "error", err)
+			}
+		}
+
+		if err := tx.Model(&db.Subscription{}).Where("id = ?", sub.ID).Update("active", false).Error; err != nil {
+			return nil, ErrDatabasef("Failed to deactivate subscription #%v: %v", sub.ID, err)
+		}
+	}
+
+	return subscriptions, nil
+}
@@ -0,0 +1,180 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+var (
+	errTrialAlreadyUsed   = errors.New("trial already used")
+	errTrialPhoneRequired = errors.New("phone contact required for trial")
+	errTrialPhoneUsed     = errors.New("trial already used with this phone")
+)
+
+// trialEligibility проверяет, может ли пользователь активировать пробный период.
+// Пробный период выдается один раз на TgID и, если включено, один раз на номер телефона.
+func (s *Service) trialEligibility(userID int64) error {
+	var used int64
+	err := s.repo.DB().Model(&db.Subscription{}).
+		Where("user_id = ? AND plan_id IN (?)", userID,
+			s.repo.DB().Model(&db.Plan{}).Select("id").Where("is_trial = true")).
+		Count(&used).Error
+	if err != nil {
+		return ErrDatabasef("Failed to check previous trials: %v", err)
+	}
+	if used > 0 {
+		return errTrialAlreadyUsed
+	}
+
+	if !s.cfg.TrialRequirePhone {
+		return nil
+	}
+
+	var user db.User
+	if err := s.repo.DB().First(&user, "tg_id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errTrialPhoneRequired
+		}
+		return ErrDatabasef("Failed to fetch user #%v: %v", userID, err)
+	}
+	if user.Phone == "" {
+		return errTrialPhoneRequired
+	}
+
+	// Тот же номер телефона на другом аккаунте тоже считается использованным пробным периодом
+	var samePhone int64
+	err = s.repo.DB().Model(&db.Subscription{}).
+		Joins("JOIN users ON users.tg_id = subscriptions.user_id").
+		Where("users.phone = ? AND users.tg_id <> ? AND subscriptions.plan_id IN (?)", user.Phone, userID,
+			s.repo.DB().Model(&db.Plan{}).Select("id").Where("is_trial = true")).
+		Count(&samePhone).Error
+	if err != nil {
+		return ErrDatabasef("Failed to check trials by phone: %v", err)
+	}
+	if samePhone > 0 {
+		return errTrialPhoneUsed
+	}
+
+	return nil
+}
+
+// activateTrial выдает ключ по пробному тарифу без оплаты и чека
+func (s *Service) activateTrial(chatID int64, state *BuyState) {
+	slog.Info("Activating trial", "user_id", state.UserID, "plan_id", state.PlanID)
+
+	if err := s.trialEligibility(state.UserID); err != nil {
+		switch {
+		case errors.Is(err, errTrialPhoneRequired):
+			s.requestPhoneContact(chatID)
+		case errors.Is(err, errTrialAlreadyUsed), errors.Is(err, errTrialPhoneUsed):
+			delete(buyStates, state.UserID)
+			s.reply(chatID, "🎁 Пробный период уже был использован. Выберите платный тариф в /buy")
+		default:
+			delete(buyStates, state.UserID)
+			s.handleError(chatID, err)
+		}
+		return
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().Where("id = ? AND is_trial = true AND "+db.PlanOnSale, state.PlanID).First(&plan).Error; err != nil {
+		delete(buyStates, state.UserID)
+		s.handleError(chatID, ErrPlanNotFoundf("Trial plan #%v not found", state.PlanID))
+		return
+	}
+
+	tx := s.repo.DB().Begin()
+	if tx.Error != nil {
+		s.handleError(chatID, ErrDatabasef("Failed to begin trial transaction: %v", tx.Error))
+		return
+	}
+
+	subscription, err := s.createSubscriptionForPlan(tx, state.UserID, &plan, nil)
+	if err != nil {
+		tx.Rollback()
+		delete(buyStates, state.UserID)
+		s.handleError(chatID, err)
+		return
+	}
+
+	subscription.Platform = state.Platform.String()
+	if err := tx.Model(subscription).Update("platform", subscription.Platform).Error; err != nil {
+		tx.Rollback()
+		delete(buyStates, state.UserID)
+		s.handleError(chatID, ErrDatabasef("Failed to set trial platform: %v", err))
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		delete(buyStates, state.UserID)
+		s.handleError(chatID, ErrDatabasef("Failed to commit trial transaction: %v", err))
+		return
+	}
+
+	delete(buyStates, state.UserID)
+	slog.Info("Trial activated", "user_id", state.UserID, "subscription_id", subscription.ID)
+
+	if subscription.PrivKeyEnc == "PLACEHOLDER_PRIVATE_KEY" {
+		s.sendPlaceholderNotification(chatID, subscription)
+		return
+	}
+
+	s.sendSubscriptionToUser(chatID, subscription)
+	s.reply(chatID, fmt.Sprintf("🎁 Пробный период активирован на %d дн. Понравится — продлите через /buy", plan.DurationDays))
+}
+
+// requestPhoneContact просит пользователя поделиться номером телефона
+func (s *Service) requestPhoneContact(chatID int64) {
+	keyboard := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButtonContact("📞 Отправить номер телефона")),
+	)
+	keyboard.OneTimeKeyboard = true
+	keyboard.ResizeKeyboard = true
+
+	msg := tgbotapi.NewMessage(chatID, "🎁 Для активации пробного периода подтвердите номер телефона кнопкой ниже.")
+	msg.ReplyMarkup = keyboard
+	s.bot.Send(msg)
+}
+
+// handleContactMessage сохраняет номер телефона и продолжает активацию пробного периода
+func (s *Service) handleContactMessage(msg *tgbotapi.Message) {
+	// Принимаем только собственный контакт пользователя, а не пересланный чужой
+	if msg.Contact.UserID != msg.From.ID {
+		s.reply(msg.Chat.ID, "Отправьте, пожалуйста, свой номер телефона кнопкой под сообщением")
+		return
+	}
+
+	if err := s.repo.DB().Model(&db.User{}).Where("tg_id = ?", msg.From.ID).
+		Update("phone", msg.Contact.PhoneNumber).Error; err != nil {
+		s.logAndReportError("Phone update failed", err, map[string]interface{}{
+			"user_id": msg.From.ID,
+		})
+		s.reply(msg.Chat.ID, "Ошибка сохранения номера телефона")
+		return
+	}
+
+	slog.Info("User phone saved", "user_id", msg.From.ID)
+
+	removeKeyboard := tgbotapi.NewMessage(msg.Chat.ID, "✅ Номер телефона сохранен")
+	removeKeyboard.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	s.bot.Send(removeKeyboard)
+
+	state, exists := buyStates[msg.From.ID]
+	if !exists || state.Step != BuyStepPlatform || state.Platform == "" {
+		return
+	}
+
+	var plan db.Plan
+	if err := s.repo.DB().First(&plan, state.PlanID).Error; err != nil || !plan.IsTrial {
+		return
+	}
+
+	s.activateTrial(msg.Chat.ID, state)
+	s.saveCheckout(state)
+}
@@ -1,6 +1,10 @@
 package telegram
 
-import "fmt"
+import (
+	"fmt"
+
+	"lime-bot/internal/db"
+)
 
 // Command представляет команду бота
 type Command string
@@ -11,6 +15,9 @@ const (
 	CmdPlans          Command = "plans"
 	CmdAddPlan        Command = "addplan"
 	CmdArchivePlan    Command = "archiveplan"
+	CmdPlanStars      Command = "planstars"
+	CmdReasons        Command = "reasons"
+	CmdAddReason      Command = "addreason"
 	CmdAddPMethod     Command = "addpmethod"
 	CmdListPMethods   Command = "listpmethods"
 	CmdArchivePMethod Command = "archivepmethod"
@@ -25,6 +32,24 @@ const (
 	CmdRef            Command = "ref"
 	CmdFeedback       Command = "feedback"
 	CmdSupport        Command = "support"
+	CmdBalance        Command = "balance"
+	CmdTopUp          Command = "topup"
+	CmdAdjust         Command = "adjust"
+	CmdRefReview      Command = "refreview"
+	CmdRefCode        Command = "refcode"
+	CmdSetRefCode     Command = "setrefcode"
+	CmdCampaigns      Command = "campaigns"
+	CmdPartner        Command = "partner"
+	CmdPartnerPrice   Command = "partnerprice"
+	CmdFamily         Command = "family"
+	CmdPlanSeats      Command = "planseats"
+	CmdPlanDiscount   Command = "plandiscount"
+	CmdPlanPrice      Command = "planprice"
+	CmdRate           Command = "rate"
+	CmdPMethodLimit   Command = "pmethodlimit"
+	CmdPMethodQR      Command = "pmethodqr"
+	CmdCheckouts      Command = "checkouts"
+	CmdBankSMS        Command = "banksms"
 )
 
 func (c Command) String() string {
@@ -33,10 +58,13 @@ func (c Command) String() string {
 
 func (c Command) IsValid() bool {
 	switch c {
-	case CmdStart, CmdHelp, CmdPlans, CmdAddPlan, CmdArchivePlan,
+	case CmdStart, CmdHelp, CmdPlans, CmdAddPlan, CmdArchivePlan, CmdPlanStars, CmdReasons, CmdAddReason,
 		CmdAddPMethod, CmdListPMethods, CmdArchivePMethod, CmdBuy,
 		CmdMyKeys, CmdDisable, CmdEnable, CmdAdmins, CmdPayQueue,
-		CmdInfo, CmdAddAdmin, CmdRef, CmdFeedback, CmdSupport:
+		CmdInfo, CmdAddAdmin, CmdRef, CmdFeedback, CmdSupport,
+		CmdBalance, CmdTopUp, CmdAdjust, CmdRefReview,
+		CmdRefCode, CmdSetRefCode, CmdCampaigns, CmdPartner, CmdPartnerPrice,
+		CmdFamily, CmdPlanSeats, CmdPlanDiscount, CmdPlanPrice, CmdRate, CmdPMethodLimit, CmdPMethodQR, CmdCheckouts, CmdBankSMS:
 		return true
 	}
 	return false
@@ -44,9 +72,10 @@ func (c Command) IsValid() bool {
 
 func (c Command) IsAdminOnly() bool {
 	switch c {
-	case CmdAddPlan, CmdArchivePlan, CmdAddPMethod, CmdListPMethods,
+	case CmdAddPlan, CmdArchivePlan, CmdPlanStars, CmdReasons, CmdAddReason, CmdAddPMethod, CmdListPMethods,
 		CmdArchivePMethod, CmdDisable, CmdEnable, CmdAdmins,
-		CmdPayQueue, CmdInfo, CmdAddAdmin:
+		CmdPayQueue, CmdInfo, CmdAddAdmin, CmdTopUp, CmdAdjust, CmdRefReview,
+		CmdSetRefCode, CmdCampaigns, CmdPartnerPrice, CmdPlanSeats, CmdPlanDiscount, CmdPlanPrice, CmdRate, CmdPMethodLimit, CmdPMethodQR, CmdCheckouts, CmdBankSMS:
 		return true
 	}
 	return false
@@ -60,6 +89,8 @@ const (
 	RoleAdmin   AdminRole = "admin"
 	RoleCashier AdminRole = "cashier"
 	RoleSupport AdminRole = "support"
+	// RolePartner - реселлер: покупает ключи оптом, админских прав не имеет
+	RolePartner AdminRole = "partner"
 )
 
 func (r AdminRole) String() string {
@@ -68,7 +99,7 @@ func (r AdminRole) String() string {
 
 func (r AdminRole) IsValid() bool {
 	switch r {
-	case RoleSuper, RoleAdmin, RoleCashier, RoleSupport:
+	case RoleSuper, RoleAdmin, RoleCashier, RoleSupport, RolePartner:
 		return true
 	}
 	return false
@@ -84,6 +115,8 @@ func (r AdminRole) DisplayName() string {
 		return "кассир"
 	case RoleSupport:
 		return "поддержка"
+	case RolePartner:
+		return "партнер"
 	}
 	return "неизвестная роль"
 }
@@ -98,6 +131,8 @@ func (r AdminRole) Emoji() string {
 		return "💰"
 	case RoleSupport:
 		return "🎧"
+	case RolePartner:
+		return "🤝"
 	}
 	return "👤"
 }
@@ -106,6 +141,16 @@ func (r AdminRole) CanManageAdmins() bool {
 	return r == RoleSuper
 }
 
+// CanRefund - возвраты денег доступны только администраторам, не кассирам
+func (r AdminRole) CanRefund() bool {
+	return r == RoleSuper || r == RoleAdmin
+}
+
+// CanTopUp - зачислять полученные переводы на баланс могут кассиры и выше
+func (r AdminRole) CanTopUp() bool {
+	return r == RoleSuper || r == RoleAdmin || r == RoleCashier
+}
+
 // PaymentStatus представляет статус платежа
 type PaymentStatus string
 
@@ -113,6 +158,11 @@ const (
 	PaymentStatusPending  PaymentStatus = "pending"
 	PaymentStatusApproved PaymentStatus = "approved"
 	PaymentStatusRejected PaymentStatus = "rejected"
+	PaymentStatusExpired  PaymentStatus = "expired"
+	PaymentStatusCanceled PaymentStatus = "canceled"
+	// PaymentStatusRefunding - возврат начат и платеж занят, пока провайдер не ответит
+	PaymentStatusRefunding PaymentStatus = "refunding"
+	PaymentStatusRefunded  PaymentStatus = "refunded"
 )
 
 func (s PaymentStatus) String() string {
@@ -121,7 +171,7 @@ func (s PaymentStatus) String() string {
 
 func (s PaymentStatus) IsValid() bool {
 	switch s {
-	case PaymentStatusPending, PaymentStatusApproved, PaymentStatusRejected:
+	case PaymentStatusPending, PaymentStatusApproved, PaymentStatusRejected, PaymentStatusExpired, PaymentStatusCanceled, PaymentStatusRefunding, PaymentStatusRefunded:
 		return true
 	}
 	return false
@@ -135,6 +185,14 @@ func (s PaymentStatus) DisplayName() string {
 		return "одобрен"
 	case PaymentStatusRejected:
 		return "отклонен"
+	case PaymentStatusExpired:
+		return "истек срок оплаты"
+	case PaymentStatusCanceled:
+		return "отменен пользователем"
+	case PaymentStatusRefunding:
+		return "оформляется возврат"
+	case PaymentStatusRefunded:
+		return "возвращен"
 	}
 	return "неизвестный статус"
 }
@@ -147,10 +205,134 @@ func (s PaymentStatus) Emoji() string {
 		return "✅"
 	case PaymentStatusRejected:
 		return "❌"
+	case PaymentStatusExpired:
+		return "⌛"
+	case PaymentStatusCanceled:
+		return "🚫"
+	case PaymentStatusRefunding:
+		return "⏳↩️"
+	case PaymentStatusRefunded:
+		return "↩️"
 	}
 	return "❓"
 }
 
+// LedgerKind - тип движения по балансу пользователя
+type LedgerKind string
+
+const (
+	LedgerTopUp      LedgerKind = "topup"
+	LedgerPurchase   LedgerKind = "purchase"
+	LedgerReferral   LedgerKind = "referral"
+	LedgerRefund     LedgerKind = "refund"
+	LedgerAdjustment LedgerKind = "adjustment"
+)
+
+func (k LedgerKind) String() string {
+	return string(k)
+}
+
+func (k LedgerKind) DisplayName() string {
+	switch k {
+	case LedgerTopUp:
+		return "пополнение"
+	case LedgerPurchase:
+		return "покупка"
+	case LedgerReferral:
+		return "реферальный бонус"
+	case LedgerRefund:
+		return "возврат"
+	case LedgerAdjustment:
+		return "корректировка"
+	}
+	return "неизвестная операция"
+}
+
+// ApprovalPolicy определяет, выдаются ли ключи сразу после получения чека
+type ApprovalPolicy string
+
+const (
+	// ApprovalApproveFirst - ключи только после одобрения кассиром
+	ApprovalApproveFirst ApprovalPolicy = "approve_first"
+	// ApprovalTrustOnReceipt - ключи сразу по чеку, отклонение их отзывает
+	ApprovalTrustOnReceipt ApprovalPolicy = "trust_on_receipt"
+	// ApprovalTrustKnown - сразу по чеку только тем, у кого уже были одобренные платежи
+	ApprovalTrustKnown ApprovalPolicy = "trust_known"
+)
+
+func (p ApprovalPolicy) String() string {
+	return string(p)
+}
+
+func (p ApprovalPolicy) IsValid() bool {
+	switch p {
+	case ApprovalApproveFirst, ApprovalTrustOnReceipt, ApprovalTrustKnown:
+		return true
+	}
+	return false
+}
+
+// MethodRotation определяет, сколько способов оплаты одной валюты видит покупатель
+type MethodRotation string
+
+const (
+	// RotationAll - все доступные способы
+	RotationAll MethodRotation = "all"
+	// RotationRoundRobin - один способ на валюту, по очереди от заказа к заказу
+	RotationRoundRobin MethodRotation = "round_robin"
+	// RotationLeastUsed - один способ на валюту, с наименьшей суммой заказов за сутки
+	RotationLeastUsed MethodRotation = "least_used"
+)
+
+func (r MethodRotation) String() string {
+	return string(r)
+}
+
+func (r MethodRotation) IsValid() bool {
+	switch r {
+	case RotationAll, RotationRoundRobin, RotationLeastUsed:
+		return true
+	}
+	return false
+}
+
+// PlanVisibility - кому виден тариф в /plans и /buy
+type PlanVisibility string
+
+const (
+	PlanPublic PlanVisibility = "public"
+	// PlanHidden не показывается в списках, купить можно по ссылке start=plan_<id>
+	PlanHidden      PlanVisibility = "hidden"
+	PlanPartnerOnly PlanVisibility = "partner"
+)
+
+func (v PlanVisibility) String() string {
+	return string(v)
+}
+
+func (v PlanVisibility) DisplayName() string {
+	switch v {
+	case PlanPublic:
+		return "всем"
+	case PlanHidden:
+		return "по ссылке"
+	case PlanPartnerOnly:
+		return "партнерам"
+	}
+	return "неизвестно"
+}
+
+// Next - следующая видимость для переключателя в карточке тарифа
+func (v PlanVisibility) Next() PlanVisibility {
+	switch v {
+	case PlanPublic:
+		return PlanHidden
+	case PlanHidden:
+		return PlanPartnerOnly
+	}
+	return PlanPublic
+}
+
 // Platform представляет платформу
 type Platform string
 
@@ -224,6 +406,15 @@ const (
 	CallbackMainMenu     CallbackData = "main_menu"
 	CallbackAdminPanel   CallbackData = "admin_panel"
 	CallbackSuperPanel   CallbackData = "super_panel"
+	CallbackBuyStars     CallbackData = "buy_stars"
+	CallbackBuyBalance   CallbackData = "buy_balance"
+	CallbackBuyBack      CallbackData = "buy_back"
+	CallbackBuyConfirm   CallbackData = "buy_confirm"
+	CallbackPartnerPanel CallbackData = "partner_panel"
+	CallbackPartnerKeys  CallbackData = "partner_keys"
+	CallbackPartnerUsers CallbackData = "partner_clients"
+	CallbackAdminPlans   CallbackData = "admin_plans"
+	CallbackPlanNew      CallbackData = "plan_new"
 )
 
 func (c CallbackData) String() string {
@@ -234,18 +425,42 @@ func (c CallbackData) String() string {
 type CallbackPrefix string
 
 const (
-	CallbackBuyPlan        CallbackPrefix = "buy_plan_"
-	CallbackBuyPlatform    CallbackPrefix = "buy_platform_"
-	CallbackBuyQty         CallbackPrefix = "buy_qty_"
-	CallbackBuyMethod      CallbackPrefix = "buy_method_"
-	CallbackPaymentApprove CallbackPrefix = "payment_approve_"
-	CallbackPaymentReject  CallbackPrefix = "payment_reject_"
-	CallbackInfoUser       CallbackPrefix = "info_user_"
-	CallbackDisableAdmin   CallbackPrefix = "disable_admin_"
-	CallbackSetCashier     CallbackPrefix = "set_cashier_"
-	CallbackArchivePlan    CallbackPrefix = "archive_plan_"
-	CallbackArchiveMethod  CallbackPrefix = "archive_method_"
-	CallbackSubPlatform    CallbackPrefix = "sub_"
+	CallbackBuyPlan         CallbackPrefix = "buy_plan_"
+	CallbackBuyPlatform     CallbackPrefix = "buy_platform_"
+	CallbackBuyQty          CallbackPrefix = "buy_qty_"
+	CallbackBuyMethod       CallbackPrefix = "buy_method_"
+	CallbackPaymentApprove  CallbackPrefix = "payment_approve_"
+	CallbackPaymentReject   CallbackPrefix = "payment_reject_"
+	CallbackInfoUser        CallbackPrefix = "info_user_"
+	CallbackDisableAdmin    CallbackPrefix = "disable_admin_"
+	CallbackSetCashier      CallbackPrefix = "set_cashier_"
+	CallbackArchivePlan     CallbackPrefix = "archive_plan_"
+	CallbackArchiveMethod   CallbackPrefix = "archive_method_"
+	CallbackSubPlatform     CallbackPrefix = "sub_"
+	CallbackBuyOnline       CallbackPrefix = "buy_online_"
+	CallbackBuyEdit         CallbackPrefix = "buy_edit_"
+	CallbackBuyResume       CallbackPrefix = db.CheckoutResumePrefix
+	CallbackPaymentCancel   CallbackPrefix = "payment_cancel_"
+	CallbackPaymentEdit     CallbackPrefix = "payment_edit_"
+	CallbackReceiptOrder    CallbackPrefix = "receipt_order_"
+	CallbackRejectReason    CallbackPrefix = "reject_reason_"
+	CallbackPaymentResubmit CallbackPrefix = "payment_resubmit_"
+	CallbackArchiveReason   CallbackPrefix = "archive_reason_"
+	CallbackPaymentInfo     CallbackPrefix = "payment_info_"
+	CallbackPaymentRefund   CallbackPrefix = "payment_refund_"
+	CallbackRefundAmount    CallbackPrefix = "refund_amount_"
+	CallbackRefundWallet    CallbackPrefix = "refund_wallet_"
+	CallbackAutoRenew       CallbackPrefix = "autorenew_"
+	CallbackReferralApprove CallbackPrefix = "ref_approve_"
+	CallbackReferralReject  CallbackPrefix = "ref_reject_"
+	CallbackPartnerMonth    CallbackPrefix = "partner_statement_"
+	CallbackSeatRemove      CallbackPrefix = "seat_remove_"
+	CallbackChangePlan      CallbackPrefix = "change_plan_"
+	CallbackChangePlanTo    CallbackPrefix = "change_to_"
+	CallbackPlanEdit        CallbackPrefix = "plan_edit_"
+	CallbackPlanField       CallbackPrefix = "plan_field_"
+	CallbackPlanRecommended CallbackPrefix = "plan_rec_"
+	CallbackPlanVisibility  CallbackPrefix = "plan_vis_"
 )
 
 func (c CallbackPrefix) String() string {
@@ -264,6 +479,7 @@ const (
 	BuyStepPlatform BuyStep = "platform"
 	BuyStepQty      BuyStep = "qty"
 	BuyStepMethod   BuyStep = "method"
+	BuyStepConfirm  BuyStep = "confirm"
 	BuyStepPayment  BuyStep = "payment"
 	BuyStepReceipt  BuyStep = "receipt"
 )
@@ -274,7 +490,7 @@ func (s BuyStep) String() string {
 
 func (s BuyStep) IsValid() bool {
 	switch s {
-	case BuyStepPlan, BuyStepPlatform, BuyStepQty, BuyStepMethod, BuyStepPayment, BuyStepReceipt:
+	case BuyStepPlan, BuyStepPlatform, BuyStepQty, BuyStepMethod, BuyStepConfirm, BuyStepPayment, BuyStepReceipt:
 		return true
 	}
 	return false
@@ -289,6 +505,8 @@ func (s BuyStep) Next() BuyStep {
 	case BuyStepQty:
 		return BuyStepMethod
 	case BuyStepMethod:
+		return BuyStepConfirm
+	case BuyStepConfirm:
 		return BuyStepPayment
 	case BuyStepPayment:
 		return BuyStepReceipt
@@ -296,6 +514,24 @@ func (s BuyStep) Next() BuyStep {
 	return s
 }
 
+// Prev - шаг, на который ведет кнопка "Назад". После создания заказа
+// возвращаемся к подтверждению, чтобы изменить его
+func (s BuyStep) Prev() BuyStep {
+	switch s {
+	case BuyStepPlatform:
+		return BuyStepPlan
+	case BuyStepQty:
+		return BuyStepPlatform
+	case BuyStepMethod:
+		return BuyStepQty
+	case BuyStepConfirm:
+		return BuyStepMethod
+	case BuyStepPayment, BuyStepReceipt:
+		return BuyStepConfirm
+	}
+	return s
+}
+
 func (s BuyStep) DisplayName() string {
 	switch s {
 	case BuyStepPlan:
@@ -306,6 +542,8 @@ func (s BuyStep) DisplayName() string {
 		return "выбор количества"
 	case BuyStepMethod:
 		return "выбор способа оплаты"
+	case BuyStepConfirm:
+		return "подтверждение заказа"
 	case BuyStepPayment:
 		return "оплата"
 	case BuyStepReceipt:
@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"log/slog"
 	"strconv"
+	"strings"
 
 	"lime-bot/internal/db"
 
@@ -29,6 +31,16 @@ func (s *Service) handleRef(msg *tgbotapi.Message) {
 	var referralCount int64
 	s.repo.DB().Model(&db.Referral{}).Where("inviter_id = ?", user.TgID).Count(&referralCount)
 
+	var earned struct {
+		Rewarded int64
+		Days     int
+		Amount   int
+	}
+	s.repo.DB().Model(&db.Referral{}).
+		Select("COUNT(*) AS rewarded, COALESCE(SUM(bonus_days), 0) AS days, COALESCE(SUM(bonus_amount), 0) AS amount").
+		Where("inviter_id = ? AND reward_status = ?", user.TgID, ReferralRewardGranted).
+		Scan(&earned)
+
 	botUsername := s.bot.Self.UserName
 
 	text := fmt.Sprintf(`🔗 Ваша реферальная ссылка:
@@ -37,13 +49,22 @@ https://t.me/%s?start=ref_%s
 
 📊 Статистика:
 👥 Приглашено: %d человек
-
-💰 Получайте бонусы за каждого приглашенного друга!`,
+✅ Оплатили подписку: %d
+📅 Получено бонусных дней: %d
+💰 Зачислено на баланс: %d руб.`,
 		botUsername,
 		user.RefCode,
 		referralCount,
+		earned.Rewarded,
+		earned.Days,
+		earned.Amount,
 	)
 
+	if rules := s.referralRulesText(); rules != "" {
+		text += "\n\n" + rules
+	}
+	text += "\n\n✏️ Свой код для ссылки: /refcode <код>"
+
 	s.reply(msg.Chat.ID, text)
 }
 
@@ -128,7 +149,7 @@ func (s *Service) handleStartWithRef(msg *tgbotapi.Message) {
 		TgID:     msg.From.ID,
 		Username: msg.From.UserName,
 	}
-	s.repo.DB().FirstOrCreate(user, "tg_id = ?", msg.From.ID)
+	created := s.repo.DB().FirstOrCreate(user, "tg_id = ?", msg.From.ID).RowsAffected > 0
 
 	// Обновляем username если он изменился
 	if user.Username != msg.From.UserName {
@@ -137,12 +158,33 @@ func (s *Service) handleStartWithRef(msg *tgbotapi.Message) {
 	}
 
 	args := msg.CommandArguments()
+	if startsWith(args, "claim_") {
+		s.claimPartnerKey(msg.Chat.ID, user.TgID, args[6:])
+		return
+	}
+	if startsWith(args, "seat_") {
+		s.joinSeat(msg.Chat.ID, user.TgID, args[5:])
+		return
+	}
+	if startsWith(args, "plan_") {
+		s.startPlanPurchase(msg.Chat.ID, user.TgID, args[5:])
+		return
+	}
+
+	// Кампания засчитывается только при первом запуске бота
+	if startsWith(args, "src_") {
+		if created {
+			s.recordCampaign(user.TgID, args[4:])
+		}
+		s.showMainMenu(msg.Chat.ID, msg.From.ID)
+		return
+	}
 	if !startsWith(args, "ref_") {
 		s.showMainMenu(msg.Chat.ID, msg.From.ID)
 		return
 	}
 
-	refCode := args[4:]
+	refCode := strings.ToLower(args[4:])
 
 	var inviter db.User
 	result := s.repo.DB().Where("ref_code = ?", refCode).First(&inviter)
@@ -156,8 +198,10 @@ func (s *Service) handleStartWithRef(msg *tgbotapi.Message) {
 		return
 	}
 
+	// Приглашенным можно стать только один раз, иначе один аккаунт приносит
+	// награду нескольким пригласившим
 	var existingReferral db.Referral
-	result = s.repo.DB().Where("inviter_id = ? AND invitee_id = ?", inviter.TgID, user.TgID).First(&existingReferral)
+	result = s.repo.DB().Where("invitee_id = ?", user.TgID).First(&existingReferral)
 	if result.Error == nil {
 		s.showMainMenu(msg.Chat.ID, msg.From.ID)
 		return
@@ -167,6 +211,15 @@ func (s *Service) handleStartWithRef(msg *tgbotapi.Message) {
 		InviterID: inviter.TgID,
 		InviteeID: user.TgID,
 	}
+	// Бот-аккаунты фиксируются, но награда за них не положена
+	if msg.From.IsBot {
+		referral.RewardStatus = ReferralRewardRejected
+		referral.FraudReason = "бот-аккаунт"
+		s.repo.DB().Create(referral)
+		slog.Warn("Referral from bot account rejected", "inviter_id", inviter.TgID, "invitee_id", user.TgID)
+		s.showMainMenu(msg.Chat.ID, msg.From.ID)
+		return
+	}
 	s.repo.DB().Create(referral)
 
 	// Отправляем приветственное сообщение с информацией о реферале
@@ -0,0 +1,266 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"lime-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+)
+
+// PaymentProviderBalance - заказ оплачен с внутреннего баланса пользователя
+const PaymentProviderBalance = "balance"
+
+// userBalance считает баланс пользователя по журналу движений
+func userBalance(tx *gorm.DB, userID int64) (int, error) {
+	balance, err := db.UserBalance(tx, userID)
+	if err != nil {
+		return 0, ErrDatabasef("Failed to calculate balance: %v", err)
+	}
+	return balance, nil
+}
+
+// appendLedger добавляет движение по балансу. Списание больше остатка
+// возвращает db.ErrInsufficientBalance без обертки
+func appendLedger(tx *gorm.DB, entry *db.LedgerEntry) error {
+	err := db.AppendLedger(tx, entry)
+	if err != nil && !errors.Is(err, db.ErrInsufficientBalance) {
+		return ErrDatabasef("Failed to update balance: %v", err)
+	}
+	return err
+}
+
+func (s *Service) handleBalance(msg *tgbotapi.Message) {
+	balance, err := userBalance(s.repo.DB(), msg.From.ID)
+	if err != nil {
+		s.logAndReportError("Balance fetch failed", err, map[string]interface{}{
+			"user_id": msg.From.ID,
+		})
+		s.reply(msg.Chat.ID, "Ошибка получения баланса")
+		return
+	}
+
+	var entries []db.LedgerEntry
+	s.repo.DB().Where("user_id = ?", msg.From.ID).Order("id DESC").Limit(10).Find(&entries)
+
+	text := fmt.Sprintf("💰 Ваш баланс: %d руб.", balance)
+	if len(entries) > 0 {
+		text += "\n\n📜 Последние операции:"
+		for _, entry := range entries {
+			text += fmt.Sprintf("\n%s %+d руб. - %s", entry.CreatedAt.Format("02.01"), entry.Amount, LedgerKind(entry.Kind).DisplayName())
+			if entry.Comment != "" {
+				text += " (" + entry.Comment + ")"
+			}
+		}
+	}
+	text += "\n\nБалансом можно оплатить тариф в /buy"
+
+	s.reply(msg.Chat.ID, text)
+}
+
+// handleTopUp зачисляет на баланс перевод, полученный от пользователя
+func (s *Service) handleTopUp(msg *tgbotapi.Message) {
+	if !s.adminRole(msg.From.ID).CanTopUp() {
+		s.reply(msg.Chat.ID, "Пополнение баланса доступно кассирам и администраторам")
+		return
+	}
+
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		s.reply(msg.Chat.ID, "Использование: /topup <username> <сумма> [комментарий]\nПример: /topup john_doe 500 перевод на Сбер")
+		return
+	}
+
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount <= 0 {
+		s.reply(msg.Chat.ID, "Сумма пополнения должна быть положительным числом")
+		return
+	}
+
+	s.changeBalance(msg, args[0], amount, LedgerTopUp, strings.Join(args[2:], " "))
+}
+
+// handleAdjust исправляет баланс вручную, в том числе списывает. Комментарий обязателен
+func (s *Service) handleAdjust(msg *tgbotapi.Message) {
+	if !s.canRefund(msg.From.ID) {
+		s.reply(msg.Chat.ID, "Корректировка баланса доступна только администраторам")
+		return
+	}
+
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 3 {
+		s.reply(msg.Chat.ID, "Использование: /adjust <username> <+/-сумма> <комментарий>\nПример: /adjust john_doe -200 ошибочное пополнение")
+		return
+	}
+
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount == 0 {
+		s.reply(msg.Chat.ID, "Сумма корректировки должна быть ненулевым числом")
+		return
+	}
+
+	s.changeBalance(msg, args[0], amount, LedgerAdjustment, strings.Join(args[2:], " "))
+}
+
+func (s *Service) changeBalance(msg *tgbotapi.Message, username string, amount int, kind LedgerKind, comment string) {
+	username = strings.TrimPrefix(username, "@")
+
+	var user db.User
+	if err := s.repo.DB().Where("username = ?", username).First(&user).Error; err != nil {
+		s.reply(msg.Chat.ID, "Пользователь не найден: @"+username)
+		return
+	}
+
+	adminID := msg.From.ID
+	entry := &db.LedgerEntry{
+		UserID:  user.TgID,
+		Amount:  amount,
+		Kind:    kind.String(),
+		AdminID: &adminID,
+		Comment: comment,
+	}
+
+	var balance int
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		if err := appendLedger(tx, entry); err != nil {
+			return err
+		}
+		var err error
+		balance, err = userBalance(tx, user.TgID)
+		return err
+	})
+	if errors.Is(err, db.ErrInsufficientBalance) {
+		s.reply(msg.Chat.ID, "Недостаточно средств на балансе @"+username)
+		return
+	}
+	if err != nil {
+		s.logAndReportError("Balance change failed", err, map[string]interface{}{
+			"user_id":  user.TgID,
+			"admin_id": adminID,
+			"amount":   amount,
+			"kind":     kind.String(),
+		})
+		s.reply(msg.Chat.ID, "Ошибка изменения баланса")
+		return
+	}
+
+	slog.Info("Balance changed", "user_id", user.TgID, "admin_id", adminID, "amount", amount, "kind", kind.String())
+	s.reply(msg.Chat.ID, fmt.Sprintf("✅ Баланс @%s: %+d руб. (%s). Итого: %d руб.", username, amount, kind.DisplayName(), balance))
+	s.reply(user.TgID, fmt.Sprintf("💰 Баланс изменен: %+d руб. (%s). Текущий баланс: %d руб.", amount, kind.DisplayName(), balance))
+}
+
+// HandleRenewalPayment обрабатывает платеж автопродления, созданный
+// планировщиком: продление засчитывается в реферальную программу
+func (s *Service) HandleRenewalPayment(paymentID uint) {
+	var payment db.Payment
+	if err := s.repo.DB().First(&payment, paymentID).Error; err != nil {
+		slog.Error("Failed to fetch renewal payment", "payment_id", paymentID, "error", err)
+		return
+	}
+	s.rewardReferral(&payment)
+}
+
+// payFromBalance создает заказ и списывает его стоимость с баланса в одной
+// транзакции. Ключи выдаются через обычное одобрение платежа
+func (s *Service) payFromBalance(state *BuyState) (uint, error) {
+	var paymentID uint
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		var plan db.Plan
+		if err := tx.First(&plan, state.PlanID).Error; err != nil {
+			return ErrPlanNotFoundf("Plan #%v not found: %v", state.PlanID, err)
+		}
+
+		payment := &db.Payment{
+			UserID:   state.UserID,
+			Amount:   s.statePrice(state, &plan),
+			PlanID:   plan.ID,
+			Qty:      state.Qty,
+			Status:   PaymentStatusPending.String(),
+			Provider: PaymentProviderBalance,
+		}
+		state.applyChange(payment)
+		s.recordListPrice(payment, &plan)
+		if err := tx.Create(payment).Error; err != nil {
+			return ErrDatabasef("Failed to create balance payment: %v", err)
+		}
+		paymentID = payment.ID
+
+		return appendLedger(tx, &db.LedgerEntry{
+			UserID:    state.UserID,
+			Amount:    -payment.Amount,
+			Kind:      LedgerPurchase.String(),
+			PaymentID: &payment.ID,
+			Comment:   fmt.Sprintf("%s x%d", plan.Name, state.Qty),
+		})
+	})
+	return paymentID, err
+}
+
+func (s *Service) handleBalanceSelection(callback *tgbotapi.CallbackQuery, state *BuyState) {
+	state.Step = BuyStepPayment
+
+	paymentID, err := s.payFromBalance(state)
+	if errors.Is(err, db.ErrInsufficientBalance) {
+		s.answerCallback(callback.ID, "Недостаточно средств на балансе")
+		return
+	}
+	if err != nil {
+		s.logAndReportError("Balance purchase failed", err, map[string]interface{}{
+			"user_id": state.UserID,
+			"plan_id": state.PlanID,
+		})
+		s.answerCallback(callback.ID, "Ошибка оплаты с баланса")
+		return
+	}
+
+	delete(buyStates, state.UserID)
+	s.answerCallback(callback.ID, "")
+	s.editMessageText(callback.Message.Chat.ID, callback.Message.MessageID, fmt.Sprintf("💰 Заказ #%d оплачен с баланса", paymentID))
+
+	if err := s.approvePayment(paymentID, 0); err != nil {
+		s.logAndReportError("Balance payment approval failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+			"user_id":    state.UserID,
+		})
+		s.returnBalancePayment(paymentID)
+		s.handleError(callback.Message.Chat.ID, err)
+	}
+}
+
+// returnBalancePayment отменяет заказ, по которому не удалось выдать ключи,
+// и возвращает списанную сумму на баланс
+func (s *Service) returnBalancePayment(paymentID uint) {
+	err := s.repo.DB().Transaction(func(tx *gorm.DB) error {
+		var payment db.Payment
+		if err := tx.First(&payment, paymentID).Error; err != nil {
+			return ErrDatabasef("Failed to fetch payment #%v: %v", paymentID, err)
+		}
+
+		res := tx.Model(&db.Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusPending).
+			Update("status", PaymentStatusCanceled.String())
+		if res.Error != nil {
+			return ErrDatabasef("Failed to cancel payment #%v: %v", paymentID, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		return appendLedger(tx, &db.LedgerEntry{
+			UserID:    payment.UserID,
+			Amount:    payment.Amount,
+			Kind:      LedgerRefund.String(),
+			PaymentID: &payment.ID,
+			Comment:   "ключи не выданы",
+		})
+	})
+	if err != nil {
+		s.logAndReportError("Balance payment return failed", err, map[string]interface{}{
+			"payment_id": paymentID,
+		})
+	}
+}